@@ -0,0 +1,363 @@
+package abuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+type Reason string
+
+const (
+	ReasonRecipients       Reason = "recipients"
+	ReasonRecipientDomains Reason = "recipient-domains"
+	ReasonRejectRatio      Reason = "reject-ratio"
+	ReasonSourceIPs        Reason = "source-ips"
+	ReasonManual           Reason = "manual"
+)
+
+// Alert is emitted when an account gets blocked, with the activity of the
+// account over the window at that time.
+type Alert struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Reason Reason    `json:"reason"`
+	Detail string    `json:"detail"`
+
+	Recipients       int      `json:"recipients"`
+	RecipientDomains int      `json:"recipient_domains"`
+	Rejected         int      `json:"rejected"`
+	SourceIPs        []string `json:"source_ips"`
+}
+
+type Alerter interface {
+	Alert(alert *Alert) error
+}
+
+// JSONAlerter writes alerts as JSON lines.
+type JSONAlerter struct {
+	mtx     sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONAlerter(w io.Writer) *JSONAlerter {
+	return &JSONAlerter{encoder: json.NewEncoder(w)}
+}
+
+func (a *JSONAlerter) Alert(alert *Alert) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.encoder.Encode(alert)
+}
+
+type rcptEvent struct {
+	time     time.Time
+	domain   string
+	accepted bool
+}
+
+type loginEvent struct {
+	time time.Time
+	ip   string
+}
+
+type account struct {
+	rcpts  []rcptEvent
+	logins []loginEvent
+	block  *Alert
+}
+
+// prune drops the events that left the window.
+func (a *account) prune(since time.Time) {
+	i := 0
+	for i < len(a.rcpts) && a.rcpts[i].time.Before(since) {
+		i++
+	}
+	a.rcpts = a.rcpts[i:]
+	i = 0
+	for i < len(a.logins) && a.logins[i].time.Before(since) {
+		i++
+	}
+	a.logins = a.logins[i:]
+}
+
+func (a *account) stats(alert *Alert) {
+	domains := make(map[string]bool)
+	for _, rcpt := range a.rcpts {
+		alert.Recipients++
+		if !rcpt.accepted {
+			alert.Rejected++
+		}
+		domains[rcpt.domain] = true
+	}
+	alert.RecipientDomains = len(domains)
+
+	ips := make(map[string]bool)
+	for _, login := range a.logins {
+		ips[login.ip] = true
+	}
+	alert.SourceIPs = make([]string, 0, len(ips))
+	for ip := range ips {
+		alert.SourceIPs = append(alert.SourceIPs, ip)
+	}
+	sort.Strings(alert.SourceIPs)
+}
+
+type session struct {
+	src  string
+	user string
+}
+
+type Detector struct {
+	// Window is the sliding window over which activity is measured.
+	Window time.Duration
+
+	// Thresholds flagging an account within the window, zero disables a
+	// check. The reject ratio only applies once MinRecipientsForRatio
+	// recipients were attempted.
+	MaxRecipients         int
+	MaxRecipientDomains   int
+	MaxSourceIPs          int
+	MaxRejectRatio        float64
+	MinRecipientsForRatio int
+
+	// BlockDuration lifts blocks automatically, zero keeps accounts
+	// blocked until Unblock is called.
+	BlockDuration time.Duration
+
+	RejectResponse filter.Response
+
+	// Alerter, when set, is handed an alert for every account blocked.
+	Alerter Alerter
+
+	accounts    map[string]*account
+	accountsMtx sync.Mutex
+	lastSweep   time.Time
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		Window:                time.Hour,
+		MaxRecipients:         500,
+		MaxRecipientDomains:   100,
+		MaxSourceIPs:          5,
+		MaxRejectRatio:        0.3,
+		MinRecipientsForRatio: 20,
+		RejectResponse:        filter.Reject("550 5.7.1 Account suspended for suspicious activity, contact your administrator"),
+		accounts:              make(map[string]*account),
+		sessions:              make(map[filter.Session]*session),
+	}
+}
+
+func (d *Detector) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(d.linkConnectCb)
+	in.OnLinkAuth(d.linkAuthCb)
+	in.OnLinkDisconnect(d.linkDisconnectCb)
+	in.OnTxRcpt(d.txRcptCb)
+	in.MailFromRequest(d.mailFromCb)
+}
+
+// account must be called with the lock held.
+func (d *Detector) account(user string) *account {
+	acct, ok := d.accounts[user]
+	if !ok {
+		acct = &account{}
+		d.accounts[user] = acct
+	}
+	return acct
+}
+
+// Blocked returns the alert that blocked user, if blocked.
+func (d *Detector) Blocked(user string) (*Alert, bool) {
+	d.accountsMtx.Lock()
+	defer d.accountsMtx.Unlock()
+	if acct, ok := d.accounts[user]; ok && acct.block != nil {
+		return acct.block, true
+	}
+	return nil, false
+}
+
+// BlockedUsers returns the users currently blocked.
+func (d *Detector) BlockedUsers() []string {
+	d.accountsMtx.Lock()
+	defer d.accountsMtx.Unlock()
+	users := make([]string, 0)
+	for user, acct := range d.accounts {
+		if acct.block != nil {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Block blocks user by hand as of now, which is also reported to the
+// Alerter. BlockDuration runs from now, like the timestamps of the events
+// the detector is fed.
+func (d *Detector) Block(now time.Time, user string, detail string) {
+	d.accountsMtx.Lock()
+	acct := d.account(user)
+	acct.prune(now.Add(-d.Window))
+	alert := &Alert{Time: now, User: user, Reason: ReasonManual, Detail: detail}
+	acct.stats(alert)
+	acct.block = alert
+	d.accountsMtx.Unlock()
+
+	d.alert(alert)
+}
+
+// Unblock lifts the block of user and forgets its past activity so that
+// it is not flagged again right away. It reports whether user was blocked.
+func (d *Detector) Unblock(user string) bool {
+	d.accountsMtx.Lock()
+	defer d.accountsMtx.Unlock()
+	acct, ok := d.accounts[user]
+	if !ok || acct.block == nil {
+		return false
+	}
+	delete(d.accounts, user)
+	return true
+}
+
+func (d *Detector) alert(alert *Alert) {
+	log.Printf("abuse: blocked %s: %s", alert.User, alert.Detail)
+	if d.Alerter != nil {
+		if err := d.Alerter.Alert(alert); err != nil {
+			log.Printf("abuse: alert: %s", err)
+		}
+	}
+}
+
+// evaluate checks the activity of an account against the thresholds and
+// returns an alert if it must be blocked. It must be called with the lock
+// held.
+func (d *Detector) evaluate(user string, acct *account, now time.Time) *Alert {
+	if now.Sub(d.lastSweep) > d.Window {
+		d.lastSweep = now
+		for u, a := range d.accounts {
+			a.prune(now.Add(-d.Window))
+			if a != acct && a.block == nil && len(a.rcpts) == 0 && len(a.logins) == 0 {
+				delete(d.accounts, u)
+			}
+		}
+	}
+
+	if acct.block != nil {
+		return nil
+	}
+	acct.prune(now.Add(-d.Window))
+
+	alert := &Alert{Time: now, User: user}
+	acct.stats(alert)
+
+	switch {
+	case d.MaxRecipients != 0 && alert.Recipients > d.MaxRecipients:
+		alert.Reason = ReasonRecipients
+		alert.Detail = fmt.Sprintf("%d recipients in %s", alert.Recipients, d.Window)
+	case d.MaxRecipientDomains != 0 && alert.RecipientDomains > d.MaxRecipientDomains:
+		alert.Reason = ReasonRecipientDomains
+		alert.Detail = fmt.Sprintf("%d recipient domains in %s", alert.RecipientDomains, d.Window)
+	case d.MaxSourceIPs != 0 && len(alert.SourceIPs) > d.MaxSourceIPs:
+		alert.Reason = ReasonSourceIPs
+		alert.Detail = fmt.Sprintf("logins from %d addresses in %s", len(alert.SourceIPs), d.Window)
+	case d.MaxRejectRatio != 0 && alert.Recipients >= d.MinRecipientsForRatio &&
+		float64(alert.Rejected)/float64(alert.Recipients) > d.MaxRejectRatio:
+		alert.Reason = ReasonRejectRatio
+		alert.Detail = fmt.Sprintf("%d of %d recipients rejected in %s", alert.Rejected, alert.Recipients, d.Window)
+	default:
+		return nil
+	}
+	acct.block = alert
+	return alert
+}
+
+func (d *Detector) session(sessionId filter.Session) *session {
+	d.sessionsMtx.Lock()
+	defer d.sessionsMtx.Unlock()
+	sess, ok := d.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		d.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (d *Detector) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		d.session(sessionId).src = addr.IP.String()
+	}
+}
+
+func (d *Detector) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	if result != "pass" {
+		return
+	}
+	sess := d.session(sessionId)
+	sess.user = username
+
+	d.accountsMtx.Lock()
+	acct := d.account(username)
+	if sess.src != "" {
+		acct.logins = append(acct.logins, loginEvent{time: timestamp, ip: sess.src})
+	}
+	alert := d.evaluate(username, acct, timestamp)
+	d.accountsMtx.Unlock()
+
+	if alert != nil {
+		d.alert(alert)
+	}
+}
+
+func (d *Detector) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	d.sessionsMtx.Lock()
+	defer d.sessionsMtx.Unlock()
+	delete(d.sessions, sessionId)
+}
+
+func (d *Detector) txRcptCb(timestamp time.Time, sessionId filter.Session, messageId string, result string, to string) {
+	sess := d.session(sessionId)
+	if sess.user == "" {
+		return
+	}
+	_, domain, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(to, "<"), ">"), "@")
+
+	d.accountsMtx.Lock()
+	acct := d.account(sess.user)
+	acct.rcpts = append(acct.rcpts, rcptEvent{time: timestamp, domain: strings.ToLower(domain), accepted: result == "ok"})
+	alert := d.evaluate(sess.user, acct, timestamp)
+	d.accountsMtx.Unlock()
+
+	if alert != nil {
+		d.alert(alert)
+	}
+}
+
+func (d *Detector) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := d.session(sessionId)
+	if sess.user == "" {
+		return filter.Proceed()
+	}
+
+	d.accountsMtx.Lock()
+	defer d.accountsMtx.Unlock()
+	acct, ok := d.accounts[sess.user]
+	if !ok || acct.block == nil {
+		return filter.Proceed()
+	}
+	if d.BlockDuration != 0 && timestamp.Sub(acct.block.Time) > d.BlockDuration {
+		delete(d.accounts, sess.user)
+		return filter.Proceed()
+	}
+	return d.RejectResponse
+}
@@ -0,0 +1,251 @@
+package abuse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+type alerts []*Alert
+
+func (a *alerts) Alert(alert *Alert) error {
+	*a = append(*a, alert)
+	return nil
+}
+
+func newDetector() (*Detector, *alerts) {
+	d := NewDetector()
+	d.MaxRecipients = 10
+	d.MaxRecipientDomains = 5
+	d.MaxSourceIPs = 2
+	d.MaxRejectRatio = 0.5
+	d.MinRecipientsForRatio = 4
+	a := &alerts{}
+	d.Alerter = a
+	return d, a
+}
+
+// login authenticates user from ip on a session.
+func login(d *Detector, now time.Time, ip string, user string) filter.Session {
+	s := filter.Session{}
+	d.linkDisconnectCb(now, s)
+	d.linkConnectCb(now, s, "", "", &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}, nil)
+	d.linkAuthCb(now, s, "pass", user)
+	return s
+}
+
+func TestThresholds(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type rcpt struct {
+		to     string
+		result string
+	}
+	many := func(n int, domains int, result string) []rcpt {
+		rcpts := make([]rcpt, 0, n)
+		for i := 0; i < n; i++ {
+			rcpts = append(rcpts, rcpt{fmt.Sprintf("<u%d@d%d.example>", i, i%domains), result})
+		}
+		return rcpts
+	}
+
+	tests := []struct {
+		name   string
+		ips    []string
+		rcpts  []rcpt
+		reason Reason
+	}{
+		{"quiet", []string{"192.0.2.1"}, many(10, 5, "ok"), ""},
+		{"recipients", []string{"192.0.2.1"}, many(11, 1, "ok"), ReasonRecipients},
+		{"recipient domains", []string{"192.0.2.1"}, many(6, 6, "ok"), ReasonRecipientDomains},
+		{"source addresses", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, nil, ReasonSourceIPs},
+		{"same address", []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, nil, ""},
+		{"reject ratio", []string{"192.0.2.1"}, append(many(1, 1, "ok"), many(3, 1, "permfail")...), ReasonRejectRatio},
+		{"reject ratio below minimum", []string{"192.0.2.1"}, many(3, 1, "permfail"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, a := newDetector()
+			var s filter.Session
+			for _, ip := range test.ips {
+				s = login(d, start, ip, "alice")
+			}
+			for _, rcpt := range test.rcpts {
+				d.txRcptCb(start, s, "1", rcpt.result, rcpt.to)
+			}
+
+			alert, blocked := d.Blocked("alice")
+			if test.reason == "" {
+				if blocked {
+					t.Errorf("blocked for %s: %s", alert.Reason, alert.Detail)
+				}
+				if res := d.mailFromCb(start, s, "<alice@example.org>"); res != filter.Proceed() {
+					t.Errorf("mailFromCb = %#v, want proceed", res)
+				}
+				return
+			}
+			if !blocked || alert.Reason != test.reason {
+				t.Fatalf("blocked = %v, %v, want %s", blocked, alert, test.reason)
+			}
+			if len(*a) != 1 || (*a)[0] != alert {
+				t.Errorf("alerts %v, want the block alert once", *a)
+			}
+			if res := d.mailFromCb(start, s, "<alice@example.org>"); res != d.RejectResponse {
+				t.Errorf("mailFromCb = %#v, want reject", res)
+			}
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d, _ := newDetector()
+
+	s := login(d, start, "192.0.2.1", "alice")
+	for i := 0; i < 10; i++ {
+		d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	}
+	// the recipients above left the window
+	later := start.Add(61 * time.Minute)
+	for i := 0; i < 10; i++ {
+		d.txRcptCb(later, s, "1", "ok", "<bob@example.net>")
+	}
+	if alert, blocked := d.Blocked("alice"); blocked {
+		t.Fatalf("blocked for %s", alert.Detail)
+	}
+	d.txRcptCb(later, s, "1", "ok", "<bob@example.net>")
+	if _, blocked := d.Blocked("alice"); !blocked {
+		t.Fatal("not blocked past the threshold within the window")
+	}
+
+	// idle accounts are dropped by the sweep
+	login(d, start, "192.0.2.2", "bob")
+	login(d, start.Add(3*time.Hour), "192.0.2.2", "carol")
+	if _, ok := d.accounts["bob"]; ok {
+		t.Error("idle account kept")
+	}
+	if _, ok := d.accounts["alice"]; !ok {
+		t.Error("blocked account dropped")
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d, _ := newDetector()
+	s := filter.Session{}
+	d.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}, nil)
+	d.linkAuthCb(start, s, "fail", "alice")
+	for i := 0; i < 20; i++ {
+		d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	}
+	if len(d.accounts) != 0 {
+		t.Errorf("unauthenticated activity accounted: %v", d.accounts)
+	}
+}
+
+func TestBlockDuration(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d, _ := newDetector()
+	d.BlockDuration = time.Hour
+
+	s := login(d, start, "192.0.2.1", "alice")
+	for i := 0; i < 11; i++ {
+		d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	}
+	if res := d.mailFromCb(start.Add(59*time.Minute), s, "<alice@example.org>"); res != d.RejectResponse {
+		t.Errorf("mailFromCb during the block = %#v, want reject", res)
+	}
+	if res := d.mailFromCb(start.Add(61*time.Minute), s, "<alice@example.org>"); res != filter.Proceed() {
+		t.Errorf("mailFromCb after the block = %#v, want proceed", res)
+	}
+	if _, blocked := d.Blocked("alice"); blocked {
+		t.Error("still blocked after the block duration")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d, a := newDetector()
+	d.BlockDuration = time.Hour
+
+	s := login(d, start, "192.0.2.1", "alice")
+	d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	d.Block(start.Add(2*time.Hour), "alice", "credentials leaked")
+
+	alert, blocked := d.Blocked("alice")
+	if !blocked {
+		t.Fatal("not blocked")
+	}
+	if !alert.Time.Equal(start.Add(2*time.Hour)) || alert.Reason != ReasonManual || alert.Detail != "credentials leaked" {
+		t.Errorf("alert %+v", alert)
+	}
+	// activity that left the window is not reported
+	if alert.Recipients != 0 || len(alert.SourceIPs) != 0 {
+		t.Errorf("alert reports %d recipients from %v", alert.Recipients, alert.SourceIPs)
+	}
+	if len(*a) != 1 || (*a)[0] != alert {
+		t.Errorf("alerts %v, want the block", *a)
+	}
+
+	// the block duration runs from the block timestamp
+	if res := d.mailFromCb(start.Add(2*time.Hour+59*time.Minute), s, "<alice@example.org>"); res != d.RejectResponse {
+		t.Errorf("mailFromCb during the block = %#v, want reject", res)
+	}
+	if res := d.mailFromCb(start.Add(3*time.Hour+time.Minute), s, "<alice@example.org>"); res != filter.Proceed() {
+		t.Errorf("mailFromCb after the block = %#v, want proceed", res)
+	}
+}
+
+func TestUnblock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d, _ := newDetector()
+
+	s := login(d, start, "192.0.2.1", "alice")
+	for i := 0; i < 11; i++ {
+		d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	}
+	if users := d.BlockedUsers(); len(users) != 1 || users[0] != "alice" {
+		t.Fatalf("blocked users %v, want alice", users)
+	}
+	if !d.Unblock("alice") {
+		t.Fatal("Unblock of a blocked user returned false")
+	}
+	if d.Unblock("alice") {
+		t.Error("Unblock of an unblocked user returned true")
+	}
+	// past activity is forgotten
+	d.txRcptCb(start, s, "1", "ok", "<bob@example.net>")
+	if _, blocked := d.Blocked("alice"); blocked {
+		t.Error("blocked again right after Unblock")
+	}
+}
+
+func TestJSONAlerter(t *testing.T) {
+	var buf bytes.Buffer
+	alert := &Alert{
+		Time:             time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		User:             "alice",
+		Reason:           ReasonRecipients,
+		Detail:           "11 recipients in 1h0m0s",
+		Recipients:       11,
+		RecipientDomains: 1,
+		SourceIPs:        []string{"192.0.2.1"},
+	}
+	if err := NewJSONAlerter(&buf).Alert(alert); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"time":"2024-01-02T03:04:05Z","user":"alice","reason":"recipients","detail":"11 recipients in 1h0m0s","recipients":11,"recipient_domains":1,"rejected":0,"source_ips":["192.0.2.1"]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("alert %s, want %s", buf.String(), want)
+	}
+
+	var decoded Alert
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || decoded.User != "alice" || !decoded.Time.Equal(alert.Time) {
+		t.Errorf("decoded %v, %v", decoded, err)
+	}
+}
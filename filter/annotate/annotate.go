@@ -0,0 +1,339 @@
+package annotate
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// Facts is what is known of a session and of its current transaction when
+// its message ends, rule conditions and header templates are evaluated
+// against it.
+type Facts struct {
+	Session filter.Session
+
+	Rdns string
+	Src  net.Addr
+	Dest net.Addr
+	Helo string
+
+	// TLS is the state reported by smtpd, empty when the session is not
+	// encrypted, and User the authenticated user, empty when the session
+	// is not authenticated.
+	TLS  string
+	User string
+
+	// External is set for unauthenticated sessions from clients outside
+	// of the internal networks.
+	External bool
+
+	// Junked is set when the filter marked the session or transaction as
+	// junk so far, see filter.Session.Junked.
+	Junked bool
+
+	MessageId string
+	MailFrom  string
+	RcptTo    []string
+
+	// Header is the header of the message being annotated.
+	Header message.Header
+}
+
+// IP returns the address of the client, empty for local connections.
+func (f *Facts) IP() string {
+	if addr, ok := f.Src.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// Condition tells whether a rule applies to a message, conditions reading
+// the results of other modules do so with Facts.Session.
+type Condition func(facts *Facts) bool
+
+func External(facts *Facts) bool {
+	return facts.External
+}
+
+func Authenticated(facts *Facts) bool {
+	return facts.User != ""
+}
+
+func NoTLS(facts *Facts) bool {
+	return facts.TLS == ""
+}
+
+func Junked(facts *Facts) bool {
+	return facts.Junked
+}
+
+// AuthFailed holds when one of our Authentication-Results fields has a
+// fail, softfail or permerror result for method, such as "dkim" or "spf".
+// Only the fields above the first Received field are ours, as smtpd adds
+// it before the message reaches filters, those below came with the
+// message.
+func AuthFailed(method string) Condition {
+	return func(facts *Facts) bool {
+		authservId := authres.AuthservId()
+		for _, f := range facts.Header {
+			if strings.EqualFold(f.Name, "received") {
+				break
+			}
+			if !strings.EqualFold(f.Name, "authentication-results") || !strings.EqualFold(authres.ServId(f.Value()), authservId) {
+				continue
+			}
+			for _, result := range authres.SplitResults(f.Value()) {
+				methodValue, _, _ := strings.Cut(result, " ")
+				m, value, _ := strings.Cut(methodValue, "=")
+				m, _, _ = strings.Cut(m, "/")
+				if !strings.EqualFold(m, method) {
+					continue
+				}
+				switch strings.ToLower(value) {
+				case "fail", "softfail", "permerror":
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func Not(cond Condition) Condition {
+	return func(facts *Facts) bool {
+		return !cond(facts)
+	}
+}
+
+func All(conds ...Condition) Condition {
+	return func(facts *Facts) bool {
+		for _, cond := range conds {
+			if !cond(facts) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func Any(conds ...Condition) Condition {
+	return func(facts *Facts) bool {
+		for _, cond := range conds {
+			if cond(facts) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Header is a field added by a rule.
+type Header struct {
+	Name string
+
+	// Value is executed with the Facts, fields with an empty value are
+	// not added, nor fields already in the message with the same value.
+	Value *template.Template
+
+	// Replace removes the fields of that name found in the message, such
+	// as forged ones, before adding it.
+	Replace bool
+}
+
+// Rule annotates the messages matching When, every message if nil.
+type Rule struct {
+	Name       string
+	When       Condition
+	SubjectTag string
+	Headers    []Header
+}
+
+type session struct {
+	facts Facts
+	lines []string
+}
+
+// Annotator adds header fields and subject tags to messages at the end of
+// the data-line stream, according to rules applied in order. It does not
+// annotate a message twice, so that messages going through it again are
+// left as they are.
+type Annotator struct {
+	// Internal lists networks whose clients are not external, loopback
+	// addresses and local connections are always internal.
+	Internal []*net.IPNet
+
+	rules    []Rule
+	rulesMtx sync.Mutex
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewAnnotator() *Annotator {
+	return &Annotator{
+		sessions: make(map[filter.Session]*session),
+	}
+}
+
+// SetRules replaces the rules, it may be called while the filter runs to
+// reload them.
+func (a *Annotator) SetRules(rules ...Rule) {
+	a.rulesMtx.Lock()
+	defer a.rulesMtx.Unlock()
+	a.rules = rules
+}
+
+// Register hooks the annotator, it must be registered after the modules
+// its conditions read from so that their results are available.
+func (a *Annotator) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(a.linkConnectCb)
+	in.OnLinkIdentify(a.linkIdentifyCb)
+	in.OnLinkTLS(a.linkTLSCb)
+	in.OnLinkAuth(a.linkAuthCb)
+	in.OnLinkDisconnect(a.linkDisconnectCb)
+	in.OnTxBegin(a.txBeginCb)
+	in.OnTxMail(a.txMailCb)
+	in.OnTxRcpt(a.txRcptCb)
+	in.DataLineRequest(a.dataLineCb)
+}
+
+func (a *Annotator) internal(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	for _, network := range a.Internal {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Annotator) session(sessionId filter.Session) *session {
+	a.sessionsMtx.Lock()
+	defer a.sessionsMtx.Unlock()
+	sess, ok := a.sessions[sessionId]
+	if !ok {
+		sess = &session{facts: Facts{Session: sessionId}}
+		a.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (a *Annotator) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	sess := a.session(sessionId)
+	sess.facts.Rdns = rdns
+	sess.facts.Src = src
+	sess.facts.Dest = dest
+}
+
+func (a *Annotator) linkIdentifyCb(timestamp time.Time, sessionId filter.Session, method string, hostname string) {
+	a.session(sessionId).facts.Helo = hostname
+}
+
+func (a *Annotator) linkTLSCb(timestamp time.Time, sessionId filter.Session, tlsString string) {
+	a.session(sessionId).facts.TLS = tlsString
+}
+
+func (a *Annotator) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	if result == "pass" {
+		a.session(sessionId).facts.User = username
+	}
+}
+
+func (a *Annotator) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	a.sessionsMtx.Lock()
+	defer a.sessionsMtx.Unlock()
+	delete(a.sessions, sessionId)
+}
+
+func (a *Annotator) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := a.session(sessionId)
+	sess.facts.MessageId = messageId
+	sess.facts.MailFrom = ""
+	sess.facts.RcptTo = nil
+	sess.lines = nil
+}
+
+func (a *Annotator) txMailCb(timestamp time.Time, sessionId filter.Session, messageId string, result string, from string) {
+	if result == "ok" {
+		a.session(sessionId).facts.MailFrom = from
+	}
+}
+
+func (a *Annotator) txRcptCb(timestamp time.Time, sessionId filter.Session, messageId string, result string, to string) {
+	if result == "ok" {
+		sess := a.session(sessionId)
+		sess.facts.RcptTo = append(sess.facts.RcptTo, to)
+	}
+}
+
+// Annotate applies the rules matching facts to a message header, setting
+// facts.Header to header for the conditions to read.
+func (a *Annotator) Annotate(facts *Facts, header message.Header) message.Header {
+	facts.Header = header
+
+	a.rulesMtx.Lock()
+	rules := a.rules
+	a.rulesMtx.Unlock()
+
+	added := make(message.Header, 0)
+	for _, rule := range rules {
+		if rule.When != nil && !rule.When(facts) {
+			continue
+		}
+		if rule.SubjectTag != "" {
+			header = header.TagSubject(rule.SubjectTag)
+		}
+		for _, h := range rule.Headers {
+			var value strings.Builder
+			if err := h.Value.Execute(&value, facts); err != nil {
+				log.Printf("%s: annotate: %s: %s: %s", facts.Session, rule.Name, h.Name, err)
+				continue
+			}
+			if h.Replace {
+				header = header.Remove(h.Name)
+			}
+			field := message.NewField(h.Name, strings.TrimSpace(value.String()))
+			if field.Value() == "" || present(header, field) || present(added, field) {
+				continue
+			}
+			added = append(added, field)
+		}
+	}
+	return append(added, header...)
+}
+
+func present(header message.Header, field message.Field) bool {
+	for _, value := range header.Values(field.Name) {
+		if value == field.Value() {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Annotator) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := a.session(sessionId)
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	facts := sess.facts
+	facts.External = facts.User == "" && !a.internal(facts.Src)
+	facts.Junked = sessionId.Junked()
+	msg.Header = a.Annotate(&facts, msg.Header)
+	return msg.DataLines()
+}
@@ -0,0 +1,35 @@
+package annotate
+
+import (
+	"testing"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+func TestAuthFailed(t *testing.T) {
+	id := authres.AuthservId()
+	tests := []struct {
+		name   string
+		method string
+		header []string
+		want   bool
+	}{
+		{"fail", "dkim", []string{"Authentication-Results: " + id + "; dkim=fail header.d=example.com", "Received: from x"}, true},
+		{"pass", "dkim", []string{"Authentication-Results: " + id + "; dkim=pass header.d=example.com", "Received: from x"}, false},
+		{"other method", "dkim", []string{"Authentication-Results: " + id + "; spf=fail smtp.mailfrom=example.com", "Received: from x"}, false},
+		{"several results", "spf", []string{"Authentication-Results: " + id + "; dkim=pass header.d=example.com; spf=softfail smtp.mailfrom=example.com", "Received: from x"}, true},
+		{"versioned method", "dkim", []string{"Authentication-Results: " + id + "; dkim/1=permerror", "Received: from x"}, true},
+		{"other authserv-id", "dkim", []string{"Authentication-Results: other.example.net; dkim=fail", "Received: from x"}, false},
+		{"below received", "dkim", []string{"Received: from x", "Authentication-Results: " + id + "; dkim=fail"}, false},
+		{"none", "dkim", []string{"Authentication-Results: " + id + "; none", "Received: from x"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			facts := &Facts{Header: message.Parse(append(test.header, "")).Header}
+			if got := AuthFailed(test.method)(facts); got != test.want {
+				t.Errorf("AuthFailed(%q) = %v, want %v", test.method, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package arc
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkim"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkimverify"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// MaxInstances is the highest instance number allowed (RFC 8617, 4.2.1).
+const MaxInstances = 50
+
+type Status string
+
+const (
+	None Status = "none"
+	Pass Status = "pass"
+	Fail Status = "fail"
+)
+
+// Chain is the outcome of the validation of the ARC sets of a message.
+type Chain struct {
+	Status Status
+	Reason string
+
+	// Instance is the highest instance found, 0 when there is no chain.
+	Instance int
+
+	// Domains lists the sealing domains, oldest first.
+	Domains []string
+}
+
+// set is the ARC Set of an instance (RFC 8617, section 4.1).
+type set struct {
+	results   *message.Field
+	signature *message.Field
+	seal      *message.Field
+}
+
+var instanceRe = regexp.MustCompile(`^\s*i\s*=\s*(\d+)\s*(;|$)`)
+
+func instance(field message.Field) (int, error) {
+	m := instanceRe.FindStringSubmatch(field.Value())
+	if m == nil {
+		return 0, fmt.Errorf("%s without instance", field.Name)
+	}
+	i, err := strconv.Atoi(m[1])
+	if err != nil || i < 1 || i > MaxInstances {
+		return 0, fmt.Errorf("%s with invalid instance %s", field.Name, m[1])
+	}
+	return i, nil
+}
+
+func collectSets(header message.Header) (map[int]*set, error) {
+	sets := make(map[int]*set)
+	for _, f := range header {
+		var slot func(*set) **message.Field
+		switch strings.ToLower(f.Name) {
+		case "arc-authentication-results":
+			slot = func(s *set) **message.Field { return &s.results }
+		case "arc-message-signature":
+			slot = func(s *set) **message.Field { return &s.signature }
+		case "arc-seal":
+			slot = func(s *set) **message.Field { return &s.seal }
+		default:
+			continue
+		}
+
+		i, err := instance(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := sets[i]; !ok {
+			sets[i] = &set{}
+		}
+		p := slot(sets[i])
+		if *p != nil {
+			return nil, fmt.Errorf("duplicate %s for instance %d", f.Name, i)
+		}
+		field := f
+		*p = &field
+	}
+	return sets, nil
+}
+
+// sealData returns the relaxed canonical form of the ARC Sets 1 to n as
+// hashed by the seal of instance n, whose b= value is blanked out.
+func sealData(sets map[int]*set, from int, n int) string {
+	var b strings.Builder
+	for i := from; i <= n; i++ {
+		s := sets[i]
+		b.WriteString(dkim.CanonicalizeHeader(dkim.Relaxed, *s.results) + "\r\n")
+		b.WriteString(dkim.CanonicalizeHeader(dkim.Relaxed, *s.signature) + "\r\n")
+		if i == n {
+			b.WriteString(dkim.CanonicalizeRawHeader(dkim.Relaxed, dkim.StripTagValue(s.seal.Raw(), "b")))
+		} else {
+			b.WriteString(dkim.CanonicalizeHeader(dkim.Relaxed, *s.seal) + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+func lookupPublicKey(ctx context.Context, resolver dkimverify.TXTResolver, tags map[string]string) (crypto.PublicKey, error) {
+	algorithm, err := dkim.ParseAlgorithm(tags["a"])
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := dkimverify.LookupKey(ctx, resolver, tags["s"], tags["d"])
+	if err != nil {
+		return nil, err
+	}
+	if record.KeyType != algorithm.KeyType() || !record.AllowsSHA256() {
+		return nil, fmt.Errorf("inappropriate key for %s", tags["a"])
+	}
+	return record.PublicKey, nil
+}
+
+func requireTags(tags map[string]string, names ...string) error {
+	for _, name := range names {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("missing %s= tag", name)
+		}
+	}
+	return nil
+}
+
+func verifySignature(ctx context.Context, resolver dkimverify.TXTResolver, msg *message.Message, field message.Field) error {
+	tags, err := dkim.ParseTags(field.Value())
+	if err != nil {
+		return err
+	}
+	if err := requireTags(tags, "i", "a", "b", "bh", "d", "h", "s"); err != nil {
+		return err
+	}
+	headerCanon, bodyCanon, err := dkim.ParseCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "arc-seal" {
+			return fmt.Errorf("ARC-Seal must not be signed by ARC-Message-Signature")
+		}
+		names = append(names, name)
+	}
+
+	bodyHash, err := base64.StdEncoding.DecodeString(dkim.StripWhitespace(tags["bh"]))
+	if err != nil {
+		return fmt.Errorf("malformed bh= tag")
+	}
+	computed, _ := dkim.BodyHash(crypto.SHA256, bodyCanon, msg.Body, -1)
+	if string(computed) != string(bodyHash) {
+		return fmt.Errorf("body hash did not verify")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(dkim.StripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed b= tag")
+	}
+	key, err := lookupPublicKey(ctx, resolver, tags)
+	if err != nil {
+		return err
+	}
+	data := dkim.HeaderData(headerCanon, msg.Header, names) +
+		dkim.CanonicalizeRawHeader(headerCanon, dkim.StripTagValue(field.Raw(), "b"))
+	if err := dkim.VerifyData(key, []byte(data), signature); err != nil {
+		return fmt.Errorf("message signature did not verify")
+	}
+	return nil
+}
+
+func verifySeal(ctx context.Context, resolver dkimverify.TXTResolver, sets map[int]*set, n int) error {
+	tags, err := dkim.ParseTags(sets[n].seal.Value())
+	if err != nil {
+		return err
+	}
+	if err := requireTags(tags, "i", "a", "b", "cv", "d", "s"); err != nil {
+		return err
+	}
+	if _, ok := tags["h"]; ok {
+		return fmt.Errorf("ARC-Seal must not have a h= tag")
+	}
+	expected := "pass"
+	if n == 1 {
+		expected = "none"
+	}
+	if tags["cv"] != expected {
+		return fmt.Errorf("ARC-Seal %d has cv=%s", n, tags["cv"])
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(dkim.StripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed b= tag")
+	}
+	key, err := lookupPublicKey(ctx, resolver, tags)
+	if err != nil {
+		return err
+	}
+	if err := dkim.VerifyData(key, []byte(sealData(sets, 1, n)), signature); err != nil {
+		return fmt.Errorf("seal %d did not verify", n)
+	}
+	return nil
+}
+
+// Validate runs the chain validation algorithm of RFC 8617, section 5.2.
+func Validate(ctx context.Context, resolver dkimverify.TXTResolver, msg *message.Message) *Chain {
+	chain := &Chain{Status: None, Domains: make([]string, 0)}
+	failWith := func(format string, args ...any) *Chain {
+		chain.Status = Fail
+		chain.Reason = fmt.Sprintf(format, args...)
+		return chain
+	}
+
+	sets, err := collectSets(msg.Header)
+	if err != nil {
+		return failWith("%s", err)
+	}
+	if len(sets) == 0 {
+		return chain
+	}
+
+	instances := make([]int, 0, len(sets))
+	for i := range sets {
+		instances = append(instances, i)
+	}
+	sort.Ints(instances)
+	chain.Instance = instances[len(instances)-1]
+
+	for n, i := range instances {
+		if i != n+1 {
+			return failWith("missing ARC set %d", n+1)
+		}
+		s := sets[i]
+		if s.results == nil || s.signature == nil || s.seal == nil {
+			return failWith("incomplete ARC set %d", i)
+		}
+		tags, err := dkim.ParseTags(s.seal.Value())
+		if err != nil {
+			return failWith("malformed ARC-Seal %d", i)
+		}
+		chain.Domains = append(chain.Domains, strings.ToLower(tags["d"]))
+		if tags["cv"] == "fail" {
+			return failWith("ARC set %d recorded a failed chain", i)
+		}
+	}
+
+	if err := verifySignature(ctx, resolver, msg, *sets[chain.Instance].signature); err != nil {
+		return failWith("ARC-Message-Signature %d: %s", chain.Instance, err)
+	}
+	for i := chain.Instance; i >= 1; i-- {
+		if err := verifySeal(ctx, resolver, sets, i); err != nil {
+			return failWith("ARC-Seal %d: %s", i, err)
+		}
+	}
+
+	chain.Status = Pass
+	return chain
+}
+
+// seal computes the ARC Set of the next instance.
+func (s *Sealer) seal(msg *message.Message, chain *Chain, results []string) ([]message.Field, error) {
+	if s.key == nil {
+		return nil, fmt.Errorf("no sealing key")
+	}
+	if chain.Status == Fail && chain.Instance == 0 {
+		return nil, fmt.Errorf("cannot seal a malformed chain")
+	}
+	n := chain.Instance + 1
+	if n > MaxInstances {
+		return nil, fmt.Errorf("too many ARC sets")
+	}
+	instanceTag := strconv.Itoa(n)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	aarLines := []string{"ARC-Authentication-Results: i=" + instanceTag + "; " + authres.AuthservId() + ";"}
+	if len(results) == 0 {
+		aarLines[0] += " none"
+	}
+	for i, r := range results {
+		line := "\t" + r
+		if i != len(results)-1 {
+			line += ";"
+		}
+		aarLines = append(aarLines, line)
+	}
+	aar := message.Field{Name: "ARC-Authentication-Results", Lines: aarLines}
+
+	names := make([]string, 0)
+	for _, name := range s.Headers {
+		key := strings.ToLower(name)
+		for range msg.Header.Fields(key) {
+			names = append(names, key)
+		}
+	}
+	bodyHash, _ := dkim.BodyHash(crypto.SHA256, dkim.Relaxed, msg.Body, -1)
+	amsTags := []dkim.Tag{
+		{Name: "i", Value: instanceTag},
+		{Name: "a", Value: s.algorithm.String()},
+		{Name: "c", Value: "relaxed/relaxed"},
+		{Name: "d", Value: s.Domain},
+		{Name: "s", Value: s.Selector},
+		{Name: "t", Value: timestamp},
+		{Name: "h", Value: strings.Join(names, ":")},
+		{Name: "bh", Value: base64.StdEncoding.EncodeToString(bodyHash)},
+	}
+	unsigned := dkim.SignatureField("ARC-Message-Signature", amsTags, nil)
+	data := dkim.HeaderData(dkim.Relaxed, msg.Header, names) + dkim.CanonicalizeHeader(dkim.Relaxed, unsigned)
+	signature, err := dkim.SignData(s.key, []byte(data))
+	if err != nil {
+		return nil, err
+	}
+	ams := dkim.SignatureField("ARC-Message-Signature", amsTags, signature)
+
+	cv := string(chain.Status)
+	asTags := []dkim.Tag{
+		{Name: "i", Value: instanceTag},
+		{Name: "a", Value: s.algorithm.String()},
+		{Name: "cv", Value: cv},
+		{Name: "d", Value: s.Domain},
+		{Name: "s", Value: s.Selector},
+		{Name: "t", Value: timestamp},
+	}
+	as := dkim.SignatureField("ARC-Seal", asTags, nil)
+
+	sets, err := collectSets(msg.Header)
+	if err != nil || chain.Status == Fail {
+		// a failed chain is sealed on its own (RFC 8617, section 5.1.2)
+		sets = make(map[int]*set)
+	}
+	sets[n] = &set{results: &aar, signature: &ams, seal: &as}
+	from := 1
+	if chain.Status == Fail {
+		from = n
+	}
+	signature, err = dkim.SignData(s.key, []byte(sealData(sets, from, n)))
+	if err != nil {
+		return nil, err
+	}
+	as = dkim.SignatureField("ARC-Seal", asTags, signature)
+
+	return []message.Field{as, ams, aar}, nil
+}
@@ -0,0 +1,135 @@
+package arc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func newSealer(t *testing.T, resolver fakeResolver, domain string) *Sealer {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver["arc._domainkey."+domain] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)}
+	s := NewSealer(resolver)
+	if err := s.SetSigner(domain, "arc", private); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// relay feeds a message through the sealer as the data-line stream would.
+func relay(s *Sealer, lines []string) []string {
+	sessionId := filter.Session{}
+	s.txBeginCb(time.Now(), sessionId, "")
+	for _, line := range lines {
+		s.dataLineCb(time.Now(), sessionId, message.Stuff(line))
+	}
+	out := s.dataLineCb(time.Now(), sessionId, ".")
+	ret := make([]string, 0, len(out))
+	for _, line := range out[:len(out)-1] {
+		ret = append(ret, message.Unstuff(line))
+	}
+	return ret
+}
+
+var original = []string{
+	"Received: from client.example.net by mx.example.com",
+	"From: Gilles <gilles@example.net>",
+	"To: list@example.com",
+	"Subject: hello",
+	"",
+	"Hello.",
+}
+
+func TestValidate(t *testing.T) {
+	resolver := fakeResolver{}
+	first := newSealer(t, resolver, "example.com")
+	second := newSealer(t, resolver, "example.org")
+
+	hop1 := relay(first, original)
+	hop2 := relay(second, append([]string{"Received: from mx.example.com by mx.example.org"}, hop1...))
+
+	tampered := append([]string{}, hop2...)
+	tampered[len(tampered)-1] = "Goodbye."
+
+	withoutSeal := make([]string, 0)
+	for _, f := range message.Parse(hop1).Header {
+		if !strings.EqualFold(f.Name, "arc-seal") {
+			withoutSeal = append(withoutSeal, f.Lines...)
+		}
+	}
+	withoutSeal = append(withoutSeal, "", "Hello.")
+
+	tests := []struct {
+		name     string
+		lines    []string
+		status   Status
+		instance int
+		domains  []string
+	}{
+		{"no chain", original, None, 0, nil},
+		{"one hop", hop1, Pass, 1, []string{"example.com"}},
+		{"two hops", hop2, Pass, 2, []string{"example.com", "example.org"}},
+		{"modified body", tampered, Fail, 2, nil},
+		{"incomplete set", withoutSeal, Fail, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := Validate(context.Background(), resolver, message.Parse(tt.lines))
+			if chain.Status != tt.status || chain.Instance != tt.instance {
+				t.Errorf("got %s (%s) at instance %d, want %s at instance %d", chain.Status, chain.Reason, chain.Instance, tt.status, tt.instance)
+			}
+			if tt.domains != nil && strings.Join(chain.Domains, ",") != strings.Join(tt.domains, ",") {
+				t.Errorf("got domains %v, want %v", chain.Domains, tt.domains)
+			}
+		})
+	}
+}
+
+func TestSealForgedResults(t *testing.T) {
+	authservId := authres.AuthservId()
+	lines := []string{
+		"Authentication-Results: " + authservId + "; spf=pass smtp.mailfrom=example.net",
+		original[0],
+		"Authentication-Results: " + authservId + "; dkim=pass header.d=forged.example",
+		"Authentication-Results: other.example; dkim=pass header.d=other.example",
+	}
+	lines = append(lines, original[1:]...)
+
+	header := message.Parse(relay(newSealer(t, fakeResolver{}, "example.com"), lines)).Header
+	aar := header.Get("arc-authentication-results")
+	if !strings.Contains(aar, "spf=pass") || !strings.Contains(aar, "arc=none") {
+		t.Errorf("results added before sealing are missing from %q", aar)
+	}
+	if strings.Contains(aar, "forged.example") || strings.Contains(aar, "other.example") {
+		t.Errorf("forged or foreign results sealed in %q", aar)
+	}
+	for _, value := range header.Values("authentication-results") {
+		if strings.Contains(value, "forged.example") {
+			t.Errorf("forged field kept: %q", value)
+		}
+	}
+	if len(header.Values("authentication-results")) != 3 {
+		t.Errorf("got %d Authentication-Results fields, want 3", len(header.Values("authentication-results")))
+	}
+}
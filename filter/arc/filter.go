@@ -0,0 +1,197 @@
+package arc
+
+import (
+	"context"
+	"crypto"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkim"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkimverify"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type session struct {
+	src   net.IP
+	lines []string
+	chain *Chain
+}
+
+type Sealer struct {
+	Resolver dkimverify.TXTResolver
+
+	// Timeout bounds the key lookups of a message, done while the
+	// dispatch loop waits and no other session is served.
+	Timeout time.Duration
+
+	// Domain and Selector identify the sealing key, messages are only
+	// validated when no key is set.
+	Domain   string
+	Selector string
+
+	// Headers lists the header fields signed by ARC-Message-Signature.
+	Headers []string
+
+	// AuthResultsHeader adds the arc= result in an Authentication-Results
+	// header of our own.
+	AuthResultsHeader bool
+
+	key       crypto.Signer
+	algorithm dkim.Algorithm
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewSealer(resolver dkimverify.TXTResolver) *Sealer {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Sealer{
+		Resolver:          resolver,
+		Timeout:           5 * time.Second,
+		Headers:           append(append([]string{}, dkim.DefaultHeaders...), "DKIM-Signature"),
+		AuthResultsHeader: true,
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+// SetKey loads the private key used to seal, as dkim.Signer does.
+func (s *Sealer) SetKey(domain string, selector string, path string) error {
+	key, err := dkim.LoadPrivateKey(path)
+	if err != nil {
+		return err
+	}
+	return s.SetSigner(domain, selector, key)
+}
+
+func (s *Sealer) SetSigner(domain string, selector string, key crypto.Signer) error {
+	algorithm, err := dkim.KeyAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	s.Domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	s.Selector = selector
+	s.key = key
+	s.algorithm = algorithm
+	return nil
+}
+
+// Register hooks the sealer on the data-line stream. Since the ARC Set
+// covers the message as delivered, it must be registered after every other
+// module altering messages, and after the modules adding
+// Authentication-Results headers whose results are to be sealed.
+func (s *Sealer) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(s.linkConnectCb)
+	in.OnLinkDisconnect(s.linkDisconnectCb)
+	in.OnTxBegin(s.txBeginCb)
+	in.DataLineRequest(s.dataLineCb)
+}
+
+// Chain returns the validated chain of the current transaction.
+func (s *Sealer) Chain(sessionId filter.Session) *Chain {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	if sess, ok := s.sessions[sessionId]; ok {
+		return sess.chain
+	}
+	return nil
+}
+
+func (s *Sealer) session(sessionId filter.Session) *session {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		s.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (s *Sealer) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		s.session(sessionId).src = addr.IP
+	}
+}
+
+func (s *Sealer) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	delete(s.sessions, sessionId)
+}
+
+func (s *Sealer) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := s.session(sessionId)
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess.lines = nil
+	sess.chain = nil
+}
+
+func (s *Sealer) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := s.session(sessionId)
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	chain := Validate(ctx, s.Resolver, msg)
+	cancel()
+
+	s.sessionsMtx.Lock()
+	sess.chain = chain
+	s.sessionsMtx.Unlock()
+
+	authservId := authres.AuthservId()
+	arcResult := authres.Result{Method: "arc", Value: string(chain.Status), Reason: chain.Reason}
+	if sess.src != nil {
+		arcResult.Properties = []authres.Property{{Type: "smtp", Name: "remote-ip", Value: sess.src.String()}}
+	}
+
+	msg.Header = removeForged(msg.Header, authservId)
+	results := make([]string, 0)
+	for _, f := range msg.Header.Fields("authentication-results") {
+		if strings.EqualFold(authres.ServId(f.Value()), authservId) {
+			results = append(results, authres.SplitResults(f.Value())...)
+		}
+	}
+	results = append(results, arcResult.String())
+
+	if s.AuthResultsHeader {
+		msg.Prepend(authres.Field(authservId, arcResult))
+	}
+
+	if s.key != nil {
+		fields, err := s.seal(msg, chain, results)
+		if err != nil {
+			log.Printf("%s: arc: %s", sessionId, err)
+		} else {
+			msg.Prepend(fields...)
+		}
+	}
+	return msg.DataLines()
+}
+
+// removeForged drops the Authentication-Results fields carrying our
+// authserv-id that came with the message. smtpd prepends its Received field
+// before handing the message to filters, the fields above it were added by
+// the modules registered before the sealer and the ones below are forged.
+// Without a Received field, they cannot be told apart and are all dropped.
+func removeForged(header message.Header, authservId string) message.Header {
+	for i, f := range header {
+		if strings.EqualFold(f.Name, "received") {
+			return append(append(message.Header{}, header[:i]...), authres.RemoveForged(header[i:], authservId)...)
+		}
+	}
+	return authres.RemoveForged(header, authservId)
+}
@@ -0,0 +1,137 @@
+package authres
+
+import (
+	"os"
+	"strings"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// Property is a ptype.property=value item of a result, such as
+// header.d=poolp.org or smtp.mailfrom=gilles@poolp.org.
+type Property struct {
+	Type  string
+	Name  string
+	Value string
+}
+
+// Result is a single method result of an Authentication-Results header
+// (RFC 8601), such as dkim=pass or spf=softfail.
+type Result struct {
+	Method     string
+	Value      string
+	Reason     string
+	Properties []Property
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	b.WriteString(r.Method + "=" + r.Value)
+	if r.Reason != "" {
+		b.WriteString(" reason=" + quote(r.Reason))
+	}
+	for _, p := range r.Properties {
+		b.WriteString(" " + p.Type + "." + p.Name + "=" + quote(p.Value))
+	}
+	return b.String()
+}
+
+// quote returns value as is when it is a valid RFC 2045 token or an
+// address, as a quoted-string otherwise.
+func quote(value string) string {
+	if value == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(value, " \t\"()<>,;:\\[]?=") || isAddress(value) {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func isAddress(value string) bool {
+	return !strings.ContainsAny(value, " \t\"()<>,;:\\[]?") && strings.Count(value, "@") == 1
+}
+
+// AuthservId returns the authentication service identifier used in
+// headers: the admd advertised by smtpd, or the hostname when it did not.
+func AuthservId() string {
+	if admd := filter.Config("admd"); admd != "" {
+		return admd
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// Field formats an Authentication-Results header field, one result per
+// line.
+func Field(authservId string, results ...Result) message.Field {
+	if len(results) == 0 {
+		return message.NewField("Authentication-Results", authservId+"; none")
+	}
+	lines := []string{"Authentication-Results: " + authservId + ";"}
+	for i, r := range results {
+		line := "\t" + r.String()
+		if i != len(results)-1 {
+			line += ";"
+		}
+		lines = append(lines, line)
+	}
+	return message.Field{Name: "Authentication-Results", Lines: lines}
+}
+
+// ServId extracts the authserv-id of an Authentication-Results value.
+func ServId(value string) string {
+	id, _, _ := strings.Cut(value, ";")
+	id = strings.TrimSpace(id)
+	if i := strings.IndexAny(id, " \t("); i >= 0 {
+		id = id[:i]
+	}
+	return id
+}
+
+// RemoveForged drops the Authentication-Results fields claiming to come
+// from authservId, which can only have been added by an outsider
+// (RFC 8601, section 5).
+func RemoveForged(header message.Header, authservId string) message.Header {
+	ret := make(message.Header, 0, len(header))
+	for _, f := range header {
+		if strings.EqualFold(f.Name, "Authentication-Results") && strings.EqualFold(ServId(f.Value()), authservId) {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// SplitResults returns the method results of an Authentication-Results
+// value, as strings, leaving out the authserv-id and "none".
+func SplitResults(value string) []string {
+	parts := make([]string, 0)
+	start, quoted, escaped := 0, false, false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case value[i] == '\\':
+			escaped = true
+		case value[i] == '"':
+			quoted = !quoted
+		case value[i] == ';' && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, value[start:])
+
+	ret := make([]string, 0)
+	for _, part := range parts[1:] {
+		part = strings.Join(strings.Fields(part), " ")
+		if part != "" && part != "none" {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
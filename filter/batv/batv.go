@@ -0,0 +1,200 @@
+package batv
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+var (
+	ErrNotSigned   = errors.New("address is not signed")
+	ErrMalformed   = errors.New("malformed prvs tag")
+	ErrUnknownKey  = errors.New("unknown prvs key")
+	ErrInvalidHash = errors.New("invalid prvs hash")
+	ErrExpired     = errors.New("expired prvs tag")
+)
+
+const day = 24 * time.Hour
+
+type session struct {
+	authenticated bool
+	bounce        bool
+}
+
+// Signer tags envelope senders with BATV prvs tags,
+// prvs=KDDDSSSSSS=local@domain where K is the key number, DDD the day
+// the tag expires and SSSSSS an HMAC of both and of the address.
+type Signer struct {
+	// Keys are indexed by key number, at most ten. Tags are made with
+	// Key and verified with the key they name, so that keys can be
+	// rotated.
+	Keys [][]byte
+	Key  int
+
+	// Validity is how long a tagged address accepts bounces.
+	Validity time.Duration
+
+	// Domains are the domains whose senders are signed and whose
+	// recipients must be signed to receive bounces, all domains if empty.
+	Domains []string
+
+	// UnsignedResponse refuses bounces to unsigned addresses,
+	// InvalidResponse refuses forged or expired tags.
+	UnsignedResponse filter.Response
+	InvalidResponse  filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewSigner(keys ...[]byte) *Signer {
+	return &Signer{
+		Keys:             keys,
+		Validity:         7 * day,
+		UnsignedResponse: filter.Reject("550 5.7.1 Bounce to an address that did not send mail"),
+		InvalidResponse:  filter.Reject("550 5.7.1 Invalid or expired BATV signature"),
+		sessions:         make(map[filter.Session]*session),
+	}
+}
+
+func (s *Signer) Register(in *filter.SMTPIn) {
+	in.OnLinkAuth(s.linkAuthCb)
+	in.OnLinkDisconnect(s.linkDisconnectCb)
+	in.MailFromRequest(s.mailFromCb)
+	in.RcptToRequest(s.rcptToCb)
+}
+
+func dayNumber(t time.Time) int {
+	return int(t.Unix()/int64(day/time.Second)) % 1000
+}
+
+func (s *Signer) hash(key []byte, tag string, address string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(tag))
+	mac.Write([]byte(strings.ToLower(address)))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// Sign returns address tagged with a prvs tag valid for Validity.
+func (s *Signer) Sign(now time.Time, address string) (string, error) {
+	if s.Key < 0 || s.Key >= len(s.Keys) || s.Key > 9 {
+		return "", ErrUnknownKey
+	}
+	tag := fmt.Sprintf("%d%03d", s.Key, dayNumber(now.Add(s.Validity)))
+	return fmt.Sprintf("prvs=%s%s=%s", tag, s.hash(s.Keys[s.Key], tag, address), address), nil
+}
+
+// Verify returns the address a prvs tagged address was made from.
+func (s *Signer) Verify(now time.Time, address string) (string, error) {
+	if len(address) < 5 || !strings.EqualFold(address[:5], "prvs=") {
+		return "", ErrNotSigned
+	}
+	tagval, original, ok := strings.Cut(address[5:], "=")
+	if !ok || len(tagval) != 10 || !strings.Contains(original, "@") {
+		return "", ErrMalformed
+	}
+	key, err := strconv.Atoi(tagval[:1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	expires, err := strconv.Atoi(tagval[1:4])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	if key >= len(s.Keys) {
+		return "", ErrUnknownKey
+	}
+	if !hmac.Equal([]byte(s.hash(s.Keys[key], tagval[:4], original)), []byte(strings.ToLower(tagval[4:]))) {
+		return "", ErrInvalidHash
+	}
+	left := (expires - dayNumber(now) + 1000) % 1000
+	if time.Duration(left)*day > s.Validity {
+		return "", ErrExpired
+	}
+	return original, nil
+}
+
+func (s *Signer) ours(address string) bool {
+	if len(s.Domains) == 0 {
+		return true
+	}
+	_, domain, _ := strings.Cut(address, "@")
+	for _, d := range s.Domains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Signer) session(sessionId filter.Session) *session {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		s.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (s *Signer) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	s.session(sessionId).authenticated = result == "pass"
+}
+
+func (s *Signer) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	delete(s.sessions, sessionId)
+}
+
+func (s *Signer) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := s.session(sessionId)
+	sender, rest := message.SplitParam(from)
+	sess.bounce = sender == ""
+
+	if !sess.authenticated || sender == "" || !s.ours(sender) {
+		return filter.Proceed()
+	}
+	if _, err := s.Verify(time.Now(), sender); !errors.Is(err, ErrNotSigned) {
+		// already tagged
+		return filter.Proceed()
+	}
+	signed, err := s.Sign(time.Now(), sender)
+	if err != nil {
+		log.Printf("%s: batv: %s", sessionId, err)
+		return filter.Proceed()
+	}
+	return filter.Rewrite("<" + signed + ">" + rest)
+}
+
+func (s *Signer) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	sess := s.session(sessionId)
+	recipient, rest := message.SplitParam(to)
+	if sess.authenticated || !s.ours(recipient) {
+		return filter.Proceed()
+	}
+
+	original, err := s.Verify(time.Now(), recipient)
+	switch {
+	case errors.Is(err, ErrNotSigned):
+		if sess.bounce {
+			return s.UnsignedResponse
+		}
+		return filter.Proceed()
+	case err != nil:
+		log.Printf("%s: batv: %s: %s", sessionId, recipient, err)
+		return s.InvalidResponse
+	}
+	return filter.Rewrite("<" + original + ">" + rest)
+}
@@ -0,0 +1,131 @@
+package batv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewSigner([]byte("key0"), []byte("key1"))
+	s.Key = 1
+
+	signed, err := s.Sign(now, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "prvs=1") || !strings.HasSuffix(signed, "=alice@example.org") || len(signed) != len("prvs=1DDDSSSSSS=alice@example.org") {
+		t.Fatalf("Sign = %q, want prvs=1DDDSSSSSS=alice@example.org", signed)
+	}
+
+	for _, address := range []string{signed, strings.ToUpper(signed[:15]) + signed[15:], strings.ToLower(signed)} {
+		original, err := s.Verify(now.Add(6*day), address)
+		if err != nil || !strings.EqualFold(original, "alice@example.org") {
+			t.Errorf("Verify(%q) = %q, %v, want alice@example.org", address, original, err)
+		}
+	}
+
+	// tags keep verifying with the key they name after a rotation
+	s.Key = 0
+	if _, err := s.Verify(now, signed); err != nil {
+		t.Errorf("Verify after a key rotation = %v", err)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewSigner([]byte("key0"))
+	signed, _ := s.Sign(now, "alice@example.org")
+
+	tests := []struct {
+		name    string
+		address string
+		at      time.Time
+		want    error
+	}{
+		{"not signed", "alice@example.org", now, ErrNotSigned},
+		{"short", "prvs", now, ErrNotSigned},
+		{"other address", strings.Replace(signed, "alice", "mallory", 1), now, ErrInvalidHash},
+		{"forged hash", signed[:9] + "000000" + signed[15:], now, ErrInvalidHash},
+		{"forged day", signed[:6] + "999" + signed[9:], now, ErrInvalidHash},
+		{"unknown key", "prvs=5" + signed[6:], now, ErrUnknownKey},
+		{"short tag", "prvs=0123abc=alice@example.org", now, ErrMalformed},
+		{"no address", signed[:16] + "alice", now, ErrMalformed},
+		{"non numeric day", "prvs=0ab1abcdef=alice@example.org", now, ErrMalformed},
+		{"valid", signed, now.Add(7 * day), nil},
+		{"expired", signed, now.Add(8 * day), ErrExpired},
+	}
+	for _, test := range tests {
+		if _, err := s.Verify(test.at, test.address); !errors.Is(err, test.want) {
+			t.Errorf("%s: Verify(%q) = %v, want %v", test.name, test.address, err, test.want)
+		}
+	}
+
+	s.Key = 1
+	if _, err := s.Sign(now, "alice@example.org"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Sign with a missing key = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestExpiryWrap(t *testing.T) {
+	s := NewSigner([]byte("key0"))
+	// days count modulo 1000
+	for _, days := range []int64{990, 995, 999, 1000, 1003} {
+		now := time.Unix(days*24*3600+3600, 0)
+		signed, err := s.Sign(now, "alice@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Verify(now.Add(7*day), signed); err != nil {
+			t.Errorf("day %d: Verify within validity = %v", days, err)
+		}
+		if _, err := s.Verify(now.Add(8*day), signed); !errors.Is(err, ErrExpired) {
+			t.Errorf("day %d: Verify past validity = %v, want %v", days, err, ErrExpired)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	now := time.Now()
+	s := NewSigner([]byte("key0"))
+	s.Domains = []string{"example.org"}
+	signed, _ := s.Sign(now, "alice@example.org")
+	sessionId := filter.Session{}
+
+	// outgoing mail of authenticated users is signed
+	s.linkAuthCb(now, sessionId, "pass", "alice")
+	res := s.mailFromCb(now, sessionId, "<alice@example.org> SIZE=1024")
+	if res != filter.Rewrite("<"+signed+"> SIZE=1024") {
+		t.Errorf("mailFromCb = %#v, want the signed sender", res)
+	}
+	for _, from := range []string{"<" + signed + ">", "<alice@example.com>", "<>"} {
+		if res := s.mailFromCb(now, sessionId, from); res != filter.Proceed() {
+			t.Errorf("mailFromCb(%q) = %#v, want proceed", from, res)
+		}
+	}
+	s.linkDisconnectCb(now, sessionId)
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want filter.Response
+	}{
+		{"bounce to signed", "<>", "<" + signed + ">", filter.Rewrite("<alice@example.org>")},
+		{"bounce to unsigned", "<>", "<alice@example.org>", s.UnsignedResponse},
+		{"bounce to forged", "<>", "<" + strings.Replace(signed, "alice", "bob", 1) + ">", s.InvalidResponse},
+		{"bounce to other domain", "<>", "<alice@example.com>", filter.Proceed()},
+		{"mail to unsigned", "<bob@example.net>", "<alice@example.org> NOTIFY=NEVER", filter.Proceed()},
+		{"mail to signed", "<bob@example.net>", "<" + signed + "> NOTIFY=NEVER", filter.Rewrite("<alice@example.org> NOTIFY=NEVER")},
+	}
+	for _, test := range tests {
+		s.mailFromCb(now, sessionId, test.from)
+		if res := s.rcptToCb(now, sessionId, test.to); res != test.want {
+			t.Errorf("%s: rcptToCb(%q) = %#v, want %#v", test.name, test.to, res, test.want)
+		}
+	}
+}
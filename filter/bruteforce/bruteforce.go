@@ -0,0 +1,324 @@
+package bruteforce
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// counter is a failure count decaying exponentially over time.
+type counter struct {
+	value float64
+	last  time.Time
+}
+
+func (c *counter) decay(now time.Time, halfLife time.Duration) float64 {
+	if elapsed := now.Sub(c.last); elapsed > 0 {
+		c.value *= math.Pow(0.5, elapsed.Seconds()/halfLife.Seconds())
+		c.last = now
+	}
+	return c.value
+}
+
+type session struct {
+	src      net.IP
+	attempts int
+}
+
+type Detector struct {
+	// MaxIPFailures and MaxUserFailures are the decayed failure counts
+	// past which a client is blocked. A client failing to authenticate as
+	// a user past its threshold is blocked right away, which catches
+	// attacks on an account spread over many addresses.
+	MaxIPFailures   float64
+	MaxUserFailures float64
+
+	// HalfLife is the time for failure counts to decay by half.
+	HalfLife time.Duration
+
+	// MaxSessionAttempts disconnects clients issuing more AUTH commands
+	// in a session, zero is unlimited.
+	MaxSessionAttempts int
+
+	// BlockDuration is how long clients stay blocked.
+	BlockDuration time.Duration
+
+	// Exempt lists networks never blocked.
+	Exempt []*net.IPNet
+
+	// Exporter, when set, is handed the block set whenever it changes.
+	Exporter *Exporter
+
+	DisconnectResponse filter.Response
+
+	ips     map[string]*counter
+	users   map[string]*counter
+	blocked map[string]time.Time
+	mtx     sync.Mutex
+
+	// exportMtx keeps concurrent exports from renaming a stale set last
+	exportMtx sync.Mutex
+
+	// ticker drives the expiry of blocks until Close stops it
+	ticker *time.Ticker
+	done   chan struct{}
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		MaxIPFailures:      10,
+		MaxUserFailures:    30,
+		HalfLife:           10 * time.Minute,
+		MaxSessionAttempts: 3,
+		BlockDuration:      time.Hour,
+		DisconnectResponse: filter.Disconnect("421 4.7.0 Too many authentication failures"),
+		ips:                make(map[string]*counter),
+		users:              make(map[string]*counter),
+		blocked:            make(map[string]time.Time),
+		sessions:           make(map[filter.Session]*session),
+	}
+}
+
+// Register hooks the detector and starts expiring blocks in the
+// background until Close is called. If an Exporter is set, the empty block
+// set is written.
+func (d *Detector) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(d.linkConnectCb)
+	in.OnLinkAuth(d.linkAuthCb)
+	in.OnLinkDisconnect(d.linkDisconnectCb)
+	in.ConnectRequest(d.connectCb)
+	in.AuthRequest(d.authCb)
+
+	if d.Exporter != nil {
+		d.export()
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.ticker != nil {
+		// already expiring for an earlier registration
+		return
+	}
+	d.ticker = time.NewTicker(time.Minute)
+	d.done = make(chan struct{})
+	go d.expireLoop(d.ticker, d.done)
+}
+
+func (d *Detector) expireLoop(ticker *time.Ticker, done chan struct{}) {
+	for {
+		select {
+		case now := <-ticker.C:
+			d.mtx.Lock()
+			changed := d.expire(now)
+			d.mtx.Unlock()
+			if changed && d.Exporter != nil {
+				d.export()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close stops expiring blocks in the background.
+func (d *Detector) Close() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.ticker == nil {
+		return
+	}
+	d.ticker.Stop()
+	close(d.done)
+	d.ticker = nil
+	d.done = nil
+}
+
+func (d *Detector) exempt(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, network := range d.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked returns the addresses currently blocked.
+func (d *Detector) Blocked() []net.IP {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	addrs := make([]net.IP, 0, len(d.blocked))
+	for addr := range d.blocked {
+		addrs = append(addrs, net.ParseIP(addr))
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i].To16(), addrs[j].To16()) < 0
+	})
+	return addrs
+}
+
+// Unblock lifts the block of ip and resets its failure count.
+func (d *Detector) Unblock(ip net.IP) bool {
+	d.mtx.Lock()
+	_, ok := d.blocked[ip.String()]
+	delete(d.blocked, ip.String())
+	delete(d.ips, ip.String())
+	d.mtx.Unlock()
+
+	if ok && d.Exporter != nil {
+		d.export()
+	}
+	return ok
+}
+
+func (d *Detector) export() {
+	d.exportMtx.Lock()
+	defer d.exportMtx.Unlock()
+	if err := d.Exporter.Export(d.Blocked()); err != nil {
+		log.Printf("bruteforce: export: %s", err)
+	}
+}
+
+// expire drops expired blocks and idle counters, and reports whether the
+// block set changed. It must be called with the lock held.
+func (d *Detector) expire(now time.Time) bool {
+	changed := false
+	for addr, until := range d.blocked {
+		if now.After(until) {
+			delete(d.blocked, addr)
+			changed = true
+		}
+	}
+	for _, counters := range []map[string]*counter{d.ips, d.users} {
+		for key, c := range counters {
+			if c.decay(now, d.HalfLife) < 0.01 {
+				delete(counters, key)
+			}
+		}
+	}
+	return changed
+}
+
+// isBlocked must be called with the lock held.
+func (d *Detector) isBlocked(ip net.IP, now time.Time) bool {
+	until, ok := d.blocked[ip.String()]
+	return ok && now.Before(until)
+}
+
+// Failure records an authentication failure of ip as user and reports
+// whether ip got blocked.
+func (d *Detector) Failure(now time.Time, ip net.IP, user string) bool {
+	if d.exempt(ip) {
+		return false
+	}
+
+	d.mtx.Lock()
+	c, ok := d.ips[ip.String()]
+	if !ok {
+		c = &counter{last: now}
+		d.ips[ip.String()] = c
+	}
+	ipFailures := c.decay(now, d.HalfLife) + 1
+	c.value = ipFailures
+
+	userFailures := 0.0
+	if user != "" {
+		c, ok = d.users[user]
+		if !ok {
+			c = &counter{last: now}
+			d.users[user] = c
+		}
+		userFailures = c.decay(now, d.HalfLife) + 1
+		c.value = userFailures
+	}
+
+	block := !d.isBlocked(ip, now) &&
+		((d.MaxIPFailures != 0 && ipFailures > d.MaxIPFailures) ||
+			(d.MaxUserFailures != 0 && userFailures > d.MaxUserFailures))
+	if block {
+		d.blocked[ip.String()] = now.Add(d.BlockDuration)
+	}
+	d.mtx.Unlock()
+
+	if block {
+		log.Printf("bruteforce: blocked %s (%.1f failures, %.1f for user %q)", ip, ipFailures, userFailures, user)
+		if d.Exporter != nil {
+			d.export()
+		}
+	}
+	return block
+}
+
+func (d *Detector) session(sessionId filter.Session) *session {
+	d.sessionsMtx.Lock()
+	defer d.sessionsMtx.Unlock()
+	sess, ok := d.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		d.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (d *Detector) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		d.session(sessionId).src = addr.IP
+	}
+}
+
+func (d *Detector) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	sess := d.session(sessionId)
+	if result != "fail" || sess.src == nil {
+		return
+	}
+	d.Failure(timestamp, sess.src, username)
+}
+
+func (d *Detector) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	d.sessionsMtx.Lock()
+	defer d.sessionsMtx.Unlock()
+	delete(d.sessions, sessionId)
+}
+
+func (d *Detector) connectCb(timestamp time.Time, sessionId filter.Session, rdns string, src net.Addr) filter.Response {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return filter.Proceed()
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.isBlocked(addr.IP, timestamp) {
+		return d.DisconnectResponse
+	}
+	return filter.Proceed()
+}
+
+func (d *Detector) authCb(timestamp time.Time, sessionId filter.Session, method string) filter.Response {
+	sess := d.session(sessionId)
+	if sess.src == nil || d.exempt(sess.src) {
+		return filter.Proceed()
+	}
+
+	sess.attempts++
+	if d.MaxSessionAttempts != 0 && sess.attempts > d.MaxSessionAttempts {
+		return d.DisconnectResponse
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.isBlocked(sess.src, timestamp) {
+		return d.DisconnectResponse
+	}
+	return filter.Proceed()
+}
@@ -0,0 +1,161 @@
+package bruteforce
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestCounterDecay(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := &counter{value: 8, last: start}
+
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 8},
+		{10 * time.Minute, 4},
+		{30 * time.Minute, 1},
+		// going back in time does not decay
+		{20 * time.Minute, 1},
+	}
+	for _, test := range tests {
+		if got := c.decay(start.Add(test.elapsed), 10*time.Minute); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("decay after %s = %f, want %f", test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		ips     []string
+		user    string
+		elapsed time.Duration // between failures
+		blocked []string
+	}{
+		{"ip threshold", repeat("192.0.2.1", 3), "", 0, []string{"192.0.2.1"}},
+		{"below ip threshold", repeat("192.0.2.1", 2), "", 0, nil},
+		{"decayed", repeat("192.0.2.1", 3), "", 10 * time.Minute, nil},
+		{"user threshold", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6"}, "alice", 0, []string{"192.0.2.6"}},
+		{"exempt network", repeat("198.51.100.1", 3), "", 0, nil},
+		{"loopback", repeat("127.0.0.1", 3), "", 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDetector()
+			d.MaxIPFailures = 2
+			d.MaxUserFailures = 5
+			_, exempt, _ := net.ParseCIDR("198.51.100.0/24")
+			d.Exempt = []*net.IPNet{exempt}
+
+			now := start
+			for _, ip := range test.ips {
+				d.Failure(now, net.ParseIP(ip), test.user)
+				now = now.Add(test.elapsed)
+			}
+			blocked := d.Blocked()
+			if len(blocked) != len(test.blocked) {
+				t.Fatalf("blocked %v, want %v", blocked, test.blocked)
+			}
+			for i := range blocked {
+				if blocked[i].String() != test.blocked[i] {
+					t.Errorf("blocked %v, want %v", blocked, test.blocked)
+				}
+			}
+		})
+	}
+}
+
+func repeat(s string, n int) []string {
+	r := make([]string, n)
+	for i := range r {
+		r[i] = s
+	}
+	return r
+}
+
+func TestBlock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d := NewDetector()
+	d.MaxIPFailures = 1
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	s := filter.Session{}
+
+	d.linkConnectCb(start, s, "", "", src, nil)
+	d.linkAuthCb(start, s, "fail", "alice")
+	d.linkAuthCb(start, s, "fail", "alice")
+	if res := d.authCb(start, s, "PLAIN"); res != d.DisconnectResponse {
+		t.Errorf("authCb when blocked = %#v, want disconnect", res)
+	}
+	d.linkDisconnectCb(start, s)
+	if res := d.connectCb(start, s, "", src); res != d.DisconnectResponse {
+		t.Errorf("connectCb when blocked = %#v, want disconnect", res)
+	}
+
+	// blocks expire
+	later := start.Add(time.Hour + time.Second)
+	if res := d.connectCb(later, s, "", src); res != filter.Proceed() {
+		t.Errorf("connectCb after the block = %#v, want proceed", res)
+	}
+	d.mtx.Lock()
+	changed := d.expire(later)
+	d.mtx.Unlock()
+	if !changed || len(d.Blocked()) != 0 {
+		t.Errorf("expire = %v, blocked %v, want the block dropped", changed, d.Blocked())
+	}
+}
+
+func TestUnblock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d := NewDetector()
+	d.MaxIPFailures = 1
+	ip := net.ParseIP("192.0.2.1")
+
+	d.Failure(start, ip, "")
+	if !d.Failure(start, ip, "") {
+		t.Fatal("not blocked past the threshold")
+	}
+	if !d.Unblock(ip) {
+		t.Fatal("Unblock of a blocked address returned false")
+	}
+	if d.Unblock(ip) {
+		t.Error("Unblock of an unblocked address returned true")
+	}
+	// the failure count was reset
+	if d.Failure(start, ip, "") {
+		t.Error("blocked again on the first failure after Unblock")
+	}
+}
+
+func TestMaxSessionAttempts(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		src  string
+		want []filter.Response
+	}{
+		{"client", "192.0.2.1", []filter.Response{filter.Proceed(), filter.Proceed(), filter.Disconnect("421 4.7.0 Too many authentication failures")}},
+		{"exempt", "127.0.0.1", []filter.Response{filter.Proceed(), filter.Proceed(), filter.Proceed()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDetector()
+			d.MaxSessionAttempts = 2
+			s := filter.Session{}
+			d.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP(test.src), Port: 4242}, nil)
+			for i, want := range test.want {
+				if res := d.authCb(start, s, "PLAIN"); res != want {
+					t.Errorf("attempt %d: %#v, want %#v", i, res, want)
+				}
+			}
+		})
+	}
+}
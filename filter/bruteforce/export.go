@@ -0,0 +1,142 @@
+package bruteforce
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Format int
+
+const (
+	// Plain is one address per line.
+	Plain Format = iota
+	// Nftables is an nft script replacing the content of an IPv4 and an
+	// IPv6 set, to be loaded with nft -f.
+	Nftables
+	// Pf is a table file, to be loaded with pfctl -T replace -f.
+	Pf
+)
+
+func (f Format) String() string {
+	switch f {
+	case Plain:
+		return "plain"
+	case Nftables:
+		return "nftables"
+	case Pf:
+		return "pf"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "plain":
+		return Plain, nil
+	case "nftables", "nft":
+		return Nftables, nil
+	case "pf":
+		return Pf, nil
+	}
+	return Plain, fmt.Errorf("unknown blocklist format %q", s)
+}
+
+// Exporter writes the block set to a file for host firewalls to load.
+type Exporter struct {
+	Path   string
+	Format Format
+
+	// NftTable is the family and name of the nftables table, NftSet4
+	// and NftSet6 the names of its ipv4_addr and ipv6_addr sets.
+	NftTable string
+	NftSet4  string
+	NftSet6  string
+
+	// PfTable is the name of the pf table, only used in a comment.
+	PfTable string
+}
+
+func NewExporter(path string, format Format) *Exporter {
+	return &Exporter{
+		Path:     path,
+		Format:   format,
+		NftTable: "inet filter",
+		NftSet4:  "smtpd_bruteforce4",
+		NftSet6:  "smtpd_bruteforce6",
+		PfTable:  "smtpd_bruteforce",
+	}
+}
+
+func (e *Exporter) write(w io.Writer, addrs []net.IP) error {
+	bw := bufio.NewWriter(w)
+	switch e.Format {
+	case Plain:
+		for _, addr := range addrs {
+			fmt.Fprintln(bw, addr)
+		}
+
+	case Pf:
+		fmt.Fprintf(bw, "# pfctl -t %s -T replace -f %s\n", e.PfTable, e.Path)
+		for _, addr := range addrs {
+			fmt.Fprintln(bw, addr)
+		}
+
+	case Nftables:
+		v4 := make([]string, 0)
+		v6 := make([]string, 0)
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				v4 = append(v4, addr.String())
+			} else {
+				v6 = append(v6, addr.String())
+			}
+		}
+		for _, set := range []struct {
+			name  string
+			addrs []string
+		}{{e.NftSet4, v4}, {e.NftSet6, v6}} {
+			fmt.Fprintf(bw, "flush set %s %s\n", e.NftTable, set.name)
+			if len(set.addrs) != 0 {
+				fmt.Fprintf(bw, "add element %s %s { %s }\n", e.NftTable, set.name, strings.Join(set.addrs, ", "))
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown blocklist format %s", e.Format)
+	}
+	return bw.Flush()
+}
+
+// Export replaces the file with the given addresses. The file is written
+// next to its destination and renamed over it, so that readers never see
+// a partial file.
+func (e *Exporter) Export(addrs []net.IP) error {
+	f, err := os.CreateTemp(filepath.Dir(e.Path), "."+filepath.Base(e.Path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := e.write(f, addrs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.Path)
+}
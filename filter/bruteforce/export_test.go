@@ -0,0 +1,74 @@
+package bruteforce
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExporterWrite(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")}
+
+	tests := []struct {
+		format Format
+		addrs  []net.IP
+		want   string
+	}{
+		{Plain, addrs, "192.0.2.1\n192.0.2.2\n2001:db8::1\n"},
+		{Plain, nil, ""},
+		{Pf, addrs, "# pfctl -t smtpd_bruteforce -T replace -f /var/db/blocked\n192.0.2.1\n192.0.2.2\n2001:db8::1\n"},
+		{Nftables, addrs, "flush set inet filter smtpd_bruteforce4\n" +
+			"add element inet filter smtpd_bruteforce4 { 192.0.2.1, 192.0.2.2 }\n" +
+			"flush set inet filter smtpd_bruteforce6\n" +
+			"add element inet filter smtpd_bruteforce6 { 2001:db8::1 }\n"},
+		{Nftables, nil, "flush set inet filter smtpd_bruteforce4\nflush set inet filter smtpd_bruteforce6\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewExporter("/var/db/blocked", test.format).write(&buf, test.addrs); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s with %v:\n%s\nwant:\n%s", test.format, test.addrs, buf.String(), test.want)
+		}
+	}
+
+	if err := NewExporter("/var/db/blocked", Format(42)).write(&bytes.Buffer{}, addrs); err == nil {
+		t.Error("unknown format written")
+	}
+}
+
+func TestExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked")
+	e := NewExporter(path, Plain)
+	if err := e.Export([]net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export([]net.IP{net.ParseIP("192.0.2.2")}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "192.0.2.2\n" {
+		t.Errorf("exported %q, want %q", data, "192.0.2.2\n")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("%d files left next to the export, want 1", len(entries))
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range []Format{Plain, Nftables, Pf} {
+		if got, err := ParseFormat(format.String()); err != nil || got != format {
+			t.Errorf("ParseFormat(%q) = %v, %v", format, got, err)
+		}
+	}
+	if _, err := ParseFormat("iptables"); err == nil {
+		t.Error("unknown format parsed")
+	}
+}
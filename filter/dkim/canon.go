@@ -0,0 +1,146 @@
+package dkim
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type Canonicalization int
+
+const (
+	Simple  Canonicalization = 0
+	Relaxed Canonicalization = iota
+)
+
+func (c Canonicalization) String() string {
+	switch c {
+	case Simple:
+		return "simple"
+	case Relaxed:
+		return "relaxed"
+	}
+	return fmt.Sprintf("Canonicalization(%d)", int(c))
+}
+
+func parseCanonicalization(s string) (Canonicalization, error) {
+	switch s {
+	case "simple":
+		return Simple, nil
+	case "relaxed":
+		return Relaxed, nil
+	}
+	return Simple, fmt.Errorf("unknown canonicalization %q", s)
+}
+
+// ParseCanonicalization parses the value of a c= tag, where a missing body
+// algorithm defaults to simple as per RFC 6376, section 3.5.
+func ParseCanonicalization(value string) (header Canonicalization, body Canonicalization, err error) {
+	if value == "" {
+		return Simple, Simple, nil
+	}
+	h, b, found := strings.Cut(value, "/")
+	if header, err = parseCanonicalization(h); err != nil {
+		return
+	}
+	if !found {
+		return header, Simple, nil
+	}
+	body, err = parseCanonicalization(b)
+	return
+}
+
+func isWSP(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// compressWSP replaces runs of whitespace with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if isWSP(s[i]) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+			inWSP = false
+		}
+		b.WriteByte(s[i])
+	}
+	if inWSP {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// CanonicalizeHeader returns the canonical form of a header field, without
+// the trailing CRLF.
+func CanonicalizeHeader(c Canonicalization, field message.Field) string {
+	if c == Simple {
+		return field.Raw()
+	}
+	return CanonicalizeRawHeader(c, field.Raw())
+}
+
+// CanonicalizeRawHeader is CanonicalizeHeader for a field already joined
+// with CRLF, as needed when a tag value was blanked out of it.
+func CanonicalizeRawHeader(c Canonicalization, raw string) string {
+	if c == Simple {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Trim(compressWSP(value), " ")
+	return name + ":" + value
+}
+
+// CanonicalizeBody returns the canonical form of the body lines, each line
+// terminated with CRLF.
+func CanonicalizeBody(c Canonicalization, lines []string) []byte {
+	canon := make([]string, len(lines))
+	for i, line := range lines {
+		if c == Relaxed {
+			line = strings.TrimRight(compressWSP(line), " ")
+		}
+		canon[i] = line
+	}
+
+	end := len(canon)
+	for end > 0 && canon[end-1] == "" {
+		end--
+	}
+
+	if end == 0 {
+		if c == Simple {
+			return []byte("\r\n")
+		}
+		return []byte{}
+	}
+
+	var b strings.Builder
+	for _, line := range canon[:end] {
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
+
+// BodyHash hashes the canonical body, truncated to limit octets unless
+// limit is negative. It also returns the length of the canonical body so
+// that callers can check a l= tag against it.
+func BodyHash(hash crypto.Hash, c Canonicalization, lines []string, limit int64) ([]byte, int64) {
+	body := CanonicalizeBody(c, lines)
+	length := int64(len(body))
+	if limit >= 0 && limit < length {
+		body = body[:limit]
+	}
+	h := hash.New()
+	h.Write(body)
+	return h.Sum(nil), length
+}
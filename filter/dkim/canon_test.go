@@ -0,0 +1,102 @@
+package dkim
+
+import (
+	"crypto"
+	"encoding/base64"
+	"testing"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// rfc6376Example is the canonicalization example of RFC 6376, section
+// 3.4.6.
+var rfc6376Example = message.Parse([]string{
+	"A: X",
+	"B : Y\t",
+	"\tZ  ",
+	"",
+	" C ",
+	"D \t E",
+	"",
+	"",
+})
+
+func TestCanonicalizeHeader(t *testing.T) {
+	tests := []struct {
+		c     Canonicalization
+		field int
+		want  string
+	}{
+		{Simple, 0, "A: X"},
+		{Simple, 1, "B : Y\t\r\n\tZ  "},
+		{Relaxed, 0, "a:X"},
+		{Relaxed, 1, "b:Y Z"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalizeHeader(tt.c, rfc6376Example.Header[tt.field]); got != tt.want {
+			t.Errorf("CanonicalizeHeader(%s, %d) = %q, want %q", tt.c, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalizeBody(t *testing.T) {
+	tests := []struct {
+		c     Canonicalization
+		lines []string
+		want  string
+	}{
+		{Simple, rfc6376Example.Body, " C \r\nD \t E\r\n"},
+		{Relaxed, rfc6376Example.Body, " C\r\nD E\r\n"},
+		{Simple, nil, "\r\n"},
+		{Relaxed, nil, ""},
+		{Simple, []string{"", ""}, "\r\n"},
+		{Relaxed, []string{" \t", ""}, ""},
+	}
+	for _, tt := range tests {
+		if got := string(CanonicalizeBody(tt.c, tt.lines)); got != tt.want {
+			t.Errorf("CanonicalizeBody(%s, %q) = %q, want %q", tt.c, tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	// hashes of empty bodies from RFC 6376, sections 3.4.3 and 3.4.4
+	tests := []struct {
+		c     Canonicalization
+		limit int64
+		want  string
+	}{
+		{Simple, -1, "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY="},
+		{Relaxed, -1, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		{Simple, 0, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+	for _, tt := range tests {
+		sum, length := BodyHash(crypto.SHA256, tt.c, nil, tt.limit)
+		if got := base64.StdEncoding.EncodeToString(sum); got != tt.want {
+			t.Errorf("BodyHash(%s, %d) = %s, want %s", tt.c, tt.limit, got, tt.want)
+		}
+		if want := int64(len(CanonicalizeBody(tt.c, nil))); length != want {
+			t.Errorf("BodyHash(%s, %d) length = %d, want %d", tt.c, tt.limit, length, want)
+		}
+	}
+}
+
+func TestParseCanonicalization(t *testing.T) {
+	tests := []struct {
+		value        string
+		header, body Canonicalization
+		err          bool
+	}{
+		{"", Simple, Simple, false},
+		{"relaxed", Relaxed, Simple, false},
+		{"relaxed/relaxed", Relaxed, Relaxed, false},
+		{"simple/relaxed", Simple, Relaxed, false},
+		{"nowsp", Simple, Simple, true},
+	}
+	for _, tt := range tests {
+		header, body, err := ParseCanonicalization(tt.value)
+		if (err != nil) != tt.err || err == nil && (header != tt.header || body != tt.body) {
+			t.Errorf("ParseCanonicalization(%q) = %s, %s, %v", tt.value, header, body, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package dkim
+
+import (
+	"log"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// Register hooks the signer on the events it needs: messages submitted by
+// sessions that successfully authenticated are signed as they go through
+// the data-line stream.
+func (s *Signer) Register(in *filter.SMTPIn) {
+	in.OnLinkAuth(s.linkAuthCb)
+	in.OnLinkDisconnect(s.linkDisconnectCb)
+	in.OnTxBegin(s.txBeginCb)
+	in.DataLineRequest(s.dataLineCb)
+	in.CommitRequest(s.commitCb)
+}
+
+func (s *Signer) session(sessionId filter.Session) *session {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		s.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (s *Signer) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	s.session(sessionId).authenticated = result == "pass"
+}
+
+func (s *Signer) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	delete(s.sessions, sessionId)
+}
+
+func (s *Signer) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := s.session(sessionId)
+	sess.lines = nil
+	sess.failed = false
+}
+
+func (s *Signer) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := s.session(sessionId)
+	if !sess.authenticated {
+		return []string{line}
+	}
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	domain, err := message.FromDomain(msg.Header)
+	if err == nil {
+		var fields []message.Field
+		if fields, err = s.Sign(msg, domain); err == nil {
+			msg.Prepend(fields...)
+		}
+	}
+	if err != nil {
+		log.Printf("%s: dkim: %s", sessionId, err)
+		sess.failed = true
+	}
+	return msg.DataLines()
+}
+
+func (s *Signer) commitCb(timestamp time.Time, sessionId filter.Session) filter.Response {
+	sess := s.session(sessionId)
+	failed := sess.failed
+	sess.failed = false
+	if failed && s.RejectOnError {
+		return filter.Reject("451 4.7.0 Message could not be signed, try again later")
+	}
+	return filter.Proceed()
+}
@@ -0,0 +1,116 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Algorithm int
+
+const (
+	RSASHA256     Algorithm = 0
+	Ed25519SHA256 Algorithm = iota
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case RSASHA256:
+		return "rsa-sha256"
+	case Ed25519SHA256:
+		return "ed25519-sha256"
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch strings.ToLower(name) {
+	case "rsa-sha256":
+		return RSASHA256, nil
+	case "ed25519-sha256":
+		return Ed25519SHA256, nil
+	}
+	return RSASHA256, fmt.Errorf("unsupported algorithm %q", name)
+}
+
+// KeyType returns the k= value of the key records matching the algorithm.
+func (a Algorithm) KeyType() string {
+	if a == Ed25519SHA256 {
+		return "ed25519"
+	}
+	return "rsa"
+}
+
+// LoadPrivateKey reads a private key from a file, see ParsePrivateKey.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey accepts PEM encoded PKCS#1 or PKCS#8 RSA keys, PEM
+// encoded PKCS#8 Ed25519 keys, and the bare base64 Ed25519 seeds produced
+// by the tooling described in RFC 8463.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("no PEM block or ed25519 seed found")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// KeyAlgorithm returns the signing algorithm matching a private key.
+func KeyAlgorithm(key crypto.Signer) (Algorithm, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return RSASHA256, nil
+	case ed25519.PublicKey:
+		return Ed25519SHA256, nil
+	}
+	return RSASHA256, fmt.Errorf("unsupported key type %T", key)
+}
+
+// SignData hashes data with SHA-256 and signs the digest, which is what
+// both rsa-sha256 and ed25519-sha256 (RFC 8463) expect.
+func SignData(key crypto.Signer, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
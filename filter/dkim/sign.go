@@ -0,0 +1,248 @@
+package dkim
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// DefaultHeaders is the set of header fields signed by default, taken from
+// RFC 6376, section 5.4.1.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe",
+	"List-Post", "List-Owner", "List-Archive",
+	"Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding",
+}
+
+// Tag is a tag=value pair of a signature header, in emission order.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// SignatureField builds a signature header field from its tags followed by
+// the b= tag holding signature. The b= tag is always emitted on a line of
+// its own so that blanking its value yields the exact header that was
+// signed, whatever the header canonicalization.
+func SignatureField(name string, tags []Tag, signature []byte) message.Field {
+	lines := make([]string, 0)
+	current := name + ":"
+	add := func(piece string, sep string) {
+		if len(current)+len(sep)+len(piece) > 76 && strings.TrimSpace(current) != "" {
+			lines = append(lines, current)
+			current = "\t" + piece
+		} else {
+			current += sep + piece
+		}
+	}
+
+	for _, tag := range tags {
+		if tag.Name != "h" {
+			add(tag.Name+"="+tag.Value+";", " ")
+			continue
+		}
+		// header lists may be folded after any colon
+		parts := strings.SplitAfter(tag.Value, ":")
+		parts[len(parts)-1] += ";"
+		add("h="+parts[0], " ")
+		for _, part := range parts[1:] {
+			add(part, "")
+		}
+	}
+	lines = append(lines, current)
+
+	b := base64.StdEncoding.EncodeToString(signature)
+	current = "\tb="
+	for len(b) > 72 {
+		lines = append(lines, current+b[:72])
+		current, b = "\t", b[72:]
+	}
+	lines = append(lines, current+b)
+
+	return message.Field{Name: name, Lines: lines}
+}
+
+// HeaderData returns the canonicalized header fields listed in names, as
+// fed to the signature hash. Repeated names select instances from the
+// bottom of the header up, names without a matching instance contribute
+// nothing (RFC 6376, section 5.4.2).
+func HeaderData(c Canonicalization, header message.Header, names []string) string {
+	var b strings.Builder
+	used := make(map[string]int)
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		fields := header.Fields(key)
+		n := used[key]
+		used[key]++
+		if n >= len(fields) {
+			continue
+		}
+		b.WriteString(CanonicalizeHeader(c, fields[len(fields)-1-n]))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+type Key struct {
+	Domain    string
+	Selector  string
+	Algorithm Algorithm
+	signer    crypto.Signer
+}
+
+type session struct {
+	authenticated bool
+	lines         []string
+	failed        bool
+}
+
+type Signer struct {
+	// Headers lists the header fields to sign, every instance present in
+	// the message is signed.
+	Headers []string
+
+	// Oversign lists header fields signed once more than they appear, so
+	// that adding an instance later on breaks the signature.
+	Oversign []string
+
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// RejectOnError tempfails the transaction at commit when a message
+	// could not be signed, otherwise the message goes out unsigned.
+	RejectOnError bool
+
+	keys map[string][]*Key
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewSigner() *Signer {
+	return &Signer{
+		Headers:                DefaultHeaders,
+		Oversign:               []string{"From"},
+		HeaderCanonicalization: Relaxed,
+		BodyCanonicalization:   Relaxed,
+		keys:                   make(map[string][]*Key),
+		sessions:               make(map[filter.Session]*session),
+	}
+}
+
+// AddKey loads the private key at path and uses it to sign mail from domain
+// with the given selector. Several keys may be registered for a domain, for
+// instance to sign with both rsa-sha256 and ed25519-sha256.
+func (s *Signer) AddKey(domain string, selector string, path string) error {
+	key, err := LoadPrivateKey(path)
+	if err != nil {
+		return err
+	}
+	return s.AddSigner(domain, selector, key)
+}
+
+func (s *Signer) AddSigner(domain string, selector string, key crypto.Signer) error {
+	algorithm, err := KeyAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	s.keys[domain] = append(s.keys[domain], &Key{
+		Domain:    domain,
+		Selector:  selector,
+		Algorithm: algorithm,
+		signer:    key,
+	})
+	return nil
+}
+
+// keysFor returns the keys registered for domain or, failing that, for its
+// closest parent domain.
+func (s *Signer) keysFor(domain string) []*Key {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if keys, ok := s.keys[domain]; ok {
+			return keys
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			return nil
+		}
+		domain = parent
+	}
+}
+
+func (s *Signer) headerNames(header message.Header) []string {
+	oversign := make(map[string]bool)
+	for _, name := range s.Oversign {
+		oversign[strings.ToLower(name)] = true
+	}
+
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{}, s.Headers...), s.Oversign...) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		count := len(header.Fields(key))
+		if oversign[key] {
+			count++
+		}
+		for i := 0; i < count; i++ {
+			names = append(names, key)
+		}
+	}
+	return names
+}
+
+// Sign returns one DKIM-Signature field per key registered for domain, to
+// be prepended to the message header.
+func (s *Signer) Sign(msg *message.Message, domain string) ([]message.Field, error) {
+	keys := s.keysFor(domain)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key for domain %s", domain)
+	}
+	if len(msg.Header.Fields("from")) == 0 {
+		return nil, fmt.Errorf("message has no From header")
+	}
+
+	names := s.headerNames(msg.Header)
+	headerData := HeaderData(s.HeaderCanonicalization, msg.Header, names)
+	bodyHash, _ := BodyHash(crypto.SHA256, s.BodyCanonicalization, msg.Body, -1)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	fields := make([]message.Field, 0, len(keys))
+	for _, key := range keys {
+		tags := []Tag{
+			{"v", "1"},
+			{"a", key.Algorithm.String()},
+			{"c", s.HeaderCanonicalization.String() + "/" + s.BodyCanonicalization.String()},
+			{"d", key.Domain},
+			{"s", key.Selector},
+			{"t", timestamp},
+			{"h", strings.Join(names, ":")},
+			{"bh", base64.StdEncoding.EncodeToString(bodyHash)},
+		}
+		unsigned := SignatureField("DKIM-Signature", tags, nil)
+		data := headerData + CanonicalizeHeader(s.HeaderCanonicalization, unsigned)
+		signature, err := SignData(key.signer, []byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("signing with %s._domainkey.%s: %w", key.Selector, key.Domain, err)
+		}
+		fields = append(fields, SignatureField("DKIM-Signature", tags, signature))
+	}
+	return fields, nil
+}
@@ -0,0 +1,73 @@
+package dkim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseTags parses a DKIM tag-list, as found in signature headers and key
+// records (RFC 6376, section 3.2). Whitespace around tags and values is
+// dropped, duplicate tags are an error.
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, found := strings.Cut(spec, "=")
+		if !found {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		if _, exists := tags[name]; exists {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// StripWhitespace removes all folding whitespace from a tag value, which is
+// needed for base64 values such as b= and bh=.
+func StripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// StripTagValue returns raw with the value of tag emptied, leaving
+// everything else untouched, which is how the b= tag is removed from a
+// signature header before it is hashed.
+func StripTagValue(raw string, tag string) string {
+	pos := 0
+	for pos < len(raw) {
+		start := pos
+		end := strings.IndexByte(raw[pos:], ';')
+		if end < 0 {
+			end = len(raw)
+		} else {
+			end += pos
+		}
+		spec := raw[start:end]
+		if eq := strings.IndexByte(spec, '='); eq >= 0 {
+			name := strings.TrimLeft(spec[:eq], " \t\r\n")
+			if i := strings.IndexByte(name, ':'); i >= 0 && start == 0 {
+				// first tag follows the field name
+				name = strings.TrimLeft(name[i+1:], " \t\r\n")
+			}
+			if strings.TrimRight(name, " \t\r\n") == tag {
+				return raw[:start+eq+1] + raw[end:]
+			}
+		}
+		pos = end + 1
+	}
+	return raw
+}
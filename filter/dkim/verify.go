@@ -0,0 +1,166 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// KeyRecord is a parsed DKIM key record (RFC 6376, section 3.6.1).
+type KeyRecord struct {
+	KeyType   string
+	Hashes    []string
+	Services  []string
+	Flags     []string
+	PublicKey crypto.PublicKey
+}
+
+func splitList(value string) []string {
+	ret := make([]string, 0)
+	for _, item := range strings.Split(value, ":") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// ErrKeyRevoked is returned by ParseKeyRecord for records with an empty p=.
+var ErrKeyRevoked = fmt.Errorf("key revoked")
+
+func ParseKeyRecord(txt string) (*KeyRecord, error) {
+	tags, err := ParseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key record version %q", v)
+	}
+
+	record := &KeyRecord{
+		KeyType:  "rsa",
+		Services: []string{"*"},
+	}
+	if k, ok := tags["k"]; ok {
+		record.KeyType = k
+	}
+	if h, ok := tags["h"]; ok {
+		record.Hashes = splitList(h)
+	}
+	if s, ok := tags["s"]; ok {
+		record.Services = splitList(s)
+	}
+	if t, ok := tags["t"]; ok {
+		record.Flags = splitList(t)
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, fmt.Errorf("key record has no p= tag")
+	}
+	p = StripWhitespace(p)
+	if p == "" {
+		return nil, ErrKeyRevoked
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	if record.PublicKey, err = ParsePublicKey(record.KeyType, data); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ParsePublicKey decodes the p= value of a key record of type keyType.
+func ParsePublicKey(keyType string, data []byte) (crypto.PublicKey, error) {
+	switch keyType {
+	case "rsa":
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			if key, ok := key.(*rsa.PublicKey); ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("key type mismatch, expected rsa")
+		}
+		return x509.ParsePKCS1PublicKey(data)
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key size %d", len(data))
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+func (r *KeyRecord) hasFlag(flag string) bool {
+	for _, f := range r.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Testing reports whether the domain is testing DKIM (t=y).
+func (r *KeyRecord) Testing() bool {
+	return r.hasFlag("y")
+}
+
+// Strict reports whether the i= domain must match d= exactly (t=s).
+func (r *KeyRecord) Strict() bool {
+	return r.hasFlag("s")
+}
+
+// AllowsEmail reports whether the key may be used for email signatures.
+func (r *KeyRecord) AllowsEmail() bool {
+	for _, s := range r.Services {
+		if s == "*" || s == "email" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSHA256 reports whether the key accepts sha256 based algorithms.
+func (r *KeyRecord) AllowsSHA256() bool {
+	if len(r.Hashes) == 0 {
+		return true
+	}
+	for _, h := range r.Hashes {
+		if h == "sha256" {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyBits returns the size of the public key in bits.
+func (r *KeyRecord) KeyBits() int {
+	switch key := r.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+// VerifyData checks a signature produced by SignData.
+func VerifyData(key crypto.PublicKey, data []byte, signature []byte) error {
+	digest := sha256.Sum256(data)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest[:], signature) {
+			return fmt.Errorf("ed25519 verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
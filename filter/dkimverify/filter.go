@@ -0,0 +1,108 @@
+package dkimverify
+
+import (
+	"context"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// Register hooks the verifier on the data-line stream: the signatures of
+// every message are verified when the message is complete, and the
+// outcome is recorded in an Authentication-Results header.
+func (v *Verifier) Register(in *filter.SMTPIn) {
+	in.OnLinkDisconnect(v.linkDisconnectCb)
+	in.OnTxBegin(v.txBeginCb)
+	in.DataLineRequest(v.dataLineCb)
+}
+
+// Results returns the per-signature results of the current transaction,
+// available to handlers running after the end of the data-line stream.
+func (v *Verifier) Results(sessionId filter.Session) []Result {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	if sess, ok := v.sessions[sessionId]; ok {
+		return append([]Result{}, sess.results...)
+	}
+	return nil
+}
+
+func (v *Verifier) session(sessionId filter.Session) *session {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	sess, ok := v.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		v.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (v *Verifier) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	delete(v.sessions, sessionId)
+}
+
+func (v *Verifier) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	v.sessions[sessionId] = &session{}
+}
+
+func (v *Verifier) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := v.session(sessionId)
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	results := v.Verify(ctx, msg)
+	cancel()
+
+	v.sessionsMtx.Lock()
+	sess.results = results
+	v.sessionsMtx.Unlock()
+
+	authservId := authres.AuthservId()
+	if v.RemoveForged {
+		msg.Header = authres.RemoveForged(msg.Header, authservId)
+	}
+	msg.Prepend(authres.Field(authservId, AuthResults(results)...))
+	return msg.DataLines()
+}
+
+// AuthResults converts verification results to Authentication-Results
+// method results, a message without signatures yielding dkim=none.
+func AuthResults(results []Result) []authres.Result {
+	if len(results) == 0 {
+		return []authres.Result{{Method: "dkim", Value: string(None)}}
+	}
+	ret := make([]authres.Result, 0, len(results))
+	for _, r := range results {
+		ar := authres.Result{
+			Method: "dkim",
+			Value:  string(r.Status),
+			Reason: r.Reason,
+		}
+		if r.Domain != "" {
+			ar.Properties = append(ar.Properties,
+				authres.Property{Type: "header", Name: "d", Value: r.Domain},
+				authres.Property{Type: "header", Name: "i", Value: r.Identifier},
+				authres.Property{Type: "header", Name: "s", Value: r.Selector},
+				authres.Property{Type: "header", Name: "a", Value: r.Algorithm})
+		}
+		if len(r.Signature) >= 8 {
+			// RFC 6008, enough to tell signatures of the same domain apart
+			ar.Properties = append(ar.Properties, authres.Property{Type: "header", Name: "b", Value: r.Signature[:8]})
+		}
+		ret = append(ret, ar)
+	}
+	return ret
+}
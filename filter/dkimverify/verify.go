@@ -0,0 +1,280 @@
+package dkimverify
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkim"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// TXTResolver is the subset of net.Resolver needed to fetch key records,
+// so that tests and alternate DNS clients can be plugged in.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Status is a DKIM result as registered for Authentication-Results
+// headers (RFC 8601, section 2.7.1).
+type Status string
+
+const (
+	None      Status = "none"
+	Pass      Status = "pass"
+	Fail      Status = "fail"
+	Policy    Status = "policy"
+	Neutral   Status = "neutral"
+	TempError Status = "temperror"
+	PermError Status = "permerror"
+)
+
+// Result is the outcome of the verification of a single signature.
+type Result struct {
+	Status     Status
+	Reason     string
+	Domain     string
+	Identifier string
+	Selector   string
+	Algorithm  string
+	Signature  string
+	Testing    bool
+
+	// BodyLength is the l= value of the signature, or -1 when the whole
+	// body is signed.
+	BodyLength int64
+}
+
+type session struct {
+	lines   []string
+	results []Result
+}
+
+type Verifier struct {
+	Resolver TXTResolver
+
+	// Timeout bounds the key lookups of a message. The filter verifies
+	// messages at the end of the data-line stream, from the dispatch loop,
+	// so that no other session progresses meanwhile.
+	Timeout time.Duration
+
+	// MinRSAKeyBits is the smallest RSA key accepted, signatures made
+	// with smaller keys get a policy result.
+	MinRSAKeyBits int
+
+	// AllowBodyLength lets signatures covering only part of the body (l=
+	// shorter than the body) pass, they get a policy result otherwise.
+	AllowBodyLength bool
+
+	// MaxSignatures bounds the number of signatures verified per message.
+	MaxSignatures int
+
+	// RemoveForged drops the Authentication-Results headers carrying our
+	// authserv-id that were already present in the message.
+	RemoveForged bool
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewVerifier(resolver TXTResolver) *Verifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Verifier{
+		Resolver:      resolver,
+		Timeout:       5 * time.Second,
+		MinRSAKeyBits: 1024,
+		MaxSignatures: 8,
+		RemoveForged:  true,
+		sessions:      make(map[filter.Session]*session),
+	}
+}
+
+// LookupKey fetches and parses the key record for selector and domain. On
+// failure, the returned status tells temporary errors from permanent ones.
+func LookupKey(ctx context.Context, resolver TXTResolver, selector string, domain string) (*dkim.KeyRecord, Status, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, PermError, fmt.Errorf("no key for signature")
+		}
+		return nil, TempError, fmt.Errorf("key lookup failed: %w", err)
+	}
+	if len(txts) == 0 {
+		return nil, PermError, fmt.Errorf("no key for signature")
+	}
+
+	// resolvers already concatenate the strings of a single record
+	var lastErr error
+	for _, txt := range txts {
+		record, err := dkim.ParseKeyRecord(txt)
+		if err == nil {
+			return record, Pass, nil
+		}
+		lastErr = err
+	}
+	return nil, PermError, lastErr
+}
+
+func (v *Verifier) Verify(ctx context.Context, msg *message.Message) []Result {
+	fields := msg.Header.Fields("dkim-signature")
+	if len(fields) == 0 {
+		return []Result{}
+	}
+
+	results := make([]Result, len(fields))
+	var wg sync.WaitGroup
+	for i, field := range fields {
+		if v.MaxSignatures > 0 && i >= v.MaxSignatures {
+			results[i] = Result{Status: Policy, Reason: "too many signatures", BodyLength: -1}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, field message.Field) {
+			defer wg.Done()
+			results[i] = v.verifySignature(ctx, msg, field)
+		}(i, field)
+	}
+	wg.Wait()
+	return results
+}
+
+func (v *Verifier) verifySignature(ctx context.Context, msg *message.Message, field message.Field) Result {
+	res := Result{BodyLength: -1}
+	failWith := func(status Status, format string, args ...any) Result {
+		res.Status = status
+		res.Reason = fmt.Sprintf(format, args...)
+		return res
+	}
+
+	tags, err := dkim.ParseTags(field.Value())
+	if err != nil {
+		return failWith(PermError, "malformed signature: %s", err)
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return failWith(PermError, "signature missing required tag %s", required)
+		}
+	}
+
+	res.Domain = strings.ToLower(tags["d"])
+	res.Selector = tags["s"]
+	res.Algorithm = tags["a"]
+	res.Signature = dkim.StripWhitespace(tags["b"])
+	res.Identifier = "@" + res.Domain
+	if i, ok := tags["i"]; ok {
+		res.Identifier = i
+	}
+
+	if tags["v"] != "1" {
+		return failWith(PermError, "incompatible version %s", tags["v"])
+	}
+	algorithm, err := dkim.ParseAlgorithm(tags["a"])
+	if err != nil {
+		return failWith(PermError, "%s", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(res.Signature)
+	if err != nil {
+		return failWith(PermError, "malformed b= tag")
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(dkim.StripWhitespace(tags["bh"]))
+	if err != nil {
+		return failWith(PermError, "malformed bh= tag")
+	}
+	headerCanon, bodyCanon, err := dkim.ParseCanonicalization(tags["c"])
+	if err != nil {
+		return failWith(PermError, "%s", err)
+	}
+
+	names := make([]string, 0)
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		names = append(names, name)
+		signsFrom = signsFrom || name == "from"
+	}
+	if !signsFrom {
+		return failWith(PermError, "From field not signed")
+	}
+
+	_, idDomain, found := strings.Cut(res.Identifier, "@")
+	idDomain = strings.ToLower(idDomain)
+	if !found || (idDomain != res.Domain && !strings.HasSuffix(idDomain, "."+res.Domain)) {
+		return failWith(PermError, "domain mismatch")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if res.BodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || res.BodyLength < 0 {
+			return failWith(PermError, "malformed l= tag")
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return failWith(PermError, "malformed x= tag")
+		}
+		if t, ok := tags["t"]; ok {
+			if timestamp, err := strconv.ParseInt(t, 10, 64); err == nil && expiration < timestamp {
+				return failWith(PermError, "x= tag earlier than t= tag")
+			}
+		}
+		if time.Now().Unix() > expiration {
+			return failWith(Fail, "signature expired")
+		}
+	}
+
+	record, status, err := LookupKey(ctx, v.Resolver, res.Selector, res.Domain)
+	if err != nil {
+		return failWith(status, "%s", err)
+	}
+	res.Testing = record.Testing()
+	if record.KeyType != algorithm.KeyType() {
+		return failWith(PermError, "inappropriate key algorithm")
+	}
+	if !record.AllowsSHA256() {
+		return failWith(PermError, "inappropriate hash algorithm")
+	}
+	if !record.AllowsEmail() {
+		return failWith(PermError, "inappropriate service type")
+	}
+	if record.Strict() && idDomain != res.Domain {
+		return failWith(PermError, "domain mismatch")
+	}
+
+	computed, length := dkim.BodyHash(crypto.SHA256, bodyCanon, msg.Body, res.BodyLength)
+	if res.BodyLength > length {
+		return failWith(PermError, "l= tag exceeds body length")
+	}
+	if string(computed) != string(bodyHash) {
+		return failWith(Fail, "body hash did not verify")
+	}
+
+	data := dkim.HeaderData(headerCanon, msg.Header, names) +
+		dkim.CanonicalizeRawHeader(headerCanon, dkim.StripTagValue(field.Raw(), "b"))
+	if err := dkim.VerifyData(record.PublicKey, []byte(data), signature); err != nil {
+		return failWith(Fail, "signature did not verify")
+	}
+
+	if _, ok := record.PublicKey.(*rsa.PublicKey); ok && record.KeyBits() < v.MinRSAKeyBits {
+		return failWith(Policy, "key too small (%d bits)", record.KeyBits())
+	}
+	if res.BodyLength >= 0 && res.BodyLength < length && !v.AllowBodyLength {
+		return failWith(Policy, "partial body signature")
+	}
+
+	res.Status = Pass
+	return res
+}
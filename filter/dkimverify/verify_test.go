@@ -0,0 +1,155 @@
+package dkimverify
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkim"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if len(txts) == 1 && txts[0] == "SERVFAIL" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return txts, nil
+}
+
+// rfc8463Message is the signed example of RFC 8463, appendix A.
+var rfc8463Message = []string{
+	"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;",
+	" d=football.example.com; i=@football.example.com;",
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :",
+	" subject : date : message-id : from : subject : date;",
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+	"From: Joe SixPack <joe@football.example.com>",
+	"To: Suzie Q <suzie@shopping.example.net>",
+	"Subject: Is dinner ready?",
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)",
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>",
+	"",
+	"Hi.",
+	"",
+	"We lost the game.  Are you hungry yet?",
+	"",
+	"Joe.",
+}
+
+var rfc8463Key = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
+func TestVerifyRFC8463(t *testing.T) {
+	resolver := fakeResolver{"brisbane._domainkey.football.example.com": {rfc8463Key}}
+	tampered := append([]string{}, rfc8463Message...)
+	tampered[len(tampered)-1] = "Jane."
+	resigned := append([]string{}, rfc8463Message...)
+	resigned[8] = "Subject: Is lunch ready?"
+
+	tests := []struct {
+		name     string
+		resolver fakeResolver
+		lines    []string
+		status   Status
+		reason   string
+	}{
+		{"valid", resolver, rfc8463Message, Pass, ""},
+		{"body modified", resolver, tampered, Fail, "body hash did not verify"},
+		{"header modified", resolver, resigned, Fail, "signature did not verify"},
+		{"no key", fakeResolver{}, rfc8463Message, PermError, "no key for signature"},
+		{"lookup failure", fakeResolver{"brisbane._domainkey.football.example.com": {"SERVFAIL"}}, rfc8463Message, TempError, ""},
+		{"revoked key", fakeResolver{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p="}}, rfc8463Message, PermError, ""},
+		{"key type mismatch", fakeResolver{"brisbane._domainkey.football.example.com": {strings.Replace(rfc8463Key, "ed25519", "rsa", 1)}}, rfc8463Message, PermError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := NewVerifier(tt.resolver).Verify(context.Background(), message.Parse(tt.lines))
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			r := results[0]
+			if r.Status != tt.status || tt.reason != "" && r.Reason != tt.reason {
+				t.Errorf("got %s (%s), want %s (%s)", r.Status, r.Reason, tt.status, tt.reason)
+			}
+			if r.Domain != "football.example.com" || r.Selector != "brisbane" || r.Identifier != "@football.example.com" {
+				t.Errorf("got d=%s s=%s i=%s", r.Domain, r.Selector, r.Identifier)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKey, err := rsa.GenerateKey(rand.Reader, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	smallPub, _ := x509.MarshalPKIXPublicKey(&smallKey.PublicKey)
+
+	resolver := fakeResolver{
+		"ed._domainkey.example.org":    {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+		"rsa._domainkey.example.org":   {"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"small._domainkey.example.org": {"v=DKIM1; t=y; p=" + base64.StdEncoding.EncodeToString(smallPub)},
+	}
+
+	tests := []struct {
+		name     string
+		selector string
+		key      crypto.Signer
+		status   Status
+		testing  bool
+	}{
+		{"ed25519", "ed", edKey, Pass, false},
+		{"rsa", "rsa", rsaKey, Pass, false},
+		{"small rsa key", "small", smallKey, Policy, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := dkim.NewSigner()
+			if err := signer.AddSigner("example.org", tt.selector, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			msg := message.Parse([]string{
+				"From: Gilles <gilles@example.org>",
+				"To: Eric <eric@example.net>",
+				"Subject:  folded",
+				"   subject\t ",
+				"",
+				"trailing whitespace \t",
+				"",
+				"",
+			})
+			fields, err := signer.Sign(msg, "example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Prepend(fields...)
+
+			results := NewVerifier(resolver).Verify(context.Background(), message.Parse(msg.Lines()))
+			if len(results) != 1 || results[0].Status != tt.status || results[0].Testing != tt.testing {
+				t.Errorf("got %+v, want %s", results, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkimverify"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/publicsuffix"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/spf"
+)
+
+// Resolver is the subset of net.Resolver needed to fetch policy records,
+// so that tests and alternate DNS clients can be plugged in.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Evaluation is the outcome of the DMARC evaluation of a message.
+type Evaluation struct {
+	Result     Result
+	HeaderFrom string
+
+	// PolicyDomain is the domain the record was found at, either the
+	// From domain or its organizational domain.
+	PolicyDomain string
+	Record       *Record
+
+	// Policy is the requested policy, p= or sp= depending on
+	// PolicyDomain, and Disposition the one applied after pct sampling.
+	Policy      Policy
+	Disposition Policy
+
+	SPFAligned  bool
+	DKIMAligned bool
+
+	Problem string
+}
+
+// LookupRecord discovers the policy record of domain, falling back to the
+// organizational domain (RFC 7489, section 6.6.3). It returns a nil record
+// when no policy is published.
+func LookupRecord(ctx context.Context, resolver Resolver, suffixes *publicsuffix.List, domain string) (*Record, string, error) {
+	record, err := lookupRecord(ctx, resolver, domain)
+	if record != nil || err != nil {
+		return record, domain, err
+	}
+
+	orgDomain := suffixes.OrganizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, "", nil
+	}
+	record, err = lookupRecord(ctx, resolver, orgDomain)
+	if record != nil || err != nil {
+		return record, orgDomain, err
+	}
+	return nil, "", nil
+}
+
+func lookupRecord(ctx context.Context, resolver Resolver, domain string) (*Record, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	records := make([]string, 0)
+	for _, txt := range txts {
+		if IsRecord(txt) {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		// none or several, no policy either way
+		return nil, nil
+	}
+
+	record, err := ParseRecord(records[0])
+	if err != nil {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func aligned(suffixes *publicsuffix.List, domain1 string, domain2 string, mode Alignment) bool {
+	domain1 = strings.ToLower(strings.TrimSuffix(domain1, "."))
+	domain2 = strings.ToLower(strings.TrimSuffix(domain2, "."))
+	if domain1 == "" || domain2 == "" {
+		return false
+	}
+	if mode == AlignmentStrict {
+		return domain1 == domain2
+	}
+	return suffixes.OrganizationalDomain(domain1) == suffixes.OrganizationalDomain(domain2)
+}
+
+// Evaluate computes the DMARC result of a message from the SPF outcome and
+// the DKIM results of its transaction, either of which may be missing.
+func Evaluate(ctx context.Context, resolver Resolver, suffixes *publicsuffix.List, headerFrom string, spfOutcome *spf.Outcome, dkimResults []dkimverify.Result) *Evaluation {
+	eval := &Evaluation{
+		Result:      None,
+		HeaderFrom:  headerFrom,
+		Policy:      PolicyNone,
+		Disposition: PolicyNone,
+	}
+
+	record, policyDomain, err := LookupRecord(ctx, resolver, suffixes, headerFrom)
+	if err != nil {
+		eval.Result = TempError
+		eval.Problem = fmt.Sprintf("policy lookup failed: %s", err)
+		return eval
+	}
+	if record == nil {
+		return eval
+	}
+	eval.Record = record
+	eval.PolicyDomain = policyDomain
+
+	eval.Policy = record.Policy
+	if policyDomain != headerFrom {
+		eval.Policy = record.SubdomainPolicy
+	}
+
+	if spfOutcome != nil && spfOutcome.Result == spf.Pass {
+		eval.SPFAligned = aligned(suffixes, spfOutcome.Domain, headerFrom, record.SPFAlignment)
+	}
+	for _, r := range dkimResults {
+		if r.Status == dkimverify.Pass && aligned(suffixes, r.Domain, headerFrom, record.DKIMAlignment) {
+			eval.DKIMAligned = true
+			break
+		}
+	}
+
+	if eval.SPFAligned || eval.DKIMAligned {
+		eval.Result = Pass
+		return eval
+	}
+
+	eval.Result = Fail
+	eval.Disposition = eval.Policy
+	if record.Percent < 100 && rand.IntN(100) >= record.Percent {
+		// not sampled, apply the next less strict policy (section 6.6.4)
+		switch eval.Policy {
+		case PolicyReject:
+			eval.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			eval.Disposition = PolicyNone
+		}
+	}
+	return eval
+}
@@ -0,0 +1,160 @@
+package dmarc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkimverify"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/publicsuffix"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/spf"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if len(txts) == 1 && txts[0] == "SERVFAIL" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return txts, nil
+}
+
+var resolver = fakeResolver{
+	"_dmarc.example.com":       {"v=DMARC1; p=reject; sp=quarantine"},
+	"_dmarc.strict.example":    {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+	"_dmarc.example.co.uk":     {"v=DMARC1; p=quarantine"},
+	"_dmarc.sampled.example":   {"v=DMARC1; p=reject; pct=0"},
+	"_dmarc.monitor.example":   {"v=DMARC1; rua=mailto:dmarc@monitor.example"},
+	"_dmarc.twice.example":     {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	"_dmarc.broken.example":    {"SERVFAIL"},
+	"_dmarc.unrelated.example": {"v=spf1 -all"},
+}
+
+func spfPass(domain string) *spf.Outcome {
+	return &spf.Outcome{Result: spf.Pass, Identity: "mailfrom", Domain: domain}
+}
+
+func dkimPass(domain string) []dkimverify.Result {
+	return []dkimverify.Result{{Status: dkimverify.Pass, Domain: domain}}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name        string
+		from        string
+		spf         *spf.Outcome
+		dkim        []dkimverify.Result
+		result      Result
+		policy      Policy
+		disposition Policy
+		domain      string
+	}{
+		{"spf aligned", "example.com", spfPass("example.com"), nil, Pass, PolicyReject, PolicyNone, "example.com"},
+		{"spf relaxed", "example.com", spfPass("bounces.example.com"), nil, Pass, PolicyReject, PolicyNone, "example.com"},
+		{"dkim relaxed", "example.com", nil, dkimPass("mail.example.com"), Pass, PolicyReject, PolicyNone, "example.com"},
+		{"unaligned", "example.com", spfPass("example.net"), dkimPass("example.net"), Fail, PolicyReject, PolicyReject, "example.com"},
+		{"spf not passing", "example.com", &spf.Outcome{Result: spf.SoftFail, Domain: "example.com"}, nil, Fail, PolicyReject, PolicyReject, "example.com"},
+		{"dkim not passing", "example.com", nil, []dkimverify.Result{{Status: dkimverify.Fail, Domain: "example.com"}}, Fail, PolicyReject, PolicyReject, "example.com"},
+		{"subdomain policy", "news.example.com", nil, nil, Fail, PolicyQuarantine, PolicyQuarantine, "example.com"},
+		{"subdomain aligned", "news.example.com", spfPass("example.com"), nil, Pass, PolicyQuarantine, PolicyNone, "example.com"},
+		{"strict spf", "strict.example", spfPass("mail.strict.example"), nil, Fail, PolicyReject, PolicyReject, "strict.example"},
+		{"strict dkim", "strict.example", nil, dkimPass("strict.example"), Pass, PolicyReject, PolicyNone, "strict.example"},
+		{"public suffix", "www.example.co.uk", spfPass("other.co.uk"), nil, Fail, PolicyQuarantine, PolicyQuarantine, "example.co.uk"},
+		{"public suffix aligned", "www.example.co.uk", spfPass("example.co.uk"), nil, Pass, PolicyQuarantine, PolicyNone, "example.co.uk"},
+		{"sampled out", "sampled.example", nil, nil, Fail, PolicyReject, PolicyQuarantine, "sampled.example"},
+		{"rua without p", "monitor.example", nil, nil, Fail, PolicyNone, PolicyNone, "monitor.example"},
+		{"several records", "twice.example", nil, nil, None, PolicyNone, PolicyNone, ""},
+		{"no record", "example.net", nil, nil, None, PolicyNone, PolicyNone, ""},
+		{"not a record", "unrelated.example", nil, nil, None, PolicyNone, PolicyNone, ""},
+		{"lookup failure", "broken.example", nil, nil, TempError, PolicyNone, PolicyNone, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval := Evaluate(context.Background(), resolver, publicsuffix.Default(), tt.from, tt.spf, tt.dkim)
+			if eval.Result != tt.result || eval.Policy != tt.policy || eval.Disposition != tt.disposition || eval.PolicyDomain != tt.domain {
+				t.Errorf("got %s p=%s disposition=%s at %q, want %s p=%s disposition=%s at %q",
+					eval.Result, eval.Policy, eval.Disposition, eval.PolicyDomain,
+					tt.result, tt.policy, tt.disposition, tt.domain)
+			}
+		})
+	}
+}
+
+type fixedSPF struct{ outcome *spf.Outcome }
+
+func (f fixedSPF) Outcome(sessionId filter.Session) *spf.Outcome {
+	return f.outcome
+}
+
+func TestCommitInvalidFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   filter.Response
+	}{
+		{"aligned", []string{"From: a@example.com"}, filter.Proceed()},
+		{"no from", []string{"Subject: hello"}, filter.Reject("550 5.7.1 Message must have a single From address")},
+		{"two from", []string{"From: a@example.com", "From: b@example.net"}, filter.Reject("550 5.7.1 Message must have a single From address")},
+		{"two addresses", []string{"From: a@example.com, b@example.net"}, filter.Reject("550 5.7.1 Message must have a single From address")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEvaluator(resolver, fixedSPF{spfPass("example.com")}, nil)
+			sessionId := filter.Session{}
+			e.txBeginCb(time.Now(), sessionId, "")
+			for _, line := range append(tt.header, "", "body", ".") {
+				e.dataLineCb(time.Now(), sessionId, line)
+			}
+			if got := e.commitCb(time.Now(), sessionId); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		txt       string
+		policy    Policy
+		subdomain Policy
+		err       bool
+	}{
+		{"v=DMARC1; p=reject", PolicyReject, PolicyReject, false},
+		{"v=DMARC1; p=Quarantine; sp=none", PolicyQuarantine, PolicyNone, false},
+		{"v=DMARC1; rua=mailto:dmarc@example.com", PolicyNone, PolicyNone, false},
+		{"v=DMARC1", "", "", true},
+		{"v=DMARC1; p=bogus", "", "", true},
+		{"v=DMARC1; p=reject; sp=bogus", "", "", true},
+
+		// RFC 7489, section 6.6.3: acted upon as p=none with a valid rua
+		{"v=DMARC1; p=bogus; rua=mailto:dmarc@example.com", PolicyNone, PolicyNone, false},
+		{"v=DMARC1; p=reject; sp=bogus; rua=mailto:dmarc@example.com!10m", PolicyNone, PolicyNone, false},
+		{"v=DMARC1; p=bogus; rua=dmarc@example.com", "", "", true},
+		{"v=DMARC1; p=bogus; rua=", "", "", true},
+
+		{"v=DMARC1; p=reject; pct=101", "", "", true},
+		{"p=reject", "", "", true},
+	}
+	for _, tt := range tests {
+		record, err := ParseRecord(tt.txt)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseRecord(%q) = %+v, want an error", tt.txt, record)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecord(%q): %s", tt.txt, err)
+			continue
+		}
+		if record.Policy != tt.policy || record.SubdomainPolicy != tt.subdomain {
+			t.Errorf("ParseRecord(%q) = p=%s sp=%s, want p=%s sp=%s", tt.txt, record.Policy, record.SubdomainPolicy, tt.policy, tt.subdomain)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package dmarc
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkimverify"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/publicsuffix"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/spf"
+)
+
+// SPFSource provides the SPF outcome of a transaction, as *spf.Checker
+// does.
+type SPFSource interface {
+	Outcome(sessionId filter.Session) *spf.Outcome
+}
+
+// DKIMSource provides the DKIM results of a transaction, as
+// *dkimverify.Verifier does.
+type DKIMSource interface {
+	Results(sessionId filter.Session) []dkimverify.Result
+}
+
+type session struct {
+	src           net.IP
+	authenticated bool
+	headerDone    bool
+	header        []string
+	evaluation    *Evaluation
+}
+
+type Evaluator struct {
+	Resolver Resolver
+	Suffixes *publicsuffix.List
+	SPF      SPFSource
+	DKIM     DKIMSource
+
+	// Timeout bounds the policy lookups of a message, evaluated at commit
+	// from the dispatch loop which waits for it before handling any other
+	// event.
+	Timeout time.Duration
+
+	// RejectResponse and QuarantineResponse are returned at commit for
+	// messages failing DMARC, depending on the disposition.
+	RejectResponse     filter.Response
+	QuarantineResponse filter.Response
+
+	// InvalidFromResponse is returned at commit for messages without
+	// exactly one RFC5322.From address, whose policy cannot be looked up
+	// (RFC 7489, section 6.6.1).
+	InvalidFromResponse filter.Response
+
+	// SkipAuthenticated disables the evaluation for sessions that
+	// successfully authenticated.
+	SkipAuthenticated bool
+
+	// Recorder, when set, is handed an entry per evaluated message.
+	Recorder Recorder
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewEvaluator(resolver Resolver, spfSource SPFSource, dkimSource DKIMSource) *Evaluator {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Evaluator{
+		Resolver:            resolver,
+		Suffixes:            publicsuffix.Default(),
+		SPF:                 spfSource,
+		DKIM:                dkimSource,
+		Timeout:             3 * time.Second,
+		RejectResponse:      filter.Reject("550 5.7.1 Message rejected per DMARC policy"),
+		QuarantineResponse:  filter.Junk(),
+		InvalidFromResponse: filter.Reject("550 5.7.1 Message must have a single From address"),
+		SkipAuthenticated:   true,
+		sessions:            make(map[filter.Session]*session),
+	}
+}
+
+// Register hooks the evaluator on the events it needs. It must be
+// registered after the SPF and DKIM sources so that their results are
+// available when the evaluation happens at commit.
+func (e *Evaluator) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(e.linkConnectCb)
+	in.OnLinkAuth(e.linkAuthCb)
+	in.OnLinkDisconnect(e.linkDisconnectCb)
+	in.OnTxBegin(e.txBeginCb)
+	in.DataLineRequest(e.dataLineCb)
+	in.CommitRequest(e.commitCb)
+}
+
+// Evaluation returns the DMARC evaluation of the current transaction,
+// once commit was reached.
+func (e *Evaluator) Evaluation(sessionId filter.Session) *Evaluation {
+	e.sessionsMtx.Lock()
+	defer e.sessionsMtx.Unlock()
+	if sess, ok := e.sessions[sessionId]; ok {
+		return sess.evaluation
+	}
+	return nil
+}
+
+func (e *Evaluator) session(sessionId filter.Session) *session {
+	e.sessionsMtx.Lock()
+	defer e.sessionsMtx.Unlock()
+	sess, ok := e.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		e.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (e *Evaluator) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		e.session(sessionId).src = addr.IP
+	}
+}
+
+func (e *Evaluator) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	e.session(sessionId).authenticated = result == "pass"
+}
+
+func (e *Evaluator) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	e.sessionsMtx.Lock()
+	defer e.sessionsMtx.Unlock()
+	delete(e.sessions, sessionId)
+}
+
+func (e *Evaluator) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := e.session(sessionId)
+	e.sessionsMtx.Lock()
+	defer e.sessionsMtx.Unlock()
+	sess.headerDone = false
+	sess.header = nil
+	sess.evaluation = nil
+}
+
+// dataLineCb only keeps the header section, the body is not needed.
+func (e *Evaluator) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := e.session(sessionId)
+	if !sess.headerDone {
+		if line == "" || line == "." {
+			sess.headerDone = true
+		} else {
+			sess.header = append(sess.header, message.Unstuff(line))
+		}
+	}
+	return []string{line}
+}
+
+func (e *Evaluator) commitCb(timestamp time.Time, sessionId filter.Session) filter.Response {
+	sess := e.session(sessionId)
+	if sess.authenticated && e.SkipAuthenticated {
+		return filter.Proceed()
+	}
+
+	headerFrom, err := message.FromDomain(message.Parse(sess.header).Header)
+	if err != nil {
+		log.Printf("%s: dmarc: %s", sessionId, err)
+		e.sessionsMtx.Lock()
+		sess.evaluation = &Evaluation{
+			Result:      PermError,
+			Policy:      PolicyNone,
+			Disposition: PolicyNone,
+			Problem:     err.Error(),
+		}
+		e.sessionsMtx.Unlock()
+		return e.InvalidFromResponse
+	}
+
+	var spfOutcome *spf.Outcome
+	if e.SPF != nil {
+		spfOutcome = e.SPF.Outcome(sessionId)
+	}
+	var dkimResults []dkimverify.Result
+	if e.DKIM != nil {
+		dkimResults = e.DKIM.Results(sessionId)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	eval := Evaluate(ctx, e.Resolver, e.Suffixes, headerFrom, spfOutcome, dkimResults)
+	cancel()
+
+	e.sessionsMtx.Lock()
+	sess.evaluation = eval
+	e.sessionsMtx.Unlock()
+
+	if e.Recorder != nil && eval.Record != nil {
+		if err := e.Recorder.Record(e.reportEntry(timestamp, sess, eval, spfOutcome, dkimResults)); err != nil {
+			log.Printf("%s: dmarc: failed to record entry: %s", sessionId, err)
+		}
+	}
+
+	switch eval.Disposition {
+	case PolicyReject:
+		return e.RejectResponse
+	case PolicyQuarantine:
+		return e.QuarantineResponse
+	}
+	return filter.Proceed()
+}
+
+func (e *Evaluator) reportEntry(timestamp time.Time, sess *session, eval *Evaluation, spfOutcome *spf.Outcome, dkimResults []dkimverify.Result) *ReportEntry {
+	entry := &ReportEntry{
+		Time:            timestamp,
+		HeaderFrom:      eval.HeaderFrom,
+		PolicyDomain:    eval.PolicyDomain,
+		Policy:          eval.Record.Policy,
+		SubdomainPolicy: eval.Record.SubdomainPolicy,
+		DKIMAlignment:   eval.Record.DKIMAlignment,
+		SPFAlignment:    eval.Record.SPFAlignment,
+		Percent:         eval.Record.Percent,
+		Result:          eval.Result,
+		Disposition:     eval.Disposition,
+		DKIMAligned:     eval.DKIMAligned,
+		SPFAligned:      eval.SPFAligned,
+		DKIM:            make([]DKIMAuth, 0, len(dkimResults)),
+	}
+	if sess.src != nil {
+		entry.SourceIP = sess.src.String()
+	}
+	if spfOutcome != nil {
+		entry.EnvelopeFrom = spfOutcome.Domain
+		entry.SPF = &SPFAuth{
+			Domain: spfOutcome.Domain,
+			Scope:  spfOutcome.Identity,
+			Result: string(spfOutcome.Result),
+		}
+	}
+	for _, r := range dkimResults {
+		entry.DKIM = append(entry.DKIM, DKIMAuth{
+			Domain:   r.Domain,
+			Selector: r.Selector,
+			Result:   string(r.Status),
+		})
+	}
+	return entry
+}
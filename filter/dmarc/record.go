@@ -0,0 +1,143 @@
+package dmarc
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/dkim"
+)
+
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+type Alignment string
+
+const (
+	AlignmentRelaxed Alignment = "r"
+	AlignmentStrict  Alignment = "s"
+)
+
+// Record is a parsed DMARC policy record (RFC 7489, section 6.3).
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	DKIMAlignment   Alignment
+	SPFAlignment    Alignment
+	Percent         int
+	AggregateURIs   []string
+	FailureURIs     []string
+}
+
+func parsePolicy(value string) (Policy, error) {
+	switch p := Policy(strings.ToLower(value)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+	return PolicyNone, fmt.Errorf("invalid policy %q", value)
+}
+
+func parseAlignment(value string) (Alignment, error) {
+	switch a := Alignment(strings.ToLower(value)); a {
+	case AlignmentRelaxed, AlignmentStrict:
+		return a, nil
+	}
+	return AlignmentRelaxed, fmt.Errorf("invalid alignment mode %q", value)
+}
+
+// validURI reports whether uri is a syntactically valid DMARC URI, an
+// absolute URI optionally followed by a size limit (RFC 7489, section 6.4).
+func validURI(uri string) bool {
+	uri, _, _ = strings.Cut(uri, "!")
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme != "" && u.Opaque+u.Host+u.Path != ""
+}
+
+func splitURIs(value string) []string {
+	ret := make([]string, 0)
+	for _, uri := range strings.Split(value, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			ret = append(ret, uri)
+		}
+	}
+	return ret
+}
+
+// IsRecord reports whether a TXT record is a DMARC record.
+func IsRecord(txt string) bool {
+	txt = strings.TrimSpace(txt)
+	if !strings.HasPrefix(txt, "v") {
+		return false
+	}
+	version, _, _ := strings.Cut(txt, ";")
+	name, value, found := strings.Cut(version, "=")
+	return found && strings.TrimSpace(name) == "v" && strings.TrimSpace(value) == "DMARC1"
+}
+
+func ParseRecord(txt string) (*Record, error) {
+	if !IsRecord(txt) {
+		return nil, fmt.Errorf("not a DMARC record")
+	}
+	tags, err := dkim.ParseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{
+		DKIMAlignment: AlignmentRelaxed,
+		SPFAlignment:  AlignmentRelaxed,
+		Percent:       100,
+	}
+
+	if rua, ok := tags["rua"]; ok {
+		record.AggregateURIs = splitURIs(rua)
+	}
+	if ruf, ok := tags["ruf"]; ok {
+		record.FailureURIs = splitURIs(ruf)
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		err = fmt.Errorf("missing p= tag")
+	} else if record.Policy, err = parsePolicy(p); err == nil {
+		record.SubdomainPolicy = record.Policy
+		if sp, ok := tags["sp"]; ok {
+			record.SubdomainPolicy, err = parsePolicy(sp)
+		}
+	}
+	if err != nil {
+		// RFC 7489, section 6.6.3, a record with a missing or invalid
+		// policy but a valid rua is acted upon as p=none
+		valid := false
+		for _, uri := range record.AggregateURIs {
+			valid = valid || validURI(uri)
+		}
+		if !valid {
+			return nil, err
+		}
+		record.Policy = PolicyNone
+		record.SubdomainPolicy = PolicyNone
+	}
+	if adkim, ok := tags["adkim"]; ok {
+		if record.DKIMAlignment, err = parseAlignment(adkim); err != nil {
+			return nil, err
+		}
+	}
+	if aspf, ok := tags["aspf"]; ok {
+		if record.SPFAlignment, err = parseAlignment(aspf); err != nil {
+			return nil, err
+		}
+	}
+	if pct, ok := tags["pct"]; ok {
+		if record.Percent, err = strconv.Atoi(pct); err != nil || record.Percent < 0 || record.Percent > 100 {
+			return nil, fmt.Errorf("invalid pct %q", pct)
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,66 @@
+package dmarc
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type DKIMAuth struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Result   string `json:"result"`
+}
+
+type SPFAuth struct {
+	Domain string `json:"domain"`
+	Scope  string `json:"scope"`
+	Result string `json:"result"`
+}
+
+// ReportEntry holds what an aggregate report (RFC 7489, appendix C) needs
+// to know about a single message.
+type ReportEntry struct {
+	Time         time.Time `json:"time"`
+	SourceIP     string    `json:"source_ip"`
+	HeaderFrom   string    `json:"header_from"`
+	EnvelopeFrom string    `json:"envelope_from"`
+
+	PolicyDomain    string    `json:"policy_domain"`
+	Policy          Policy    `json:"p"`
+	SubdomainPolicy Policy    `json:"sp"`
+	DKIMAlignment   Alignment `json:"adkim"`
+	SPFAlignment    Alignment `json:"aspf"`
+	Percent         int       `json:"pct"`
+
+	Result      Result `json:"result"`
+	Disposition Policy `json:"disposition"`
+	DKIMAligned bool   `json:"dkim_aligned"`
+	SPFAligned  bool   `json:"spf_aligned"`
+
+	DKIM []DKIMAuth `json:"dkim"`
+	SPF  *SPFAuth   `json:"spf,omitempty"`
+}
+
+// Recorder collects the entries of evaluated messages, to be aggregated
+// into reports by an external process.
+type Recorder interface {
+	Record(entry *ReportEntry) error
+}
+
+// JSONRecorder writes entries as JSON lines.
+type JSONRecorder struct {
+	mtx     sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONRecorder(w io.Writer) *JSONRecorder {
+	return &JSONRecorder{encoder: json.NewEncoder(w)}
+}
+
+func (r *JSONRecorder) Record(entry *ReportEntry) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.encoder.Encode(entry)
+}
@@ -0,0 +1,197 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver is the subset of *net.Resolver needed to query blocklists.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type Kind int
+
+const (
+	// IPList is a DNSBL queried with the reversed client address.
+	IPList Kind = iota
+	// DomainList is a RHSBL queried with a domain name.
+	DomainList
+)
+
+func (k Kind) String() string {
+	switch k {
+	case IPList:
+		return "ip"
+	case DomainList:
+		return "domain"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// List describes a blocklist zone and how to interpret its answers.
+type List struct {
+	Zone string
+	Kind Kind
+
+	// Weight is added to the score when the zone lists the query.
+	Weight float64
+
+	// Codes maps return codes to their own weight, overriding Weight.
+	// When set, return codes not in the map are ignored, which is how
+	// lists returning several kinds of listings are restricted to some.
+	Codes map[string]float64
+}
+
+// weight returns the weight of the answers of a zone: the highest weight
+// among the codes returned, so that a list never counts more than once.
+// Answers outside of 127.0.0.0/8 and within 127.255.255.0/24 are not
+// listings but errors, such as those returned by some lists to queries
+// from public resolvers.
+func (l *List) weight(answers []net.IP) (float64, bool) {
+	listed := false
+	weight := 0.0
+	for _, answer := range answers {
+		v4 := answer.To4()
+		if v4 == nil || v4[0] != 127 || (v4[1] == 255 && v4[2] == 255) {
+			continue
+		}
+		w := l.Weight
+		if l.Codes != nil {
+			var ok bool
+			if w, ok = l.Codes[v4.String()]; !ok {
+				continue
+			}
+		}
+		if !listed || w > weight {
+			weight = w
+		}
+		listed = true
+	}
+	return weight, listed
+}
+
+// Listing records a zone that listed a query.
+type Listing struct {
+	Zone string
+	// Name is the address or domain that was looked up, Query the
+	// actual query name.
+	Name   string
+	Query  string
+	Codes  []net.IP
+	Weight float64
+}
+
+// ReverseIP returns the query name of an address under zone: reversed
+// octets for IPv4 and reversed nibbles for IPv6.
+func ReverseIP(ip net.IP, zone string) string {
+	zone = strings.TrimSuffix(zone, ".")
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	const hexDigits = "0123456789abcdef"
+	v6 := ip.To16()
+	var b strings.Builder
+	for i := len(v6) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[v6[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[v6[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString(zone)
+	return b.String()
+}
+
+// DomainQuery returns the query name of domain under zone.
+func DomainQuery(domain string, zone string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, ".")) + "." + strings.TrimSuffix(zone, ".")
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Query looks name up in every list of the given kind, an address for IP
+// lists and a domain for domain lists, in parallel and with each lookup
+// bounded by timeout. It returns the listings along with their combined
+// weight. Lookup errors other than NXDOMAIN are returned but do
+// not prevent the other lists from being consulted.
+func Query(ctx context.Context, resolver Resolver, lists []List, kind Kind, timeout time.Duration, name string) ([]Listing, float64, []error) {
+	type answer struct {
+		query   string
+		answers []net.IP
+		err     error
+	}
+
+	var ip net.IP
+	if kind == IPList {
+		if ip = net.ParseIP(name); ip == nil {
+			return nil, 0, []error{fmt.Errorf("invalid address %q", name)}
+		}
+	} else {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+
+	answers := make([]*answer, len(lists))
+	var wg sync.WaitGroup
+	for i := range lists {
+		if lists[i].Kind != kind {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var query string
+			if kind == IPList {
+				query = ReverseIP(ip, lists[i].Zone)
+			} else {
+				query = DomainQuery(name, lists[i].Zone)
+			}
+			qctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			addrs, err := resolver.LookupIPAddr(qctx, query)
+			if err != nil && isNotFound(err) {
+				err = nil
+			}
+			ips := make([]net.IP, 0, len(addrs))
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+			answers[i] = &answer{query: query, answers: ips, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	listings := make([]Listing, 0)
+	errs := make([]error, 0)
+	score := 0.0
+	for i, res := range answers {
+		if res == nil {
+			continue
+		}
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", lists[i].Zone, res.err))
+			continue
+		}
+		weight, listed := lists[i].weight(res.answers)
+		if !listed {
+			continue
+		}
+		listings = append(listings, Listing{
+			Zone:   lists[i].Zone,
+			Name:   name,
+			Query:  res.query,
+			Codes:  res.answers,
+			Weight: weight,
+		})
+		score += weight
+	}
+	return listings, score, errs
+}
@@ -0,0 +1,213 @@
+package dnsbl
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// zone answers queries from a map of names to return codes, names missing
+// from the map are NXDOMAIN and names mapped to nil fail with SERVFAIL.
+type zone map[string][]string
+
+func (z zone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	codes, ok := z[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if codes == nil {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	ret := make([]net.IPAddr, 0, len(codes))
+	for _, code := range codes {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(code)})
+	}
+	return ret, nil
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192.bl.example"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example"},
+	}
+	for _, test := range tests {
+		if got := ReverseIP(net.ParseIP(test.ip), "bl.example."); got != test.want {
+			t.Errorf("ReverseIP(%s) = %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	resolver := zone{
+		"1.2.0.192.a.example":    {"127.0.0.2"},
+		"1.2.0.192.b.example":    {"127.0.0.2", "127.0.0.4"},
+		"1.2.0.192.c.example":    {"127.255.255.254"},
+		"1.2.0.192.d.example":    {"192.0.2.1"},
+		"1.2.0.192.e.example":    nil,
+		"1.2.0.192.f.example":    {"127.0.0.3"},
+		"spam.example.r.example": {"127.0.0.2"},
+	}
+
+	tests := []struct {
+		name     string
+		lists    []List
+		kind     Kind
+		query    string
+		listed   []string
+		score    float64
+		errCount int
+	}{
+		{
+			name:   "single listing",
+			lists:  []List{{Zone: "a.example", Weight: 3}},
+			query:  "192.0.2.1",
+			listed: []string{"a.example"},
+			score:  3,
+		},
+		{
+			name:  "not listed",
+			lists: []List{{Zone: "x.example", Weight: 3}},
+			query: "192.0.2.1",
+		},
+		{
+			name:   "weights add up across lists",
+			lists:  []List{{Zone: "a.example", Weight: 3}, {Zone: "x.example", Weight: 4}, {Zone: "f.example", Weight: 1.5}},
+			query:  "192.0.2.1",
+			listed: []string{"a.example", "f.example"},
+			score:  4.5,
+		},
+		{
+			name:   "several codes count once",
+			lists:  []List{{Zone: "b.example", Weight: 2}},
+			query:  "192.0.2.1",
+			listed: []string{"b.example"},
+			score:  2,
+		},
+		{
+			name:   "codes take the heaviest weight",
+			lists:  []List{{Zone: "b.example", Codes: map[string]float64{"127.0.0.2": 1, "127.0.0.4": 6}}},
+			query:  "192.0.2.1",
+			listed: []string{"b.example"},
+			score:  6,
+		},
+		{
+			name:  "codes outside of the map are ignored",
+			lists: []List{{Zone: "f.example", Weight: 5, Codes: map[string]float64{"127.0.0.2": 1}}},
+			query: "192.0.2.1",
+		},
+		{
+			name:  "error codes are not listings",
+			lists: []List{{Zone: "c.example", Weight: 5}, {Zone: "d.example", Weight: 5}},
+			query: "192.0.2.1",
+		},
+		{
+			name:     "servfail is an error",
+			lists:    []List{{Zone: "e.example", Weight: 5}, {Zone: "a.example", Weight: 1}},
+			query:    "192.0.2.1",
+			listed:   []string{"a.example"},
+			score:    1,
+			errCount: 1,
+		},
+		{
+			name:   "domain lists only",
+			lists:  []List{{Zone: "a.example", Weight: 3}, {Zone: "r.example", Kind: DomainList, Weight: 2}},
+			kind:   DomainList,
+			query:  "Spam.Example.",
+			listed: []string{"r.example"},
+			score:  2,
+		},
+		{
+			name:     "invalid address",
+			lists:    []List{{Zone: "a.example", Weight: 3}},
+			query:    "spam.example",
+			errCount: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listings, score, errs := Query(context.Background(), resolver, test.lists, test.kind, time.Second, test.query)
+			zones := make([]string, 0)
+			for _, listing := range listings {
+				zones = append(zones, listing.Zone)
+			}
+			if strings.Join(zones, ",") != strings.Join(test.listed, ",") {
+				t.Errorf("listed by %v, want %v", zones, test.listed)
+			}
+			if score != test.score {
+				t.Errorf("score = %v, want %v", score, test.score)
+			}
+			if len(errs) != test.errCount {
+				t.Errorf("errors = %v, want %d", errs, test.errCount)
+			}
+		})
+	}
+}
+
+func TestChecker(t *testing.T) {
+	resolver := zone{
+		"1.2.0.192.ip.example":        {"127.0.0.2"},
+		"2.2.0.192.ip.example":        {"127.0.0.10"},
+		"spam.example.domain.example": {"127.0.0.2"},
+	}
+
+	tests := []struct {
+		name  string
+		src   string
+		helo  string
+		from  string
+		auth  bool
+		score float64
+		want  filter.Response
+	}{
+		{"clean", "192.0.2.3", "mx.example.org", "<user@example.org>", false, 0, filter.Proceed()},
+		{"junk", "192.0.2.1", "mx.example.org", "<user@example.org>", false, 6, filter.Junk()},
+		{"subdomain not listed", "192.0.2.1", "mx.spam.example", "<>", false, 6, filter.Junk()},
+		{"reject", "192.0.2.1", "spam.example", "<user@spam.example>", false, 10, filter.Reject("554 5.7.1 Service unavailable; 192.0.2.1 blocked using ip.example")},
+		{"sender with parameters", "192.0.2.1", "mx.example.org", "<user@spam.example> SIZE=1024 BODY=8BITMIME", false, 10, filter.Reject("554 5.7.1 Service unavailable; 192.0.2.1 blocked using ip.example")},
+		{"heaviest code", "192.0.2.2", "mx.example.org", "<>", false, 10, filter.Reject("554 5.7.1 Service unavailable; 192.0.2.2 blocked using ip.example")},
+		{"authenticated", "192.0.2.3", "mx.example.org", "<user@spam.example>", true, 0, filter.Proceed()},
+		{"private address", "10.0.0.1", "[10.0.0.1]", "<>", false, 0, filter.Proceed()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker(resolver)
+			c.Lists = []List{
+				{Zone: "ip.example", Codes: map[string]float64{"127.0.0.2": 6, "127.0.0.10": 10}},
+				{Zone: "domain.example", Kind: DomainList, Weight: 4},
+			}
+			sessionId := filter.Session{}
+			if test.auth {
+				c.linkAuthCb(time.Now(), sessionId, "pass", "user")
+			}
+
+			stages := []func() filter.Response{
+				func() filter.Response {
+					return c.connectCb(time.Now(), sessionId, "", &net.TCPAddr{IP: net.ParseIP(test.src), Port: 25})
+				},
+				func() filter.Response { return c.heloCb(time.Now(), sessionId, test.helo) },
+				func() filter.Response { return c.mailFromCb(time.Now(), sessionId, test.from) },
+			}
+			var res filter.Response
+			for _, stage := range stages {
+				if res = stage(); res != filter.Proceed() && res != filter.Junk() {
+					break
+				}
+			}
+			if got := c.Score(sessionId); got != test.score {
+				t.Errorf("score = %v, want %v", got, test.score)
+			}
+			if res != test.want {
+				t.Errorf("response = %#v, want %#v", res, test.want)
+			}
+		})
+	}
+}
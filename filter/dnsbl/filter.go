@@ -0,0 +1,256 @@
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type session struct {
+	authenticated bool
+
+	ipListings   []Listing
+	ipScore      float64
+	heloListings []Listing
+	heloScore    float64
+	mailListings []Listing
+	mailScore    float64
+}
+
+func (s *session) score() float64 {
+	return s.ipScore + s.heloScore + s.mailScore
+}
+
+func (s *session) listings() []Listing {
+	ret := make([]Listing, 0, len(s.ipListings)+len(s.heloListings)+len(s.mailListings))
+	ret = append(ret, s.ipListings...)
+	ret = append(ret, s.heloListings...)
+	return append(ret, s.mailListings...)
+}
+
+type Checker struct {
+	Resolver Resolver
+	Lists    []List
+
+	// Timeout bounds each query, lists failing to answer in time are
+	// considered as not listing the query. Lists are queried in parallel
+	// but each stage waits for them in the dispatch loop, holding every
+	// other session.
+	Timeout time.Duration
+
+	// RejectScore and JunkScore are the thresholds the combined score is
+	// checked against after each stage, a zero threshold is disabled.
+	RejectScore float64
+	JunkScore   float64
+
+	// RejectResponse is returned when the reject threshold is reached, a
+	// response naming the heaviest listing is built when nil.
+	RejectResponse filter.Response
+
+	// SkipAuthenticated lets transactions of sessions that successfully
+	// authenticated proceed whatever their score.
+	SkipAuthenticated bool
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Checker{
+		Resolver:          resolver,
+		Timeout:           2 * time.Second,
+		RejectScore:       10,
+		JunkScore:         5,
+		SkipAuthenticated: true,
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+// AddIPList adds a DNSBL zone queried with the client address.
+func (c *Checker) AddIPList(zone string, weight float64) {
+	c.Lists = append(c.Lists, List{Zone: zone, Kind: IPList, Weight: weight})
+}
+
+// AddDomainList adds a RHSBL zone queried with the HELO and MAIL FROM
+// domains.
+func (c *Checker) AddDomainList(zone string, weight float64) {
+	c.Lists = append(c.Lists, List{Zone: zone, Kind: DomainList, Weight: weight})
+}
+
+// CheckIP queries the IP lists for ip.
+func (c *Checker) CheckIP(ctx context.Context, ip net.IP) ([]Listing, float64, []error) {
+	return Query(ctx, c.Resolver, c.Lists, IPList, c.Timeout, ip.String())
+}
+
+// CheckDomain queries the domain lists for domain.
+func (c *Checker) CheckDomain(ctx context.Context, domain string) ([]Listing, float64, []error) {
+	return Query(ctx, c.Resolver, c.Lists, DomainList, c.Timeout, domain)
+}
+
+func (c *Checker) Register(in *filter.SMTPIn) {
+	in.OnLinkAuth(c.linkAuthCb)
+	in.OnLinkDisconnect(c.linkDisconnectCb)
+	in.ConnectRequest(c.connectCb)
+	in.HeloRequest(c.heloCb)
+	in.EhloRequest(c.heloCb)
+	in.MailFromRequest(c.mailFromCb)
+}
+
+// Score returns the combined score of the listings of the session.
+func (c *Checker) Score(sessionId filter.Session) float64 {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.score()
+	}
+	return 0
+}
+
+// Listings returns the listings of the session: client address, HELO and
+// MAIL FROM domain of the current transaction.
+func (c *Checker) Listings(sessionId filter.Session) []Listing {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.listings()
+	}
+	return nil
+}
+
+func (c *Checker) session(sessionId filter.Session) *session {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess, ok := c.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		c.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (c *Checker) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	c.session(sessionId).authenticated = result == "pass"
+}
+
+func (c *Checker) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	delete(c.sessions, sessionId)
+}
+
+func (c *Checker) logErrors(sessionId filter.Session, errs []error) {
+	for _, err := range errs {
+		log.Printf("%s: dnsbl: %s", sessionId, err)
+	}
+}
+
+// response checks the combined score against the thresholds.
+func (c *Checker) response(sess *session) filter.Response {
+	c.sessionsMtx.Lock()
+	score := sess.score()
+	listings := sess.listings()
+	c.sessionsMtx.Unlock()
+
+	if c.RejectScore != 0 && score >= c.RejectScore {
+		if c.RejectResponse != nil {
+			return c.RejectResponse
+		}
+		if len(listings) == 0 {
+			return filter.Reject("554 5.7.1 Service unavailable")
+		}
+		listing := listings[0]
+		for _, l := range listings[1:] {
+			if l.Weight > listing.Weight {
+				listing = l
+			}
+		}
+		return filter.Reject(fmt.Sprintf("554 5.7.1 Service unavailable; %s blocked using %s", listing.Name, listing.Zone))
+	}
+	if c.JunkScore != 0 && score >= c.JunkScore {
+		return filter.Junk()
+	}
+	return filter.Proceed()
+}
+
+func (c *Checker) connectCb(timestamp time.Time, sessionId filter.Session, rdns string, src net.Addr) filter.Response {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok || addr.IP.IsLoopback() || addr.IP.IsPrivate() || addr.IP.IsLinkLocalUnicast() {
+		return filter.Proceed()
+	}
+	sess := c.session(sessionId)
+
+	listings, score, errs := c.CheckIP(context.Background(), addr.IP)
+	c.logErrors(sessionId, errs)
+
+	c.sessionsMtx.Lock()
+	sess.ipListings = listings
+	sess.ipScore = score
+	c.sessionsMtx.Unlock()
+
+	return c.response(sess)
+}
+
+// domainOf returns the domain part of a HELO name or address, or an empty
+// string for address literals and the null sender.
+func domainOf(s string) string {
+	if _, domain, found := strings.Cut(s, "@"); found {
+		s = domain
+	}
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || strings.HasPrefix(s, "[") || net.ParseIP(s) != nil || !strings.Contains(s, ".") {
+		return ""
+	}
+	return s
+}
+
+func (c *Checker) heloCb(timestamp time.Time, sessionId filter.Session, helo string) filter.Response {
+	sess := c.session(sessionId)
+
+	var listings []Listing
+	var score float64
+	if domain := domainOf(helo); domain != "" {
+		var errs []error
+		listings, score, errs = c.CheckDomain(context.Background(), domain)
+		c.logErrors(sessionId, errs)
+	}
+
+	c.sessionsMtx.Lock()
+	sess.heloListings = listings
+	sess.heloScore = score
+	c.sessionsMtx.Unlock()
+
+	return c.response(sess)
+}
+
+func (c *Checker) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := c.session(sessionId)
+	if sess.authenticated && c.SkipAuthenticated {
+		return filter.Proceed()
+	}
+
+	var listings []Listing
+	var score float64
+	sender, _ := message.SplitParam(from)
+	if domain := domainOf(sender); domain != "" {
+		var errs []error
+		listings, score, errs = c.CheckDomain(context.Background(), domain)
+		c.logErrors(sessionId, errs)
+	}
+
+	c.sessionsMtx.Lock()
+	sess.mailListings = listings
+	sess.mailScore = score
+	c.sessionsMtx.Unlock()
+
+	return c.response(sess)
+}
@@ -75,6 +75,10 @@ type reject struct{ errorMsg string }
 type disconnect struct{ errorMsg string }
 type rewrite struct{ parameter string }
 type report struct{ parameter string }
+type delay struct {
+	duration time.Duration
+	response Response
+}
 
 func (f proceed) _x()    {}
 func (f junk) _x()       {}
@@ -82,6 +86,7 @@ func (f reject) _x()     {}
 func (f disconnect) _x() {}
 func (f rewrite) _x()    {}
 func (f report) _x()     {}
+func (f delay) _x()      {}
 
 func Proceed() Response {
 	return proceed{}
@@ -107,6 +112,18 @@ func Report(parameter string) Response {
 	return report{parameter: parameter}
 }
 
+// Delay sends response r only after d has elapsed, without holding other
+// sessions. Once the tarpit budget is exhausted, r is sent right away.
+func Delay(d time.Duration, r Response) Response {
+	switch r := r.(type) {
+	case nil:
+		return delay{duration: d, response: proceed{}}
+	case delay:
+		return delay{duration: d + r.duration, response: r.response}
+	}
+	return delay{duration: d, response: r}
+}
+
 type LinkConnectCb func(timestamp time.Time, sessionId Session, rdns string, fcrdns string, src net.Addr, dest net.Addr)
 type LinkGreetingCb func(timestamp time.Time, sessionId Session, hostname string)
 type LinkIdentifyCb func(timestamp time.Time, sessionId Session, method string, hostname string)
@@ -148,306 +165,357 @@ type WizRequestCb func(timestamp time.Time, sessionId Session) Response
 
 type reporting struct {
 	sessionAllocator func() SessionData
-	linkConnect      LinkConnectCb
-	linkGreeting     LinkGreetingCb
-	linkIdentify     LinkIdentifyCb
-	linkTLS          LinkTLSCb
-	linkAuth         LinkAuthCb
-	linkDisconnect   LinkDisconnectCb
+	linkConnect      []LinkConnectCb
+	linkGreeting     []LinkGreetingCb
+	linkIdentify     []LinkIdentifyCb
+	linkTLS          []LinkTLSCb
+	linkAuth         []LinkAuthCb
+	linkDisconnect   []LinkDisconnectCb
 
-	txReset    TxResetCb
-	txBegin    TxBeginCb
-	txMail     TxMailCb
-	txRcpt     TxRcptCb
-	txEnvelope TxEnvelopeCb
-	txData     TxDataCb
-	txCommit   TxCommitCb
-	txRollback TxRollbackCb
+	txReset    []TxResetCb
+	txBegin    []TxBeginCb
+	txMail     []TxMailCb
+	txRcpt     []TxRcptCb
+	txEnvelope []TxEnvelopeCb
+	txData     []TxDataCb
+	txCommit   []TxCommitCb
+	txRollback []TxRollbackCb
 
-	protocolClient ProtocolClientCb
-	protocolServer ProtocolServerCb
+	protocolClient []ProtocolClientCb
+	protocolServer []ProtocolServerCb
 
-	filterReport   FilterReportCb
-	filterResponse FilterResponseCb
+	filterReport   []FilterReportCb
+	filterResponse []FilterResponseCb
 
-	timeout TimeoutCb
+	timeout []TimeoutCb
 }
 
 func (r *reporting) reportEvents() []string {
 	ret := make([]string, 0)
-	if r.linkConnect != nil || r.sessionAllocator != nil {
+	if len(r.linkConnect) != 0 || r.sessionAllocator != nil {
 		ret = append(ret, "link-connect")
 	}
-	if r.linkGreeting != nil {
+	if len(r.linkGreeting) != 0 {
 		ret = append(ret, "link-greeting")
 	}
-	if r.linkIdentify != nil {
+	if len(r.linkIdentify) != 0 {
 		ret = append(ret, "link-identify")
 	}
-	if r.linkTLS != nil {
+	if len(r.linkTLS) != 0 {
 		ret = append(ret, "link-tls")
 	}
-	if r.linkAuth != nil {
+	if len(r.linkAuth) != 0 {
 		ret = append(ret, "link-auth")
 	}
-	if r.linkDisconnect != nil || r.sessionAllocator != nil {
+	if len(r.linkDisconnect) != 0 || r.sessionAllocator != nil {
 		ret = append(ret, "link-disconnect")
 	}
-	if r.txReset != nil {
+	if len(r.txReset) != 0 {
 		ret = append(ret, "tx-reset")
 	}
-	if r.txBegin != nil {
+	if len(r.txBegin) != 0 {
 		ret = append(ret, "tx-begin")
 	}
-	if r.txMail != nil {
+	if len(r.txMail) != 0 {
 		ret = append(ret, "tx-mail")
 	}
-	if r.txRcpt != nil {
+	if len(r.txRcpt) != 0 {
 		ret = append(ret, "tx-rcpt")
 	}
-	if r.txEnvelope != nil {
+	if len(r.txEnvelope) != 0 {
 		ret = append(ret, "tx-envelope")
 	}
-	if r.txData != nil {
+	if len(r.txData) != 0 {
 		ret = append(ret, "tx-data")
 	}
-	if r.txCommit != nil {
+	if len(r.txCommit) != 0 {
 		ret = append(ret, "tx-commit")
 	}
-	if r.txRollback != nil {
+	if len(r.txRollback) != 0 {
 		ret = append(ret, "tx-rollback")
 	}
-	if r.protocolClient != nil {
+	if len(r.protocolClient) != 0 {
 		ret = append(ret, "protocol-client")
 	}
-	if r.protocolServer != nil {
+	if len(r.protocolServer) != 0 {
 		ret = append(ret, "protocol-server")
 	}
-	if r.filterReport != nil {
+	if len(r.filterReport) != 0 {
 		ret = append(ret, "filter-report")
 	}
-	if r.filterResponse != nil {
+	if len(r.filterResponse) != 0 {
 		ret = append(ret, "filter-response")
 	}
-	if r.timeout != nil {
+	if len(r.timeout) != 0 {
 		ret = append(ret, "timeout")
 	}
 	return ret
 }
 
 type filtering struct {
-	filterConnect  ConnectRequestCb
-	filterHelo     HeloRequestCb
-	filterEhlo     EhloRequestCb
-	filterStartTLS StartTLSRequestCb
-	filterAuth     AuthRequestCb
-	filterMailFrom MailFromRequestCb
-	filterRcptTo   RcptToRequestCb
-	filterData     DataRequestCb
-	filterDataLine DataLineRequestCb
-	filterCommit   CommitRequestCb
-	filterNoop     NoopRequestCb
-	filterRset     RsetRequestCb
-	filterHelp     HelpRequestCb
-	filterWiz      WizRequestCb
+	filterConnect  []ConnectRequestCb
+	filterHelo     []HeloRequestCb
+	filterEhlo     []EhloRequestCb
+	filterStartTLS []StartTLSRequestCb
+	filterAuth     []AuthRequestCb
+	filterMailFrom []MailFromRequestCb
+	filterRcptTo   []RcptToRequestCb
+	filterData     []DataRequestCb
+	filterDataLine []DataLineRequestCb
+	filterCommit   []CommitRequestCb
+	filterNoop     []NoopRequestCb
+	filterRset     []RsetRequestCb
+	filterHelp     []HelpRequestCb
+	filterWiz      []WizRequestCb
 }
 
 func (f *filtering) filterEvents() []string {
 	ret := make([]string, 0)
-	if f.filterConnect != nil {
+	if len(f.filterConnect) != 0 {
 		ret = append(ret, "connect")
 	}
-	if f.filterHelo != nil {
+	if len(f.filterHelo) != 0 {
 		ret = append(ret, "helo")
 	}
-	if f.filterEhlo != nil {
+	if len(f.filterEhlo) != 0 {
 		ret = append(ret, "ehlo")
 	}
-	if f.filterStartTLS != nil {
+	if len(f.filterStartTLS) != 0 {
 		ret = append(ret, "starttls")
 	}
-	if f.filterAuth != nil {
+	if len(f.filterAuth) != 0 {
 		ret = append(ret, "auth")
 	}
-	if f.filterMailFrom != nil {
+	if len(f.filterMailFrom) != 0 {
 		ret = append(ret, "mail-from")
 	}
-	if f.filterRcptTo != nil {
+	if len(f.filterRcptTo) != 0 {
 		ret = append(ret, "rcpt-to")
 	}
-	if f.filterData != nil {
+	// data is also filtered to answer a junk carried forward by a rewrite
+	if len(f.filterData) != 0 || len(f.filterMailFrom) != 0 || len(f.filterRcptTo) != 0 {
 		ret = append(ret, "data")
 	}
-	if f.filterDataLine != nil {
+	if len(f.filterDataLine) != 0 {
 		ret = append(ret, "data-line")
 	}
-	if f.filterCommit != nil {
+	if len(f.filterCommit) != 0 {
 		ret = append(ret, "commit")
 	}
-	if f.filterNoop != nil {
+	if len(f.filterNoop) != 0 {
 		ret = append(ret, "noop")
 	}
-	if f.filterRset != nil {
+	if len(f.filterRset) != 0 {
 		ret = append(ret, "rset")
 	}
-	if f.filterHelp != nil {
+	if len(f.filterHelp) != 0 {
 		ret = append(ret, "help")
 	}
-	if f.filterWiz != nil {
+	if len(f.filterWiz) != 0 {
 		ret = append(ret, "wiz")
 	}
 	return ret
 }
 
-type smtpIn struct {
+type SMTPIn struct {
 	reporting
 	filtering
+
+	listeners map[string]*SMTPIn
+	merged    *SMTPIn
+
+	// detectingViolations is set once DetectProtocolViolations hooked
+	// its handlers
+	detectingViolations bool
 }
 
-type smtpOut struct {
+type SMTPOut struct {
 	reporting
 }
 
-var SMTP_IN = &smtpIn{}
-var SMTP_OUT = &smtpOut{}
+// reportEvents returns the events reported to the handlers of in and of its
+// listener sets. link-connect is needed to bind sessions to listener sets,
+// link-disconnect to release them and to drop the delayed results of
+// sessions that went away.
+func (in *SMTPIn) reportEvents() []string {
+	ret := in.all().reporting.reportEvents()
+	needed := make([]string, 0)
+	if len(in.listeners) != 0 {
+		needed = append(needed, "link-connect", "link-disconnect")
+	}
+	if len(in.filterEvents()) != 0 {
+		needed = append(needed, "link-disconnect")
+	}
+	for _, event := range needed {
+		found := false
+		for _, e := range ret {
+			found = found || e == event
+		}
+		if !found {
+			ret = append(ret, event)
+		}
+	}
+	return ret
+}
+
+// filterEvents returns the requests filtered by the handlers of in and of
+// its listener sets.
+func (in *SMTPIn) filterEvents() []string {
+	return in.all().filtering.filterEvents()
+}
+
+var SMTP_IN = &SMTPIn{}
+var SMTP_OUT = &SMTPOut{}
+
+var configuration = make(map[string]string)
+var configurationMtx sync.Mutex
 
 func Init() {
 }
 
+// Config returns the value smtpd advertised for key during the
+// configuration handshake (smtpd-version, subsystem, admd, ...), or "" if
+// it was not advertised.
+func Config(key string) string {
+	configurationMtx.Lock()
+	defer configurationMtx.Unlock()
+	return configuration[key]
+}
+
 func (r *reporting) SessionAllocator(cb func() SessionData) {
 	r.sessionAllocator = cb
 }
 
 func (r *reporting) OnLinkConnect(cb LinkConnectCb) {
-	r.linkConnect = cb
+	r.linkConnect = append(r.linkConnect, cb)
 }
 
 func (r *reporting) OnLinkDisconnect(cb LinkDisconnectCb) {
-	r.linkDisconnect = cb
+	r.linkDisconnect = append(r.linkDisconnect, cb)
 }
 
 func (r *reporting) OnLinkGreeting(cb LinkGreetingCb) {
-	r.linkGreeting = cb
+	r.linkGreeting = append(r.linkGreeting, cb)
 }
 
 func (r *reporting) OnLinkIdentify(cb LinkIdentifyCb) {
-	r.linkIdentify = cb
+	r.linkIdentify = append(r.linkIdentify, cb)
 }
 
 func (r *reporting) OnLinkAuth(cb LinkAuthCb) {
-	r.linkAuth = cb
+	r.linkAuth = append(r.linkAuth, cb)
 }
 
 func (r *reporting) OnLinkTLS(cb LinkTLSCb) {
-	r.linkTLS = cb
+	r.linkTLS = append(r.linkTLS, cb)
 }
 
 func (r *reporting) OnTxReset(cb TxResetCb) {
-	r.txReset = cb
+	r.txReset = append(r.txReset, cb)
 }
 
 func (r *reporting) OnTxBegin(cb TxBeginCb) {
-	r.txBegin = cb
+	r.txBegin = append(r.txBegin, cb)
 }
 
 func (r *reporting) OnTxMail(cb TxMailCb) {
-	r.txMail = cb
+	r.txMail = append(r.txMail, cb)
 }
 
 func (r *reporting) OnTxRcpt(cb TxRcptCb) {
-	r.txRcpt = cb
+	r.txRcpt = append(r.txRcpt, cb)
 }
 
 func (r *reporting) OnTxEnvelope(cb TxEnvelopeCb) {
-	r.txEnvelope = cb
+	r.txEnvelope = append(r.txEnvelope, cb)
 }
 
 func (r *reporting) OnTxData(cb TxDataCb) {
-	r.txData = cb
+	r.txData = append(r.txData, cb)
 }
 
 func (r *reporting) OnTxCommit(cb TxCommitCb) {
-	r.txCommit = cb
+	r.txCommit = append(r.txCommit, cb)
 }
 
 func (r *reporting) OnTxRollback(cb TxRollbackCb) {
-	r.txRollback = cb
+	r.txRollback = append(r.txRollback, cb)
 }
 
 func (r *reporting) OnProtocolClient(cb ProtocolClientCb) {
-	r.protocolClient = cb
+	r.protocolClient = append(r.protocolClient, cb)
 }
 
 func (r *reporting) OnProtocolServer(cb ProtocolServerCb) {
-	r.protocolServer = cb
+	r.protocolServer = append(r.protocolServer, cb)
 }
 
 func (r *reporting) OnFilterReport(cb FilterReportCb) {
-	r.filterReport = cb
+	r.filterReport = append(r.filterReport, cb)
 }
 
 func (r *reporting) OnFilterResponse(cb FilterResponseCb) {
-	r.filterResponse = cb
+	r.filterResponse = append(r.filterResponse, cb)
 }
 
 func (r *reporting) OnTimeout(cb TimeoutCb) {
-	r.timeout = cb
+	r.timeout = append(r.timeout, cb)
 }
 
 func (f *filtering) ConnectRequest(cb ConnectRequestCb) {
-	f.filterConnect = cb
+	f.filterConnect = append(f.filterConnect, cb)
 }
 
 func (f *filtering) HeloRequest(cb HeloRequestCb) {
-	f.filterHelo = cb
+	f.filterHelo = append(f.filterHelo, cb)
 }
 
 func (f *filtering) EhloRequest(cb EhloRequestCb) {
-	f.filterEhlo = cb
+	f.filterEhlo = append(f.filterEhlo, cb)
 }
 
 func (f *filtering) StartTLSRequest(cb StartTLSRequestCb) {
-	f.filterStartTLS = cb
+	f.filterStartTLS = append(f.filterStartTLS, cb)
 }
 
 func (f *filtering) AuthRequest(cb AuthRequestCb) {
-	f.filterAuth = cb
+	f.filterAuth = append(f.filterAuth, cb)
 }
 
 func (f *filtering) MailFromRequest(cb MailFromRequestCb) {
-	f.filterMailFrom = cb
+	f.filterMailFrom = append(f.filterMailFrom, cb)
 }
 
 func (f *filtering) RcptToRequest(cb RcptToRequestCb) {
-	f.filterRcptTo = cb
+	f.filterRcptTo = append(f.filterRcptTo, cb)
 }
 
 func (f *filtering) DataRequest(cb DataRequestCb) {
-	f.filterData = cb
+	f.filterData = append(f.filterData, cb)
 }
 
 func (f *filtering) DataLineRequest(cb DataLineRequestCb) {
-	f.filterDataLine = cb
+	f.filterDataLine = append(f.filterDataLine, cb)
 }
 
 func (f *filtering) CommitRequest(cb CommitRequestCb) {
-	f.filterCommit = cb
+	f.filterCommit = append(f.filterCommit, cb)
 }
 
 func (f *filtering) NoopRequest(cb NoopRequestCb) {
-	f.filterNoop = cb
+	f.filterNoop = append(f.filterNoop, cb)
 }
 
 func (f *filtering) RsetRequest(cb RsetRequestCb) {
-	f.filterRset = cb
+	f.filterRset = append(f.filterRset, cb)
 }
 
 func (f *filtering) HelpRequest(cb HelpRequestCb) {
-	f.filterHelp = cb
+	f.filterHelp = append(f.filterHelp, cb)
 }
 
 func (f *filtering) WizRequest(cb WizRequestCb) {
-	f.filterWiz = cb
+	f.filterWiz = append(f.filterWiz, cb)
 }
 
 func handleReport(timestamp time.Time, event string, dir *reporting, sessionId Session, atoms []string) {
@@ -456,10 +524,12 @@ func handleReport(timestamp time.Time, event string, dir *reporting, sessionId S
 
 	switch event {
 	case "link-connect":
-		sessionsMtx.Lock()
-		sessions[sessionId] = dir.sessionAllocator()
-		sessionsMtx.Unlock()
-		if dir.linkConnect == nil {
+		if dir.sessionAllocator != nil {
+			sessionsMtx.Lock()
+			sessions[sessionId] = dir.sessionAllocator()
+			sessionsMtx.Unlock()
+		}
+		if len(dir.linkConnect) == 0 {
 			return
 		}
 		if len(atoms) != 4 {
@@ -470,240 +540,326 @@ func handleReport(timestamp time.Time, event string, dir *reporting, sessionId S
 		} else if destAddr, err := parseAddress(atoms[3]); err != nil {
 			log.Fatalf("Failed to parse destination address %s", atoms[3])
 		} else {
-			dir.linkConnect(timestamp, sessionId, atoms[0], atoms[1], srcAddr, destAddr)
+			for _, cb := range dir.linkConnect {
+				cb(timestamp, sessionId, atoms[0], atoms[1], srcAddr, destAddr)
+			}
 		}
 
 	case "link-disconnect":
-		if dir.linkDisconnect == nil {
-			return
-		}
 		if len(atoms) != 0 {
 			log.Fatalf("Invalid input, too many fields: %s", atoms)
 		}
-		dir.linkDisconnect(timestamp, sessionId)
+		untarpit(sessionId)
+		unjunk(sessionId)
+		for _, cb := range dir.linkDisconnect {
+			cb(timestamp, sessionId)
+		}
 		sessionsMtx.Lock()
 		delete(sessions, sessionId)
 		sessionsMtx.Unlock()
 
 	case "link-greeting":
-		if dir.linkGreeting == nil {
+		if len(dir.linkGreeting) == 0 {
 			return
 		}
 		if len(atoms) != 1 {
 			log.Fatalf("Invalid input, expects only one field: %s", atoms)
 		}
-		dir.linkGreeting(timestamp, sessionId, atoms[0])
+		for _, cb := range dir.linkGreeting {
+			cb(timestamp, sessionId, atoms[0])
+		}
 
 	case "link-identify":
-		if dir.linkIdentify == nil {
-			return
+		for _, cb := range dir.linkIdentify {
+			cb(timestamp, sessionId, atoms[0], atoms[1])
 		}
-		dir.linkIdentify(timestamp, sessionId, atoms[0], atoms[1])
 
 	case "link-auth":
-		if dir.linkAuth == nil {
-			return
+		for _, cb := range dir.linkAuth {
+			cb(timestamp, sessionId, atoms[0], atoms[1])
 		}
-		dir.linkAuth(timestamp, sessionId, atoms[0], atoms[1])
 
 	case "link-tls":
-		if dir.linkTLS == nil {
-			return
+		for _, cb := range dir.linkTLS {
+			cb(timestamp, sessionId, atoms[0])
 		}
-		dir.linkTLS(timestamp, sessionId, atoms[0])
 
 	case "tx-reset":
-		if dir.txReset == nil {
-			return
+		for _, cb := range dir.txReset {
+			cb(timestamp, sessionId, atoms[0])
 		}
-		dir.txReset(timestamp, sessionId, atoms[0])
 
 	case "tx-begin":
-		if dir.txBegin == nil {
-			return
+		for _, cb := range dir.txBegin {
+			cb(timestamp, sessionId, atoms[0])
 		}
-		dir.txBegin(timestamp, sessionId, atoms[0])
 
 	case "tx-mail":
-		if dir.txMail == nil {
-			return
+		for _, cb := range dir.txMail {
+			cb(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 		}
-		dir.txMail(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 
 	case "tx-rcpt":
-		if dir.txRcpt == nil {
-			return
+		for _, cb := range dir.txRcpt {
+			cb(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 		}
-		dir.txRcpt(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 
 	case "tx-envelope":
-		if dir.txEnvelope == nil {
-			return
+		for _, cb := range dir.txEnvelope {
+			cb(timestamp, sessionId, atoms[0], atoms[1])
 		}
-		dir.txEnvelope(timestamp, sessionId, atoms[0], atoms[1])
 
 	case "tx-data":
-		if dir.txData == nil {
-			return
+		for _, cb := range dir.txData {
+			cb(timestamp, sessionId, atoms[0], atoms[1])
 		}
-		dir.txData(timestamp, sessionId, atoms[0], atoms[1])
 
 	case "tx-commit":
-		if dir.txCommit == nil {
+		if len(dir.txCommit) == 0 {
 			return
 		}
 
 		if size, err := strconv.Atoi(atoms[1]); err != nil {
 			log.Fatalf("Failed to convert size %s to int", atoms[1])
 		} else {
-			dir.txCommit(timestamp, sessionId, atoms[0], size)
+			for _, cb := range dir.txCommit {
+				cb(timestamp, sessionId, atoms[0], size)
+			}
 		}
 
 	case "tx-rollback":
-		if dir.txRollback == nil {
-			return
+		for _, cb := range dir.txRollback {
+			cb(timestamp, sessionId, atoms[0])
 		}
-		dir.txRollback(timestamp, sessionId, atoms[0])
 
 	case "protocol-client":
-		if dir.protocolClient == nil {
-			return
+		for _, cb := range dir.protocolClient {
+			cb(timestamp, sessionId, strings.Join(atoms, "|"))
 		}
-		dir.protocolClient(timestamp, sessionId, strings.Join(atoms, "|"))
 
 	case "protocol-server":
-		if dir.protocolServer == nil {
-			return
+		for _, cb := range dir.protocolServer {
+			cb(timestamp, sessionId, strings.Join(atoms, "|"))
 		}
-		dir.protocolServer(timestamp, sessionId, strings.Join(atoms, "|"))
 
 	case "filter-report":
-		if dir.filterReport == nil {
-			return
+		for _, cb := range dir.filterReport {
+			cb(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 		}
-		dir.filterReport(timestamp, sessionId, atoms[0], atoms[1], atoms[2])
 
 	case "filter-response":
-		if dir.filterResponse == nil {
-			return
+		for _, cb := range dir.filterResponse {
+			cb(timestamp, sessionId, atoms[0], atoms[1], atoms[2:]...)
 		}
-		dir.filterResponse(timestamp, sessionId, atoms[0], atoms[1], atoms[2:]...)
 
 	case "timeout":
-		if dir.timeout == nil {
-			return
+		for _, cb := range dir.timeout {
+			cb(timestamp, sessionId)
 		}
-		dir.timeout(timestamp, sessionId)
 
 	default:
 		log.Fatalf("Unknown event %s", event)
 	}
 }
 
+// chainRequest calls the handlers registered for a filter request in
+// registration order. A junk response is remembered and the chain goes on,
+// any other response than proceed or junk ends the chain and is returned.
+// Delays are unwrapped for chaining, the longest one applies to the result.
+func chainRequest[T any](cbs []T, call func(cb T) Response) Response {
+	var res Response = proceed{}
+	var wait time.Duration
+	for _, cb := range cbs {
+		r := call(cb)
+		if d, ok := r.(delay); ok {
+			wait = max(wait, d.duration)
+			r = d.response
+		}
+		switch r := r.(type) {
+		case nil, proceed:
+		case junk:
+			res = r
+		default:
+			return withDelay(wait, r)
+		}
+	}
+	return withDelay(wait, res)
+}
+
+// chainParamRequest is chainRequest for the requests whose parameter may be
+// rewritten. A rewrite response does not end the chain: the handlers after
+// it are called with the rewritten parameter, and the last rewrite is the
+// result unless one of them ends the chain. Since smtpd takes a single
+// result, the rewrite is sent and the second value reports that a junk
+// response of the chain is to be carried forward to a later request.
+func chainParamRequest[T any](cbs []T, param string, call func(cb T, param string) Response) (Response, bool) {
+	var res Response = proceed{}
+	var wait time.Duration
+	sawJunk := false
+	for _, cb := range cbs {
+		r := call(cb, param)
+		if d, ok := r.(delay); ok {
+			wait = max(wait, d.duration)
+			r = d.response
+		}
+		switch r := r.(type) {
+		case nil, proceed:
+		case junk:
+			sawJunk = true
+			if _, ok := res.(rewrite); !ok {
+				res = r
+			}
+		case rewrite:
+			param = r.parameter
+			res = r
+		default:
+			return withDelay(wait, r), false
+		}
+	}
+	_, rewritten := res.(rewrite)
+	return withDelay(wait, res), sawJunk && rewritten
+}
+
+func withDelay(d time.Duration, r Response) Response {
+	if d <= 0 {
+		return r
+	}
+	return delay{duration: d, response: r}
+}
+
+// chainDataLine feeds a data line through the registered handlers, each
+// handler being fed the lines produced by the previous one.
+func chainDataLine(timestamp time.Time, sessionId Session, cbs []DataLineRequestCb, line string) []string {
+	lines := []string{line}
+	for _, cb := range cbs {
+		next := make([]string, 0, len(lines))
+		for _, line := range lines {
+			next = append(next, cb(timestamp, sessionId, line)...)
+		}
+		lines = next
+	}
+	return lines
+}
+
 func handleFilter(timestamp time.Time, event string, dir *filtering, sessionId Session, atoms []string) {
 	var res Response
 
 	// XXX - need to ensure atoms is properly parsed (last field may be split multiple times)
 	opaqueValue, atoms := atoms[0], atoms[1:]
 
+	if event == "mail-from" {
+		resetTxJunk(sessionId)
+	}
+
 	switch event {
 	case "connect":
-		if dir.filterConnect == nil {
-			return
-		}
 		if srcAddr, err := parseAddress(atoms[1]); err != nil {
 			log.Fatalf("Failed to parse source address %s", atoms[1])
 		} else {
-			res = dir.filterConnect(timestamp, sessionId, atoms[0], srcAddr)
+			res = chainRequest(dir.filterConnect, func(cb ConnectRequestCb) Response {
+				return cb(timestamp, sessionId, atoms[0], srcAddr)
+			})
 		}
 
 	case "helo":
-		if dir.filterHelo == nil {
-			return
-		}
-		res = dir.filterHelo(timestamp, sessionId, atoms[0])
+		res = chainRequest(dir.filterHelo, func(cb HeloRequestCb) Response {
+			return cb(timestamp, sessionId, atoms[0])
+		})
 
 	case "ehlo":
-		if dir.filterHelo == nil {
-			return
-		}
-		res = dir.filterEhlo(timestamp, sessionId, atoms[0])
+		res = chainRequest(dir.filterEhlo, func(cb EhloRequestCb) Response {
+			return cb(timestamp, sessionId, atoms[0])
+		})
 
 	case "starttls":
-		if dir.filterStartTLS == nil {
-			return
-		}
-		res = dir.filterStartTLS(timestamp, sessionId, atoms[0])
+		res = chainRequest(dir.filterStartTLS, func(cb StartTLSRequestCb) Response {
+			return cb(timestamp, sessionId, atoms[0])
+		})
 
 	case "auth":
-		if dir.filterAuth == nil {
-			return
-		}
-		res = dir.filterAuth(timestamp, sessionId, atoms[0])
+		res = chainRequest(dir.filterAuth, func(cb AuthRequestCb) Response {
+			return cb(timestamp, sessionId, atoms[0])
+		})
 
 	case "mail-from":
-		if dir.filterMailFrom == nil {
-			return
+		var junked bool
+		res, junked = chainParamRequest(dir.filterMailFrom, atoms[0], func(cb MailFromRequestCb, from string) Response {
+			return cb(timestamp, sessionId, from)
+		})
+		if junked {
+			deferJunk(sessionId)
 		}
-		res = dir.filterMailFrom(timestamp, sessionId, atoms[0])
 
 	case "rcpt-to":
-		if dir.filterRcptTo == nil {
-			return
+		var junked bool
+		res, junked = chainParamRequest(dir.filterRcptTo, atoms[0], func(cb RcptToRequestCb, to string) Response {
+			return cb(timestamp, sessionId, to)
+		})
+		if junked {
+			deferJunk(sessionId)
+		} else {
+			res = deferredJunk(sessionId, res)
 		}
-		res = dir.filterRcptTo(timestamp, sessionId, atoms[0])
 
 	case "data":
-		if dir.filterData == nil {
-			return
-		}
-		res = dir.filterData(timestamp, sessionId)
+		res = chainRequest(dir.filterData, func(cb DataRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
+		res = deferredJunk(sessionId, res)
 
 	case "data-line":
-		if dir.filterDataLine == nil {
-			return
-		}
 		// data line has special handling
-		lines := dir.filterDataLine(timestamp, sessionId, strings.Join(atoms, "|"))
+		lines := chainDataLine(timestamp, sessionId, dir.filterDataLine, strings.Join(atoms, "|"))
+		outputMtx.Lock()
 		for _, line := range lines {
 			fmt.Fprintf(os.Stdout, "filter-dataline|%s|%s|%s\n", sessionId, opaqueValue, line)
 		}
+		outputMtx.Unlock()
 		return
 
 	case "commit":
-		if dir.filterCommit == nil {
-			return
-		}
-		res = dir.filterCommit(timestamp, sessionId)
+		res = chainRequest(dir.filterCommit, func(cb CommitRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
 
 	case "noop":
-		if dir.filterNoop == nil {
-			return
-		}
-		res = dir.filterNoop(timestamp, sessionId)
+		res = chainRequest(dir.filterNoop, func(cb NoopRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
 
 	case "rset":
-		if dir.filterRset == nil {
-			return
-		}
-		res = dir.filterRset(timestamp, sessionId)
+		res = chainRequest(dir.filterRset, func(cb RsetRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
 
 	case "help":
-		if dir.filterHelp == nil {
-			return
-		}
-		res = dir.filterHelp(timestamp, sessionId)
+		res = chainRequest(dir.filterHelp, func(cb HelpRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
 
 	case "wiz":
-		if dir.filterWiz == nil {
-			return
-		}
-		res = dir.filterWiz(timestamp, sessionId)
+		res = chainRequest(dir.filterWiz, func(cb WizRequestCb) Response {
+			return cb(timestamp, sessionId)
+		})
 
 	default:
 		log.Fatalf("Unknown event %s", event)
 	}
 
+	recordJunk(sessionId, event, res)
+	if d, ok := res.(delay); ok {
+		tarpit(sessionId, opaqueValue, d)
+		return
+	}
+	writeResult(sessionId, opaqueValue, res)
+}
+
+// writeResult outputs the result of a filter request, results may be
+// written by tarpit timers so output is serialized.
+func writeResult(sessionId Session, opaqueValue string, res Response) {
+	outputMtx.Lock()
+	defer outputMtx.Unlock()
+
 	switch res := res.(type) {
 	case proceed:
 		fmt.Fprintf(os.Stdout, "filter-result|%s|%s|proceed\n", sessionId, opaqueValue)
@@ -736,6 +892,11 @@ func Dispatch() {
 		if line == "config|ready" {
 			break
 		}
+		if atoms := strings.SplitN(line, "|", 3); len(atoms) == 3 && atoms[0] == "config" {
+			configurationMtx.Lock()
+			configuration[atoms[1]] = atoms[2]
+			configurationMtx.Unlock()
+		}
 	}
 
 	// table registration
@@ -792,21 +953,28 @@ func Dispatch() {
 
 		atoms = atoms[6:]
 
+		sessionId := Session{eventSessionId}
 		if eventType == "report" {
 			var direction *reporting
 			if eventDirection == "smtp-in" {
-				direction = &SMTP_IN.reporting
+				if eventKind == "link-connect" {
+					SMTP_IN.bind(sessionId, atoms)
+				}
+				direction = &SMTP_IN.handlers(sessionId).reporting
 			} else if eventDirection == "smtp-out" {
 				direction = &SMTP_OUT.reporting
 			}
-			handleReport(timestampToTime(timestamp), eventKind, direction, Session{eventSessionId}, atoms)
+			handleReport(timestampToTime(timestamp), eventKind, direction, sessionId, atoms)
+			if eventDirection == "smtp-in" && eventKind == "link-disconnect" {
+				SMTP_IN.unbind(sessionId)
+			}
 		} else if eventType == "filter" {
 			var direction *filtering
 			if eventDirection != "smtp-in" {
 				log.Fatalf("Unknown direction %s", eventDirection)
 			}
-			direction = &SMTP_IN.filtering
-			handleFilter(timestampToTime(timestamp), eventKind, direction, Session{eventSessionId}, atoms)
+			direction = &SMTP_IN.handlers(sessionId).filtering
+			handleFilter(timestampToTime(timestamp), eventKind, direction, sessionId, atoms)
 		} else {
 			log.Fatalf("Unknown command %s", eventType)
 		}
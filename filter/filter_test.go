@@ -0,0 +1,212 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainRequest(t *testing.T) {
+	respond := func(res Response) DataRequestCb {
+		return func(timestamp time.Time, sessionId Session) Response {
+			return res
+		}
+	}
+
+	tests := []struct {
+		name  string
+		cbs   []DataRequestCb
+		want  Response
+		calls int
+	}{
+		{"empty", nil, Proceed(), 0},
+		{"proceed", []DataRequestCb{respond(Proceed()), respond(Proceed())}, Proceed(), 2},
+		{"nil proceeds", []DataRequestCb{respond(nil), respond(Proceed())}, Proceed(), 2},
+		{"junk goes on", []DataRequestCb{respond(Junk()), respond(Proceed())}, Junk(), 2},
+		{"reject ends the chain", []DataRequestCb{respond(Proceed()), respond(Reject("550 no")), respond(Disconnect("421 bye"))}, Reject("550 no"), 2},
+		{"reject after junk", []DataRequestCb{respond(Junk()), respond(Reject("550 no"))}, Reject("550 no"), 2},
+		{"disconnect ends the chain", []DataRequestCb{respond(Disconnect("421 bye")), respond(Junk())}, Disconnect("421 bye"), 1},
+		{"longest delay", []DataRequestCb{respond(Delay(time.Second, Junk())), respond(Delay(2*time.Second, Proceed()))}, Delay(2*time.Second, Junk()), 2},
+		{"delay applies to reject", []DataRequestCb{respond(Delay(time.Second, Proceed())), respond(Reject("550 no"))}, Delay(time.Second, Reject("550 no")), 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			res := chainRequest(test.cbs, func(cb DataRequestCb) Response {
+				calls++
+				return cb(time.Now(), Session{})
+			})
+			if res != test.want {
+				t.Errorf("result = %#v, want %#v", res, test.want)
+			}
+			if calls != test.calls {
+				t.Errorf("%d handlers called, want %d", calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestChainDataLine(t *testing.T) {
+	upper := func(timestamp time.Time, sessionId Session, line string) []string {
+		return []string{strings.ToUpper(line)}
+	}
+	header := func(timestamp time.Time, sessionId Session, line string) []string {
+		if line == "" {
+			return []string{"X-Filtered: yes", line}
+		}
+		return []string{line}
+	}
+	drop := func(timestamp time.Time, sessionId Session, line string) []string {
+		if strings.HasPrefix(line, "X-") {
+			return nil
+		}
+		return []string{line}
+	}
+
+	tests := []struct {
+		name string
+		cbs  []DataLineRequestCb
+		line string
+		want []string
+	}{
+		{"empty", nil, "Subject: hello", []string{"Subject: hello"}},
+		{"one", []DataLineRequestCb{upper}, "Subject: hello", []string{"SUBJECT: HELLO"}},
+		{"fed the previous output", []DataLineRequestCb{header, upper}, "", []string{"X-FILTERED: YES", ""}},
+		{"dropped", []DataLineRequestCb{header, drop}, "", []string{""}},
+		{"dropped before", []DataLineRequestCb{drop, upper}, "X-Spam: yes", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := chainDataLine(time.Now(), Session{}, test.cbs, test.line)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") || len(got) != len(test.want) {
+				t.Errorf("lines %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterAppends(t *testing.T) {
+	calls := make([]string, 0)
+	in := &SMTPIn{}
+	in.OnTxBegin(func(timestamp time.Time, sessionId Session, messageId string) {
+		calls = append(calls, "first")
+	})
+	in.OnTxBegin(func(timestamp time.Time, sessionId Session, messageId string) {
+		calls = append(calls, "second")
+	})
+	handleReport(time.Now(), "tx-begin", &in.reporting, Session{}, []string{"a"})
+	if got := strings.Join(calls, " "); got != "first second" {
+		t.Errorf("calls %q, want %q", got, "first second")
+	}
+}
+
+func TestChainParamRequest(t *testing.T) {
+	rewriteTo := func(param string) MailFromRequestCb {
+		return func(timestamp time.Time, sessionId Session, from string) Response {
+			return Rewrite(param)
+		}
+	}
+	respond := func(res Response) MailFromRequestCb {
+		return func(timestamp time.Time, sessionId Session, from string) Response {
+			return res
+		}
+	}
+
+	tests := []struct {
+		name   string
+		cbs    []MailFromRequestCb
+		want   Response
+		junked bool
+		seen   []string
+	}{
+		{"proceed", []MailFromRequestCb{respond(Proceed()), respond(Proceed())}, Proceed(), false, []string{"<a@example.com>", "<a@example.com>"}},
+		{"junk goes on", []MailFromRequestCb{respond(Junk()), respond(Proceed())}, Junk(), false, []string{"<a@example.com>", "<a@example.com>"}},
+		{"reject ends the chain", []MailFromRequestCb{respond(Reject("550 no")), respond(Proceed())}, Reject("550 no"), false, []string{"<a@example.com>"}},
+		{"rewrite goes on", []MailFromRequestCb{rewriteTo("<b@example.com>"), respond(Proceed())}, Rewrite("<b@example.com>"), false, []string{"<a@example.com>", "<b@example.com>"}},
+		{"last rewrite wins", []MailFromRequestCb{rewriteTo("<b@example.com>"), rewriteTo("<c@example.com>"), respond(Proceed())}, Rewrite("<c@example.com>"), false, []string{"<a@example.com>", "<b@example.com>", "<c@example.com>"}},
+		{"reject after rewrite", []MailFromRequestCb{rewriteTo("<b@example.com>"), respond(Reject("550 no"))}, Reject("550 no"), false, []string{"<a@example.com>", "<b@example.com>"}},
+		{"rewrite over junk", []MailFromRequestCb{respond(Junk()), rewriteTo("<b@example.com>"), respond(Junk())}, Rewrite("<b@example.com>"), true, []string{"<a@example.com>", "<a@example.com>", "<b@example.com>"}},
+		{"junk then rewrite", []MailFromRequestCb{respond(Junk()), rewriteTo("<b@example.com>")}, Rewrite("<b@example.com>"), true, []string{"<a@example.com>", "<a@example.com>"}},
+		{"rewrite then junk", []MailFromRequestCb{rewriteTo("<b@example.com>"), respond(Junk())}, Rewrite("<b@example.com>"), true, []string{"<a@example.com>", "<b@example.com>"}},
+		{"junk before reject", []MailFromRequestCb{respond(Junk()), rewriteTo("<b@example.com>"), respond(Reject("550 no"))}, Reject("550 no"), false, []string{"<a@example.com>", "<a@example.com>", "<b@example.com>"}},
+		{"delay applies to rewrite", []MailFromRequestCb{respond(Delay(time.Second, Rewrite("<b@example.com>"))), respond(Proceed())}, Delay(time.Second, Rewrite("<b@example.com>")), false, []string{"<a@example.com>", "<b@example.com>"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := make([]string, 0)
+			res, junked := chainParamRequest(test.cbs, "<a@example.com>", func(cb MailFromRequestCb, from string) Response {
+				seen = append(seen, from)
+				return cb(time.Now(), Session{}, from)
+			})
+			if res != test.want || junked != test.junked {
+				t.Errorf("result = %#v, %v, want %#v, %v", res, junked, test.want, test.junked)
+			}
+			if len(seen) != len(test.seen) {
+				t.Fatalf("handlers saw %v, want %v", seen, test.seen)
+			}
+			for i := range seen {
+				if seen[i] != test.seen[i] {
+					t.Errorf("handlers saw %v, want %v", seen, test.seen)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestJunked(t *testing.T) {
+	s := Session{}
+	defer unjunk(s)
+
+	recordJunk(s, "mail-from", Delay(time.Second, Junk()))
+	if !s.Junked() {
+		t.Fatal("delayed junk at mail-from not recorded")
+	}
+	resetTxJunk(s)
+	if s.Junked() {
+		t.Fatal("transaction junk kept after reset")
+	}
+
+	recordJunk(s, "helo", Proceed())
+	recordJunk(s, "connect", Junk())
+	resetTxJunk(s)
+	if !s.Junked() {
+		t.Fatal("session junk lost after transaction reset")
+	}
+	unjunk(s)
+	if s.Junked() {
+		t.Fatal("junk kept after disconnect")
+	}
+}
+
+func TestDeferredJunk(t *testing.T) {
+	s := Session{}
+	defer unjunk(s)
+
+	if res := deferredJunk(s, Proceed()); res != Proceed() {
+		t.Fatalf("result without deferred junk = %#v, want proceed", res)
+	}
+
+	deferJunk(s)
+	if !s.Junked() {
+		t.Fatal("junk dropped for a rewrite not recorded")
+	}
+	if res := deferredJunk(s, Reject("550 no")); res != Reject("550 no") {
+		t.Errorf("reject result = %#v, want it unchanged", res)
+	}
+	if res := deferredJunk(s, Delay(time.Second, Proceed())); res != Delay(time.Second, Junk()) {
+		t.Errorf("result = %#v, want delayed junk", res)
+	}
+	if res := deferredJunk(s, Proceed()); res != Proceed() {
+		t.Errorf("deferred junk answered twice: %#v", res)
+	}
+
+	deferJunk(s)
+	resetTxJunk(s)
+	if res := deferredJunk(s, Proceed()); res != Proceed() {
+		t.Errorf("deferred junk kept after transaction reset: %#v", res)
+	}
+}
@@ -0,0 +1,203 @@
+package greylist
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type session struct {
+	src           net.IP
+	authenticated bool
+	sender        string
+}
+
+type Greylister struct {
+	Store Store
+
+	// Delay is how long a new triplet is tempfailed, RetryWindow how long
+	// after its first attempt a retry is accepted before the triplet is
+	// greylisted anew.
+	Delay       time.Duration
+	RetryWindow time.Duration
+
+	// Expiry is how long passed triplets and whitelisted networks are
+	// kept since they were last seen.
+	Expiry time.Duration
+
+	// AutoWhitelist is the number of passed triplets after which a source
+	// network is no longer greylisted, zero disables auto-whitelisting.
+	AutoWhitelist int
+
+	// IPv4Mask and IPv6Mask are the prefix lengths grouping source
+	// addresses, so that retries from another host of a pool match.
+	IPv4Mask int
+	IPv6Mask int
+
+	// SkipAuthenticated bypasses greylisting for sessions that
+	// successfully authenticated.
+	SkipAuthenticated bool
+
+	TempfailResponse filter.Response
+
+	lastExpire time.Time
+
+	mtx         sync.Mutex
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewGreylister(store Store) *Greylister {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Greylister{
+		Store:             store,
+		Delay:             5 * time.Minute,
+		RetryWindow:       48 * time.Hour,
+		Expiry:            35 * 24 * time.Hour,
+		AutoWhitelist:     5,
+		IPv4Mask:          24,
+		IPv6Mask:          64,
+		SkipAuthenticated: true,
+		TempfailResponse:  filter.Reject("451 4.7.1 Greylisted, please try again later"),
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+func (g *Greylister) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(g.linkConnectCb)
+	in.OnLinkAuth(g.linkAuthCb)
+	in.OnLinkDisconnect(g.linkDisconnectCb)
+	in.OnTxMail(g.txMailCb)
+	in.RcptToRequest(g.rcptToCb)
+}
+
+// Network returns the source network of ip, as used in keys.
+func (g *Greylister) Network(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(g.IPv4Mask, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(g.IPv6Mask, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func tripletKey(network string, sender string, recipient string) string {
+	return "triplet|" + network + "|" + strings.ToLower(sender) + "|" + strings.ToLower(recipient)
+}
+
+func networkKey(network string) string {
+	return "network|" + network
+}
+
+// Check records a delivery attempt and reports whether it may proceed.
+func (g *Greylister) Check(now time.Time, ip net.IP, sender string, recipient string) (bool, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if now.Sub(g.lastExpire) > time.Hour {
+		g.lastExpire = now
+		if err := g.Store.Expire(now.Add(-g.Expiry)); err != nil {
+			return false, err
+		}
+	}
+
+	network := g.Network(ip)
+	nkey := networkKey(network)
+	whitelist, found, err := g.Store.Get(nkey)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		whitelist = Record{First: now}
+	}
+	if g.AutoWhitelist != 0 && whitelist.Passes >= g.AutoWhitelist {
+		whitelist.Last = now
+		return true, g.Store.Put(nkey, whitelist)
+	}
+
+	tkey := tripletKey(network, sender, recipient)
+	triplet, found, err := g.Store.Get(tkey)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !found, triplet.Passes == 0 && now.Sub(triplet.First) > g.RetryWindow:
+		return false, g.Store.Put(tkey, Record{First: now, Last: now})
+
+	case triplet.Passes == 0 && now.Sub(triplet.First) < g.Delay:
+		triplet.Last = now
+		return false, g.Store.Put(tkey, triplet)
+
+	case triplet.Passes == 0:
+		// first retry past the delay, the source network earns a pass
+		whitelist.Passes++
+		whitelist.Last = now
+		if err := g.Store.Put(nkey, whitelist); err != nil {
+			return false, err
+		}
+	}
+
+	triplet.Passes++
+	triplet.Last = now
+	return true, g.Store.Put(tkey, triplet)
+}
+
+func (g *Greylister) session(sessionId filter.Session) *session {
+	g.sessionsMtx.Lock()
+	defer g.sessionsMtx.Unlock()
+	sess, ok := g.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		g.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (g *Greylister) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		g.session(sessionId).src = addr.IP
+	}
+}
+
+func (g *Greylister) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	g.session(sessionId).authenticated = result == "pass"
+}
+
+func (g *Greylister) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	g.sessionsMtx.Lock()
+	defer g.sessionsMtx.Unlock()
+	delete(g.sessions, sessionId)
+}
+
+func (g *Greylister) txMailCb(timestamp time.Time, sessionId filter.Session, messageId string, result string, from string) {
+	if result == "ok" {
+		g.session(sessionId).sender = strings.TrimSuffix(strings.TrimPrefix(from, "<"), ">")
+	}
+}
+
+func (g *Greylister) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	sess := g.session(sessionId)
+	if sess.src == nil || sess.src.IsLoopback() || (sess.authenticated && g.SkipAuthenticated) {
+		return filter.Proceed()
+	}
+
+	recipient, _ := message.SplitParam(to)
+	pass, err := g.Check(timestamp, sess.src, sess.sender, recipient)
+	if err != nil {
+		// fail open rather than tempfailing every delivery
+		log.Printf("%s: greylist: %s", sessionId, err)
+		return filter.Proceed()
+	}
+	if !pass {
+		return g.TempfailResponse
+	}
+	return filter.Proceed()
+}
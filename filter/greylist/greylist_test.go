@@ -0,0 +1,141 @@
+package greylist
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestCheck(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		name     string
+		attempts []time.Duration // since start
+		want     []bool
+	}{
+		{"new triplet", []time.Duration{0}, []bool{false}},
+		{"retry too early", []time.Duration{0, time.Minute}, []bool{false, false}},
+		{"retry past the delay", []time.Duration{0, time.Minute, 6 * time.Minute}, []bool{false, false, true}},
+		{"passed triplet", []time.Duration{0, 6 * time.Minute, 24 * time.Hour}, []bool{false, true, true}},
+		{"retry past the window", []time.Duration{0, 49 * time.Hour, 49*time.Hour + time.Minute}, []bool{false, false, false}},
+		{"retried past the window", []time.Duration{0, 49 * time.Hour, 49*time.Hour + 6*time.Minute}, []bool{false, false, true}},
+		{"passed triplet expired", []time.Duration{0, 6 * time.Minute, 40 * 24 * time.Hour}, []bool{false, true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGreylister(nil)
+			g.AutoWhitelist = 0
+			for i, attempt := range test.attempts {
+				pass, err := g.Check(start.Add(attempt), ip, "a@example.com", "b@example.org")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pass != test.want[i] {
+					t.Errorf("attempt %d at %s: pass = %v, want %v", i, attempt, pass, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTriplet(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	g := NewGreylister(nil)
+	g.AutoWhitelist = 0
+
+	g.Check(start, net.ParseIP("192.0.2.1"), "a@example.com", "b@example.org")
+	later := start.Add(10 * time.Minute)
+
+	tests := []struct {
+		name      string
+		ip        string
+		sender    string
+		recipient string
+		want      bool
+	}{
+		{"same network", "192.0.2.200", "a@example.com", "b@example.org", true},
+		{"case", "192.0.2.1", "A@Example.com", "b@EXAMPLE.org", true},
+		{"other network", "198.51.100.1", "a@example.com", "b@example.org", false},
+		{"other sender", "192.0.2.1", "c@example.com", "b@example.org", false},
+		{"other recipient", "192.0.2.1", "a@example.com", "c@example.org", false},
+	}
+	for _, test := range tests {
+		pass, err := g.Check(later, net.ParseIP(test.ip), test.sender, test.recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pass != test.want {
+			t.Errorf("%s: pass = %v, want %v", test.name, pass, test.want)
+		}
+	}
+}
+
+func TestAutoWhitelist(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	ip := net.ParseIP("192.0.2.1")
+	g := NewGreylister(nil)
+	g.AutoWhitelist = 2
+
+	for _, recipient := range []string{"b@example.org", "c@example.org"} {
+		g.Check(start, ip, "a@example.com", recipient)
+		if pass, _ := g.Check(start.Add(10*time.Minute), ip, "a@example.com", recipient); !pass {
+			t.Fatalf("retry to %s not passed", recipient)
+		}
+	}
+	pass, err := g.Check(start.Add(20*time.Minute), net.ParseIP("192.0.2.2"), "new@example.net", "d@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pass {
+		t.Errorf("new triplet from a whitelisted network greylisted")
+	}
+}
+
+func TestRcptToCb(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		src  string
+		auth string
+		want filter.Response
+	}{
+		{"greylisted", "192.0.2.1", "", filter.Reject("451 4.7.1 Greylisted, please try again later")},
+		{"loopback", "127.0.0.1", "", filter.Proceed()},
+		{"authenticated", "192.0.2.1", "pass", filter.Proceed()},
+		{"failed authentication", "192.0.2.1", "fail", filter.Reject("451 4.7.1 Greylisted, please try again later")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewGreylister(nil)
+			s := filter.Session{}
+			g.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP(test.src), Port: 4242}, nil)
+			if test.auth != "" {
+				g.linkAuthCb(start, s, test.auth, "a")
+			}
+			g.txMailCb(start, s, "1", "ok", "<a@example.com>")
+			if res := g.rcptToCb(start, s, "<b@example.org>"); res != test.want {
+				t.Errorf("rcptToCb = %#v, want %#v", res, test.want)
+			}
+		})
+	}
+
+	g := NewGreylister(nil)
+	s := filter.Session{}
+	g.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}, nil)
+	g.txMailCb(start, s, "1", "ok", "<a@example.com>")
+	g.rcptToCb(start, s, "<b@example.org>")
+	if res := g.rcptToCb(start.Add(10*time.Minute), s, "<B@example.org>"); res != filter.Proceed() {
+		t.Errorf("retry rcptToCb = %#v, want proceed", res)
+	}
+
+	// DSN parameters are not part of the triplet
+	if res := g.rcptToCb(start.Add(10*time.Minute), s, "<b@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b@example.org"); res != filter.Proceed() {
+		t.Errorf("retry rcptToCb with parameters = %#v, want proceed", res)
+	}
+}
@@ -0,0 +1,277 @@
+package greylist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is the state kept for a triplet or, for auto-whitelisting, for a
+// source network.
+type Record struct {
+	// First is the time of the first attempt.
+	First time.Time
+	// Last is the time the record was last seen.
+	Last time.Time
+	// Passes counts the deliveries let through, a triplet with no pass
+	// is still greylisted.
+	Passes int
+}
+
+// Store persists greylisting records. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	Get(key string) (Record, bool, error)
+	Put(key string, record Record) error
+	Delete(key string) error
+
+	// Expire removes the records last seen before t.
+	Expire(t time.Time) error
+}
+
+type MemoryStore struct {
+	records map[string]Record
+	mtx     sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(key string) (Record, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	record, ok := s.records[key]
+	return record, ok, nil
+}
+
+func (s *MemoryStore) Put(key string, record Record) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStore) Expire(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, record := range s.records {
+		if record.Last.Before(t) {
+			delete(s.records, key)
+		}
+	}
+	return nil
+}
+
+// journalEntry is a line of the FileStore journal, a nil Record being a
+// deletion.
+type journalEntry struct {
+	Key    string  `json:"k"`
+	Record *Record `json:"r,omitempty"`
+}
+
+// FileStore keeps records in memory and persists every change to an
+// append-only journal, synced before the change is acknowledged. The
+// journal is compacted by writing a snapshot to a temporary file renamed
+// over it, so that a crash at any point leaves either the old or the new
+// file. A truncated last line, left by a crash during an append, is
+// ignored on load, any other malformed line fails it.
+type FileStore struct {
+	// SyncInterval bounds how long updates that only move the Last time
+	// of a record, such as whitelist refreshes, are left unsynced. They
+	// are written right away but synced with the next change or once the
+	// interval has passed, a crash losing at most an earlier expiry.
+	SyncInterval time.Duration
+
+	path     string
+	file     *os.File
+	records  map[string]Record
+	entries  int
+	lastSync time.Time
+	mtx      sync.Mutex
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		SyncInterval: time.Minute,
+		path:         path,
+		records:      make(map[string]Record),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var malformed error
+	for line := 1; scanner.Scan(); line++ {
+		if malformed != nil {
+			// only a partially written last line is expected
+			return malformed
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			malformed = fmt.Errorf("%s:%d: malformed journal entry: %w", s.path, line, err)
+			continue
+		}
+		if entry.Record == nil {
+			delete(s.records, entry.Key)
+		} else {
+			s.records[entry.Key] = *entry.Record
+		}
+	}
+	return scanner.Err()
+}
+
+// compact replaces the journal with a snapshot of the records and reopens
+// it for appending. It must be called with the lock held.
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for key, record := range s.records {
+		record := record
+		if err := enc.Encode(journalEntry{Key: key, Record: &record}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.entries = len(s.records)
+	s.lastSync = time.Now()
+	return nil
+}
+
+// append writes entry to the journal, syncing it unless lazy is set and
+// the last sync is within SyncInterval.
+func (s *FileStore) append(entry journalEntry, lazy bool) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("greylist journal: %w", err)
+	}
+	if now := time.Now(); !lazy || now.Sub(s.lastSync) >= s.SyncInterval {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("greylist journal: %w", err)
+		}
+		s.lastSync = now
+	}
+	s.entries++
+	if s.entries > 2*len(s.records)+1024 {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) Get(key string) (Record, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	record, ok := s.records[key]
+	return record, ok, nil
+}
+
+func (s *FileStore) Put(key string, record Record) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	previous, found := s.records[key]
+	lazy := found && previous.First.Equal(record.First) && previous.Passes == record.Passes
+	s.records[key] = record
+	return s.append(journalEntry{Key: key, Record: &record}, lazy)
+}
+
+func (s *FileStore) Delete(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	delete(s.records, key)
+	return s.append(journalEntry{Key: key}, false)
+}
+
+func (s *FileStore) Expire(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	expired := 0
+	for key, record := range s.records {
+		if record.Last.Before(t) {
+			delete(s.records, key)
+			expired++
+		}
+	}
+	if expired == 0 {
+		return nil
+	}
+	return s.compact()
+}
+
+func (s *FileStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
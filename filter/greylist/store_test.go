@@ -0,0 +1,93 @@
+package greylist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		keys    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"entries", `{"k":"a","r":{"Passes":1}}` + "\n" + `{"k":"b","r":{}}` + "\n", []string{"a", "b"}, false},
+		{"deletion", `{"k":"a","r":{}}` + "\n" + `{"k":"a"}` + "\n", nil, false},
+		{"partial last line", `{"k":"a","r":{}}` + "\n" + `{"k":"b","r":{"Pa`, []string{"a"}, false},
+		{"malformed line", `{"k":"a","r":{}}` + "\n" + `garbage` + "\n" + `{"k":"b","r":{}}` + "\n", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "greylist.journal")
+			if err := os.WriteFile(path, []byte(test.journal), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := OpenFileStore(path)
+			if test.wantErr {
+				if err == nil {
+					s.Close()
+					t.Fatal("malformed journal loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if len(s.records) != len(test.keys) {
+				t.Errorf("loaded %d records, want %d", len(s.records), len(test.keys))
+			}
+			for _, key := range test.keys {
+				if _, found, _ := s.Get(key); !found {
+					t.Errorf("record %s not loaded", key)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.journal")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SyncInterval = time.Hour
+
+	now := time.Now().Truncate(time.Second)
+	if err := s.Put("net", Record{First: now, Last: now, Passes: 3}); err != nil {
+		t.Fatal(err)
+	}
+	synced := s.lastSync
+	later := now.Add(time.Minute)
+	if err := s.Put("net", Record{First: now, Last: later, Passes: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if s.lastSync != synced {
+		t.Error("refresh of Last synced within SyncInterval")
+	}
+	if err := s.Put("triplet", Record{First: now, Last: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	record, found, _ := s.Get("net")
+	if !found || !record.Last.Equal(later) || record.Passes != 3 {
+		t.Errorf("reloaded %+v, %v", record, found)
+	}
+	if _, found, _ := s.Get("triplet"); !found {
+		t.Error("triplet not reloaded")
+	}
+}
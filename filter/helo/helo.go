@@ -0,0 +1,393 @@
+package helo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// Resolver is the subset of *net.Resolver needed for forward
+// confirmation.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Scorer receives the hits of checks mapped to the Score action, as
+// *score.Scorer does. Check names are used as score check names.
+type Scorer interface {
+	AddSession(sessionId filter.Session, name string, detail string)
+}
+
+type Check string
+
+const (
+	InvalidSyntax   Check = "HELO_INVALID_SYNTAX"
+	InvalidLiteral  Check = "HELO_INVALID_LITERAL"
+	LiteralMismatch Check = "HELO_LITERAL_MISMATCH"
+	Impersonation   Check = "HELO_IMPERSONATION"
+	Dynamic         Check = "HELO_DYNAMIC"
+	NotConfirmed    Check = "HELO_NOT_CONFIRMED"
+)
+
+type Action int
+
+const (
+	Ignore Action = iota
+	Score
+	Junk
+	Reject
+)
+
+// Result is a failed check.
+type Result struct {
+	Check  Check
+	Detail string
+}
+
+type session struct {
+	src     net.IP
+	results []Result
+}
+
+type Checker struct {
+	Resolver Resolver
+	Timeout  time.Duration
+
+	// Actions maps failed checks to what is done about them, checks
+	// mapped to Ignore or missing are not run. The most severe action of
+	// the failed checks applies.
+	Actions map[Check]Action
+
+	// Scorer receives hits of checks mapped to Score.
+	Scorer Scorer
+
+	// LocalNames and LocalAddresses are our own identities, which clients
+	// must not claim.
+	LocalNames     []string
+	LocalAddresses []net.IP
+
+	// DynamicPatterns match names assigned to dynamic address pools,
+	// names embedding the client address are always considered dynamic.
+	DynamicPatterns []*regexp.Regexp
+
+	// Exempt lists networks whose HELO is not checked, loopback addresses
+	// are always exempt.
+	Exempt []*net.IPNet
+
+	// RejectResponse is returned for the Reject action, a response naming
+	// the failed check is built when nil.
+	RejectResponse filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+var DefaultDynamicPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(^|[.-])(dyn|dynamic|dhcp|dial|dialup|ppp|pppoe|dsl|adsl|vdsl|xdsl|cable|pool|broadband|customer|cust|client|residential)([.-]|[0-9])`),
+	regexp.MustCompile(`[0-9]{1,3}[.-][0-9]{1,3}[.-][0-9]{1,3}[.-][0-9]{1,3}`),
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	c := &Checker{
+		Resolver: resolver,
+		Timeout:  5 * time.Second,
+		Actions: map[Check]Action{
+			InvalidSyntax:   Reject,
+			InvalidLiteral:  Reject,
+			LiteralMismatch: Score,
+			Impersonation:   Reject,
+			Dynamic:         Score,
+			NotConfirmed:    Score,
+		},
+		DynamicPatterns: DefaultDynamicPatterns,
+		sessions:        make(map[filter.Session]*session),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		c.LocalNames = []string{hostname}
+	}
+	return c
+}
+
+func (c *Checker) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(c.linkConnectCb)
+	in.OnLinkDisconnect(c.linkDisconnectCb)
+	in.HeloRequest(c.heloCb)
+	in.EhloRequest(c.heloCb)
+}
+
+// Results returns the checks failed by the HELO of the session.
+func (c *Checker) Results(sessionId filter.Session) []Result {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.results
+	}
+	return nil
+}
+
+func (c *Checker) enabled(check Check) bool {
+	return c.Actions[check] != Ignore
+}
+
+// ValidFQDN reports whether name is a syntactically valid fully qualified
+// domain name: at least two labels of letters, digits and hyphens, and a
+// top-level label that is not all-numeric.
+func ValidFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			ch := label[i]
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
+
+// ParseLiteral parses an address literal such as [192.0.2.1] or
+// [IPv6:2001:db8::1] (RFC 5321, section 4.1.3).
+func ParseLiteral(literal string) (net.IP, error) {
+	if !strings.HasPrefix(literal, "[") || !strings.HasSuffix(literal, "]") {
+		return nil, fmt.Errorf("not an address literal")
+	}
+	inner := literal[1 : len(literal)-1]
+	if len(inner) > 5 && strings.EqualFold(inner[:5], "IPv6:") {
+		ip := net.ParseIP(inner[5:])
+		if ip == nil || ip.To4() != nil && !strings.Contains(inner[5:], ":") {
+			return nil, fmt.Errorf("invalid IPv6 literal %s", literal)
+		}
+		return ip, nil
+	}
+	ip := net.ParseIP(inner)
+	if ip == nil || ip.To4() == nil || strings.Contains(inner, ":") {
+		return nil, fmt.Errorf("invalid IPv4 literal %s", literal)
+	}
+	return ip, nil
+}
+
+// EmbedsAddress reports whether name contains the octets of ip, in either
+// order, as commonly found in names of dynamic pools. Octets joined by a
+// separator must not be surrounded by other digits, and octets written
+// together, in decimal or hexadecimal, must fill a label or a part of one
+// between separators, so that unrelated numbers in a name do not match.
+func EmbedsAddress(name string, ip net.IP) bool {
+	v4 := ip.To4()
+	if v4 == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	octets := []string{fmt.Sprint(v4[0]), fmt.Sprint(v4[1]), fmt.Sprint(v4[2]), fmt.Sprint(v4[3])}
+	reversed := []string{octets[3], octets[2], octets[1], octets[0]}
+	for _, sep := range []string{".", "-", "_"} {
+		if containsBounded(name, strings.Join(octets, sep), isDigit) || containsBounded(name, strings.Join(reversed, sep), isDigit) {
+			return true
+		}
+	}
+	return containsBounded(name, strings.Join(octets, ""), isLabelChar) ||
+		containsBounded(name, strings.Join(reversed, ""), isLabelChar) ||
+		containsBounded(name, fmt.Sprintf("%02x%02x%02x%02x", v4[0], v4[1], v4[2], v4[3]), isLabelChar)
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isLabelChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || isDigit(ch)
+}
+
+// containsBounded reports whether s contains substr at a position where
+// the bytes around it, if any, are not inside.
+func containsBounded(s string, substr string, inside func(byte) bool) bool {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		j := strings.Index(s[i:], substr)
+		if j < 0 {
+			return false
+		}
+		i += j
+		end := i + len(substr)
+		if (i == 0 || !inside(s[i-1])) && (end == len(s) || !inside(s[end])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) local(name string, ip net.IP) bool {
+	for _, local := range c.LocalNames {
+		if name != "" && strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(local, ".")) {
+			return true
+		}
+	}
+	for _, local := range c.LocalAddresses {
+		if ip != nil && local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check runs the enabled checks on the HELO name of a client at src and
+// returns those that failed.
+func (c *Checker) Check(ctx context.Context, helo string, src net.IP) []Result {
+	results := make([]Result, 0)
+	fail := func(check Check, format string, args ...interface{}) {
+		results = append(results, Result{Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.HasPrefix(helo, "[") {
+		ip, err := ParseLiteral(helo)
+		if err != nil {
+			if c.enabled(InvalidLiteral) {
+				fail(InvalidLiteral, "%s", err)
+			}
+			return results
+		}
+		if c.enabled(Impersonation) && c.local("", ip) {
+			fail(Impersonation, "%s is one of our addresses", helo)
+		}
+		if c.enabled(LiteralMismatch) && src != nil && !ip.Equal(src) {
+			fail(LiteralMismatch, "%s does not match client address %s", helo, src)
+		}
+		return results
+	}
+
+	if !ValidFQDN(helo) {
+		if c.enabled(InvalidSyntax) {
+			fail(InvalidSyntax, "%q is not a fully qualified domain name", helo)
+		}
+		return results
+	}
+	name := strings.ToLower(strings.TrimSuffix(helo, "."))
+
+	if c.enabled(Impersonation) && c.local(name, nil) {
+		fail(Impersonation, "%s is our own name", name)
+	}
+
+	if c.enabled(Dynamic) {
+		dynamic := src != nil && EmbedsAddress(name, src)
+		for _, pattern := range c.DynamicPatterns {
+			dynamic = dynamic || pattern.MatchString(name)
+		}
+		if dynamic {
+			fail(Dynamic, "%s looks dynamic", name)
+		}
+	}
+
+	if c.enabled(NotConfirmed) && src != nil {
+		lctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		addrs, err := c.Resolver.LookupIPAddr(lctx, name)
+		cancel()
+
+		var dnsErr *net.DNSError
+		switch {
+		case err != nil && errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			fail(NotConfirmed, "%s does not resolve", name)
+		case err != nil:
+			// temporary failures are not held against the client
+		default:
+			confirmed := false
+			for _, addr := range addrs {
+				confirmed = confirmed || addr.IP.Equal(src)
+			}
+			if !confirmed {
+				fail(NotConfirmed, "%s does not resolve to %s", name, src)
+			}
+		}
+	}
+	return results
+}
+
+func (c *Checker) session(sessionId filter.Session) *session {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess, ok := c.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		c.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (c *Checker) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		c.session(sessionId).src = addr.IP
+	}
+}
+
+func (c *Checker) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	delete(c.sessions, sessionId)
+}
+
+func (c *Checker) exempt(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+	for _, network := range c.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) heloCb(timestamp time.Time, sessionId filter.Session, helo string) filter.Response {
+	sess := c.session(sessionId)
+	if c.exempt(sess.src) {
+		return filter.Proceed()
+	}
+
+	results := c.Check(context.Background(), helo, sess.src)
+	c.sessionsMtx.Lock()
+	sess.results = results
+	c.sessionsMtx.Unlock()
+
+	action := Ignore
+	var worst Result
+	for _, result := range results {
+		a := c.Actions[result.Check]
+		if a == Score && c.Scorer != nil {
+			c.Scorer.AddSession(sessionId, string(result.Check), result.Detail)
+		}
+		if a > action {
+			action = a
+			worst = result
+		}
+	}
+
+	switch action {
+	case Reject:
+		if c.RejectResponse != nil {
+			return c.RejectResponse
+		}
+		return filter.Reject(fmt.Sprintf("550 5.7.1 HELO rejected: %s", worst.Detail))
+	case Junk:
+		return filter.Junk()
+	}
+	return filter.Proceed()
+}
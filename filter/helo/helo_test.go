@@ -0,0 +1,198 @@
+package helo
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// zone answers address lookups from a map, names missing from it are
+// NXDOMAIN and names mapped to nil fail with SERVFAIL.
+type zone map[string][]string
+
+func (z zone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := z[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if addrs == nil {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	ret := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ret, nil
+}
+
+func TestValidFQDN(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"mx.example.com", true},
+		{"mx.example.com.", true},
+		{"a-b.example", true},
+		{"localhost", false},
+		{"", false},
+		{"-mx.example.com", false},
+		{"mx..example.com", false},
+		{"mx_1.example.com", false},
+		{"192.0.2.1", false},
+		{strings.Repeat("a", 64) + ".example", false},
+	}
+	for _, test := range tests {
+		if got := ValidFQDN(test.name); got != test.want {
+			t.Errorf("ValidFQDN(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseLiteral(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    string
+	}{
+		{"[192.0.2.1]", "192.0.2.1"},
+		{"[IPv6:2001:db8::1]", "2001:db8::1"},
+		{"[ipv6:2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]", ""},
+		{"[IPv6:192.0.2.1]", ""},
+		{"[192.0.2]", ""},
+		{"192.0.2.1", ""},
+	}
+	for _, test := range tests {
+		ip, err := ParseLiteral(test.literal)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ParseLiteral(%s) = %s, want error", test.literal, ip)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(test.want)) {
+			t.Errorf("ParseLiteral(%s) = %s, %v, want %s", test.literal, ip, err, test.want)
+		}
+	}
+}
+
+func TestEmbedsAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"192-0-2-1.pool.example.net", "192.0.2.1", true},
+		{"1.2.0.192.dyn.example.net", "192.0.2.1", true},
+		{"host-198_51_100_7.example.net", "198.51.100.7", true},
+		{"ip198-51-100-7.example.net", "198.51.100.7", true},
+		{"c0000201.example.net", "192.0.2.1", true},
+		{"x-19202-1.example.net", "192.0.2.1", false},
+		{"cust192221.example.net", "192.2.2.1", false},
+		{"192221.example.net", "192.2.2.1", true},
+		{"mail-7100512.example.net", "198.51.100.7", false},
+		{"2192-0-2-10.example.net", "192.0.2.1", false},
+		{"abc0000201.example.net", "192.0.2.1", false},
+		{"mx.example.net", "192.0.2.1", false},
+		{"2001-db8--1.example.net", "2001:db8::1", false},
+	}
+	for _, test := range tests {
+		if got := EmbedsAddress(test.name, net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("EmbedsAddress(%s, %s) = %v, want %v", test.name, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	resolver := zone{
+		"mx.example.com":        {"192.0.2.1"},
+		"other.example.com":     {"198.51.100.1"},
+		"broken.example.com":    nil,
+		"dsl-1.isp.example":     {"192.0.2.1"},
+		"mail.example.org":      {"192.0.2.1"},
+		"1-2-0-192.example.net": {"192.0.2.1"},
+	}
+
+	tests := []struct {
+		helo string
+		want []Check
+	}{
+		{"mx.example.com", nil},
+		{"MX.Example.Com.", nil},
+		{"localhost", []Check{InvalidSyntax}},
+		{"[192.0.2.1]", nil},
+		{"[198.51.100.1]", []Check{LiteralMismatch}},
+		{"[192.0.2.999]", []Check{InvalidLiteral}},
+		{"[203.0.113.25]", []Check{Impersonation, LiteralMismatch}},
+		{"mail.example.org", []Check{Impersonation}},
+		{"dsl-1.isp.example", []Check{Dynamic}},
+		{"1-2-0-192.example.net", []Check{Dynamic}},
+		{"other.example.com", []Check{NotConfirmed}},
+		{"missing.example.com", []Check{NotConfirmed}},
+		{"broken.example.com", nil},
+	}
+
+	c := NewChecker(resolver)
+	c.LocalNames = []string{"mail.example.org"}
+	c.LocalAddresses = []net.IP{net.ParseIP("203.0.113.25")}
+	for _, test := range tests {
+		results := c.Check(context.Background(), test.helo, net.ParseIP("192.0.2.1"))
+		got := make([]Check, 0)
+		for _, result := range results {
+			got = append(got, result.Check)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Check(%s) = %v, want %v", test.helo, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("Check(%s) = %v, want %v", test.helo, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+type scorer []string
+
+func (s *scorer) AddSession(sessionId filter.Session, name string, detail string) {
+	*s = append(*s, name)
+}
+
+func TestHeloCb(t *testing.T) {
+	resolver := zone{"mx.example.com": {"192.0.2.1"}, "dsl-1.isp.example": {"192.0.2.1"}}
+	tests := []struct {
+		src    string
+		helo   string
+		want   filter.Response
+		scored []string
+	}{
+		{"192.0.2.1", "mx.example.com", filter.Proceed(), nil},
+		{"192.0.2.1", "localhost", filter.Reject("550 5.7.1 HELO rejected: \"localhost\" is not a fully qualified domain name"), nil},
+		{"192.0.2.1", "unknown.example.com", filter.Junk(), nil},
+		{"192.0.2.1", "dsl-1.isp.example", filter.Proceed(), []string{string(Dynamic)}},
+		{"127.0.0.1", "localhost", filter.Proceed(), nil},
+		{"10.0.0.1", "localhost", filter.Proceed(), nil},
+	}
+
+	for _, test := range tests {
+		s := &scorer{}
+		c := NewChecker(resolver)
+		c.Scorer = s
+		c.Actions[NotConfirmed] = Junk
+		c.Exempt = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+		sessionId := filter.Session{}
+		c.linkConnectCb(time.Now(), sessionId, "", "", &net.TCPAddr{IP: net.ParseIP(test.src), Port: 25}, nil)
+		if got := c.heloCb(time.Now(), sessionId, test.helo); got != test.want {
+			t.Errorf("%s from %s: response = %#v, want %#v", test.helo, test.src, got, test.want)
+		}
+		if strings.Join(*s, ",") != strings.Join(test.scored, ",") {
+			t.Errorf("%s from %s: scored %v, want %v", test.helo, test.src, *s, test.scored)
+		}
+	}
+}
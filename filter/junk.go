@@ -0,0 +1,98 @@
+package filter
+
+import "sync"
+
+type junkState struct {
+	session bool
+	tx      bool
+
+	// deferred is set when the junk result of the transaction could not
+	// be sent because a rewrite was, it is sent at a later request.
+	deferred bool
+}
+
+var junked = make(map[Session]*junkState)
+var junkedMtx sync.Mutex
+
+// recordJunk remembers that the result of a filter request marked the
+// session as junk. As smtpd does, a junk result before mail-from applies
+// to the whole session, a later one only to the current transaction.
+func recordJunk(sessionId Session, event string, res Response) {
+	if d, ok := res.(delay); ok {
+		res = d.response
+	}
+	if _, ok := res.(junk); !ok {
+		return
+	}
+
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	state, ok := junked[sessionId]
+	if !ok {
+		state = &junkState{}
+		junked[sessionId] = state
+	}
+	switch event {
+	case "connect", "helo", "ehlo", "starttls", "auth":
+		state.session = true
+	default:
+		state.tx = true
+	}
+}
+
+// resetTxJunk forgets the junk result of the previous transaction of a
+// session, before the mail-from of the next one is filtered.
+func resetTxJunk(sessionId Session) {
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	if state, ok := junked[sessionId]; ok {
+		state.tx = false
+		state.deferred = false
+	}
+}
+
+// deferJunk records a junk result of the transaction that was dropped in
+// favour of a rewrite, smtpd taking a single result.
+func deferJunk(sessionId Session) {
+	recordJunk(sessionId, "mail-from", junk{})
+
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	junked[sessionId].deferred = true
+}
+
+// deferredJunk turns a proceed result into the junk result deferred by a
+// previous request of the transaction, if any.
+func deferredJunk(sessionId Session, res Response) Response {
+	d, delayed := res.(delay)
+	if delayed {
+		res = d.response
+	}
+	if _, ok := res.(proceed); !ok {
+		return withDelay(d.duration, res)
+	}
+
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	if state, ok := junked[sessionId]; ok && state.deferred {
+		state.deferred = false
+		res = junk{}
+	}
+	return withDelay(d.duration, res)
+}
+
+func unjunk(sessionId Session) {
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	delete(junked, sessionId)
+}
+
+// Junked reports whether the filter marked the session, or its current
+// transaction, as junk: the handler chain of one of its filter requests
+// resulted in Junk().
+func (s Session) Junked() bool {
+	junkedMtx.Lock()
+	defer junkedMtx.Unlock()
+	state, ok := junked[s]
+	return ok && (state.session || state.tx)
+}
@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var sessionListeners = make(map[Session]*SMTPIn)
+var sessionListenersMtx sync.Mutex
+
+// listenerKey normalizes a listener address given as "ip:port", ":port",
+// "ip" or a unix socket path.
+func listenerKey(address string) string {
+	if strings.Contains(address, "/") {
+		return address
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			log.Fatalf("Invalid listener port %s", address)
+		}
+		if host == "" {
+			return ":" + port
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	} else if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	log.Fatalf("Invalid listener address %s", address)
+	return ""
+}
+
+// Listener returns the handler set of the sessions received on a listener,
+// identified by the destination address of link-connect: "ip:port",
+// ":port", "ip" or a unix socket path. Handlers registered on it run after
+// the ones registered on in, for matching sessions only. When several
+// listener sets match, the most specific one applies, in the order above.
+// Listener sets do not nest.
+func (in *SMTPIn) Listener(address string) *SMTPIn {
+	key := listenerKey(address)
+	if in.listeners == nil {
+		in.listeners = make(map[string]*SMTPIn)
+	}
+	l, ok := in.listeners[key]
+	if !ok {
+		l = &SMTPIn{}
+		in.listeners[key] = l
+	}
+	return l
+}
+
+// match returns the listener set of dest, nil if none.
+func (in *SMTPIn) match(dest net.Addr) *SMTPIn {
+	var keys []string
+	switch addr := dest.(type) {
+	case *net.TCPAddr:
+		port := strconv.Itoa(addr.Port)
+		keys = []string{net.JoinHostPort(addr.IP.String(), port), ":" + port, addr.IP.String()}
+	case *net.UnixAddr:
+		keys = []string{addr.Name}
+	}
+	for _, key := range keys {
+		if l, ok := in.listeners[key]; ok {
+			return l
+		}
+	}
+	return nil
+}
+
+func concat[T any](a []T, b []T) []T {
+	return append(append(make([]T, 0, len(a)+len(b)), a...), b...)
+}
+
+// merge returns a handler set running the handlers of in, then those of l.
+func (in *SMTPIn) merge(l *SMTPIn) *SMTPIn {
+	m := &SMTPIn{}
+	m.sessionAllocator = in.sessionAllocator
+	if l.sessionAllocator != nil {
+		m.sessionAllocator = l.sessionAllocator
+	}
+
+	m.linkConnect = concat(in.linkConnect, l.linkConnect)
+	m.linkGreeting = concat(in.linkGreeting, l.linkGreeting)
+	m.linkIdentify = concat(in.linkIdentify, l.linkIdentify)
+	m.linkTLS = concat(in.linkTLS, l.linkTLS)
+	m.linkAuth = concat(in.linkAuth, l.linkAuth)
+	m.linkDisconnect = concat(in.linkDisconnect, l.linkDisconnect)
+	m.txReset = concat(in.txReset, l.txReset)
+	m.txBegin = concat(in.txBegin, l.txBegin)
+	m.txMail = concat(in.txMail, l.txMail)
+	m.txRcpt = concat(in.txRcpt, l.txRcpt)
+	m.txEnvelope = concat(in.txEnvelope, l.txEnvelope)
+	m.txData = concat(in.txData, l.txData)
+	m.txCommit = concat(in.txCommit, l.txCommit)
+	m.txRollback = concat(in.txRollback, l.txRollback)
+	m.protocolClient = concat(in.protocolClient, l.protocolClient)
+	m.protocolServer = concat(in.protocolServer, l.protocolServer)
+	m.filterReport = concat(in.filterReport, l.filterReport)
+	m.filterResponse = concat(in.filterResponse, l.filterResponse)
+	m.timeout = concat(in.timeout, l.timeout)
+
+	m.filterConnect = concat(in.filterConnect, l.filterConnect)
+	m.filterHelo = concat(in.filterHelo, l.filterHelo)
+	m.filterEhlo = concat(in.filterEhlo, l.filterEhlo)
+	m.filterStartTLS = concat(in.filterStartTLS, l.filterStartTLS)
+	m.filterAuth = concat(in.filterAuth, l.filterAuth)
+	m.filterMailFrom = concat(in.filterMailFrom, l.filterMailFrom)
+	m.filterRcptTo = concat(in.filterRcptTo, l.filterRcptTo)
+	m.filterData = concat(in.filterData, l.filterData)
+	m.filterDataLine = concat(in.filterDataLine, l.filterDataLine)
+	m.filterCommit = concat(in.filterCommit, l.filterCommit)
+	m.filterNoop = concat(in.filterNoop, l.filterNoop)
+	m.filterRset = concat(in.filterRset, l.filterRset)
+	m.filterHelp = concat(in.filterHelp, l.filterHelp)
+	m.filterWiz = concat(in.filterWiz, l.filterWiz)
+	return m
+}
+
+// all returns a handler set with the handlers of in and of every listener
+// set, to compute the events to register.
+func (in *SMTPIn) all() *SMTPIn {
+	m := in
+	for _, l := range in.listeners {
+		m = m.merge(l)
+	}
+	return m
+}
+
+// bind attaches a session to the handler set of the listener it was
+// received on, from the atoms of its link-connect report.
+func (in *SMTPIn) bind(sessionId Session, atoms []string) {
+	if len(in.listeners) == 0 || len(atoms) != 4 {
+		return
+	}
+	dest, err := parseAddress(atoms[3])
+	if err != nil {
+		log.Fatalf("Failed to parse destination address %s", atoms[3])
+	}
+	l := in.match(dest)
+	if l == nil {
+		return
+	}
+
+	sessionListenersMtx.Lock()
+	defer sessionListenersMtx.Unlock()
+	if l.merged == nil {
+		l.merged = in.merge(l)
+	}
+	sessionListeners[sessionId] = l.merged
+}
+
+func (in *SMTPIn) unbind(sessionId Session) {
+	sessionListenersMtx.Lock()
+	defer sessionListenersMtx.Unlock()
+	delete(sessionListeners, sessionId)
+}
+
+// handlers returns the handler set of a session.
+func (in *SMTPIn) handlers(sessionId Session) *SMTPIn {
+	sessionListenersMtx.Lock()
+	defer sessionListenersMtx.Unlock()
+	if l, ok := sessionListeners[sessionId]; ok {
+		return l
+	}
+	return in
+}
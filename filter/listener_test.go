@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerMatch(t *testing.T) {
+	in := &SMTPIn{}
+	ipPort := in.Listener("192.0.2.1:25")
+	port := in.Listener(":587")
+	ip := in.Listener("192.0.2.1")
+	ip6 := in.Listener("2001:db8::1")
+	unix := in.Listener("/var/run/smtpd.sock")
+
+	if in.Listener("192.0.2.1:25") != ipPort {
+		t.Errorf("Listener returned a new set for an existing address")
+	}
+
+	tests := []struct {
+		dest string
+		want *SMTPIn
+	}{
+		{"192.0.2.1:25", ipPort},
+		{"192.0.2.1:587", port},
+		{"192.0.2.2:587", port},
+		{"192.0.2.1:465", ip},
+		{"[2001:db8::1]:25", ip6},
+		{"[2001:db8::2]:587", port},
+		{"/var/run/smtpd.sock", unix},
+		{"192.0.2.2:25", nil},
+		{"/var/run/other.sock", nil},
+	}
+	for _, test := range tests {
+		dest, err := parseAddress(test.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := in.match(dest); got != test.want {
+			t.Errorf("match(%s) returned the wrong listener set", test.dest)
+		}
+	}
+}
+
+func TestListenerBind(t *testing.T) {
+	calls := make([]string, 0)
+	in := &SMTPIn{}
+	in.OnTxBegin(func(timestamp time.Time, sessionId Session, messageId string) {
+		calls = append(calls, "in")
+	})
+	in.Listener(":587").OnTxBegin(func(timestamp time.Time, sessionId Session, messageId string) {
+		calls = append(calls, "submission")
+	})
+
+	submission, smtp := Session{"1"}, Session{"2"}
+	in.bind(submission, []string{"client.example.com", "pass", "198.51.100.1:4242", "192.0.2.1:587"})
+	in.bind(smtp, []string{"client.example.com", "pass", "198.51.100.1:4243", "192.0.2.1:25"})
+	defer in.unbind(submission)
+	defer in.unbind(smtp)
+
+	if in.handlers(smtp) != in {
+		t.Errorf("session of an unmatched listener bound to a listener set")
+	}
+	set := in.handlers(submission)
+	for _, messageId := range []string{"a", "b"} {
+		if in.handlers(submission) != set {
+			t.Fatalf("handler set of session changed before disconnect")
+		}
+		handleReport(time.Now(), "tx-begin", &in.handlers(submission).reporting, submission, []string{messageId})
+	}
+	if want := "in submission in submission"; strings.Join(calls, " ") != want {
+		t.Errorf("calls %q, want %q", strings.Join(calls, " "), want)
+	}
+
+	in.unbind(submission)
+	if in.handlers(submission) != in {
+		t.Errorf("session still bound after disconnect")
+	}
+}
+
+func TestListenerKey(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1:25", "192.0.2.1:25"},
+		{":587", ":587"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"[2001:db8::1]:25", "[2001:db8::1]:25"},
+		{"/var/run/smtpd.sock", "/var/run/smtpd.sock"},
+	}
+	for _, test := range tests {
+		if got := listenerKey(test.address); got != test.want {
+			t.Errorf("listenerKey(%q) = %q, want %q", test.address, got, test.want)
+		}
+	}
+}
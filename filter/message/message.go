@@ -0,0 +1,262 @@
+package message
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Unstuff removes the SMTP dot-stuffing from a line received through the
+// data-line stream.
+func Unstuff(line string) string {
+	return strings.TrimPrefix(line, ".")
+}
+
+// Stuff applies SMTP dot-stuffing to a line before it is written back to
+// the data-line stream.
+func Stuff(line string) string {
+	if strings.HasPrefix(line, ".") {
+		return "." + line
+	}
+	return line
+}
+
+// Field is a single header field as it appears in the message, folding
+// preserved: Lines[0] holds the field name and the colon.
+type Field struct {
+	Name  string
+	Lines []string
+}
+
+func NewField(name string, value string) Field {
+	return Field{Name: name, Lines: []string{name + ": " + value}}
+}
+
+// Raw returns the field as it appears on the wire, without the final CRLF.
+func (f Field) Raw() string {
+	return strings.Join(f.Lines, "\r\n")
+}
+
+// Value returns the unfolded field value, with surrounding whitespace
+// removed.
+func (f Field) Value() string {
+	raw := strings.Join(f.Lines, "")
+	if i := strings.IndexByte(raw, ':'); i >= 0 {
+		raw = raw[i+1:]
+	}
+	return strings.TrimSpace(raw)
+}
+
+var encodedWord = regexp.MustCompile(`=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=`)
+
+// DecodedValue returns the unfolded field value with RFC 2047 encoded
+// words decoded. Only UTF-8, ISO-8859-1 and US-ASCII are decoded, words in
+// other charsets, such as windows-1252 or ISO-2022-JP, and malformed words
+// are left encoded while the others are decoded.
+func (f Field) DecodedValue() string {
+	value := f.Value()
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(value); err == nil {
+		return decoded
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range encodedWord.FindAllStringIndex(value, -1) {
+		// whitespace between encoded words is not part of the value
+		if between := value[last:m[0]]; last == 0 || strings.TrimSpace(between) != "" {
+			b.WriteString(between)
+		}
+		word := value[m[0]:m[1]]
+		if decoded, err := dec.Decode(word); err == nil {
+			b.WriteString(decoded)
+		} else {
+			b.WriteString(word)
+		}
+		last = m[1]
+	}
+	b.WriteString(value[last:])
+	return b.String()
+}
+
+type Header []Field
+
+// Get returns the value of the first field named name, or "" if absent.
+func (h Header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields named name, top to bottom.
+func (h Header) Values(name string) []string {
+	ret := make([]string, 0)
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			ret = append(ret, f.Value())
+		}
+	}
+	return ret
+}
+
+// Fields returns all fields named name, top to bottom.
+func (h Header) Fields(name string) []Field {
+	ret := make([]Field, 0)
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// Remove returns the header without the fields named name.
+func (h Header) Remove(name string) Header {
+	ret := make(Header, 0, len(h))
+	for _, f := range h {
+		if !strings.EqualFold(f.Name, name) {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// TagSubject returns the header with tag prepended to the Subject field,
+// or with a Subject field holding tag when there is none. Subjects whose
+// decoded or raw value already contains tag, or its encoded form, are left
+// as is, so that processing a message again, or a reply to it, does not
+// stack tags. Folding and encoded words are preserved, non-ASCII tags are
+// encoded.
+func (h Header) TagSubject(tag string) Header {
+	encoded := tag
+	for _, r := range tag {
+		if r >= 0x80 {
+			encoded = mime.QEncoding.Encode("utf-8", tag)
+			break
+		}
+	}
+
+	ret := append(make(Header, 0, len(h)+1), h...)
+	for i, f := range ret {
+		if !strings.EqualFold(f.Name, "subject") {
+			continue
+		}
+		if strings.Contains(f.DecodedValue(), tag) || strings.Contains(f.Value(), encoded) {
+			return ret
+		}
+		if encoded != tag && strings.HasPrefix(f.Value(), "=?") {
+			// whitespace between encoded words is not displayed
+			encoded = mime.QEncoding.Encode("utf-8", tag+" ")
+		}
+		lines := append([]string{}, f.Lines...)
+		name, value, _ := strings.Cut(lines[0], ":")
+		lines[0] = name + ": " + encoded
+		if value = strings.TrimLeft(value, " \t"); value != "" {
+			lines[0] += " " + value
+		}
+		ret[i].Lines = lines
+		return ret
+	}
+	return append(ret, NewField("Subject", encoded))
+}
+
+type Message struct {
+	Header Header
+	Body   []string
+}
+
+// Parse splits unstuffed message lines into header fields and body lines.
+// Lines that are neither a field nor a continuation end the header.
+func Parse(lines []string) *Message {
+	msg := &Message{Header: make(Header, 0)}
+
+	i := 0
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			i++
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(msg.Header) == 0 {
+				break
+			}
+			last := &msg.Header[len(msg.Header)-1]
+			last.Lines = append(last.Lines, line)
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			break
+		}
+		msg.Header = append(msg.Header, Field{
+			Name:  strings.TrimRight(line[:colon], " \t"),
+			Lines: []string{line},
+		})
+	}
+	msg.Body = lines[i:]
+	return msg
+}
+
+// Prepend adds fields at the top of the header, in the given order.
+func (m *Message) Prepend(fields ...Field) {
+	m.Header = append(append(make(Header, 0, len(fields)+len(m.Header)), fields...), m.Header...)
+}
+
+// Lines returns the unstuffed message lines.
+func (m *Message) Lines() []string {
+	ret := make([]string, 0, len(m.Body)+len(m.Header)+1)
+	for _, f := range m.Header {
+		ret = append(ret, f.Lines...)
+	}
+	if len(m.Header) != 0 {
+		ret = append(ret, "")
+	}
+	return append(ret, m.Body...)
+}
+
+// DataLines returns the message as stuffed data lines, terminated by the
+// single dot line expected by the data-line stream.
+func (m *Message) DataLines() []string {
+	lines := m.Lines()
+	ret := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		ret = append(ret, Stuff(line))
+	}
+	return append(ret, ".")
+}
+
+// FromDomain returns the lowercased domain of the RFC5322.From address,
+// which must hold exactly one address.
+func FromDomain(header Header) (string, error) {
+	fields := header.Fields("from")
+	if len(fields) != 1 {
+		return "", fmt.Errorf("message has %d From headers", len(fields))
+	}
+	addrs, err := mail.ParseAddressList(fields[0].Value())
+	if err != nil || len(addrs) != 1 {
+		return "", fmt.Errorf("invalid From header %q", fields[0].Value())
+	}
+	_, domain, found := strings.Cut(addrs[0].Address, "@")
+	if !found || domain == "" {
+		return "", fmt.Errorf("invalid From address %q", addrs[0].Address)
+	}
+	return strings.ToLower(domain), nil
+}
+
+// SplitParam separates the address of a mail-from or rcpt-to parameter,
+// without its angle brackets, from the ESMTP parameters that may follow
+// it. rest keeps its leading space so that a rewritten parameter is
+// "<" + address + ">" + rest.
+func SplitParam(param string) (address string, rest string) {
+	address, rest, _ = strings.Cut(param, " ")
+	if rest != "" {
+		rest = " " + rest
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "<"), ">"), rest
+}
@@ -0,0 +1,73 @@
+package message
+
+import "testing"
+
+func TestSplitParam(t *testing.T) {
+	tests := []struct {
+		param   string
+		address string
+		rest    string
+	}{
+		{"<user@example.com>", "user@example.com", ""},
+		{"<>", "", ""},
+		{"user@example.com", "user@example.com", ""},
+		{"<user@example.com> SIZE=1024 BODY=8BITMIME", "user@example.com", " SIZE=1024 BODY=8BITMIME"},
+		{"<> SIZE=1024", "", " SIZE=1024"},
+	}
+	for _, test := range tests {
+		address, rest := SplitParam(test.param)
+		if address != test.address || rest != test.rest {
+			t.Errorf("SplitParam(%q) = %q, %q, want %q, %q", test.param, address, rest, test.address, test.rest)
+		}
+	}
+}
+
+func TestDecodedValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain subject", "plain subject"},
+		{"=?utf-8?q?caf=C3=A9?= au lait", "café au lait"},
+		{"=?iso-8859-1?q?caf=E9?= =?utf-8?q?_cr=C3=A8me?=", "café crème"},
+		{"=?windows-1252?q?caf=E9?= ok", "=?windows-1252?q?caf=E9?= ok"},
+		{"=?utf-8?q?=E2=9A=A0?= =?windows-1252?q?caf=E9?=", "⚠=?windows-1252?q?caf=E9?="},
+		{"Re: =?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?=", "Re: =?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?="},
+	}
+	for _, test := range tests {
+		if got := NewField("Subject", test.value).DecodedValue(); got != test.want {
+			t.Errorf("DecodedValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTagSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		tag     string
+		want    string
+	}{
+		{"hello", "[EXT]", "[EXT] hello"},
+		{"[EXT] hello", "[EXT]", "[EXT] hello"},
+		{"Re: [EXT] hello", "[EXT]", "Re: [EXT] hello"},
+		{"=?utf-8?q?caf=C3=A9?=", "[EXT]", "[EXT] =?utf-8?q?caf=C3=A9?="},
+		{"hello", "[EXTÉRIEUR]", "=?utf-8?q?[EXT=C3=89RIEUR]?= hello"},
+		{"=?windows-1252?q?caf=E9?=", "[EXTÉRIEUR]", "=?utf-8?q?[EXT=C3=89RIEUR]_?= =?windows-1252?q?caf=E9?="},
+		{"=?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?=", "[外部]", "=?utf-8?q?[=E5=A4=96=E9=83=A8]_?= =?iso-2022-jp?B?GyRCJDMkcyRLJEEkTxsoQg==?="},
+	}
+	for _, test := range tests {
+		header := Header{NewField("Subject", test.subject)}.TagSubject(test.tag)
+		if got := header.Get("subject"); got != test.want {
+			t.Errorf("TagSubject(%q, %q) = %q, want %q", test.subject, test.tag, got, test.want)
+		}
+		// tagging again does not stack
+		if got := header.TagSubject(test.tag).Get("subject"); got != test.want {
+			t.Errorf("TagSubject(%q, %q) twice = %q, want %q", test.subject, test.tag, got, test.want)
+		}
+	}
+
+	header := Header{NewField("From", "a@example.com")}.TagSubject("[EXT]")
+	if got := header.Get("subject"); got != "[EXT]" {
+		t.Errorf("TagSubject without subject = %q, want [EXT]", got)
+	}
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type ViolationKind string
+
+const (
+	// EarlyTalker is a client command issued before the greeting banner.
+	EarlyTalker ViolationKind = "early-talker"
+
+	// Pipelining is a client command issued before the reply to the
+	// previous one, while PIPELINING was not advertised or the previous
+	// command must end a pipelined group (RFC 2920, section 3.1).
+	Pipelining ViolationKind = "pipelining"
+)
+
+// Violation is a protocol violation detected from the protocol-client and
+// protocol-server reports of a session.
+type Violation struct {
+	Kind      ViolationKind
+	Verb      string
+	Timestamp time.Time
+}
+
+type protocolState struct {
+	greeted    bool
+	greeting   time.Time
+	pending    int
+	previous   string
+	replied    time.Time
+	pipelining bool
+	violations []Violation
+}
+
+var protocolSessions = make(map[Session]*protocolState)
+var protocolSessionsMtx sync.Mutex
+
+// commands after which a client must wait for the reply even when
+// PIPELINING is advertised.
+var groupEnders = map[string]bool{
+	"EHLO":     true,
+	"HELO":     true,
+	"DATA":     true,
+	"VRFY":     true,
+	"EXPN":     true,
+	"TURN":     true,
+	"QUIT":     true,
+	"NOOP":     true,
+	"AUTH":     true,
+	"STARTTLS": true,
+}
+
+// DetectProtocolViolations subscribes to the reports needed to detect
+// early talkers and pipelining violations, which are then available from
+// Session.Violations. Reports of a command are received before its filter
+// request, so the verdict is known by the time the command is filtered.
+//
+// Calling it again on the same handler set has no effect. Since the
+// handlers of SMTP_IN also run for sessions of its listener sets, it must
+// be called on SMTP_IN or on listener sets, not both.
+//
+// Pipelining is detected from the order of reports and from their
+// timestamps, a command stamped before the reply to the previous one
+// counting as pipelined. Timestamps are taken when smtpd processes an
+// event, not when data arrives on the socket, so a command buffered while
+// the reply was pending may be stamped after it: violations reported are
+// real, but clients pipelining are not all caught.
+func (in *SMTPIn) DetectProtocolViolations() {
+	if in.detectingViolations {
+		return
+	}
+	in.detectingViolations = true
+	in.OnLinkGreeting(protocolGreetingCb)
+	in.OnProtocolClient(protocolClientCb)
+	in.OnProtocolServer(protocolServerCb)
+	in.OnLinkDisconnect(protocolDisconnectCb)
+}
+
+// Violations returns the protocol violations of the session so far, it
+// is always empty unless DetectProtocolViolations was called.
+func (s Session) Violations() []Violation {
+	protocolSessionsMtx.Lock()
+	defer protocolSessionsMtx.Unlock()
+	if state, ok := protocolSessions[s]; ok {
+		return append([]Violation{}, state.violations...)
+	}
+	return nil
+}
+
+// protocolSession must be called with the lock held.
+func protocolSession(sessionId Session) *protocolState {
+	state, ok := protocolSessions[sessionId]
+	if !ok {
+		state = &protocolState{}
+		protocolSessions[sessionId] = state
+	}
+	return state
+}
+
+func protocolGreetingCb(timestamp time.Time, sessionId Session, hostname string) {
+	protocolSessionsMtx.Lock()
+	defer protocolSessionsMtx.Unlock()
+	state := protocolSession(sessionId)
+	state.greeted = true
+	state.greeting = timestamp
+}
+
+func protocolClientCb(timestamp time.Time, sessionId Session, command string) {
+	verb, _, _ := strings.Cut(command, " ")
+	verb = strings.ToUpper(verb)
+
+	protocolSessionsMtx.Lock()
+	defer protocolSessionsMtx.Unlock()
+	state := protocolSession(sessionId)
+
+	switch {
+	case !state.greeted || timestamp.Before(state.greeting):
+		state.violations = append(state.violations, Violation{Kind: EarlyTalker, Verb: verb, Timestamp: timestamp})
+	case state.pending > 0 || timestamp.Before(state.replied):
+		if !state.pipelining || groupEnders[state.previous] {
+			state.violations = append(state.violations, Violation{Kind: Pipelining, Verb: verb, Timestamp: timestamp})
+		}
+	}
+
+	// extensions must be advertised again after EHLO, HELO and STARTTLS
+	if verb == "EHLO" || verb == "HELO" || verb == "STARTTLS" {
+		state.pipelining = false
+	}
+	state.pending++
+	state.previous = verb
+}
+
+func protocolServerCb(timestamp time.Time, sessionId Session, response string) {
+	protocolSessionsMtx.Lock()
+	defer protocolSessionsMtx.Unlock()
+	state := protocolSession(sessionId)
+
+	if len(response) > 4 && strings.EqualFold(strings.TrimSpace(response[4:]), "PIPELINING") && state.previous == "EHLO" {
+		state.pipelining = true
+	}
+
+	// only the last line of a multiline reply completes it
+	if len(response) > 3 && response[3] == '-' {
+		return
+	}
+	if state.pending > 0 {
+		state.pending--
+	}
+	state.replied = timestamp
+}
+
+func protocolDisconnectCb(timestamp time.Time, sessionId Session) {
+	protocolSessionsMtx.Lock()
+	defer protocolSessionsMtx.Unlock()
+	delete(protocolSessions, sessionId)
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtocolViolations(t *testing.T) {
+	type event struct {
+		kind  string // "greeting", "client" or "server"
+		at    int    // milliseconds into the session
+		value string
+	}
+	ehlo := []event{
+		{"greeting", 0, "mx.example.org"},
+		{"client", 10, "EHLO client.example.com"},
+		{"server", 11, "250-mx.example.org Hello"},
+		{"server", 11, "250-PIPELINING"},
+		{"server", 11, "250 HELP"},
+	}
+	helo := []event{
+		{"greeting", 0, "mx.example.org"},
+		{"client", 10, "HELO client.example.com"},
+		{"server", 11, "250 mx.example.org Hello"},
+	}
+	tests := []struct {
+		name   string
+		events []event
+		want   []Violation
+	}{
+		{"clean", append(ehlo,
+			event{"client", 20, "MAIL FROM:<a@example.com>"},
+			event{"server", 21, "250 Ok"},
+			event{"client", 30, "RCPT TO:<b@example.org>"},
+			event{"server", 31, "250 Ok"},
+			event{"client", 40, "DATA"},
+			event{"server", 41, "354 Enter mail"},
+		), []Violation{}},
+		{"pipelined group", append(ehlo,
+			event{"client", 20, "MAIL FROM:<a@example.com>"},
+			event{"client", 20, "RCPT TO:<b@example.org>"},
+			event{"client", 20, "DATA"},
+			event{"server", 21, "250 Ok"},
+			event{"server", 21, "250 Ok"},
+			event{"server", 21, "354 Enter mail"},
+		), []Violation{}},
+		{"early talker", []event{
+			{"client", 0, "EHLO client.example.com"},
+			{"greeting", 5, "mx.example.org"},
+		}, []Violation{{Kind: EarlyTalker, Verb: "EHLO"}}},
+		{"early talker stamped before greeting", []event{
+			{"greeting", 5, "mx.example.org"},
+			{"client", 0, "EHLO client.example.com"},
+		}, []Violation{{Kind: EarlyTalker, Verb: "EHLO"}}},
+		{"not advertised", append(helo,
+			event{"client", 20, "MAIL FROM:<a@example.com>"},
+			event{"client", 20, "RCPT TO:<b@example.org>"},
+			event{"server", 21, "250 Ok"},
+			event{"server", 21, "250 Ok"},
+		), []Violation{{Kind: Pipelining, Verb: "RCPT"}}},
+		{"stamped before reply", append(helo,
+			event{"client", 20, "MAIL FROM:<a@example.com>"},
+			event{"server", 25, "250 Ok"},
+			event{"client", 22, "RCPT TO:<b@example.org>"},
+			event{"server", 26, "250 Ok"},
+		), []Violation{{Kind: Pipelining, Verb: "RCPT"}}},
+		{"after group ender", append(ehlo,
+			event{"client", 20, "NOOP"},
+			event{"client", 20, "MAIL FROM:<a@example.com>"},
+			event{"server", 21, "250 Ok"},
+			event{"server", 21, "250 Ok"},
+		), []Violation{{Kind: Pipelining, Verb: "MAIL"}}},
+		{"after ehlo", append(ehlo[:2:2],
+			event{"client", 10, "MAIL FROM:<a@example.com>"},
+			event{"server", 11, "250-mx.example.org Hello"},
+			event{"server", 11, "250-PIPELINING"},
+			event{"server", 11, "250 HELP"},
+			event{"server", 11, "250 Ok"},
+		), []Violation{{Kind: Pipelining, Verb: "MAIL"}}},
+		{"not advertised again after starttls", append(ehlo,
+			event{"client", 20, "STARTTLS"},
+			event{"server", 21, "220 Ready"},
+			event{"client", 30, "MAIL FROM:<a@example.com>"},
+			event{"client", 30, "RCPT TO:<b@example.org>"},
+			event{"server", 31, "250 Ok"},
+			event{"server", 31, "250 Ok"},
+		), []Violation{{Kind: Pipelining, Verb: "RCPT"}}},
+	}
+
+	start := time.Unix(1700000000, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := Session{"1"}
+			defer protocolDisconnectCb(start, s)
+			for _, e := range test.events {
+				timestamp := start.Add(time.Duration(e.at) * time.Millisecond)
+				switch e.kind {
+				case "greeting":
+					protocolGreetingCb(timestamp, s, e.value)
+				case "client":
+					protocolClientCb(timestamp, s, e.value)
+				case "server":
+					protocolServerCb(timestamp, s, e.value)
+				}
+			}
+
+			got := s.Violations()
+			if len(got) != len(test.want) {
+				t.Fatalf("violations %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i].Kind != test.want[i].Kind || got[i].Verb != test.want[i].Verb {
+					t.Errorf("violations %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+
+	s := Session{"1"}
+	protocolClientCb(start, s, "EHLO client.example.com")
+	protocolDisconnectCb(start, s)
+	if got := s.Violations(); got != nil {
+		t.Errorf("violations %v after disconnect, want none", got)
+	}
+}
@@ -0,0 +1,122 @@
+package publicsuffix
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+//go:embed public_suffix_list.dat
+var embedded string
+
+type ruleKind int
+
+const (
+	ruleNormal    ruleKind = 0
+	ruleWildcard  ruleKind = iota
+	ruleException ruleKind = iota
+)
+
+// List is a parsed Public Suffix List (https://publicsuffix.org/).
+type List struct {
+	rules map[string]ruleKind
+}
+
+// Parse reads a list in the publicsuffix.org format. Unicode rules are
+// converted to A-labels so that they match the names found in DNS.
+func Parse(r io.Reader) (*List, error) {
+	l := &List{rules: make(map[string]ruleKind)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+
+		kind := ruleNormal
+		if strings.HasPrefix(line, "!") {
+			kind, line = ruleException, line[1:]
+		} else if strings.HasPrefix(line, "*.") {
+			kind, line = ruleWildcard, line[2:]
+		}
+		l.rules[toASCII(strings.ToLower(line))] = kind
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func Load(path string) (*List, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return Parse(fp)
+}
+
+var defaultList *List
+var defaultListOnce sync.Once
+
+// Default returns the list embedded at build time.
+func Default() *List {
+	defaultListOnce.Do(func() {
+		defaultList, _ = Parse(strings.NewReader(embedded))
+	})
+	return defaultList
+}
+
+// PublicSuffix returns the public suffix of domain, using the implicit
+// "*" rule when no rule matches.
+func (l *List) PublicSuffix(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if kind, ok := l.rules[candidate]; ok {
+			switch kind {
+			case ruleException:
+				return strings.Join(labels[i+1:], ".")
+			case ruleNormal:
+				return candidate
+			}
+		}
+		if i+1 < len(labels) {
+			if kind, ok := l.rules[strings.Join(labels[i+1:], ".")]; ok && kind == ruleWildcard {
+				return candidate
+			}
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// OrganizationalDomain returns the public suffix of domain plus one label,
+// as defined by DMARC (RFC 7489, section 3.2). A domain that is itself a
+// public suffix is returned unchanged.
+func (l *List) OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix := l.PublicSuffix(domain)
+	if domain == suffix {
+		return domain
+	}
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest + "." + suffix
+}
+
+func PublicSuffix(domain string) string {
+	return Default().PublicSuffix(domain)
+}
+
+func OrganizationalDomain(domain string) string {
+	return Default().OrganizationalDomain(domain)
+}
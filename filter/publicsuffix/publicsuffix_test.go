@@ -0,0 +1,53 @@
+package publicsuffix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		suffix string
+		org    string
+	}{
+		{"example.com", "com", "example.com"},
+		{"mail.example.com", "com", "example.com"},
+		{"a.b.example.co.uk", "co.uk", "example.co.uk"},
+		{"co.uk", "co.uk", "co.uk"},
+		{"Mail.Example.COM.", "com", "example.com"},
+		{"www.example.foo.ck", "foo.ck", "example.foo.ck"},
+		{"www.ck", "ck", "www.ck"},
+		{"a.city.kawasaki.jp", "kawasaki.jp", "city.kawasaki.jp"},
+		{"a.b.other.kawasaki.jp", "other.kawasaki.jp", "b.other.kawasaki.jp"},
+		{"user.github.io", "github.io", "user.github.io"},
+		{"www.example.xn--55qx5d.cn", "xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+		{"example.unlisted", "unlisted", "example.unlisted"},
+	}
+	for _, tt := range tests {
+		if got := PublicSuffix(tt.domain); got != tt.suffix {
+			t.Errorf("PublicSuffix(%q) = %q, want %q", tt.domain, got, tt.suffix)
+		}
+		if got := OrganizationalDomain(tt.domain); got != tt.org {
+			t.Errorf("OrganizationalDomain(%q) = %q, want %q", tt.domain, got, tt.org)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	l, err := Parse(strings.NewReader("// comment\n\nexample\n*.wild.example\n!keep.wild.example\nbücher.example extra\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"a.b.example":             "b.example",
+		"a.b.wild.example":        "a.b.wild.example",
+		"a.keep.wild.example":     "keep.wild.example",
+		"a.xn--bcher-kva.example": "a.xn--bcher-kva.example",
+	}
+	for domain, want := range tests {
+		if got := l.OrganizationalDomain(domain); got != want {
+			t.Errorf("OrganizationalDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
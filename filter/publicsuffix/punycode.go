@@ -0,0 +1,109 @@
+package publicsuffix
+
+import (
+	"strings"
+)
+
+// Punycode parameters from RFC 3492, section 5.
+const (
+	base        = 36
+	tmin        = 1
+	tmax        = 26
+	skew        = 38
+	damp        = 700
+	initialBias = 72
+	initialN    = 128
+)
+
+func adapt(delta int, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
+
+func encodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycode encodes a single label as per RFC 3492.
+func punycode(label string) string {
+	runes := []rune(label)
+	var b strings.Builder
+	for _, r := range runes {
+		if r < 0x80 {
+			b.WriteRune(r)
+		}
+	}
+	basic := b.Len()
+	handled := basic
+	if basic > 0 {
+		b.WriteByte('-')
+	}
+
+	n, delta, bias := initialN, 0, initialBias
+	for handled < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				b.WriteByte(encodeDigit(t + (q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			b.WriteByte(encodeDigit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return b.String()
+}
+
+// toASCII converts the non-ASCII labels of a domain to their xn-- form.
+func toASCII(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		for _, r := range label {
+			if r >= 0x80 {
+				labels[i] = "xn--" + punycode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit is a rate of Count events Per duration, also allowing bursts of
+// Count events. The zero Limit is disabled.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Count > 0 && l.Per > 0
+}
+
+func (l Limit) rate() float64 {
+	return float64(l.Count) / l.Per.Seconds()
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets is a set of token buckets sharing a limit, keyed by client
+// address, user or domain.
+type buckets struct {
+	limit     Limit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newBuckets(limit Limit) *buckets {
+	return &buckets{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+func (b *buckets) refill(key string, now time.Time) *bucket {
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: float64(b.limit.Count), last: now}
+		b.buckets[key] = bk
+		return bk
+	}
+	if elapsed := now.Sub(bk.last).Seconds(); elapsed > 0 {
+		bk.tokens = math.Min(float64(b.limit.Count), bk.tokens+elapsed*b.limit.rate())
+		bk.last = now
+	}
+	return bk
+}
+
+// allow reports whether a token is available for key without taking it,
+// or how long until one is.
+func (b *buckets) allow(key string, now time.Time) (bool, time.Duration) {
+	if !b.limit.enabled() {
+		return true, 0
+	}
+	b.sweep(now)
+	bk := b.refill(key, now)
+	if bk.tokens >= 1 {
+		return true, 0
+	}
+	wait := (1 - bk.tokens) / b.limit.rate()
+	return false, time.Duration(math.Ceil(wait)) * time.Second
+}
+
+// take consumes n tokens for key, possibly going into debt when events
+// were accounted for after being allowed.
+func (b *buckets) take(key string, now time.Time, n int) {
+	if !b.limit.enabled() {
+		return
+	}
+	bk := b.refill(key, now)
+	bk.tokens -= float64(n)
+}
+
+// sweep drops the buckets that have refilled, as they are equivalent to
+// a missing one, at most once per limit period.
+func (b *buckets) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.limit.Per {
+		return
+	}
+	b.lastSweep = now
+	for key, bk := range b.buckets {
+		if bk.tokens+now.Sub(bk.last).Seconds()*b.limit.rate() >= float64(b.limit.Count) {
+			delete(b.buckets, key)
+		}
+	}
+}
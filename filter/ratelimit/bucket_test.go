@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := newBuckets(Limit{Count: 2, Per: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.allow("a", start); !ok {
+			t.Fatalf("event %d of the burst not allowed", i)
+		}
+		b.take("a", start, 1)
+	}
+	ok, wait := b.allow("a", start)
+	if ok {
+		t.Fatal("event beyond the burst allowed")
+	}
+	if wait != 30*time.Second {
+		t.Errorf("wait %s, want 30s", wait)
+	}
+	if ok, _ := b.allow("b", start); !ok {
+		t.Error("other key not allowed")
+	}
+
+	if ok, _ := b.allow("a", start.Add(29*time.Second)); ok {
+		t.Error("allowed before a token refilled")
+	}
+	if ok, _ := b.allow("a", start.Add(30*time.Second)); !ok {
+		t.Error("not allowed once a token refilled")
+	}
+
+	// refilling stops at the burst size
+	later := start.Add(time.Hour)
+	b.take("a", later, 2)
+	if ok, _ := b.allow("a", later); ok {
+		t.Error("refilled beyond the burst size")
+	}
+}
+
+func TestBucketsDebt(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := newBuckets(Limit{Count: 1, Per: time.Minute})
+
+	b.take("a", start, 3)
+	ok, wait := b.allow("a", start)
+	if ok || wait != 3*time.Minute {
+		t.Errorf("allow = %v, %s, want false, 3m", ok, wait)
+	}
+	if ok, _ := b.allow("a", start.Add(3*time.Minute)); !ok {
+		t.Error("not allowed once the debt was paid")
+	}
+}
+
+func TestBucketsDisabled(t *testing.T) {
+	b := newBuckets(Limit{})
+	now := time.Unix(1700000000, 0)
+	b.take("a", now, 100)
+	if ok, _ := b.allow("a", now); !ok {
+		t.Error("disabled limit not allowed")
+	}
+}
+
+func TestBucketsSweep(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := newBuckets(Limit{Count: 2, Per: time.Minute})
+	b.take("a", start, 1)
+	b.take("b", start.Add(time.Minute), 2)
+
+	b.allow("c", start.Add(90*time.Second))
+	if _, ok := b.buckets["a"]; ok {
+		t.Error("refilled bucket not swept")
+	}
+	if _, ok := b.buckets["b"]; !ok {
+		t.Error("bucket still refilling swept")
+	}
+}
@@ -0,0 +1,268 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type session struct {
+	ip        string
+	prefix    string
+	connected bool
+	user      string
+	domain    string
+}
+
+type Limiter struct {
+	// MaxConnections and MaxPrefixConnections bound the concurrent
+	// connections per address and per prefix, zero is unlimited.
+	MaxConnections       int
+	MaxPrefixConnections int
+
+	// IPv4Mask and IPv6Mask are the prefix lengths grouping addresses for
+	// MaxPrefixConnections.
+	IPv4Mask int
+	IPv6Mask int
+
+	// ConnectionRate limits new connections per address.
+	ConnectionRate Limit
+
+	// MessageRate, UserMessageRate and DomainMessageRate limit committed
+	// messages per address, authenticated user and sender domain.
+	MessageRate       Limit
+	UserMessageRate   Limit
+	DomainMessageRate Limit
+
+	// RecipientRate, UserRecipientRate and DomainRecipientRate limit
+	// accepted recipients per address, authenticated user and sender
+	// domain.
+	RecipientRate       Limit
+	UserRecipientRate   Limit
+	DomainRecipientRate Limit
+
+	connections map[string]int
+
+	connectionRate      *buckets
+	messageRate         *buckets
+	userMessageRate     *buckets
+	domainMessageRate   *buckets
+	recipientRate       *buckets
+	userRecipientRate   *buckets
+	domainRecipientRate *buckets
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		IPv4Mask:    24,
+		IPv6Mask:    64,
+		connections: make(map[string]int),
+		sessions:    make(map[filter.Session]*session),
+	}
+}
+
+// Register hooks the limiter, limits must be set before as they are not
+// read afterwards.
+func (l *Limiter) Register(in *filter.SMTPIn) {
+	l.connectionRate = newBuckets(l.ConnectionRate)
+	l.messageRate = newBuckets(l.MessageRate)
+	l.userMessageRate = newBuckets(l.UserMessageRate)
+	l.domainMessageRate = newBuckets(l.DomainMessageRate)
+	l.recipientRate = newBuckets(l.RecipientRate)
+	l.userRecipientRate = newBuckets(l.UserRecipientRate)
+	l.domainRecipientRate = newBuckets(l.DomainRecipientRate)
+
+	in.OnLinkConnect(l.linkConnectCb)
+	in.OnLinkAuth(l.linkAuthCb)
+	in.OnLinkDisconnect(l.linkDisconnectCb)
+	in.OnTxRcpt(l.txRcptCb)
+	in.OnTxCommit(l.txCommitCb)
+	in.ConnectRequest(l.connectCb)
+	in.MailFromRequest(l.mailFromCb)
+	in.RcptToRequest(l.rcptToCb)
+}
+
+func (l *Limiter) prefix(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(l.IPv4Mask, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(l.IPv6Mask, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// session must be called with the lock held.
+func (l *Limiter) session(sessionId filter.Session) *session {
+	sess, ok := l.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		l.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+// setAddress must be called with the lock held.
+func (l *Limiter) setAddress(sess *session, src net.Addr) bool {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	sess.ip = addr.IP.String()
+	sess.prefix = l.prefix(addr.IP)
+	return true
+}
+
+func (l *Limiter) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	sess := l.session(sessionId)
+	if sess.connected || !l.setAddress(sess, src) {
+		return
+	}
+	sess.connected = true
+	l.connections["ip|"+sess.ip]++
+	l.connections["prefix|"+sess.prefix]++
+}
+
+func (l *Limiter) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	if result != "pass" {
+		return
+	}
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	l.session(sessionId).user = username
+}
+
+func (l *Limiter) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	if sess, ok := l.sessions[sessionId]; ok && sess.connected {
+		for _, key := range []string{"ip|" + sess.ip, "prefix|" + sess.prefix} {
+			if l.connections[key]--; l.connections[key] <= 0 {
+				delete(l.connections, key)
+			}
+		}
+	}
+	delete(l.sessions, sessionId)
+}
+
+func senderDomain(from string) string {
+	from, _ = message.SplitParam(from)
+	if _, domain, found := strings.Cut(from, "@"); found {
+		return strings.ToLower(domain)
+	}
+	return ""
+}
+
+// account takes n tokens for each scope of the session.
+func (l *Limiter) account(sess *session, now time.Time, n int, ip *buckets, user *buckets, domain *buckets) {
+	if sess.ip != "" {
+		ip.take(sess.ip, now, n)
+	}
+	if sess.user != "" {
+		user.take(sess.user, now, n)
+	}
+	if sess.domain != "" {
+		domain.take(sess.domain, now, n)
+	}
+}
+
+func (l *Limiter) txRcptCb(timestamp time.Time, sessionId filter.Session, messageId string, result string, to string) {
+	if result != "ok" {
+		return
+	}
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	l.account(l.session(sessionId), timestamp, 1, l.recipientRate, l.userRecipientRate, l.domainRecipientRate)
+}
+
+func (l *Limiter) txCommitCb(timestamp time.Time, sessionId filter.Session, messageId string, messageSize int) {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	l.account(l.session(sessionId), timestamp, 1, l.messageRate, l.userMessageRate, l.domainMessageRate)
+}
+
+func retryHint(wait time.Duration) string {
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("try again in %d seconds", int(wait.Round(time.Second).Seconds()))
+}
+
+func (l *Limiter) connectCb(timestamp time.Time, sessionId filter.Session, rdns string, src net.Addr) filter.Response {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	sess := l.session(sessionId)
+	if !l.setAddress(sess, src) {
+		return filter.Proceed()
+	}
+
+	// the link-connect report may already have counted this session
+	self := 0
+	if sess.connected {
+		self = 1
+	}
+	if l.MaxConnections != 0 && l.connections["ip|"+sess.ip]-self >= l.MaxConnections {
+		return filter.Disconnect(fmt.Sprintf("421 4.7.0 Too many connections from %s, try again later", sess.ip))
+	}
+	if l.MaxPrefixConnections != 0 && l.connections["prefix|"+sess.prefix]-self >= l.MaxPrefixConnections {
+		return filter.Disconnect(fmt.Sprintf("421 4.7.0 Too many connections from %s, try again later", sess.prefix))
+	}
+	if ok, wait := l.connectionRate.allow(sess.ip, timestamp); !ok {
+		return filter.Disconnect(fmt.Sprintf("421 4.7.0 Connection rate limit exceeded for %s, %s", sess.ip, retryHint(wait)))
+	}
+	l.connectionRate.take(sess.ip, timestamp, 1)
+	return filter.Proceed()
+}
+
+// check returns a tempfail naming the first exhausted scope of the
+// session, or nil.
+func (l *Limiter) check(sess *session, now time.Time, what string, ip *buckets, user *buckets, domain *buckets) filter.Response {
+	scopes := []struct {
+		buckets *buckets
+		key     string
+		name    string
+	}{
+		{ip, sess.ip, "address " + sess.ip},
+		{user, sess.user, "user " + sess.user},
+		{domain, sess.domain, "domain " + sess.domain},
+	}
+	for _, scope := range scopes {
+		if scope.key == "" {
+			continue
+		}
+		if ok, wait := scope.buckets.allow(scope.key, now); !ok {
+			return filter.Reject(fmt.Sprintf("451 4.7.1 %s rate limit exceeded for %s, %s", what, scope.name, retryHint(wait)))
+		}
+	}
+	return nil
+}
+
+func (l *Limiter) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	sess := l.session(sessionId)
+	sess.domain = senderDomain(from)
+	if res := l.check(sess, timestamp, "Message", l.messageRate, l.userMessageRate, l.domainMessageRate); res != nil {
+		return res
+	}
+	return filter.Proceed()
+}
+
+func (l *Limiter) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	sess := l.session(sessionId)
+	if res := l.check(sess, timestamp, "Recipient", l.recipientRate, l.userRecipientRate, l.domainRecipientRate); res != nil {
+		return res
+	}
+	return filter.Proceed()
+}
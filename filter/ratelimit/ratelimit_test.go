@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// runSession runs a session from ip, authenticated as user when set, with one
+// transaction from sender to each recipient. It returns the first response
+// other than proceed.
+func runSession(l *Limiter, now time.Time, ip string, user string, sender string, recipients ...string) filter.Response {
+	s := filter.Session{}
+	src := &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}
+	l.linkConnectCb(now, s, "", "", src, nil)
+	defer l.linkDisconnectCb(now, s)
+	if res := l.connectCb(now, s, "", src); res != filter.Proceed() {
+		return res
+	}
+	if user != "" {
+		l.linkAuthCb(now, s, "pass", user)
+	}
+
+	if res := l.mailFromCb(now, s, "<"+sender+">"); res != filter.Proceed() {
+		return res
+	}
+	for _, rcpt := range recipients {
+		if res := l.rcptToCb(now, s, "<"+rcpt+">"); res != filter.Proceed() {
+			return res
+		}
+		l.txRcptCb(now, s, "1", "ok", rcpt)
+	}
+	l.txCommitCb(now, s, "1", 1024)
+	return filter.Proceed()
+}
+
+func newLimiter(configure func(l *Limiter)) *Limiter {
+	l := NewLimiter()
+	configure(l)
+	l.Register(&filter.SMTPIn{})
+	return l
+}
+
+func TestMessageRate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	hour := Limit{Count: 2, Per: time.Hour}
+
+	tests := []struct {
+		name      string
+		configure func(l *Limiter)
+		first     [3]string // ip, user, sender of the first two sessions
+		third     [3]string
+		limited   string
+	}{
+		{"address", func(l *Limiter) { l.MessageRate = hour },
+			[3]string{"192.0.2.1", "", "a@example.com"}, [3]string{"192.0.2.1", "", "b@example.net"}, "address 192.0.2.1"},
+		{"other address", func(l *Limiter) { l.MessageRate = hour },
+			[3]string{"192.0.2.1", "", "a@example.com"}, [3]string{"192.0.2.2", "", "a@example.com"}, ""},
+		{"user", func(l *Limiter) { l.UserMessageRate = hour },
+			[3]string{"192.0.2.1", "alice", "a@example.com"}, [3]string{"198.51.100.1", "alice", "b@example.net"}, "user alice"},
+		{"other user", func(l *Limiter) { l.UserMessageRate = hour },
+			[3]string{"192.0.2.1", "alice", "a@example.com"}, [3]string{"192.0.2.1", "bob", "a@example.com"}, ""},
+		{"unauthenticated", func(l *Limiter) { l.UserMessageRate = hour },
+			[3]string{"192.0.2.1", "", "a@example.com"}, [3]string{"192.0.2.1", "", "a@example.com"}, ""},
+		{"domain", func(l *Limiter) { l.DomainMessageRate = hour },
+			[3]string{"192.0.2.1", "", "a@example.com"}, [3]string{"198.51.100.1", "", "b@EXAMPLE.com"}, "domain example.com"},
+		{"other domain", func(l *Limiter) { l.DomainMessageRate = hour },
+			[3]string{"192.0.2.1", "", "a@example.com"}, [3]string{"192.0.2.1", "", "a@example.net"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLimiter(test.configure)
+			for i := 0; i < 2; i++ {
+				if res := runSession(l, start, test.first[0], test.first[1], test.first[2], "rcpt@example.org"); res != filter.Proceed() {
+					t.Fatalf("session %d: %#v", i, res)
+				}
+			}
+			res := runSession(l, start, test.third[0], test.third[1], test.third[2], "rcpt@example.org")
+			if test.limited == "" {
+				if res != filter.Proceed() {
+					t.Errorf("third session: %#v, want proceed", res)
+				}
+				return
+			}
+			want := filter.Reject("451 4.7.1 Message rate limit exceeded for " + test.limited + ", try again in 1800 seconds")
+			if res != want {
+				t.Errorf("third session: %#v, want %#v", res, want)
+			}
+
+			// a token refilled half an hour later
+			if res := runSession(l, start.Add(30*time.Minute), test.third[0], test.third[1], test.third[2], "rcpt@example.org"); res != filter.Proceed() {
+				t.Errorf("session after refill: %#v, want proceed", res)
+			}
+		})
+	}
+}
+
+func TestRecipientRate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := newLimiter(func(l *Limiter) {
+		l.UserRecipientRate = Limit{Count: 3, Per: time.Hour}
+	})
+
+	if res := runSession(l, start, "192.0.2.1", "alice", "a@example.com", "b@example.org", "c@example.org"); res != filter.Proceed() {
+		t.Fatalf("first session: %#v", res)
+	}
+	res := runSession(l, start, "192.0.2.1", "alice", "a@example.com", "d@example.org", "e@example.org")
+	want := filter.Reject("451 4.7.1 Recipient rate limit exceeded for user alice, try again in 1200 seconds")
+	if res != want {
+		t.Errorf("second session: %#v, want %#v", res, want)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := newLimiter(func(l *Limiter) {
+		l.MaxConnections = 1
+		l.MaxPrefixConnections = 2
+	})
+
+	if res := runSession(l, start, "192.0.2.1", "", "a@example.com"); res != filter.Proceed() {
+		t.Fatalf("single connection: %#v", res)
+	}
+	if len(l.connections) != 0 {
+		t.Errorf("connections %v left after disconnect", l.connections)
+	}
+
+	// another session from the address is connected
+	l.connections["ip|192.0.2.1"]++
+	l.connections["prefix|192.0.2.0/24"]++
+	want := filter.Disconnect("421 4.7.0 Too many connections from 192.0.2.1, try again later")
+	if res := runSession(l, start, "192.0.2.1", "", "a@example.com"); res != want {
+		t.Errorf("second connection: %#v, want %#v", res, want)
+	}
+	if res := runSession(l, start, "192.0.2.2", "", "a@example.com"); res != filter.Proceed() {
+		t.Errorf("connection from the prefix: %#v, want proceed", res)
+	}
+
+	l.connections["ip|192.0.2.3"]++
+	l.connections["prefix|192.0.2.0/24"]++
+	want = filter.Disconnect("421 4.7.0 Too many connections from 192.0.2.0/24, try again later")
+	if res := runSession(l, start, "192.0.2.4", "", "a@example.com"); res != want {
+		t.Errorf("third connection from the prefix: %#v, want %#v", res, want)
+	}
+}
+
+func TestConnectionRate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := newLimiter(func(l *Limiter) {
+		l.ConnectionRate = Limit{Count: 1, Per: time.Minute}
+	})
+
+	if res := runSession(l, start, "192.0.2.1", "", "a@example.com"); res != filter.Proceed() {
+		t.Fatalf("first connection: %#v", res)
+	}
+	want := filter.Disconnect("421 4.7.0 Connection rate limit exceeded for 192.0.2.1, try again in 60 seconds")
+	if res := runSession(l, start, "192.0.2.1", "", "a@example.com"); res != want {
+		t.Errorf("second connection: %#v, want %#v", res, want)
+	}
+	if res := runSession(l, start.Add(time.Minute), "192.0.2.1", "", "a@example.com"); res != filter.Proceed() {
+		t.Errorf("connection after refill: %#v, want proceed", res)
+	}
+}
+
+func TestSenderDomain(t *testing.T) {
+	tests := map[string]string{
+		"<a@Example.COM>":                         "example.com",
+		"<a@example.com> SIZE=1024 BODY=8BITMIME": "example.com",
+		"<a@example.com> SIZE=1024":               "example.com",
+		"<postmaster>":                            "",
+		"<>":                                      "",
+	}
+	for from, want := range tests {
+		if got := senderDomain(from); got != want {
+			t.Errorf("senderDomain(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/helo"
+)
+
+// Scorer, Check and Action are those of the helo module, so that both
+// modules are configured alike and can share a scorer.
+type Scorer = helo.Scorer
+type Check = helo.Check
+type Action = helo.Action
+
+const (
+	Missing      Check = "RDNS_NONE"
+	NotConfirmed Check = "RDNS_NOT_CONFIRMED"
+	Generic      Check = "RDNS_GENERIC"
+)
+
+const (
+	Ignore = helo.Ignore
+	Score  = helo.Score
+	Junk   = helo.Junk
+	Reject = helo.Reject
+)
+
+// Result is the interpretation of the reverse DNS data of a session.
+type Result struct {
+	// RDNS is the name the client address resolves to, empty if none.
+	RDNS string
+
+	// FCrDNS is "pass" when RDNS resolves back to the client address,
+	// "fail" when it does not and "error" when it could not be checked.
+	FCrDNS string
+
+	// Failed lists the checks that failed.
+	Failed []Check
+}
+
+// Has reports whether the result failed check.
+func (r *Result) Has(check Check) bool {
+	for _, c := range r.Failed {
+		if c == check {
+			return true
+		}
+	}
+	return false
+}
+
+type session struct {
+	src           net.IP
+	authenticated bool
+	result        *Result
+	scored        bool
+}
+
+type Checker struct {
+	// Actions maps failed checks to what is done about them, the most
+	// severe action of the failed checks applies.
+	Actions map[Check]Action
+
+	// Scorer receives hits of checks mapped to Score.
+	Scorer Scorer
+
+	// GenericPatterns match names of generic or dynamic PTR records,
+	// names embedding the client address are always considered generic.
+	GenericPatterns []*regexp.Regexp
+
+	// Exempt lists networks not checked, loopback addresses are always
+	// exempt.
+	Exempt []*net.IPNet
+
+	// SkipAuthenticated exempts sessions that successfully authenticated.
+	SkipAuthenticated bool
+
+	// AtConnect applies actions at connect instead of mail-from, which
+	// turns clients away earlier but cannot exempt sessions that
+	// authenticate later on.
+	AtConnect bool
+
+	// RejectResponse is returned for the Reject action, a response naming
+	// the failed check is built when nil.
+	RejectResponse filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+// DefaultGenericPatterns match common naming schemes of access networks:
+// the dynamic names of helo.DefaultDynamicPatterns, and the numbered or
+// hexadecimal names providers assign to any address, static ones included.
+var DefaultGenericPatterns = append(append([]*regexp.Regexp{}, helo.DefaultDynamicPatterns...),
+	regexp.MustCompile(`(?i)(^|[.-])(ip|host|static|unassigned|unknown)[.-]?[0-9]`),
+	regexp.MustCompile(`(?i)(^|[.-])[0-9a-f]{8}\.`),
+)
+
+func NewChecker() *Checker {
+	return &Checker{
+		Actions: map[Check]Action{
+			Missing:      Junk,
+			NotConfirmed: Score,
+			Generic:      Score,
+		},
+		GenericPatterns:   append([]*regexp.Regexp{}, DefaultGenericPatterns...),
+		SkipAuthenticated: true,
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+func (c *Checker) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(c.linkConnectCb)
+	in.OnLinkAuth(c.linkAuthCb)
+	in.OnLinkDisconnect(c.linkDisconnectCb)
+	if c.AtConnect {
+		in.ConnectRequest(c.connectCb)
+	} else {
+		in.MailFromRequest(c.mailFromCb)
+	}
+}
+
+// Result returns the reverse DNS result of the session, or nil if the
+// session is exempt.
+func (c *Checker) Result(sessionId filter.Session) *Result {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.result
+	}
+	return nil
+}
+
+// Check interprets the rdns and fcrdns values reported by link-connect
+// for a client at src.
+func (c *Checker) Check(rdns string, fcrdns string, src net.IP) *Result {
+	result := &Result{FCrDNS: fcrdns, Failed: make([]Check, 0)}
+	if rdns == "" || rdns == "<unknown>" {
+		result.Failed = append(result.Failed, Missing)
+		return result
+	}
+	result.RDNS = strings.ToLower(strings.TrimSuffix(rdns, "."))
+
+	// errors are temporary failures, not held against the client
+	if fcrdns == "fail" {
+		result.Failed = append(result.Failed, NotConfirmed)
+	}
+
+	generic := src != nil && helo.EmbedsAddress(result.RDNS, src)
+	for _, pattern := range c.GenericPatterns {
+		generic = generic || pattern.MatchString(result.RDNS)
+	}
+	if generic {
+		result.Failed = append(result.Failed, Generic)
+	}
+	return result
+}
+
+func (c *Checker) exempt(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+	for _, network := range c.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) session(sessionId filter.Session) *session {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess, ok := c.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		c.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (c *Checker) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok || c.exempt(addr.IP) {
+		return
+	}
+	sess := c.session(sessionId)
+	result := c.Check(rdns, fcrdns, addr.IP)
+
+	c.sessionsMtx.Lock()
+	sess.src = addr.IP
+	sess.result = result
+	c.sessionsMtx.Unlock()
+}
+
+func (c *Checker) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	c.session(sessionId).authenticated = result == "pass"
+}
+
+func (c *Checker) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	delete(c.sessions, sessionId)
+}
+
+// apply maps the failed checks of a session to a response, scoring them
+// once per session.
+func (c *Checker) apply(sessionId filter.Session, sess *session) filter.Response {
+	c.sessionsMtx.Lock()
+	result := sess.result
+	scored := sess.scored
+	sess.scored = true
+	c.sessionsMtx.Unlock()
+
+	if result == nil || (sess.authenticated && c.SkipAuthenticated) {
+		return filter.Proceed()
+	}
+
+	action := Ignore
+	var worst Check
+	for _, check := range result.Failed {
+		a := c.Actions[check]
+		if a == Score && c.Scorer != nil && !scored {
+			c.Scorer.AddSession(sessionId, string(check), result.RDNS)
+		}
+		if a > action {
+			action = a
+			worst = check
+		}
+	}
+
+	switch action {
+	case Reject:
+		if c.RejectResponse != nil {
+			return c.RejectResponse
+		}
+		switch worst {
+		case Missing:
+			return filter.Reject(fmt.Sprintf("550 5.7.25 Client %s has no reverse DNS", sess.src))
+		case NotConfirmed:
+			return filter.Reject(fmt.Sprintf("550 5.7.25 Reverse DNS %s of %s is not forward-confirmed", result.RDNS, sess.src))
+		}
+		return filter.Reject(fmt.Sprintf("550 5.7.1 Reverse DNS %s of %s looks generic", result.RDNS, sess.src))
+	case Junk:
+		return filter.Junk()
+	}
+	return filter.Proceed()
+}
+
+func (c *Checker) connectCb(timestamp time.Time, sessionId filter.Session, rdns string, src net.Addr) filter.Response {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok || c.exempt(addr.IP) {
+		return filter.Proceed()
+	}
+	sess := c.session(sessionId)
+	if sess.result == nil {
+		// link-connect not seen yet, forward confirmation is unknown
+		result := c.Check(rdns, "error", addr.IP)
+		c.sessionsMtx.Lock()
+		sess.src = addr.IP
+		sess.result = result
+		c.sessionsMtx.Unlock()
+	}
+	return c.apply(sessionId, sess)
+}
+
+func (c *Checker) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	return c.apply(sessionId, c.session(sessionId))
+}
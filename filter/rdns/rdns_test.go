@@ -0,0 +1,134 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+type scorer []string
+
+func (s *scorer) AddSession(sessionId filter.Session, name string, detail string) {
+	*s = append(*s, name)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		rdns   string
+		fcrdns string
+		src    string
+		want   []Check
+	}{
+		{"mx.example.org", "pass", "192.0.2.1", nil},
+		{"MX.Example.org.", "pass", "192.0.2.1", nil},
+		{"", "fail", "192.0.2.1", []Check{Missing}},
+		{"<unknown>", "fail", "192.0.2.1", []Check{Missing}},
+		{"mx.example.org", "fail", "192.0.2.1", []Check{NotConfirmed}},
+		{"mx.example.org", "error", "192.0.2.1", nil},
+		{"dynamic-12.isp.example", "pass", "192.0.2.1", []Check{Generic}},
+		{"static-45.isp.example", "pass", "192.0.2.1", []Check{Generic}},
+		{"c0000201.isp.example", "pass", "192.0.2.1", []Check{Generic}},
+		{"192-0-2-1.isp.example", "fail", "192.0.2.1", []Check{NotConfirmed, Generic}},
+		{"host1.example.org", "pass", "192.0.2.1", []Check{Generic}},
+		{"mail2.example.org", "pass", "192.0.2.1", nil},
+	}
+
+	c := NewChecker()
+	for _, test := range tests {
+		result := c.Check(test.rdns, test.fcrdns, net.ParseIP(test.src))
+		if len(result.Failed) != len(test.want) {
+			t.Errorf("Check(%q, %q) failed %v, want %v", test.rdns, test.fcrdns, result.Failed, test.want)
+			continue
+		}
+		for i := range test.want {
+			if result.Failed[i] != test.want[i] || !result.Has(test.want[i]) {
+				t.Errorf("Check(%q, %q) failed %v, want %v", test.rdns, test.fcrdns, result.Failed, test.want)
+			}
+		}
+	}
+}
+
+func TestMailFrom(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		rdns    string
+		fcrdns  string
+		src     string
+		auth    bool
+		actions map[Check]Action
+		want    filter.Response
+		scored  []string
+	}{
+		{"clean", "mx.example.org", "pass", "192.0.2.1", false, nil, filter.Proceed(), nil},
+		{"missing", "", "fail", "192.0.2.1", false, nil, filter.Junk(), nil},
+		{"scored", "dynamic-12.isp.example", "fail", "192.0.2.1", false, nil, filter.Proceed(), []string{"RDNS_NOT_CONFIRMED", "RDNS_GENERIC"}},
+		{"reject missing", "", "fail", "192.0.2.1", false, map[Check]Action{Missing: Reject},
+			filter.Reject("550 5.7.25 Client 192.0.2.1 has no reverse DNS"), nil},
+		{"reject not confirmed", "mx.example.org", "fail", "192.0.2.1", false, map[Check]Action{NotConfirmed: Reject},
+			filter.Reject("550 5.7.25 Reverse DNS mx.example.org of 192.0.2.1 is not forward-confirmed"), nil},
+		{"reject generic", "dynamic-12.isp.example", "pass", "192.0.2.1", false, map[Check]Action{Generic: Reject},
+			filter.Reject("550 5.7.1 Reverse DNS dynamic-12.isp.example of 192.0.2.1 looks generic"), nil},
+		{"most severe", "dynamic-12.isp.example", "fail", "192.0.2.1", false, map[Check]Action{NotConfirmed: Junk, Generic: Score},
+			filter.Junk(), []string{"RDNS_GENERIC"}},
+		{"authenticated", "", "fail", "192.0.2.1", true, nil, filter.Proceed(), nil},
+		{"loopback", "", "fail", "127.0.0.1", false, nil, filter.Proceed(), nil},
+		{"exempt", "", "fail", "198.51.100.1", false, nil, filter.Proceed(), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scored := &scorer{}
+			c := NewChecker()
+			c.Scorer = scored
+			_, exempt, _ := net.ParseCIDR("198.51.100.0/24")
+			c.Exempt = []*net.IPNet{exempt}
+			for check, action := range test.actions {
+				c.Actions[check] = action
+			}
+			s := filter.Session{}
+			c.linkConnectCb(start, s, test.rdns, test.fcrdns, &net.TCPAddr{IP: net.ParseIP(test.src), Port: 4242}, nil)
+			if test.auth {
+				c.linkAuthCb(start, s, "pass", "alice")
+			}
+
+			// scored once per session
+			for i := 0; i < 2; i++ {
+				if res := c.mailFromCb(start, s, "<a@example.com>"); res != test.want {
+					t.Errorf("mailFromCb = %#v, want %#v", res, test.want)
+				}
+			}
+			if len(*scored) != len(test.scored) {
+				t.Fatalf("scored %v, want %v", *scored, test.scored)
+			}
+			for i := range test.scored {
+				if (*scored)[i] != test.scored[i] {
+					t.Errorf("scored %v, want %v", *scored, test.scored)
+				}
+			}
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewChecker()
+	c.Actions[Missing] = Reject
+	c.RejectResponse = filter.Disconnect("421 go away")
+	s := filter.Session{}
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+
+	// the filter request may come before the link-connect report
+	if res := c.connectCb(start, s, "<unknown>", src); res != c.RejectResponse {
+		t.Errorf("connectCb = %#v, want %#v", res, c.RejectResponse)
+	}
+	if result := c.Result(s); result == nil || result.FCrDNS != "error" {
+		t.Errorf("result %+v, want an unconfirmed result", result)
+	}
+	c.linkDisconnectCb(start, s)
+	if result := c.Result(s); result != nil {
+		t.Errorf("result %+v after disconnect", result)
+	}
+}
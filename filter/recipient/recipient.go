@@ -0,0 +1,198 @@
+package recipient
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+	"github.com/poolpOrg/OpenSMTPD-framework/table"
+)
+
+// Recipient is the data available to the reject template.
+type Recipient struct {
+	Address string
+	User    string
+	Domain  string
+}
+
+type session struct {
+	authenticated bool
+}
+
+// Validator checks recipients at rcpt-to against a table backend, with the
+// lookup logic smtpd applies to tables.
+type Validator struct {
+	// Backend defaults to the table handlers registered in the same
+	// binary. NewValidator wraps it in Cache.
+	Backend table.Backend
+	Timeout time.Duration
+
+	// DomainTable, when set, is checked with K_DOMAIN for the recipient
+	// domain, recipients of other domains are not validated.
+	DomainTable string
+
+	// AliasTable is looked up with K_ALIAS for virtual users, as smtpd
+	// does: user+tag@domain, user@domain, user and @domain.
+	AliasTable string
+
+	// MailaddrTable is checked with K_MAILADDR for the recipient address.
+	MailaddrTable string
+
+	// Separator delimits the tag of a local part.
+	Separator string
+
+	// Cache remembers the table answers for 5 minutes, and the keys not
+	// found for a minute. Its TTLs may be changed, and it may be flushed
+	// when the tables are updated.
+	Cache *table.Cache
+
+	// SkipAuthenticated does not validate recipients of authenticated
+	// sessions, which mostly send to remote domains.
+	SkipAuthenticated bool
+
+	// RejectTemplate builds the response to unknown recipients from a
+	// Recipient.
+	RejectTemplate *template.Template
+
+	// TempfailResponse is returned when a table handler fails.
+	TempfailResponse filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+var DefaultRejectTemplate = template.Must(template.New("reject").Parse("550 5.1.1 <{{.Address}}>: Recipient address rejected: User unknown"))
+
+func NewValidator(backend table.Backend) *Validator {
+	if backend == nil {
+		backend = table.Handlers
+	}
+	cache := table.NewCache(backend, 5*time.Minute)
+	cache.NegativeTTL = time.Minute
+	return &Validator{
+		Backend:           cache,
+		Timeout:           5 * time.Second,
+		Separator:         "+",
+		Cache:             cache,
+		SkipAuthenticated: true,
+		RejectTemplate:    DefaultRejectTemplate,
+		TempfailResponse:  filter.Reject("451 4.3.0 Temporary lookup failure"),
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+func (v *Validator) Register(in *filter.SMTPIn) {
+	in.OnLinkAuth(v.linkAuthCb)
+	in.OnLinkDisconnect(v.linkDisconnectCb)
+	in.RcptToRequest(v.rcptToCb)
+}
+
+// Validate reports whether address is a known recipient, recipients of
+// domains not in DomainTable are always valid. So are all recipients when
+// neither AliasTable nor MailaddrTable is set, as there are no users to
+// validate them against.
+func (v *Validator) Validate(ctx context.Context, address string) (bool, error) {
+	if v.AliasTable == "" && v.MailaddrTable == "" {
+		return true, nil
+	}
+	address = strings.ToLower(address)
+	user, domain, _ := strings.Cut(address, "@")
+	if user == "postmaster" {
+		return true, nil
+	}
+
+	if v.DomainTable != "" {
+		ours, err := v.Backend.Check(ctx, table.K_DOMAIN, v.DomainTable, domain)
+		if err != nil {
+			return false, err
+		}
+		if !ours {
+			return true, nil
+		}
+	}
+
+	if v.MailaddrTable != "" {
+		found, err := v.Backend.Check(ctx, table.K_MAILADDR, v.MailaddrTable, address)
+		if err != nil || found {
+			return found, err
+		}
+	}
+
+	if v.AliasTable != "" {
+		bare := user
+		if v.Separator != "" {
+			bare, _, _ = strings.Cut(user, v.Separator)
+		}
+		keys := []string{address}
+		if bare != user {
+			keys = append(keys, bare+"@"+domain)
+		}
+		keys = append(keys, bare, "@"+domain)
+		for _, key := range keys {
+			value, err := v.Backend.Lookup(ctx, table.K_ALIAS, v.AliasTable, key)
+			if err != nil {
+				return false, err
+			}
+			if value != "" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (v *Validator) session(sessionId filter.Session) *session {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	sess, ok := v.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		v.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (v *Validator) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	v.session(sessionId).authenticated = result == "pass"
+}
+
+func (v *Validator) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	v.sessionsMtx.Lock()
+	defer v.sessionsMtx.Unlock()
+	delete(v.sessions, sessionId)
+}
+
+func (v *Validator) reject(address string) filter.Response {
+	user, domain, _ := strings.Cut(address, "@")
+	var sb strings.Builder
+	if err := v.RejectTemplate.Execute(&sb, Recipient{Address: address, User: user, Domain: domain}); err != nil {
+		log.Printf("recipient: reject template: %s", err)
+		return filter.Reject("550 5.1.1 Recipient address rejected: User unknown")
+	}
+	return filter.Reject(sb.String())
+}
+
+func (v *Validator) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	if v.session(sessionId).authenticated && v.SkipAuthenticated {
+		return filter.Proceed()
+	}
+	address, _ := message.SplitParam(to)
+	address = strings.ToLower(address)
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	valid, err := v.Validate(ctx, address)
+	cancel()
+	if err != nil {
+		log.Printf("%s: recipient: %s: %s", sessionId, address, err)
+		return v.TempfailResponse
+	}
+	if !valid {
+		return v.reject(address)
+	}
+	return filter.Proceed()
+}
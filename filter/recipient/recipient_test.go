@@ -0,0 +1,187 @@
+package recipient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/table"
+)
+
+// backend answers from maps of table to keys and values, lookups of keys
+// listed in fail return an error.
+type backend struct {
+	tables map[string]map[string]string
+	fail   map[string]bool
+	calls  int
+}
+
+func (b *backend) Check(ctx context.Context, service table.Service, name string, key string) (bool, error) {
+	value, err := b.Lookup(ctx, service, name, key)
+	return value != "", err
+}
+
+func (b *backend) Lookup(ctx context.Context, service table.Service, name string, key string) (string, error) {
+	b.calls++
+	if b.fail[key] {
+		return "", errors.New("table unavailable")
+	}
+	return b.tables[name][key], nil
+}
+
+func (b *backend) Fetch(ctx context.Context, service table.Service, name string) (string, error) {
+	return "", table.ErrNoHandler
+}
+
+func newBackend() *backend {
+	return &backend{
+		tables: map[string]map[string]string{
+			"domains": {
+				"example.com": "example.com",
+				"example.org": "example.org",
+			},
+			"virtuals": {
+				"alice@example.com": "alice",
+				"bob":               "bob",
+				"@example.org":      "catchall",
+			},
+			"addresses": {
+				"carol@example.com": "carol@example.com",
+			},
+		},
+		fail: map[string]bool{"broken@example.com": true},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+		err     bool
+	}{
+		{"alice@example.com", true, false},
+		{"Alice@Example.COM", true, false},
+		{"alice+news@example.com", true, false},
+		{"bob@example.com", true, false},
+		{"bob+tag+more@example.com", true, false},
+		{"carol@example.com", true, false},
+		{"anyone@example.org", true, false},
+		{"postmaster@example.com", true, false},
+		{"mallory@example.com", false, false},
+		{"mallory@remote.example", true, false},
+		{"broken@example.com", false, true},
+	}
+
+	v := NewValidator(newBackend())
+	v.DomainTable = "domains"
+	v.AliasTable = "virtuals"
+	v.MailaddrTable = "addresses"
+	for _, test := range tests {
+		valid, err := v.Validate(context.Background(), test.address)
+		if valid != test.valid || (err != nil) != test.err {
+			t.Errorf("Validate(%s) = %v, %v, want %v, error %v", test.address, valid, err, test.valid, test.err)
+		}
+	}
+}
+
+func TestValidateSeparator(t *testing.T) {
+	v := NewValidator(newBackend())
+	v.AliasTable = "virtuals"
+	v.Separator = ""
+	if valid, _ := v.Validate(context.Background(), "alice+news@example.com"); valid {
+		t.Error("tagged address valid without separator")
+	}
+	v.Separator = "-"
+	if valid, _ := v.Validate(context.Background(), "bob-news@example.com"); !valid {
+		t.Error("address tagged with - not valid")
+	}
+}
+
+func TestValidateNoUserTable(t *testing.T) {
+	b := newBackend()
+	v := NewValidator(b)
+	v.DomainTable = "domains"
+	if valid, err := v.Validate(context.Background(), "mallory@example.com"); !valid || err != nil {
+		t.Errorf("Validate without user tables = %v, %v, want valid", valid, err)
+	}
+	if b.calls != 0 {
+		t.Errorf("backend called %d times without user tables", b.calls)
+	}
+}
+
+func TestRcptToCb(t *testing.T) {
+	tests := []struct {
+		name string
+		to   string
+		auth bool
+		want filter.Response
+	}{
+		{"known", "<alice@example.com>", false, filter.Proceed()},
+		{"known with parameters", "<Alice@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;alice@example.com", false, filter.Proceed()},
+		{"unknown", "<mallory@example.com>", false, filter.Reject("550 5.1.1 <mallory@example.com>: Recipient address rejected: User unknown")},
+		{"unknown with parameters", "<mallory@example.com> NOTIFY=NEVER", false, filter.Reject("550 5.1.1 <mallory@example.com>: Recipient address rejected: User unknown")},
+		{"remote", "<mallory@remote.example>", false, filter.Proceed()},
+		{"tempfail", "<broken@example.com>", false, filter.Reject("451 4.3.0 Temporary lookup failure")},
+		{"authenticated", "<mallory@example.com>", true, filter.Proceed()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := NewValidator(newBackend())
+			v.DomainTable = "domains"
+			v.AliasTable = "virtuals"
+
+			sessionId := filter.Session{}
+			if test.auth {
+				v.linkAuthCb(time.Now(), sessionId, "pass", "user")
+			}
+			if got := v.rcptToCb(time.Now(), sessionId, test.to); got != test.want {
+				t.Errorf("response = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRejectTemplate(t *testing.T) {
+	v := NewValidator(newBackend())
+	v.DomainTable = "domains"
+	v.AliasTable = "virtuals"
+	v.RejectTemplate = template.Must(template.New("reject").Parse("550 5.1.1 No {{.User}} at {{.Domain}}"))
+	want := filter.Reject("550 5.1.1 No mallory at example.com")
+	if got := v.rcptToCb(time.Now(), filter.Session{}, "<mallory@example.com>"); got != want {
+		t.Errorf("response = %#v, want %#v", got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	b := newBackend()
+	v := NewValidator(b)
+	v.DomainTable = "domains"
+	v.AliasTable = "virtuals"
+
+	for _, to := range []string{"<alice@example.com>", "<mallory@example.com>"} {
+		v.rcptToCb(time.Now(), filter.Session{}, to)
+		calls := b.calls
+		v.rcptToCb(time.Now(), filter.Session{}, to)
+		if b.calls != calls {
+			t.Errorf("%s: backend called again, answers not cached", to)
+		}
+	}
+
+	v.rcptToCb(time.Now(), filter.Session{}, "<broken@example.com>")
+	calls := b.calls
+	v.rcptToCb(time.Now(), filter.Session{}, "<broken@example.com>")
+	if b.calls == calls {
+		t.Error("lookup error cached")
+	}
+
+	v.Cache.Flush()
+	calls = b.calls
+	v.rcptToCb(time.Now(), filter.Session{}, "<alice@example.com>")
+	if b.calls == calls {
+		t.Error("answers cached after Flush")
+	}
+}
@@ -0,0 +1,123 @@
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type Direction int
+
+const (
+	Sender Direction = iota
+	Recipient
+)
+
+func (d Direction) String() string {
+	if d == Sender {
+		return "sender"
+	}
+	return "recipient"
+}
+
+// Step is the change made to an address by a rule.
+type Step struct {
+	Rule string
+	From string
+	To   string
+}
+
+// Engine rewrites envelope senders at mail-from and recipients at rcpt-to
+// by running them through a chain of rules, in order.
+type Engine struct {
+	// DryRun logs what would be rewritten and lets the parameter through
+	// unchanged, so that the handlers registered after the engine still
+	// run.
+	DryRun bool
+
+	Timeout time.Duration
+
+	rules    map[Direction][]Rule
+	rulesMtx sync.Mutex
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		Timeout: 5 * time.Second,
+		rules:   make(map[Direction][]Rule),
+	}
+}
+
+// SetRules replaces the rules of a direction, it may be called while the
+// filter runs to reload them.
+func (e *Engine) SetRules(direction Direction, rules ...Rule) {
+	e.rulesMtx.Lock()
+	defer e.rulesMtx.Unlock()
+	e.rules[direction] = rules
+}
+
+func (e *Engine) Register(in *filter.SMTPIn) {
+	in.MailFromRequest(e.mailFromCb)
+	in.RcptToRequest(e.rcptToCb)
+}
+
+// Rewrite runs address through the rules of direction and returns the
+// result along with the steps that changed it, which is what a dry run
+// reports.
+func (e *Engine) Rewrite(ctx context.Context, direction Direction, address string) (string, []Step, error) {
+	e.rulesMtx.Lock()
+	rules := e.rules[direction]
+	e.rulesMtx.Unlock()
+
+	steps := make([]Step, 0)
+	for _, rule := range rules {
+		rewritten, err := rule.Apply(ctx, address)
+		if err != nil {
+			return address, steps, fmt.Errorf("%s: %w", rule.Name(), err)
+		}
+		if rewritten != address {
+			steps = append(steps, Step{Rule: rule.Name(), From: address, To: rewritten})
+			address = rewritten
+		}
+	}
+	return address, steps, nil
+}
+
+func (e *Engine) apply(sessionId filter.Session, direction Direction, param string) filter.Response {
+	address, rest := message.SplitParam(param)
+	if address == "" {
+		return filter.Proceed()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	rewritten, steps, err := e.Rewrite(ctx, direction, address)
+	cancel()
+	if err != nil {
+		log.Printf("%s: rewrite: %s %s: %s", sessionId, direction, address, err)
+		return filter.Proceed()
+	}
+	if len(steps) == 0 {
+		return filter.Proceed()
+	}
+
+	if e.DryRun {
+		for _, step := range steps {
+			log.Printf("%s: rewrite: dry-run: %s %s -> %s (%s)", sessionId, direction, step.From, step.To, step.Rule)
+		}
+		return filter.Proceed()
+	}
+	return filter.Rewrite("<" + rewritten + ">" + rest)
+}
+
+func (e *Engine) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	return e.apply(sessionId, Sender, from)
+}
+
+func (e *Engine) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	return e.apply(sessionId, Recipient, to)
+}
@@ -0,0 +1,118 @@
+package rewrite
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// Rule rewrites an address, returning it unchanged when it does not apply.
+type Rule interface {
+	Name() string
+	Apply(ctx context.Context, address string) (string, error)
+}
+
+func cutAddress(address string) (string, string) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return address, ""
+	}
+	return address[:i], address[i+1:]
+}
+
+func joinAddress(local string, domain string) string {
+	if domain == "" {
+		return local
+	}
+	return local + "@" + domain
+}
+
+// Lowercase lowercases the domain, and the local part if LocalPart is set
+// as local parts are case-sensitive in theory.
+type Lowercase struct {
+	LocalPart bool
+}
+
+func (r *Lowercase) Name() string {
+	return "lowercase"
+}
+
+func (r *Lowercase) Apply(ctx context.Context, address string) (string, error) {
+	local, domain := cutAddress(address)
+	if r.LocalPart {
+		local = strings.ToLower(local)
+	}
+	return joinAddress(local, strings.ToLower(domain)), nil
+}
+
+// StripSubaddress removes the subaddress of local parts, user+tag@domain
+// becomes user@domain.
+type StripSubaddress struct {
+	Separator string
+}
+
+func (r *StripSubaddress) Name() string {
+	return "strip-subaddress"
+}
+
+func (r *StripSubaddress) Apply(ctx context.Context, address string) (string, error) {
+	local, domain := cutAddress(address)
+	if i := strings.Index(local, r.Separator); r.Separator != "" && i > 0 {
+		local = local[:i]
+	}
+	return joinAddress(local, domain), nil
+}
+
+// Regexp replaces matches of Pattern in the address with Replacement, which
+// may refer to submatches as regexp.Regexp.ReplaceAllString does.
+type Regexp struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func (r *Regexp) Name() string {
+	return "regexp " + r.Pattern.String()
+}
+
+func (r *Regexp) Apply(ctx context.Context, address string) (string, error) {
+	return r.Pattern.ReplaceAllString(address, r.Replacement), nil
+}
+
+// AddressMap replaces addresses found in Source by their value.
+type AddressMap struct {
+	Source Source
+}
+
+func (r *AddressMap) Name() string {
+	return "address-map"
+}
+
+func (r *AddressMap) Apply(ctx context.Context, address string) (string, error) {
+	value, err := r.Source.Lookup(ctx, address)
+	if err != nil || value == "" {
+		return address, err
+	}
+	return value, nil
+}
+
+// DomainMap replaces domains found in Source by their value, for domain
+// aliasing.
+type DomainMap struct {
+	Source Source
+}
+
+func (r *DomainMap) Name() string {
+	return "domain-map"
+}
+
+func (r *DomainMap) Apply(ctx context.Context, address string) (string, error) {
+	local, domain := cutAddress(address)
+	if domain == "" {
+		return address, nil
+	}
+	value, err := r.Source.Lookup(ctx, domain)
+	if err != nil || value == "" {
+		return address, err
+	}
+	return joinAddress(local, value), nil
+}
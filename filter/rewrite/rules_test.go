@@ -0,0 +1,94 @@
+package rewrite
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+type failingSource struct{}
+
+func (failingSource) Lookup(ctx context.Context, key string) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestRules(t *testing.T) {
+	domains := MapSource{"example.net": "example.org"}
+	addresses := MapSource{"postmaster@example.org": "root@example.org"}
+
+	tests := []struct {
+		rule    Rule
+		address string
+		want    string
+	}{
+		{&Lowercase{}, "Alice@EXAMPLE.org", "Alice@example.org"},
+		{&Lowercase{LocalPart: true}, "Alice@EXAMPLE.org", "alice@example.org"},
+		{&Lowercase{}, "Alice", "Alice"},
+		{&StripSubaddress{Separator: "+"}, "alice+lists@example.org", "alice@example.org"},
+		{&StripSubaddress{Separator: "+"}, "alice+a+b@example.org", "alice@example.org"},
+		{&StripSubaddress{Separator: "+"}, "+alice@example.org", "+alice@example.org"},
+		{&StripSubaddress{Separator: "+"}, "alice@exa+mple.org", "alice@exa+mple.org"},
+		{&StripSubaddress{}, "alice+lists@example.org", "alice+lists@example.org"},
+		{&Regexp{Pattern: regexp.MustCompile(`^(.*)@old\.example$`), Replacement: "$1@example.org"}, "alice@old.example", "alice@example.org"},
+		{&Regexp{Pattern: regexp.MustCompile(`^(.*)@old\.example$`), Replacement: "$1@example.org"}, "alice@example.com", "alice@example.com"},
+		{&AddressMap{Source: addresses}, "Postmaster@example.org", "root@example.org"},
+		{&AddressMap{Source: addresses}, "alice@example.org", "alice@example.org"},
+		{&DomainMap{Source: domains}, "alice@Example.NET", "alice@example.org"},
+		{&DomainMap{Source: domains}, "alice@example.com", "alice@example.com"},
+		{&DomainMap{Source: domains}, "example.net", "example.net"},
+	}
+	for _, test := range tests {
+		got, err := test.rule.Apply(context.Background(), test.address)
+		if err != nil || got != test.want {
+			t.Errorf("%s: Apply(%q) = %q, %v, want %q", test.rule.Name(), test.address, got, err, test.want)
+		}
+	}
+
+	for _, rule := range []Rule{&AddressMap{Source: failingSource{}}, &DomainMap{Source: failingSource{}}} {
+		if got, err := rule.Apply(context.Background(), "alice@example.org"); err == nil || got != "alice@example.org" {
+			t.Errorf("%s: Apply with a failing source = %q, %v, want the address and an error", rule.Name(), got, err)
+		}
+	}
+}
+
+func TestEngineRewrite(t *testing.T) {
+	e := NewEngine()
+	e.SetRules(Recipient,
+		&Lowercase{},
+		&StripSubaddress{Separator: "+"},
+		&DomainMap{Source: MapSource{"example.net": "example.org"}},
+		&AddressMap{Source: MapSource{"postmaster@example.org": "root@example.org"}},
+	)
+
+	got, steps, err := e.Rewrite(context.Background(), Recipient, "postmaster+x@EXAMPLE.net")
+	if err != nil || got != "root@example.org" {
+		t.Fatalf("Rewrite = %q, %v, want root@example.org", got, err)
+	}
+	want := []Step{
+		{"lowercase", "postmaster+x@EXAMPLE.net", "postmaster+x@example.net"},
+		{"strip-subaddress", "postmaster+x@example.net", "postmaster@example.net"},
+		{"domain-map", "postmaster@example.net", "postmaster@example.org"},
+		{"address-map", "postmaster@example.org", "root@example.org"},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("Rewrite steps = %v, want %v", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Errorf("step %d = %v, want %v", i, steps[i], want[i])
+		}
+	}
+
+	// rules only apply to their direction
+	if got, steps, _ := e.Rewrite(context.Background(), Sender, "Alice@EXAMPLE.net"); got != "Alice@EXAMPLE.net" || len(steps) != 0 {
+		t.Errorf("Rewrite(Sender) = %q, %v, want no change", got, steps)
+	}
+
+	// a failing rule stops the chain and keeps the address as it was
+	e.SetRules(Sender, &Lowercase{}, &DomainMap{Source: failingSource{}}, &StripSubaddress{Separator: "+"})
+	got, steps, err = e.Rewrite(context.Background(), Sender, "Alice+x@EXAMPLE.org")
+	if err == nil || got != "Alice+x@example.org" || len(steps) != 1 {
+		t.Errorf("Rewrite with a failing rule = %q, %v, %v", got, steps, err)
+	}
+}
@@ -0,0 +1,127 @@
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/table"
+)
+
+// Source provides the data of map rules, Lookup returns "" for keys it
+// does not have.
+type Source interface {
+	Lookup(ctx context.Context, key string) (string, error)
+}
+
+// MapSource is a literal map, keys are lowercase.
+type MapSource map[string]string
+
+func (m MapSource) Lookup(ctx context.Context, key string) (string, error) {
+	return m[strings.ToLower(key)], nil
+}
+
+// TableSource looks keys up in a table backend.
+type TableSource struct {
+	Backend table.Backend
+	Service table.Service
+	Table   string
+}
+
+func (t *TableSource) Lookup(ctx context.Context, key string) (string, error) {
+	return t.Backend.Lookup(ctx, t.Service, t.Table, strings.ToLower(key))
+}
+
+// FileSource is a map file in the format of smtpd file tables, a key and a
+// value per line, separated by blanks or a colon, with # comments. The file
+// is loaded again when it changes.
+type FileSource struct {
+	Path string
+
+	// Interval is how often the modification time of the file is
+	// checked.
+	Interval time.Duration
+
+	entries map[string]string
+	modTime time.Time
+	checked time.Time
+	mtx     sync.Mutex
+}
+
+func OpenFileSource(path string) (*FileSource, error) {
+	f := &FileSource{Path: path, Interval: 10 * time.Second}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload loads the file again, the previous data is kept on error.
+func (f *FileSource) Reload() error {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		key, value := fields[0], strings.Join(fields[1:], " ")
+		if k, v, ok := strings.Cut(key, ":"); ok {
+			key, value = k, strings.TrimSpace(v+" "+value)
+		}
+		entries[strings.ToLower(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.entries = entries
+	f.modTime = fi.ModTime()
+	f.checked = time.Now()
+	return nil
+}
+
+// changed reports whether the file changed since it was loaded, checking
+// at most once per Interval.
+func (f *FileSource) changed() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(f.checked) < f.Interval {
+		return false
+	}
+	f.checked = now
+	fi, err := os.Stat(f.Path)
+	return err == nil && !fi.ModTime().Equal(f.modTime)
+}
+
+// Lookup serves the entries last loaded when the file fails to load again,
+// such as while it is being replaced, the reload being retried after
+// Interval.
+func (f *FileSource) Lookup(ctx context.Context, key string) (string, error) {
+	if f.changed() {
+		if err := f.Reload(); err != nil {
+			log.Printf("rewrite: %s: %s", f.Path, err)
+		}
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.entries[strings.ToLower(key)], nil
+}
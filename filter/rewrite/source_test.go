@@ -0,0 +1,124 @@
+package rewrite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeMap(t *testing.T, path string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lookup(t *testing.T, source Source, key string) string {
+	t.Helper()
+	value, err := source.Lookup(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Lookup(%q): %s", key, err)
+	}
+	return value
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	writeMap(t, path, `# domain aliases
+example.net	example.org
+Example.COM:example.org
+postmaster: root@example.org   # trailing comment
+
+abuse	root@example.org, security@example.org
+`, time.Unix(1000, 0))
+
+	f, err := OpenFileSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"example.net": "example.org",
+		"example.com": "example.org",
+		"POSTMASTER":  "root@example.org",
+		"abuse":       "root@example.org, security@example.org",
+		"example.org": "",
+		"#":           "",
+	}
+	for key, want := range tests {
+		if got := lookup(t, f, key); got != want {
+			t.Errorf("Lookup(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	if _, err := OpenFileSource(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("OpenFileSource of a missing file succeeded")
+	}
+}
+
+func TestFileSourceReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	writeMap(t, path, "example.net example.org\n", time.Unix(1000, 0))
+
+	f, err := OpenFileSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes are only noticed once Interval elapsed
+	writeMap(t, path, "example.net example.com\n", time.Unix(2000, 0))
+	if got := lookup(t, f, "example.net"); got != "example.org" {
+		t.Errorf("Lookup before Interval = %q, want example.org", got)
+	}
+
+	f.Interval = 0
+	if got := lookup(t, f, "example.net"); got != "example.com" {
+		t.Errorf("Lookup after a change = %q, want example.com", got)
+	}
+}
+
+func TestMapSource(t *testing.T) {
+	m := MapSource{"example.net": "example.org"}
+	if got := lookup(t, m, "Example.NET"); got != "example.org" {
+		t.Errorf("Lookup = %q, want example.org", got)
+	}
+	if got := lookup(t, m, "example.com"); got != "" {
+		t.Errorf("Lookup of a missing key = %q, want empty", got)
+	}
+}
+
+func TestFileSourceReloadFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	writeMap(t, path, "example.net example.org\n", time.Unix(1000, 0))
+
+	f, err := OpenFileSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Interval = 0
+
+	// the file cannot be read while it is being replaced, the entries
+	// last loaded are served meanwhile
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(t, f, "example.net"); got != "example.org" {
+		t.Errorf("Lookup after a failed reload = %q, want example.org", got)
+	}
+
+	// and the reload is retried
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	writeMap(t, path, "example.net example.com\n", time.Unix(3000, 0))
+	if got := lookup(t, f, "example.net"); got != "example.com" {
+		t.Errorf("Lookup after a successful reload = %q, want example.com", got)
+	}
+}
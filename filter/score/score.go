@@ -0,0 +1,305 @@
+package score
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// CheckFunc is evaluated at the end of a transaction for checks defined
+// with DefineFunc. It returns the factor applied to the check weight,
+// zero for no hit, and a detail for the report.
+type CheckFunc func(sessionId filter.Session) (float64, string)
+
+type Check struct {
+	Name        string
+	Weight      float64
+	Description string
+	Func        CheckFunc
+}
+
+// Hit is a contribution of a check to a score.
+type Hit struct {
+	Name   string
+	Score  float64
+	Detail string
+}
+
+type session struct {
+	hits      []Hit
+	txHits    []Hit
+	evaluated bool
+	lines     []string
+}
+
+type Scorer struct {
+	// JunkScore and RejectScore are the thresholds checked at commit, a
+	// zero threshold is disabled.
+	JunkScore   float64
+	RejectScore float64
+
+	RejectResponse filter.Response
+
+	// Headers adds X-Spam-Score and X-Spam-Report headers, replacing any
+	// found in the message.
+	Headers bool
+
+	checks    map[string]*Check
+	checksMtx sync.Mutex
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewScorer() *Scorer {
+	return &Scorer{
+		JunkScore:      5,
+		RejectScore:    15,
+		RejectResponse: filter.Reject("550 5.7.1 Message refused, spam score too high"),
+		Headers:        true,
+		checks:         make(map[string]*Check),
+		sessions:       make(map[filter.Session]*session),
+	}
+}
+
+// Define registers a check whose hits are reported with Add.
+func (s *Scorer) Define(name string, weight float64, description string) {
+	s.checksMtx.Lock()
+	defer s.checksMtx.Unlock()
+	s.checks[name] = &Check{Name: name, Weight: weight, Description: description}
+}
+
+// DefineFunc registers a check evaluated by fn at the end of each
+// transaction, typically reading the results of another module.
+func (s *Scorer) DefineFunc(name string, weight float64, description string, fn CheckFunc) {
+	s.checksMtx.Lock()
+	defer s.checksMtx.Unlock()
+	s.checks[name] = &Check{Name: name, Weight: weight, Description: description, Func: fn}
+}
+
+// SetWeight changes the weight of a defined check.
+func (s *Scorer) SetWeight(name string, weight float64) error {
+	s.checksMtx.Lock()
+	defer s.checksMtx.Unlock()
+	check, ok := s.checks[name]
+	if !ok {
+		return fmt.Errorf("unknown check %s", name)
+	}
+	check.Weight = weight
+	return nil
+}
+
+func (s *Scorer) check(name string) (Check, bool) {
+	s.checksMtx.Lock()
+	defer s.checksMtx.Unlock()
+	check, ok := s.checks[name]
+	if !ok {
+		return Check{}, false
+	}
+	return *check, true
+}
+
+// Register hooks the scorer, it must be registered after the modules its
+// checks read from so that their results are available.
+func (s *Scorer) Register(in *filter.SMTPIn) {
+	in.OnLinkDisconnect(s.linkDisconnectCb)
+	in.OnTxBegin(s.txBeginCb)
+	in.OnTxReset(s.txEndCb)
+	in.OnTxCommit(s.txCommitCb)
+	in.OnTxRollback(s.txEndCb)
+	if s.Headers {
+		in.DataLineRequest(s.dataLineCb)
+	}
+	in.CommitRequest(s.commitCb)
+}
+
+func (s *Scorer) session(sessionId filter.Session) *session {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		s.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+// add records a hit of a check scaled by factor, to the transaction if
+// tx is set and to the session otherwise.
+func (s *Scorer) add(sessionId filter.Session, name string, factor float64, detail string, tx bool) {
+	check, ok := s.check(name)
+	if !ok {
+		log.Printf("%s: score: unknown check %s", sessionId, name)
+		return
+	}
+	hit := Hit{Name: name, Score: check.Weight * factor, Detail: detail}
+
+	sess := s.session(sessionId)
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	if tx {
+		sess.txHits = append(sess.txHits, hit)
+	} else {
+		sess.hits = append(sess.hits, hit)
+	}
+}
+
+// Add records a hit of a check for the current transaction.
+func (s *Scorer) Add(sessionId filter.Session, name string, detail string) {
+	s.add(sessionId, name, 1, detail, true)
+}
+
+// AddScaled records a hit of a check for the current transaction with its
+// weight multiplied by factor, for checks producing a graded result.
+func (s *Scorer) AddScaled(sessionId filter.Session, name string, factor float64, detail string) {
+	s.add(sessionId, name, factor, detail, true)
+}
+
+// AddSession records a hit of a check for the whole session, it counts
+// in the score of every transaction, as needed for connect and HELO
+// checks.
+func (s *Scorer) AddSession(sessionId filter.Session, name string, detail string) {
+	s.add(sessionId, name, 1, detail, false)
+}
+
+// evaluate runs the function checks once per transaction.
+func (s *Scorer) evaluate(sessionId filter.Session, sess *session) {
+	s.sessionsMtx.Lock()
+	done := sess.evaluated
+	sess.evaluated = true
+	s.sessionsMtx.Unlock()
+	if done {
+		return
+	}
+
+	s.checksMtx.Lock()
+	checks := make([]Check, 0)
+	for _, check := range s.checks {
+		if check.Func != nil {
+			checks = append(checks, *check)
+		}
+	}
+	s.checksMtx.Unlock()
+
+	for _, check := range checks {
+		if factor, detail := check.Func(sessionId); factor != 0 {
+			s.add(sessionId, check.Name, factor, detail, true)
+		}
+	}
+}
+
+// Hits returns the hits of the session and current transaction, heaviest
+// first.
+func (s *Scorer) Hits(sessionId filter.Session) []Hit {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess, ok := s.sessions[sessionId]
+	if !ok {
+		return nil
+	}
+	hits := append(append(make([]Hit, 0, len(sess.hits)+len(sess.txHits)), sess.hits...), sess.txHits...)
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	return hits
+}
+
+// Score returns the score of the session and current transaction.
+func (s *Scorer) Score(sessionId filter.Session) float64 {
+	total := 0.0
+	for _, hit := range s.Hits(sessionId) {
+		total += hit.Score
+	}
+	return total
+}
+
+// Report returns the X-Spam-Score and X-Spam-Report header fields.
+func (s *Scorer) Report(sessionId filter.Session) []message.Field {
+	hits := s.Hits(sessionId)
+	total := 0.0
+	for _, hit := range hits {
+		total += hit.Score
+	}
+
+	lines := []string{fmt.Sprintf("X-Spam-Report: score=%.1f junk=%.1f reject=%.1f", total, s.JunkScore, s.RejectScore)}
+	for _, hit := range hits {
+		line := fmt.Sprintf("\t* %5.1f %s", hit.Score, hit.Name)
+		if check, ok := s.check(hit.Name); ok && check.Description != "" {
+			line += " " + check.Description
+		}
+		if hit.Detail != "" {
+			line += " (" + strings.ReplaceAll(hit.Detail, "\n", " ") + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	return []message.Field{
+		message.NewField("X-Spam-Score", fmt.Sprintf("%.1f", total)),
+		{Name: "X-Spam-Report", Lines: lines},
+	}
+}
+
+func (s *Scorer) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	delete(s.sessions, sessionId)
+}
+
+func (s *Scorer) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := s.session(sessionId)
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess.lines = nil
+	sess.evaluated = false
+}
+
+// txEndCb drops the transaction hits once it is over, hits of the next
+// transaction may be added before its tx-begin report.
+func (s *Scorer) txEndCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := s.session(sessionId)
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	sess.txHits = nil
+	sess.lines = nil
+	sess.evaluated = false
+}
+
+func (s *Scorer) txCommitCb(timestamp time.Time, sessionId filter.Session, messageId string, messageSize int) {
+	s.txEndCb(timestamp, sessionId, messageId)
+}
+
+func (s *Scorer) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := s.session(sessionId)
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	s.evaluate(sessionId, sess)
+	msg.Header = msg.Header.Remove("X-Spam-Score").Remove("X-Spam-Report")
+	msg.Prepend(s.Report(sessionId)...)
+	return msg.DataLines()
+}
+
+func (s *Scorer) commitCb(timestamp time.Time, sessionId filter.Session) filter.Response {
+	sess := s.session(sessionId)
+	s.evaluate(sessionId, sess)
+
+	score := s.Score(sessionId)
+	if s.RejectScore != 0 && score >= s.RejectScore {
+		return s.RejectResponse
+	}
+	if s.JunkScore != 0 && score >= s.JunkScore {
+		return filter.Junk()
+	}
+	return filter.Proceed()
+}
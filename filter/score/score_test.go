@@ -0,0 +1,146 @@
+package score
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func newScorer() *Scorer {
+	s := NewScorer()
+	s.Define("RDNS_NONE", 2, "no reverse DNS")
+	s.Define("DNSBL", 4, "listed")
+	s.Define("SPF_FAIL", 3, "")
+	return s
+}
+
+func TestScore(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newScorer()
+	sessionId := filter.Session{}
+
+	s.AddSession(sessionId, "RDNS_NONE", "")
+	s.Add(sessionId, "DNSBL", "zen.example")
+	s.AddScaled(sessionId, "SPF_FAIL", 0.5, "")
+	s.Add(sessionId, "UNKNOWN", "")
+	if score := s.Score(sessionId); score != 7.5 {
+		t.Errorf("score %.1f, want 7.5", score)
+	}
+	hits := s.Hits(sessionId)
+	if len(hits) != 3 || hits[0].Name != "DNSBL" || hits[2].Name != "SPF_FAIL" {
+		t.Errorf("hits %v, want heaviest first", hits)
+	}
+
+	// transaction hits are dropped at the end of the transaction, session
+	// hits are kept
+	s.txCommitCb(start, sessionId, "1", 1024)
+	if score := s.Score(sessionId); score != 2 {
+		t.Errorf("score %.1f after commit, want 2", score)
+	}
+	s.Add(sessionId, "DNSBL", "")
+	s.txEndCb(start, sessionId, "2")
+	if score := s.Score(sessionId); score != 2 {
+		t.Errorf("score %.1f after rollback, want 2", score)
+	}
+
+	if err := s.SetWeight("RDNS_NONE", 1); err != nil {
+		t.Fatal(err)
+	}
+	s.AddSession(sessionId, "RDNS_NONE", "")
+	if score := s.Score(sessionId); score != 3 {
+		t.Errorf("score %.1f after reweighting, want 3", score)
+	}
+	if err := s.SetWeight("UNKNOWN", 1); err == nil {
+		t.Error("unknown check reweighted")
+	}
+
+	s.linkDisconnectCb(start, sessionId)
+	if score := s.Score(sessionId); score != 0 {
+		t.Errorf("score %.1f after disconnect, want 0", score)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		hits  []string
+		junk  float64
+		want  filter.Response
+		calls int
+	}{
+		{"clean", nil, 5, filter.Proceed(), 1},
+		{"junk", []string{"DNSBL", "SPF_FAIL"}, 5, filter.Junk(), 1},
+		{"reject", []string{"DNSBL", "DNSBL", "DNSBL", "SPF_FAIL"}, 5, filter.Reject("550 5.7.1 Message refused, spam score too high"), 1},
+		{"junk disabled", []string{"DNSBL", "SPF_FAIL"}, 0, filter.Proceed(), 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScorer()
+			s.JunkScore = test.junk
+			calls := 0
+			s.DefineFunc("FUNC", 1, "", func(sessionId filter.Session) (float64, string) {
+				calls++
+				return 0, ""
+			})
+			sessionId := filter.Session{}
+			s.txBeginCb(start, sessionId, "1")
+			for _, hit := range test.hits {
+				s.Add(sessionId, hit, "")
+			}
+			if res := s.commitCb(start, sessionId); res != test.want {
+				t.Errorf("commitCb = %#v, want %#v", res, test.want)
+			}
+			s.commitCb(start, sessionId)
+			if calls != test.calls {
+				t.Errorf("function check evaluated %d times, want %d", calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestDataLine(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newScorer()
+	s.DefineFunc("SUBJECT", 1.5, "suspicious subject", func(sessionId filter.Session) (float64, string) {
+		return 2, "all caps"
+	})
+	sessionId := filter.Session{}
+	s.txBeginCb(start, sessionId, "1")
+	s.AddSession(sessionId, "RDNS_NONE", "")
+
+	lines := []string{
+		"X-Spam-Score: 0.0",
+		"X-Spam-Report: forged",
+		"\tcontinued",
+		"Subject: HELLO",
+		"",
+		"..body",
+		".",
+	}
+	out := make([]string, 0)
+	for _, line := range lines {
+		out = append(out, s.dataLineCb(start, sessionId, line)...)
+	}
+	want := []string{
+		"X-Spam-Score: 5.0",
+		"X-Spam-Report: score=5.0 junk=5.0 reject=15.0",
+		"\t*   3.0 SUBJECT suspicious subject (all caps)",
+		"\t*   2.0 RDNS_NONE no reverse DNS",
+		"Subject: HELLO",
+		"",
+		"..body",
+		".",
+	}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Errorf("data lines:\n%s\nwant:\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the function checks already ran for this transaction
+	if res := s.commitCb(start, sessionId); res != filter.Junk() {
+		t.Errorf("commitCb = %#v, want junk", res)
+	}
+}
@@ -0,0 +1,163 @@
+package spamtrap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindIP     Kind = "ip"
+	KindSender Kind = "sender"
+)
+
+// Entry is a blocklisted address or sender.
+type Entry struct {
+	Kind    Kind      `json:"kind"`
+	Value   string    `json:"value"`
+	Trap    string    `json:"trap"`
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"`
+	Hits    int       `json:"hits"`
+}
+
+func entryKey(kind Kind, value string) string {
+	return string(kind) + "|" + value
+}
+
+// Blocklist is a set of time-limited entries, saved to a JSON file on
+// every change when a path is set.
+type Blocklist struct {
+	path    string
+	entries map[string]*Entry
+	mtx     sync.Mutex
+}
+
+func NewBlocklist() *Blocklist {
+	return &Blocklist{entries: make(map[string]*Entry)}
+}
+
+// OpenBlocklist loads the blocklist saved at path, if any, and saves it
+// there from now on.
+func OpenBlocklist(path string) (*Blocklist, error) {
+	b := NewBlocklist()
+	b.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before(entry.Expires) {
+			b.entries[entryKey(entry.Kind, entry.Value)] = entry
+		}
+	}
+	return b, nil
+}
+
+// list must be called with the lock held.
+func (b *Blocklist) list(now time.Time) []Entry {
+	ret := make([]Entry, 0, len(b.entries))
+	for key, entry := range b.entries {
+		if !now.Before(entry.Expires) {
+			delete(b.entries, key)
+			continue
+		}
+		ret = append(ret, *entry)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Added.Before(ret[j].Added)
+	})
+	return ret
+}
+
+// save writes the file next to its destination and renames it over, so
+// that a crash never leaves a partial file. It must be called with the
+// lock held.
+func (b *Blocklist) save(now time.Time) error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.list(now), "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(b.path), "."+filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// Add blocklists value until now+duration, extending an existing entry.
+func (b *Blocklist) Add(now time.Time, kind Kind, value string, trap string, duration time.Duration) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := entryKey(kind, value)
+	entry, ok := b.entries[key]
+	if !ok || !now.Before(entry.Expires) {
+		entry = &Entry{Kind: kind, Value: value, Added: now}
+		b.entries[key] = entry
+	}
+	entry.Trap = trap
+	entry.Expires = now.Add(duration)
+	entry.Hits++
+	return b.save(now)
+}
+
+// Lookup returns the entry for value if it is blocklisted.
+func (b *Blocklist) Lookup(now time.Time, kind Kind, value string) (Entry, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	entry, ok := b.entries[entryKey(kind, value)]
+	if !ok || !now.Before(entry.Expires) {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// Remove drops value from the blocklist and reports whether it was
+// listed.
+func (b *Blocklist) Remove(kind Kind, value string) (bool, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := entryKey(kind, value)
+	if _, ok := b.entries[key]; !ok {
+		return false, nil
+	}
+	delete(b.entries, key)
+	return true, b.save(time.Now())
+}
+
+// Entries returns the entries currently blocklisted, oldest first.
+func (b *Blocklist) Entries() []Entry {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.list(time.Now())
+}
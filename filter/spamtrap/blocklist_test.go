@@ -0,0 +1,68 @@
+package spamtrap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := NewBlocklist()
+
+	if err := b.Add(start, KindIP, "192.0.2.1", "trap@example.org", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, listed := b.Lookup(start, KindSender, "192.0.2.1"); listed {
+		t.Error("entry found under another kind")
+	}
+	if _, listed := b.Lookup(start.Add(time.Hour), KindIP, "192.0.2.1"); listed {
+		t.Error("entry found once expired")
+	}
+
+	// a hit extends the entry
+	b.Add(start.Add(30*time.Minute), KindIP, "192.0.2.1", "other@example.org", time.Hour)
+	entry, listed := b.Lookup(start.Add(time.Hour), KindIP, "192.0.2.1")
+	if !listed || entry.Hits != 2 || entry.Trap != "other@example.org" || !entry.Added.Equal(start) {
+		t.Errorf("extended entry %+v, %v", entry, listed)
+	}
+
+	// a hit past expiry starts a new entry
+	b.Add(start.Add(2*time.Hour), KindIP, "192.0.2.1", "trap@example.org", time.Hour)
+	entry, _ = b.Lookup(start.Add(2*time.Hour), KindIP, "192.0.2.1")
+	if entry.Hits != 1 || !entry.Added.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("renewed entry %+v", entry)
+	}
+
+	if removed, err := b.Remove(KindIP, "192.0.2.1"); !removed || err != nil {
+		t.Errorf("Remove = %v, %v", removed, err)
+	}
+	if removed, _ := b.Remove(KindIP, "192.0.2.1"); removed {
+		t.Error("Remove of a missing entry returned true")
+	}
+}
+
+func TestBlocklistPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spamtrap.json")
+	now := time.Now()
+
+	b, err := OpenBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(now, KindIP, "192.0.2.1", "trap@example.org", time.Hour)
+	b.Add(now.Add(-2*time.Hour), KindSender, "expired@example.com", "trap@example.org", time.Hour)
+	b.Add(now.Add(time.Second), KindSender, "spammer@example.com", "trap@example.org", time.Hour)
+
+	b, err = OpenBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := b.Entries()
+	if len(entries) != 2 || entries[0].Value != "192.0.2.1" || entries[1].Value != "spammer@example.com" {
+		t.Fatalf("entries %+v, want the two live ones, oldest first", entries)
+	}
+	if _, listed := b.Lookup(now, KindSender, "spammer@example.com"); !listed {
+		t.Error("loaded entry not found")
+	}
+}
@@ -0,0 +1,205 @@
+package spamtrap
+
+import (
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type Action int
+
+const (
+	// Reject refuses the spamtrap recipient and the whole transaction at
+	// data.
+	Reject Action = iota
+	// Junk accepts the transaction, as to not reveal the spamtrap, and
+	// marks it as junk.
+	Junk
+)
+
+type session struct {
+	src           net.IP
+	authenticated bool
+	sender        string
+	trapped       bool
+}
+
+type Trap struct {
+	// Patterns are the spamtrap recipients: full addresses, "@domain"
+	// for a whole domain, or shell patterns as understood by path.Match.
+	// Matching is case-insensitive.
+	Patterns []string
+
+	Blocklist *Blocklist
+
+	// Duration is how long sources and senders stay blocklisted.
+	Duration time.Duration
+
+	Action Action
+
+	// SkipAuthenticated ignores sessions that successfully authenticated.
+	SkipAuthenticated bool
+
+	// ConnectResponse refuses blocklisted sources, RejectResponse
+	// refuses blocklisted senders and trapped transactions.
+	ConnectResponse filter.Response
+	RejectResponse  filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewTrap(blocklist *Blocklist) *Trap {
+	if blocklist == nil {
+		blocklist = NewBlocklist()
+	}
+	return &Trap{
+		Blocklist:         blocklist,
+		Duration:          7 * 24 * time.Hour,
+		Action:            Reject,
+		SkipAuthenticated: true,
+		ConnectResponse:   filter.Disconnect("554 5.7.1 Client blocklisted"),
+		RejectResponse:    filter.Reject("550 5.7.1 Delivery refused"),
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+func (t *Trap) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(t.linkConnectCb)
+	in.OnLinkAuth(t.linkAuthCb)
+	in.OnLinkDisconnect(t.linkDisconnectCb)
+	in.OnTxBegin(t.txBeginCb)
+	in.ConnectRequest(t.connectCb)
+	in.MailFromRequest(t.mailFromCb)
+	in.RcptToRequest(t.rcptToCb)
+	in.DataRequest(t.dataCb)
+}
+
+// Match reports whether address is a spamtrap.
+func (t *Trap) Match(address string) bool {
+	address = strings.ToLower(address)
+	_, domain, _ := strings.Cut(address, "@")
+	for _, pattern := range t.Patterns {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case strings.HasPrefix(pattern, "@"):
+			if domain == pattern[1:] {
+				return true
+			}
+		case pattern == address:
+			return true
+		default:
+			if ok, _ := path.Match(pattern, address); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *Trap) session(sessionId filter.Session) *session {
+	t.sessionsMtx.Lock()
+	defer t.sessionsMtx.Unlock()
+	sess, ok := t.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		t.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (t *Trap) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		t.session(sessionId).src = addr.IP
+	}
+}
+
+func (t *Trap) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	t.session(sessionId).authenticated = result == "pass"
+}
+
+func (t *Trap) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	t.sessionsMtx.Lock()
+	defer t.sessionsMtx.Unlock()
+	delete(t.sessions, sessionId)
+}
+
+func (t *Trap) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := t.session(sessionId)
+	sess.sender = ""
+	sess.trapped = false
+}
+
+func (t *Trap) connectCb(timestamp time.Time, sessionId filter.Session, rdns string, src net.Addr) filter.Response {
+	addr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return filter.Proceed()
+	}
+	if _, listed := t.Blocklist.Lookup(timestamp, KindIP, addr.IP.String()); listed {
+		return t.ConnectResponse
+	}
+	return filter.Proceed()
+}
+
+func (t *Trap) skip(sess *session) bool {
+	return sess.authenticated && t.SkipAuthenticated
+}
+
+func (t *Trap) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := t.session(sessionId)
+	sender, _ := message.SplitParam(from)
+	sess.sender = strings.ToLower(sender)
+	if sess.sender == "" || t.skip(sess) {
+		return filter.Proceed()
+	}
+	if _, listed := t.Blocklist.Lookup(timestamp, KindSender, sess.sender); listed {
+		return t.RejectResponse
+	}
+	return filter.Proceed()
+}
+
+func (t *Trap) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	sess := t.session(sessionId)
+	if t.skip(sess) {
+		return filter.Proceed()
+	}
+	recipient, _ := message.SplitParam(to)
+	if !t.Match(recipient) {
+		if sess.trapped && t.Action == Reject {
+			return t.RejectResponse
+		}
+		return filter.Proceed()
+	}
+
+	sess.trapped = true
+	log.Printf("%s: spamtrap: %s hit by %s from %s", sessionId, recipient, sess.sender, sess.src)
+	if sess.src != nil && !sess.src.IsLoopback() {
+		if err := t.Blocklist.Add(timestamp, KindIP, sess.src.String(), recipient, t.Duration); err != nil {
+			log.Printf("%s: spamtrap: %s", sessionId, err)
+		}
+	}
+	if sess.sender != "" {
+		if err := t.Blocklist.Add(timestamp, KindSender, sess.sender, recipient, t.Duration); err != nil {
+			log.Printf("%s: spamtrap: %s", sessionId, err)
+		}
+	}
+
+	if t.Action == Junk {
+		return filter.Junk()
+	}
+	return t.RejectResponse
+}
+
+func (t *Trap) dataCb(timestamp time.Time, sessionId filter.Session) filter.Response {
+	sess := t.session(sessionId)
+	if sess.trapped && t.Action == Reject {
+		return t.RejectResponse
+	}
+	return filter.Proceed()
+}
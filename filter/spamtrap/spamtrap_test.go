@@ -0,0 +1,124 @@
+package spamtrap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestMatch(t *testing.T) {
+	trap := NewTrap(nil)
+	trap.Patterns = []string{"trap@example.org", "@traps.example.org", "old-*@example.org"}
+
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"trap@example.org", true},
+		{"TRAP@Example.org", true},
+		{"anything@traps.example.org", true},
+		{"old-sales@example.org", true},
+		{"user@example.org", false},
+		{"trap@example.com", false},
+		{"user@sub.traps.example.org", false},
+	}
+	for _, test := range tests {
+		if got := trap.Match(test.address); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+}
+
+func TestTrap(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	reject := filter.Reject("550 5.7.1 Delivery refused")
+
+	tests := []struct {
+		name   string
+		action Action
+		auth   bool
+		rcpts  []string
+		want   []filter.Response
+		data   filter.Response
+		listed bool
+	}{
+		{"clean", Reject, false, []string{"<user@example.org>"}, []filter.Response{filter.Proceed()}, filter.Proceed(), false},
+		{"reject", Reject, false, []string{"<user@example.org>", "<trap@example.org> NOTIFY=NEVER ORCPT=rfc822;trap@example.org", "<other@example.org>"},
+			[]filter.Response{filter.Proceed(), reject, reject}, reject, true},
+		{"junk", Junk, false, []string{"<trap@example.org>", "<other@example.org>"},
+			[]filter.Response{filter.Junk(), filter.Proceed()}, filter.Proceed(), true},
+		{"authenticated", Reject, true, []string{"<trap@example.org>"}, []filter.Response{filter.Proceed()}, filter.Proceed(), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trap := NewTrap(nil)
+			trap.Patterns = []string{"trap@example.org"}
+			trap.Action = test.action
+			s := filter.Session{}
+
+			trap.linkConnectCb(start, s, "", "", src, nil)
+			if res := trap.connectCb(start, s, "", src); res != filter.Proceed() {
+				t.Fatalf("connectCb = %#v", res)
+			}
+			if test.auth {
+				trap.linkAuthCb(start, s, "pass", "alice")
+			}
+			trap.txBeginCb(start, s, "1")
+			if res := trap.mailFromCb(start, s, "<Spammer@example.com> SIZE=1024 BODY=8BITMIME"); res != filter.Proceed() {
+				t.Fatalf("mailFromCb = %#v", res)
+			}
+			for i, rcpt := range test.rcpts {
+				if res := trap.rcptToCb(start, s, rcpt); res != test.want[i] {
+					t.Errorf("rcptToCb(%s) = %#v, want %#v", rcpt, res, test.want[i])
+				}
+			}
+			if res := trap.dataCb(start, s); res != test.data {
+				t.Errorf("dataCb = %#v, want %#v", res, test.data)
+			}
+			trap.linkDisconnectCb(start, s)
+
+			// the next session from the source or sender is refused
+			_, ipListed := trap.Blocklist.Lookup(start, KindIP, "192.0.2.1")
+			entry, senderListed := trap.Blocklist.Lookup(start, KindSender, "spammer@example.com")
+			if ipListed != test.listed || senderListed != test.listed {
+				t.Fatalf("listed source %v, sender %v, want %v", ipListed, senderListed, test.listed)
+			}
+			if !test.listed {
+				return
+			}
+			if entry.Trap != "trap@example.org" {
+				t.Errorf("entry trap %q, want trap@example.org", entry.Trap)
+			}
+			if res := trap.connectCb(start, s, "", src); res != trap.ConnectResponse {
+				t.Errorf("connectCb of a listed source = %#v, want %#v", res, trap.ConnectResponse)
+			}
+			other := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4242}
+			trap.linkConnectCb(start, s, "", "", other, nil)
+			trap.txBeginCb(start, s, "2")
+			if res := trap.mailFromCb(start, s, "<spammer@example.com> SIZE=2048"); res != reject {
+				t.Errorf("mailFromCb of a listed sender = %#v, want %#v", res, reject)
+			}
+			if res := trap.connectCb(start.Add(8*24*time.Hour), s, "", src); res != filter.Proceed() {
+				t.Errorf("connectCb after expiry = %#v, want proceed", res)
+			}
+		})
+	}
+}
+
+func TestLoopbackNotListed(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	trap := NewTrap(nil)
+	trap.Patterns = []string{"trap@example.org"}
+	s := filter.Session{}
+	trap.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}, nil)
+	trap.txBeginCb(start, s, "1")
+	trap.mailFromCb(start, s, "<>")
+	trap.rcptToCb(start, s, "<trap@example.org>")
+	if entries := trap.Blocklist.Entries(); len(entries) != 0 {
+		t.Errorf("entries %v, want none for a loopback bounce", entries)
+	}
+}
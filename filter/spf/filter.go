@@ -0,0 +1,287 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/authres"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// Outcome is the result of the SPF evaluation of a transaction.
+type Outcome struct {
+	Result Result
+
+	// Identity is "mailfrom", or "helo" when the null sender was used
+	// and the HELO identity was checked instead.
+	Identity string
+	Domain   string
+	Sender   string
+	ClientIP net.IP
+	Helo     string
+
+	// Explanation is the exp= text published by the domain on fail.
+	Explanation string
+
+	// Problem describes the error behind temperror and permerror.
+	Problem string
+}
+
+type session struct {
+	src           net.IP
+	helo          string
+	authenticated bool
+	outcome       *Outcome
+	headersDone   bool
+}
+
+type Checker struct {
+	Resolver Resolver
+
+	// Timeout bounds the DNS lookups of an evaluation, which then gives
+	// a temperror. Evaluations run in the dispatch loop and are serial:
+	// every session waits while one is pending, so keep it short.
+	Timeout        time.Duration
+	MaxLookups     int
+	MaxVoidLookups int
+
+	// Receiver is the host name used in headers and for the r macro,
+	// it defaults to the authserv-id.
+	Receiver string
+
+	// Actions maps results to the response returned at mail-from,
+	// results without an action proceed.
+	Actions map[Result]filter.Response
+
+	// SkipAuthenticated disables the check for sessions that
+	// successfully authenticated.
+	SkipAuthenticated bool
+
+	ReceivedSPFHeader bool
+	AuthResultsHeader bool
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Checker{
+		Resolver:       resolver,
+		Timeout:        5 * time.Second,
+		MaxLookups:     DefaultMaxLookups,
+		MaxVoidLookups: DefaultMaxVoidLookups,
+		Actions: map[Result]filter.Response{
+			Fail:      filter.Reject("550 5.7.23 SPF validation failed"),
+			SoftFail:  filter.Junk(),
+			TempError: filter.Reject("451 4.7.24 SPF validation error, try again later"),
+		},
+		SkipAuthenticated: true,
+		ReceivedSPFHeader: true,
+		AuthResultsHeader: true,
+		sessions:          make(map[filter.Session]*session),
+	}
+}
+
+func (c *Checker) receiver() string {
+	if c.Receiver != "" {
+		return c.Receiver
+	}
+	return authres.AuthservId()
+}
+
+// CheckHost runs the check_host() function of RFC 7208 and returns the
+// result along with the explanation published for a fail result.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, domain string, sender string, helo string) (Result, string, error) {
+	e := &evaluation{
+		ctx:            ctx,
+		resolver:       c.Resolver,
+		receiver:       c.receiver(),
+		ip:             ip,
+		sender:         sender,
+		helo:           helo,
+		maxLookups:     c.MaxLookups,
+		maxVoidLookups: c.MaxVoidLookups,
+	}
+	res, err := e.checkHost(strings.ToLower(strings.TrimSuffix(domain, ".")))
+	return res, e.explanation, err
+}
+
+// Check evaluates the MAIL FROM identity of a transaction, falling back to
+// the HELO identity for the null sender (RFC 7208, section 2.4).
+func (c *Checker) Check(ctx context.Context, ip net.IP, helo string, mailFrom string) *Outcome {
+	outcome := &Outcome{
+		Identity: "mailfrom",
+		ClientIP: ip,
+		Helo:     helo,
+	}
+
+	sender, _ := message.SplitParam(mailFrom)
+	if sender == "" {
+		outcome.Identity = "helo"
+		sender = "postmaster@" + helo
+	}
+	local, domain, found := strings.Cut(sender, "@")
+	if !found {
+		local, domain = "postmaster", sender
+	}
+	if local == "" {
+		local = "postmaster"
+	}
+	outcome.Sender = local + "@" + domain
+	outcome.Domain = domain
+
+	res, explanation, err := c.CheckHost(ctx, ip, domain, outcome.Sender, helo)
+	outcome.Result = res
+	outcome.Explanation = explanation
+	if err != nil {
+		outcome.Problem = err.Error()
+	}
+	return outcome
+}
+
+// Register hooks the checker on the events it needs: the client address
+// and HELO are collected from reports, the evaluation happens at mail-from
+// and headers are added at the top of the message.
+func (c *Checker) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(c.linkConnectCb)
+	in.OnLinkIdentify(c.linkIdentifyCb)
+	in.OnLinkAuth(c.linkAuthCb)
+	in.OnLinkDisconnect(c.linkDisconnectCb)
+	in.MailFromRequest(c.mailFromCb)
+	in.DataLineRequest(c.dataLineCb)
+}
+
+// Outcome returns the SPF outcome of the current transaction, or nil if
+// none was evaluated.
+func (c *Checker) Outcome(sessionId filter.Session) *Outcome {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.outcome
+	}
+	return nil
+}
+
+func (c *Checker) session(sessionId filter.Session) *session {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess, ok := c.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		c.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (c *Checker) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	if addr, ok := src.(*net.TCPAddr); ok {
+		c.session(sessionId).src = addr.IP
+	}
+}
+
+func (c *Checker) linkIdentifyCb(timestamp time.Time, sessionId filter.Session, method string, hostname string) {
+	c.session(sessionId).helo = hostname
+}
+
+func (c *Checker) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	c.session(sessionId).authenticated = result == "pass"
+}
+
+func (c *Checker) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	delete(c.sessions, sessionId)
+}
+
+func (c *Checker) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := c.session(sessionId)
+
+	c.sessionsMtx.Lock()
+	sess.outcome = nil
+	sess.headersDone = false
+	c.sessionsMtx.Unlock()
+
+	if sess.src == nil || (sess.authenticated && c.SkipAuthenticated) {
+		return filter.Proceed()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	outcome := c.Check(ctx, sess.src, sess.helo, from)
+	cancel()
+
+	c.sessionsMtx.Lock()
+	sess.outcome = outcome
+	c.sessionsMtx.Unlock()
+
+	if res, ok := c.Actions[outcome.Result]; ok {
+		return res
+	}
+	return filter.Proceed()
+}
+
+func (c *Checker) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := c.session(sessionId)
+	if sess.headersDone || sess.outcome == nil {
+		return []string{line}
+	}
+	sess.headersDone = true
+
+	lines := make([]string, 0)
+	if c.ReceivedSPFHeader {
+		lines = append(lines, c.ReceivedSPF(sess.outcome).Lines...)
+	}
+	if c.AuthResultsHeader {
+		lines = append(lines, authres.Field(authres.AuthservId(), AuthResult(sess.outcome)).Lines...)
+	}
+	return append(lines, line)
+}
+
+func comment(o *Outcome) string {
+	switch o.Result {
+	case Pass:
+		return fmt.Sprintf("domain of %s designates %s as permitted sender", o.Sender, o.ClientIP)
+	case Fail:
+		return fmt.Sprintf("domain of %s does not designate %s as permitted sender", o.Sender, o.ClientIP)
+	case SoftFail:
+		return fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", o.Sender, o.ClientIP)
+	case Neutral:
+		return fmt.Sprintf("%s is neither permitted nor denied by domain of %s", o.ClientIP, o.Sender)
+	case None:
+		return fmt.Sprintf("domain of %s does not designate permitted sender hosts", o.Sender)
+	case TempError:
+		return fmt.Sprintf("error in processing during lookup of %s: %s", o.Sender, o.Problem)
+	}
+	return fmt.Sprintf("permanent error in processing domain of %s: %s", o.Sender, o.Problem)
+}
+
+// ReceivedSPF formats the Received-SPF header of RFC 7208, section 9.1.
+func (c *Checker) ReceivedSPF(o *Outcome) message.Field {
+	return message.Field{
+		Name: "Received-SPF",
+		Lines: []string{
+			fmt.Sprintf("Received-SPF: %s (%s: %s)", o.Result, c.receiver(), comment(o)),
+			fmt.Sprintf("\tclient-ip=%s; envelope-from=%q; helo=%s;", o.ClientIP, o.Sender, o.Helo),
+			fmt.Sprintf("\treceiver=%s; identity=%s", c.receiver(), o.Identity),
+		},
+	}
+}
+
+// AuthResult converts an outcome to an Authentication-Results method
+// result.
+func AuthResult(o *Outcome) authres.Result {
+	res := authres.Result{Method: "spf", Value: string(o.Result), Reason: o.Problem}
+	if o.Identity == "helo" {
+		res.Properties = []authres.Property{{Type: "smtp", Name: "helo", Value: o.Helo}}
+	} else {
+		res.Properties = []authres.Property{{Type: "smtp", Name: "mailfrom", Value: o.Sender}}
+	}
+	return res
+}
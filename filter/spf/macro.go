@@ -0,0 +1,162 @@
+package spf
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipMacro formats the client address for the i macro: dotted quad for
+// IPv4, dot separated nibbles for IPv6.
+func ipMacro(e *evaluation) string {
+	if ip4 := e.ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	ip := e.ip.To16()
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func (e *evaluation) macroValue(letter byte, domain string, exp bool) (string, error) {
+	local, senderDomain, _ := strings.Cut(e.sender, "@")
+
+	switch letter {
+	case 's':
+		return e.sender, nil
+	case 'l':
+		return local, nil
+	case 'o':
+		return senderDomain, nil
+	case 'd':
+		return domain, nil
+	case 'i':
+		return ipMacro(e), nil
+	case 'p':
+		names, err := e.validatedNames()
+		if err != nil || len(names) == 0 {
+			return "unknown", nil
+		}
+		for _, name := range names {
+			if isSubdomain(name, domain) {
+				return name, nil
+			}
+		}
+		return names[0], nil
+	case 'v':
+		if e.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return e.helo, nil
+	}
+
+	if exp {
+		switch letter {
+		case 'c':
+			return e.ip.String(), nil
+		case 'r':
+			return e.receiver, nil
+		case 't':
+			return strconv.FormatInt(time.Now().Unix(), 10), nil
+		}
+	}
+	return "", permError("invalid macro letter %q", letter)
+}
+
+// expand performs the macro expansion of RFC 7208, section 7. The c, r and
+// t macros are only allowed in explanation strings.
+func (e *evaluation) expand(spec string, domain string, exp bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i >= len(spec) {
+			return "", permError("truncated macro in %q", spec)
+		}
+
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", permError("malformed macro in %q", spec)
+			}
+			value, err := e.expandMacro(spec[i+1:i+end], domain, exp)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", permError("malformed macro in %q", spec)
+		}
+	}
+	return b.String(), nil
+}
+
+func (e *evaluation) expandMacro(macro string, domain string, exp bool) (string, error) {
+	letter := macro[0]
+	escape := letter >= 'A' && letter <= 'Z'
+	if escape {
+		letter += 'a' - 'A'
+	}
+	value, err := e.macroValue(letter, domain, exp)
+	if err != nil {
+		return "", err
+	}
+
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		if keep, err = strconv.Atoi(rest[:digits]); err != nil || keep == 0 {
+			return "", permError("invalid macro transformer %q", macro)
+		}
+	}
+	rest = rest[digits:]
+	reverse := strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R")
+	if reverse {
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("invalid macro delimiter %q", macro)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	if escape {
+		value = strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+	}
+	return value, nil
+}
@@ -0,0 +1,525 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Resolver is the subset of net.Resolver needed for SPF evaluation, so
+// that tests and alternate DNS clients can be plugged in.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// evalError carries the result an error maps to, temperror or permerror.
+type evalError struct {
+	result Result
+	msg    string
+}
+
+func (e *evalError) Error() string {
+	return e.msg
+}
+
+func permError(format string, args ...any) error {
+	return &evalError{result: PermError, msg: fmt.Sprintf(format, args...)}
+}
+
+func tempError(format string, args ...any) error {
+	return &evalError{result: TempError, msg: fmt.Sprintf(format, args...)}
+}
+
+func errorResult(err error) Result {
+	var e *evalError
+	if errors.As(err, &e) {
+		return e.result
+	}
+	return TempError
+}
+
+// Limits from RFC 7208, section 4.6.4.
+const (
+	DefaultMaxLookups     = 10
+	DefaultMaxVoidLookups = 2
+	maxNamesPerLookup     = 10
+)
+
+// evaluation holds the state of a single check_host() run and of the
+// nested runs it triggers through include and redirect.
+type evaluation struct {
+	ctx      context.Context
+	resolver Resolver
+	receiver string
+
+	ip     net.IP
+	sender string
+	helo   string
+
+	maxLookups     int
+	maxVoidLookups int
+	lookups        int
+	voids          int
+
+	explanation string
+}
+
+func (e *evaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > e.maxLookups {
+		return permError("too many DNS lookups")
+	}
+	return nil
+}
+
+// classify turns a DNS error into nil for void lookups, which are counted,
+// or into a temperror.
+func (e *evaluation) classify(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return e.countVoid()
+	}
+	return tempError("DNS lookup failed: %s", err)
+}
+
+func (e *evaluation) countVoid() error {
+	e.voids++
+	if e.voids > e.maxVoidLookups {
+		return permError("too many void DNS lookups")
+	}
+	return nil
+}
+
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRecord returns the single SPF record published at domain, or "" if
+// there is none.
+func (e *evaluation) fetchRecord(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", tempError("DNS lookup failed: %s", err)
+	}
+
+	records := make([]string, 0)
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	}
+	return "", permError("multiple SPF records for %s", domain)
+}
+
+type term struct {
+	qualifier Result
+	name      string
+	value     string
+	cidr4     int
+	cidr6     int
+}
+
+var modifierRe = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9._-]*)=(.*)$`)
+var cidrRe = regexp.MustCompile(`(/(\d+))?(//(\d+))?$`)
+
+func parseRecord(record string) (terms []term, redirect string, exp string, err error) {
+	hasRedirect, hasExp := false, false
+	for _, field := range strings.Fields(record)[1:] {
+		if m := modifierRe.FindStringSubmatch(field); m != nil {
+			switch strings.ToLower(m[1]) {
+			case "redirect":
+				if hasRedirect {
+					return nil, "", "", permError("duplicate redirect modifier")
+				}
+				hasRedirect, redirect = true, m[2]
+			case "exp":
+				if hasExp {
+					return nil, "", "", permError("duplicate exp modifier")
+				}
+				hasExp, exp = true, m[2]
+			}
+			continue
+		}
+
+		t := term{qualifier: Pass, cidr4: 32, cidr6: 128}
+		switch field[0] {
+		case '+':
+			field = field[1:]
+		case '-':
+			t.qualifier, field = Fail, field[1:]
+		case '~':
+			t.qualifier, field = SoftFail, field[1:]
+		case '?':
+			t.qualifier, field = Neutral, field[1:]
+		}
+
+		name, value, hasValue := strings.Cut(field, ":")
+		if !hasValue {
+			if i := strings.IndexByte(name, '/'); i >= 0 {
+				name, value = name[:i], name[i:]
+			}
+		}
+		t.name = strings.ToLower(name)
+
+		switch t.name {
+		case "all":
+			if value != "" {
+				return nil, "", "", permError("invalid all mechanism %q", field)
+			}
+		case "include", "exists":
+			if value == "" {
+				return nil, "", "", permError("%s mechanism requires a domain", t.name)
+			}
+		case "a", "mx":
+			m := cidrRe.FindStringSubmatch(value)
+			if m[2] != "" {
+				t.cidr4, _ = strconv.Atoi(m[2])
+			}
+			if m[4] != "" {
+				t.cidr6, _ = strconv.Atoi(m[4])
+			}
+			if t.cidr4 > 32 || t.cidr6 > 128 {
+				return nil, "", "", permError("invalid prefix length in %q", field)
+			}
+			value = strings.TrimSuffix(value, m[0])
+		case "ptr":
+		case "ip4", "ip6":
+			if value == "" {
+				return nil, "", "", permError("%s mechanism requires an address", t.name)
+			}
+		default:
+			return nil, "", "", permError("unknown mechanism %q", field)
+		}
+		t.value = value
+		terms = append(terms, t)
+	}
+	return terms, redirect, exp, nil
+}
+
+// checkHost implements the check_host() function of RFC 7208, section 4.
+func (e *evaluation) checkHost(domain string) (Result, error) {
+	if !validDomain(domain) {
+		return None, nil
+	}
+
+	record, err := e.fetchRecord(domain)
+	if err != nil {
+		return errorResult(err), err
+	}
+	if record == "" {
+		return None, nil
+	}
+
+	terms, redirect, exp, err := parseRecord(record)
+	if err != nil {
+		return PermError, err
+	}
+
+	for _, t := range terms {
+		match, err := e.matches(t, domain)
+		if err != nil {
+			return errorResult(err), err
+		}
+		if match {
+			if t.qualifier == Fail && exp != "" {
+				e.explain(exp, domain)
+			}
+			return t.qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return PermError, err
+		}
+		target, err := e.expandDomain(redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		res, err := e.checkHost(target)
+		if res == None {
+			return PermError, permError("redirect to %s without SPF record", target)
+		}
+		return res, err
+	}
+	return Neutral, nil
+}
+
+// explain sets the explanation from the exp= modifier, errors are ignored
+// as mandated by RFC 7208, section 6.2.
+func (e *evaluation) explain(exp string, domain string) {
+	target, err := e.expandDomain(exp, domain)
+	if err != nil {
+		return
+	}
+	txts, err := e.resolver.LookupTXT(e.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return
+	}
+	if explanation, err := e.expand(txts[0], domain, true); err == nil {
+		e.explanation = explanation
+	}
+}
+
+func (e *evaluation) expandDomain(spec string, domain string) (string, error) {
+	target, err := e.expand(spec, domain, false)
+	if err != nil {
+		return "", err
+	}
+	// RFC 7208, section 7.3, drop labels from the left until it fits
+	for len(target) > 253 {
+		_, rest, found := strings.Cut(target, ".")
+		if !found {
+			break
+		}
+		target = rest
+	}
+	return target, nil
+}
+
+func (e *evaluation) targetDomain(t term, domain string) (string, error) {
+	if t.value == "" {
+		return domain, nil
+	}
+	return e.expandDomain(t.value, domain)
+}
+
+func (e *evaluation) matchIP(ip net.IP, t term) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if e.ip.To4() == nil {
+			return false
+		}
+		return ip4.Mask(net.CIDRMask(t.cidr4, 32)).Equal(e.ip.To4().Mask(net.CIDRMask(t.cidr4, 32)))
+	}
+	if e.ip.To4() != nil {
+		return false
+	}
+	return ip.Mask(net.CIDRMask(t.cidr6, 128)).Equal(e.ip.Mask(net.CIDRMask(t.cidr6, 128)))
+}
+
+func (e *evaluation) lookupIPs(host string) ([]net.IP, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, host)
+	if err != nil {
+		return nil, e.classify(err)
+	}
+	if len(addrs) == 0 {
+		return nil, e.countVoid()
+	}
+	ret := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ret = append(ret, addr.IP)
+	}
+	return ret, nil
+}
+
+func (e *evaluation) matches(t term, domain string) (bool, error) {
+	switch t.name {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.targetDomain(t, domain)
+		if err != nil {
+			return false, err
+		}
+		res, err := e.checkHost(target)
+		switch res {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, err
+		case None:
+			return false, permError("include of %s without SPF record", target)
+		}
+		return false, err
+
+	case "a":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.targetDomain(t, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if e.matchIP(ip, t) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "mx":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.targetDomain(t, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := e.resolver.LookupMX(e.ctx, target)
+		if err != nil {
+			return false, e.classify(err)
+		}
+		if len(mxs) == 0 {
+			return false, e.countVoid()
+		}
+		if len(mxs) > maxNamesPerLookup {
+			return false, permError("too many MX records for %s", target)
+		}
+		for _, mx := range mxs {
+			ips, err := e.lookupIPs(mx.Host)
+			if err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if e.matchIP(ip, t) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.targetDomain(t, domain)
+		if err != nil {
+			return false, err
+		}
+		names, err := e.validatedNames()
+		if err != nil {
+			return false, err
+		}
+		for _, name := range names {
+			if isSubdomain(name, target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		value := t.value
+		if !strings.Contains(value, "/") {
+			if t.name == "ip4" {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return false, permError("invalid %s network %q", t.name, t.value)
+		}
+		if (t.name == "ip4") != (network.IP.To4() != nil) {
+			return false, permError("invalid %s network %q", t.name, t.value)
+		}
+		return network.Contains(e.ip), nil
+
+	case "exists":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.targetDomain(t, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, permError("unknown mechanism %q", t.name)
+}
+
+// validatedNames returns the names pointing to the client address whose
+// forward lookup leads back to it (RFC 7208, section 5.5). A failing PTR
+// lookup yields no names rather than a temperror, the mechanism must then
+// fail to match.
+func (e *evaluation) validatedNames() ([]string, error) {
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, e.countVoid()
+		}
+		return nil, nil
+	}
+	if len(names) > maxNamesPerLookup {
+		names = names[:maxNamesPerLookup]
+	}
+	ret := make([]string, 0)
+	for _, name := range names {
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				ret = append(ret, strings.TrimSuffix(name, "."))
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func isSubdomain(name string, domain string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
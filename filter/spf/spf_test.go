@@ -0,0 +1,253 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// zone is a fake Resolver, names missing from every map do not exist and
+// names listed in servfail fail temporarily.
+type zone struct {
+	txt      map[string][]string
+	ip       map[string][]string
+	mx       map[string][]string
+	ptr      map[string][]string
+	servfail map[string]bool
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z *zone) fail(name string) error {
+	if z.servfail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil
+}
+
+func (z *zone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := z.fail(name); err != nil {
+		return nil, err
+	}
+	if txts, ok := z.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (z *zone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := z.fail(host); err != nil {
+		return nil, err
+	}
+	ips, ok := z.ip[strings.TrimSuffix(host, ".")]
+	if !ok {
+		return nil, notFound(host)
+	}
+	ret := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return ret, nil
+}
+
+func (z *zone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := z.mx[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	ret := make([]*net.MX, 0, len(hosts))
+	for _, host := range hosts {
+		ret = append(ret, &net.MX{Host: host, Pref: 10})
+	}
+	return ret, nil
+}
+
+func (z *zone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := z.fail(addr); err != nil {
+		return nil, err
+	}
+	names, ok := z.ptr[addr]
+	if !ok {
+		return nil, notFound(addr)
+	}
+	return names, nil
+}
+
+func includeChain(n int) map[string][]string {
+	txt := make(map[string][]string)
+	for i := 0; i < n; i++ {
+		txt[fmt.Sprintf("i%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:i%d.example.com -all", i+1)}
+	}
+	txt[fmt.Sprintf("i%d.example.com", n)] = []string{"v=spf1 ip4:192.0.2.3 -all"}
+	return txt
+}
+
+func TestCheckHost(t *testing.T) {
+	dns := &zone{
+		txt: map[string][]string{
+			"ip4.example.com":         {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"softfail.example.com":    {"v=spf1 ~all"},
+			"neutral.example.com":     {"v=spf1 ?all"},
+			"default.example.com":     {"v=spf1"},
+			"multiple.example.com":    {"v=spf1 -all", "v=spf1 +all"},
+			"other.example.com":       {"some verification token"},
+			"a.example.com":           {"v=spf1 a/24 -all"},
+			"mx.example.com":          {"v=spf1 mx -all"},
+			"ptr.example.com":         {"v=spf1 ptr -all"},
+			"include.example.com":     {"v=spf1 include:ip4.example.com -all"},
+			"badinclude.example.com":  {"v=spf1 include:nothing.example.com -all"},
+			"redirect.example.com":    {"v=spf1 redirect=ip4.example.com"},
+			"badredirect.example.com": {"v=spf1 redirect=nothing.example.com"},
+			"exists.example.com":      {"v=spf1 exists:%{ir}.%{v}._spf.%{d} -all"},
+			"unknown.example.com":     {"v=spf1 foo:bar -all"},
+			"servfail.example.com":    {"v=spf1 a:down.example.com -all"},
+			"ip6.example.com":         {"v=spf1 ip6:2001:db8::/32 -all"},
+			"voids2.example.com":      {"v=spf1 a:nx1.example.com a:nx2.example.com -all"},
+			"voids3.example.com":      {"v=spf1 a:nx1.example.com a:nx2.example.com a:nx3.example.com -all"},
+		},
+		ip: map[string][]string{
+			"a.example.com":    {"192.0.2.200"},
+			"mail.example.com": {"192.0.2.3"},
+			"3.2.0.192.in-addr._spf.exists.example.com": {"127.0.0.2"},
+		},
+		mx:       map[string][]string{"mx.example.com": {"mail.example.com."}},
+		ptr:      map[string][]string{"192.0.2.3": {"host.ptr.example.com."}},
+		servfail: map[string]bool{"down.example.com": true, "temp.example.com": true, "192.0.2.9": true},
+	}
+	dns.ip["host.ptr.example.com"] = []string{"192.0.2.3"}
+	for name, txts := range includeChain(10) {
+		dns.txt["ten-"+name] = []string{strings.ReplaceAll(txts[0], "include:i", "include:ten-i")}
+	}
+	for name, txts := range includeChain(11) {
+		dns.txt["eleven-"+name] = []string{strings.ReplaceAll(txts[0], "include:i", "include:eleven-i")}
+	}
+
+	tests := []struct {
+		domain string
+		ip     string
+		want   Result
+	}{
+		{"ip4.example.com", "192.0.2.3", Pass},
+		{"ip4.example.com", "198.51.100.1", Fail},
+		{"softfail.example.com", "192.0.2.3", SoftFail},
+		{"neutral.example.com", "192.0.2.3", Neutral},
+		{"default.example.com", "192.0.2.3", Neutral},
+		{"nothing.example.com", "192.0.2.3", None},
+		{"other.example.com", "192.0.2.3", None},
+		{"localhost", "192.0.2.3", None},
+		{"multiple.example.com", "192.0.2.3", PermError},
+		{"a.example.com", "192.0.2.3", Pass},
+		{"a.example.com", "192.0.3.3", Fail},
+		{"mx.example.com", "192.0.2.3", Pass},
+		{"mx.example.com", "192.0.2.4", Fail},
+		{"ptr.example.com", "192.0.2.3", Pass},
+		{"ptr.example.com", "192.0.2.4", Fail},
+		{"ptr.example.com", "192.0.2.9", Fail},
+		{"include.example.com", "192.0.2.3", Pass},
+		{"include.example.com", "198.51.100.1", Fail},
+		{"badinclude.example.com", "192.0.2.3", PermError},
+		{"redirect.example.com", "192.0.2.3", Pass},
+		{"redirect.example.com", "198.51.100.1", Fail},
+		{"badredirect.example.com", "192.0.2.3", PermError},
+		{"exists.example.com", "192.0.2.3", Pass},
+		{"exists.example.com", "192.0.2.4", Fail},
+		{"unknown.example.com", "192.0.2.3", PermError},
+		{"servfail.example.com", "192.0.2.3", TempError},
+		{"temp.example.com", "192.0.2.3", TempError},
+		{"ip6.example.com", "2001:db8::1", Pass},
+		{"ip6.example.com", "192.0.2.3", Fail},
+
+		// RFC 7208, section 4.6.4: at most 10 lookups and 2 void lookups
+		{"ten-i0.example.com", "192.0.2.3", Pass},
+		{"eleven-i0.example.com", "192.0.2.3", PermError},
+		{"voids2.example.com", "192.0.2.3", Fail},
+		{"voids3.example.com", "192.0.2.3", PermError},
+	}
+	c := NewChecker(dns)
+	c.Receiver = "mx.example.org"
+	for _, tt := range tests {
+		t.Run(tt.domain+"/"+tt.ip, func(t *testing.T) {
+			got, _, err := c.CheckHost(context.Background(), net.ParseIP(tt.ip), tt.domain, "user@"+tt.domain, "helo.example.com")
+			if got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	dns := &zone{txt: map[string][]string{
+		"example.com":         {"v=spf1 -all exp=explain.example.com"},
+		"explain.example.com": {"%{i} is not one of %{d}'s designated mail servers."},
+	}}
+	res, explanation, _ := NewChecker(dns).CheckHost(context.Background(), net.ParseIP("192.0.2.3"), "example.com", "user@example.com", "")
+	if want := "192.0.2.3 is not one of example.com's designated mail servers."; res != Fail || explanation != want {
+		t.Errorf("got %s %q, want fail %q", res, explanation, want)
+	}
+}
+
+func TestCheckNullSender(t *testing.T) {
+	dns := &zone{txt: map[string][]string{"helo.example.com": {"v=spf1 ip4:192.0.2.3 -all"}}}
+	outcome := NewChecker(dns).Check(context.Background(), net.ParseIP("192.0.2.3"), "helo.example.com", "<>")
+	if outcome.Result != Pass || outcome.Identity != "helo" || outcome.Sender != "postmaster@helo.example.com" {
+		t.Errorf("got %+v", outcome)
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	dns := &zone{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.3 -all"}}}
+	outcome := NewChecker(dns).Check(context.Background(), net.ParseIP("192.0.2.3"), "helo.example.com", "<user@example.com> SIZE=1024 BODY=8BITMIME")
+	if outcome.Result != Pass || outcome.Identity != "mailfrom" || outcome.Sender != "user@example.com" || outcome.Domain != "example.com" {
+		t.Errorf("got %+v", outcome)
+	}
+}
+
+func TestMacroExpansion(t *testing.T) {
+	// examples of RFC 7208, section 7.4
+	tests := []struct {
+		ip   string
+		spec string
+		want string
+	}{
+		{"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+		{"192.0.2.3", "%{o}", "email.example.com"},
+		{"192.0.2.3", "%{d}", "email.example.com"},
+		{"192.0.2.3", "%{d4}", "email.example.com"},
+		{"192.0.2.3", "%{d3}", "email.example.com"},
+		{"192.0.2.3", "%{d2}", "example.com"},
+		{"192.0.2.3", "%{d1}", "com"},
+		{"192.0.2.3", "%{dr}", "com.example.email"},
+		{"192.0.2.3", "%{d2r}", "example.email"},
+		{"192.0.2.3", "%{l}", "strong-bad"},
+		{"192.0.2.3", "%{l-}", "strong.bad"},
+		{"192.0.2.3", "%{lr}", "strong-bad"},
+		{"192.0.2.3", "%{lr-}", "bad.strong"},
+		{"192.0.2.3", "%{l1r-}", "strong"},
+		{"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{"192.0.2.3", "%%%_%-", "% %20"},
+		{"192.0.2.3", "%{L}", "strong-bad"},
+	}
+	for _, tt := range tests {
+		e := &evaluation{ip: net.ParseIP(tt.ip), sender: "strong-bad@email.example.com"}
+		got, err := e.expand(tt.spec, "email.example.com", false)
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%q) with %s = %q, %v, want %q", tt.spec, tt.ip, got, err, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"%", "%x", "%{x}", "%{c}", "%{d0}", "%{d!}"} {
+		e := &evaluation{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com"}
+		if got, err := e.expand(spec, "email.example.com", false); err == nil {
+			t.Errorf("expand(%q) = %q, want an error", spec, got)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package spoofing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/publicsuffix"
+	"github.com/poolpOrg/OpenSMTPD-framework/table"
+)
+
+// Scorer receives the hits of checks mapped to the Score action, as
+// *score.Scorer does. Check names are used as score check names.
+type Scorer interface {
+	Add(sessionId filter.Session, name string, detail string)
+}
+
+type Check string
+
+const (
+	// UnownedSender is an authenticated user sending as an address they
+	// do not own, in the envelope or the From and Sender headers.
+	UnownedSender Check = "SPOOF_UNOWNED_SENDER"
+	// DisplayName is an external From whose display name is an internal
+	// name or address.
+	DisplayName Check = "SPOOF_DISPLAY_NAME"
+	// InternalFrom is an external message with a From in a local domain.
+	InternalFrom Check = "SPOOF_INTERNAL_FROM"
+	// ReplyTo is an external message with a From in a local domain and a
+	// Reply-To elsewhere.
+	ReplyTo Check = "SPOOF_REPLY_TO"
+	// Misaligned is an external message whose envelope sender and From
+	// are not in the same organizational domain.
+	Misaligned Check = "SPOOF_MISALIGNED"
+	// InvalidFrom is a From field without any address to check, which
+	// would otherwise let a message through every other check.
+	InvalidFrom Check = "SPOOF_INVALID_FROM"
+)
+
+type Action int
+
+const (
+	Ignore Action = iota
+	Score
+	// Warn adds a warning header and tags the subject.
+	Warn
+	Junk
+	Reject
+)
+
+// Result is a failed check.
+type Result struct {
+	Check  Check
+	Detail string
+}
+
+type session struct {
+	user    string
+	sender  string
+	lines   []string
+	results []Result
+}
+
+type Checker struct {
+	// Actions maps failed checks to what is done about them, the most
+	// severe action of the failed checks applies.
+	Actions map[Check]Action
+
+	Scorer Scorer
+
+	// LocalDomains are the domains of internal senders.
+	LocalDomains []string
+
+	// InternalNames are names external senders must not use as display
+	// name, such as those of executives or of the IT department.
+	InternalNames []string
+
+	// Senders maps users to the addresses they own, with K_MAILADDRMAP
+	// lookups in SendersTable as smtpd does for "auth ... senders".
+	// Values list addresses and @domain entries. Without it, users logged
+	// in with an address own its domain.
+	Senders      table.Backend
+	SendersTable string
+
+	// WarningHeader is added with the failed checks mapped to Warn,
+	// replacing any found in the message. SubjectTag, if set, is
+	// prepended to the subject of those messages.
+	WarningHeader string
+	SubjectTag    string
+
+	Suffixes *publicsuffix.List
+
+	RejectResponse filter.Response
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		Actions: map[Check]Action{
+			UnownedSender: Reject,
+			DisplayName:   Warn,
+			InternalFrom:  Warn,
+			ReplyTo:       Score,
+			Misaligned:    Ignore,
+			InvalidFrom:   Warn,
+		},
+		WarningHeader: "X-Spoofing-Warning",
+		Suffixes:      publicsuffix.Default(),
+		sessions:      make(map[filter.Session]*session),
+	}
+}
+
+// Register hooks the checker, it must be registered before the scorer so
+// that its hits are counted.
+func (c *Checker) Register(in *filter.SMTPIn) {
+	in.OnLinkAuth(c.linkAuthCb)
+	in.OnLinkDisconnect(c.linkDisconnectCb)
+	in.OnTxBegin(c.txBeginCb)
+	in.MailFromRequest(c.mailFromCb)
+	in.DataLineRequest(c.dataLineCb)
+	in.CommitRequest(c.commitCb)
+}
+
+// Results returns the checks failed by the current transaction.
+func (c *Checker) Results(sessionId filter.Session) []Result {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	if sess, ok := c.sessions[sessionId]; ok {
+		return sess.results
+	}
+	return nil
+}
+
+func domainOf(address string) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(address[i+1:])
+}
+
+func (c *Checker) local(domain string) bool {
+	for _, d := range c.LocalDomains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns reports whether user may send as address.
+func (c *Checker) Owns(ctx context.Context, user string, address string) (bool, error) {
+	entries := make([]string, 0)
+	if c.Senders != nil {
+		value, err := c.Senders.Lookup(ctx, table.K_MAILADDRMAP, c.SendersTable, user)
+		if err != nil {
+			return false, err
+		}
+		entries = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+	} else if domain := domainOf(user); domain != "" {
+		entries = append(entries, "@"+domain)
+	} else {
+		// nothing to tell which addresses are owned
+		return true, nil
+	}
+
+	for _, entry := range entries {
+		if strings.EqualFold(entry, address) || strings.HasPrefix(entry, "@") && strings.EqualFold(entry[1:], domainOf(address)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *Checker) session(sessionId filter.Session) *session {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess, ok := c.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		c.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (c *Checker) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	if result == "pass" {
+		c.session(sessionId).user = username
+	}
+}
+
+func (c *Checker) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	delete(c.sessions, sessionId)
+}
+
+func (c *Checker) txBeginCb(timestamp time.Time, sessionId filter.Session, messageId string) {
+	sess := c.session(sessionId)
+	c.sessionsMtx.Lock()
+	defer c.sessionsMtx.Unlock()
+	sess.lines = nil
+	sess.results = nil
+}
+
+func (c *Checker) unowned(sessionId filter.Session, user string, address string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	owned, err := c.Owns(ctx, user, address)
+	if err != nil {
+		log.Printf("%s: spoofing: %s", sessionId, err)
+		return false
+	}
+	return !owned
+}
+
+func (c *Checker) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := c.session(sessionId)
+	sess.sender, _ = message.SplitParam(from)
+
+	if sess.user != "" && sess.sender != "" && c.Actions[UnownedSender] == Reject && c.unowned(sessionId, sess.user, sess.sender) {
+		return c.reject(Result{Check: UnownedSender, Detail: fmt.Sprintf("%s may not send as %s", sess.user, sess.sender)})
+	}
+	return filter.Proceed()
+}
+
+// addressPattern matches the addresses of values net/mail rejects, such as
+// those with unquoted specials or raw 8-bit characters in a display name.
+var addressPattern = regexp.MustCompile(`[^\s<>"(),;:@]+@[^\s<>"(),;:@]+`)
+
+// parseAddresses returns the addresses of the fields of header named name.
+// Values net/mail rejects are parsed leniently, each address found taking
+// the text before it as display name. The values in which no address was
+// found are returned as invalid.
+func parseAddresses(header message.Header, name string) ([]*mail.Address, []string) {
+	ret := make([]*mail.Address, 0)
+	invalid := make([]string, 0)
+	for _, value := range header.Values(name) {
+		if addrs, err := mail.ParseAddressList(value); err == nil {
+			ret = append(ret, addrs...)
+			continue
+		}
+		matches := addressPattern.FindAllStringIndex(value, -1)
+		if len(matches) == 0 {
+			invalid = append(invalid, value)
+			continue
+		}
+		start := 0
+		for _, m := range matches {
+			displayName := strings.Trim(value[start:m[0]], " \t<>,\"")
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(displayName); err == nil {
+				displayName = decoded
+			}
+			ret = append(ret, &mail.Address{Name: displayName, Address: value[m[0]:m[1]]})
+			start = m[1]
+		}
+	}
+	return ret, invalid
+}
+
+// Evaluate runs the checks on a message header for a transaction of
+// sender, authenticated as user if not empty.
+func (c *Checker) Evaluate(ctx context.Context, user string, sender string, header message.Header) ([]Result, error) {
+	results := make([]Result, 0)
+	fail := func(check Check, format string, args ...interface{}) {
+		if c.Actions[check] != Ignore {
+			results = append(results, Result{Check: check, Detail: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	from, invalid := parseAddresses(header, "from")
+	for _, value := range invalid {
+		fail(InvalidFrom, "no address in From %q", value)
+	}
+
+	if user != "" {
+		if c.Actions[UnownedSender] == Ignore {
+			return results, nil
+		}
+		addresses := make([]string, 0)
+		if sender != "" {
+			addresses = append(addresses, sender)
+		}
+		senderField, _ := parseAddresses(header, "sender")
+		for _, addr := range append(from, senderField...) {
+			addresses = append(addresses, addr.Address)
+		}
+		for _, address := range addresses {
+			owned, err := c.Owns(ctx, user, address)
+			if err != nil {
+				return results, err
+			}
+			if !owned {
+				fail(UnownedSender, "%s may not send as %s", user, address)
+			}
+		}
+		return results, nil
+	}
+
+	for _, addr := range from {
+		domain := domainOf(addr.Address)
+		if c.local(domain) {
+			fail(InternalFrom, "external message from %s", addr.Address)
+			replyTo, _ := parseAddresses(header, "reply-to")
+			for _, replyTo := range replyTo {
+				if !c.local(domainOf(replyTo.Address)) {
+					fail(ReplyTo, "replies to %s diverted to %s", addr.Address, replyTo.Address)
+				}
+			}
+			continue
+		}
+
+		name := strings.ToLower(addr.Name)
+		for _, internal := range c.InternalNames {
+			if internal != "" && strings.Contains(name, strings.ToLower(internal)) {
+				fail(DisplayName, "display name %q of %s", addr.Name, addr.Address)
+			}
+		}
+		for _, d := range c.LocalDomains {
+			if strings.Contains(name, "@"+strings.ToLower(d)) {
+				fail(DisplayName, "display name %q of %s", addr.Name, addr.Address)
+			}
+		}
+
+		if sender != "" && c.Suffixes.OrganizationalDomain(domainOf(sender)) != c.Suffixes.OrganizationalDomain(domain) {
+			fail(Misaligned, "envelope %s for %s", sender, addr.Address)
+		}
+	}
+	return results, nil
+}
+
+func (c *Checker) dataLineCb(timestamp time.Time, sessionId filter.Session, line string) []string {
+	sess := c.session(sessionId)
+	if line != "." {
+		sess.lines = append(sess.lines, message.Unstuff(line))
+		return nil
+	}
+
+	msg := message.Parse(sess.lines)
+	sess.lines = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	results, err := c.Evaluate(ctx, sess.user, sess.sender, msg.Header)
+	cancel()
+	if err != nil {
+		log.Printf("%s: spoofing: %s", sessionId, err)
+	}
+	c.sessionsMtx.Lock()
+	sess.results = results
+	c.sessionsMtx.Unlock()
+
+	if c.WarningHeader != "" {
+		msg.Header = msg.Header.Remove(c.WarningHeader)
+	}
+	warnings := make([]message.Field, 0)
+	for _, result := range results {
+		switch c.Actions[result.Check] {
+		case Score:
+			if c.Scorer != nil {
+				c.Scorer.Add(sessionId, string(result.Check), result.Detail)
+			}
+		case Warn:
+			if c.WarningHeader != "" {
+				warnings = append(warnings, message.NewField(c.WarningHeader, string(result.Check)+" "+result.Detail))
+			}
+		}
+	}
+	for _, result := range results {
+		if c.Actions[result.Check] == Warn && c.SubjectTag != "" {
+			msg.Header = msg.Header.TagSubject(c.SubjectTag)
+			break
+		}
+	}
+	msg.Prepend(warnings...)
+	return msg.DataLines()
+}
+
+func (c *Checker) reject(result Result) filter.Response {
+	if c.RejectResponse != nil {
+		return c.RejectResponse
+	}
+	if result.Check == UnownedSender {
+		return filter.Reject(fmt.Sprintf("553 5.7.1 Sender address rejected: %s", result.Detail))
+	}
+	return filter.Reject(fmt.Sprintf("550 5.7.1 Message rejected: %s", result.Detail))
+}
+
+func (c *Checker) commitCb(timestamp time.Time, sessionId filter.Session) filter.Response {
+	action := Ignore
+	var worst Result
+	for _, result := range c.Results(sessionId) {
+		if a := c.Actions[result.Check]; a > action {
+			action = a
+			worst = result
+		}
+	}
+
+	switch action {
+	case Reject:
+		return c.reject(worst)
+	case Junk:
+		return filter.Junk()
+	}
+	return filter.Proceed()
+}
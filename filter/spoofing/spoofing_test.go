@@ -0,0 +1,62 @@
+package spoofing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		sender string
+		header []string
+		want   []Check
+	}{
+		{"external", "", "bob@example.net", []string{"From: Bob <bob@example.net>"}, nil},
+		{"internal from", "", "bob@example.net", []string{"From: Alice <alice@example.org>"}, []Check{InternalFrom}},
+		{"reply-to", "", "bob@example.net", []string{"From: alice@example.org", "Reply-To: bob@example.net"}, []Check{InternalFrom, ReplyTo}},
+		{"display name", "", "bob@example.net", []string{"From: IT Support <bob@example.net>"}, []Check{DisplayName}},
+		{"address as display name", "", "bob@example.net", []string{`From: "alice@example.org" <bob@example.net>`}, []Check{DisplayName}},
+		{"misaligned", "", "bounces@example.com", []string{"From: bob@example.net"}, []Check{Misaligned}},
+		{"aligned subdomain", "", "bounces@mail.example.net", []string{"From: bob@example.net"}, nil},
+		{"owned", "alice@example.org", "alice@example.org", []string{"From: alice@example.org"}, nil},
+		{"unowned from", "alice@example.org", "alice@example.org", []string{"From: ceo@example.com"}, []Check{UnownedSender}},
+		{"unowned sender field", "alice@example.org", "alice@example.org", []string{"From: alice@example.org", "Sender: ceo@example.com"}, []Check{UnownedSender}},
+
+		// values net/mail rejects
+		{"unquoted comma", "", "bob@example.net", []string{"From: IT Support, Inc. <bob@example.net>"}, []Check{DisplayName}},
+		{"unquoted local from", "", "bob@example.net", []string{"From: Alice [HR] <alice@example.org>"}, []Check{InternalFrom}},
+		{"8-bit display name", "", "bob@example.net", []string{"From: IT Support \xe9quipe <bob@example.net>"}, []Check{DisplayName}},
+		{"unparsable unowned", "alice@example.org", "alice@example.org", []string{"From: Boss; <ceo@example.com>"}, []Check{UnownedSender}},
+		{"no address", "", "bob@example.net", []string{"From: undisclosed"}, []Check{InvalidFrom}},
+		{"no address authenticated", "alice@example.org", "alice@example.org", []string{"From: ;;;"}, []Check{InvalidFrom}},
+	}
+
+	c := NewChecker()
+	c.LocalDomains = []string{"example.org"}
+	c.InternalNames = []string{"IT Support"}
+	c.Actions[Misaligned] = Score
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, err := c.Evaluate(context.Background(), test.user, test.sender, message.Parse(append(test.header, "")).Header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]Check, 0)
+			for _, result := range results {
+				got = append(got, result.Check)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("failed %v, want %v", results, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("failed %v, want %v", results, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package srs
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+type Forwarder struct {
+	Scheme *Scheme
+
+	// LocalDomains are the domains whose senders are not rewritten, the
+	// scheme domain always is.
+	LocalDomains []string
+
+	// InvalidResponse refuses forged SRS recipients, ExpiredResponse
+	// those whose timestamp is too old.
+	InvalidResponse filter.Response
+	ExpiredResponse filter.Response
+}
+
+func NewForwarder(scheme *Scheme) *Forwarder {
+	return &Forwarder{
+		Scheme:          scheme,
+		InvalidResponse: filter.Reject("550 5.7.1 Invalid SRS address"),
+		ExpiredResponse: filter.Reject("550 5.7.1 Expired SRS address"),
+	}
+}
+
+func (f *Forwarder) Register(in *filter.SMTPIn) {
+	in.MailFromRequest(f.mailFromCb)
+	in.RcptToRequest(f.rcptToCb)
+}
+
+func (f *Forwarder) local(domain string) bool {
+	if strings.EqualFold(domain, f.Scheme.Domain) {
+		return true
+	}
+	for _, d := range f.LocalDomains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Forwarder) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sender, rest := message.SplitParam(from)
+	_, domain, ok := cutAddress(sender)
+	if !ok || f.local(domain) {
+		return filter.Proceed()
+	}
+
+	rewritten, err := f.Scheme.Forward(time.Now(), sender)
+	if err != nil {
+		log.Printf("%s: srs: %s: %s", sessionId, sender, err)
+		return filter.Proceed()
+	}
+	return filter.Rewrite("<" + rewritten + ">" + rest)
+}
+
+func (f *Forwarder) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	recipient, rest := message.SplitParam(to)
+	original, err := f.Scheme.Reverse(time.Now(), recipient)
+	switch {
+	case errors.Is(err, ErrNotSRS):
+		return filter.Proceed()
+	case errors.Is(err, ErrExpired):
+		return f.ExpiredResponse
+	case err != nil:
+		log.Printf("%s: srs: %s: %s", sessionId, recipient, err)
+		return f.InvalidResponse
+	}
+	return filter.Rewrite("<" + original + ">" + rest)
+}
@@ -0,0 +1,45 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestForwarder(t *testing.T) {
+	f := NewForwarder(NewScheme("forwarder.example", []byte("secret")))
+	f.LocalDomains = []string{"example.org"}
+	now := time.Now()
+	s := filter.Session{}
+
+	for _, from := range []string{"<>", "<alice@example.org>", "<alice@Forwarder.example>"} {
+		if res := f.mailFromCb(now, s, from); res != filter.Proceed() {
+			t.Errorf("mailFromCb(%q) = %#v, want proceed", from, res)
+		}
+	}
+
+	res := f.mailFromCb(now, s, "<alice@example.com> SIZE=1024")
+	forwarded, err := f.Scheme.Forward(now, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filter.Rewrite("<" + forwarded + "> SIZE=1024"); res != want {
+		t.Fatalf("mailFromCb = %#v, want %#v", res, want)
+	}
+
+	if res := f.rcptToCb(now, s, "<"+forwarded+"> NOTIFY=NEVER"); res != filter.Rewrite("<alice@example.com> NOTIFY=NEVER") {
+		t.Errorf("rcptToCb = %#v, want the original address", res)
+	}
+	if res := f.rcptToCb(now, s, "<bob@example.org>"); res != filter.Proceed() {
+		t.Errorf("rcptToCb of a regular address = %#v, want proceed", res)
+	}
+	if res := f.rcptToCb(now, s, "<"+strings.Replace(forwarded, "alice", "mallory", 1)+">"); res != f.InvalidResponse {
+		t.Errorf("rcptToCb of a forged address = %#v, want %#v", res, f.InvalidResponse)
+	}
+	old, _ := f.Scheme.Forward(now.Add(-30*24*time.Hour), "alice@example.com")
+	if res := f.rcptToCb(now, s, "<"+old+">"); res != f.ExpiredResponse {
+		t.Errorf("rcptToCb of an expired address = %#v, want %#v", res, f.ExpiredResponse)
+	}
+}
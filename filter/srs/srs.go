@@ -0,0 +1,192 @@
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotSRS      = errors.New("not an SRS address")
+	ErrMalformed   = errors.New("malformed SRS address")
+	ErrInvalidHash = errors.New("invalid SRS hash")
+	ErrExpired     = errors.New("expired SRS timestamp")
+)
+
+const timestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// timestamps count days modulo 1024, on two base32 characters
+const timestampPrecision = 24 * time.Hour
+const timestampSlots = 1024
+
+// Scheme rewrites addresses with the Sender Rewriting Scheme, in the
+// format of libsrs2 and postsrsd:
+//
+//	SRS0=HHHH=TT=orig-domain=orig-local@domain
+//	SRS1=HHHH=first-forwarder==HHHH=TT=orig-domain=orig-local@domain
+type Scheme struct {
+	// Domain is the domain of rewritten addresses.
+	Domain string
+
+	// Secrets sign addresses with the first one, addresses signed with
+	// any are accepted so that secrets can be rotated.
+	Secrets [][]byte
+
+	// MaxAge is how long a rewritten address may receive bounces.
+	MaxAge time.Duration
+
+	HashLength int
+}
+
+func NewScheme(domain string, secrets ...[]byte) *Scheme {
+	return &Scheme{
+		Domain:     domain,
+		Secrets:    secrets,
+		MaxAge:     21 * 24 * time.Hour,
+		HashLength: 4,
+	}
+}
+
+func (s *Scheme) hash(secret []byte, data ...string) string {
+	mac := hmac.New(sha1.New, secret)
+	for _, d := range data {
+		mac.Write([]byte(strings.ToLower(d)))
+	}
+	sum := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return sum[:s.HashLength]
+}
+
+// verify checks hash against every secret, case-insensitively as
+// addresses may have been lowercased on the way.
+func (s *Scheme) verify(hash string, data ...string) bool {
+	for _, secret := range s.Secrets {
+		if hmac.Equal([]byte(strings.ToLower(s.hash(secret, data...))), []byte(strings.ToLower(hash))) {
+			return true
+		}
+	}
+	return false
+}
+
+func timestamp(now time.Time) string {
+	t := int(now.Unix()/int64(timestampPrecision/time.Second)) % timestampSlots
+	return string([]byte{timestampAlphabet[t>>5], timestampAlphabet[t&31]})
+}
+
+func (s *Scheme) checkTimestamp(now time.Time, ts string) error {
+	if len(ts) != 2 {
+		return ErrMalformed
+	}
+	t := 0
+	for _, ch := range strings.ToUpper(ts) {
+		i := strings.IndexRune(timestampAlphabet, ch)
+		if i < 0 {
+			return ErrMalformed
+		}
+		t = t<<5 | i
+	}
+	today := int(now.Unix()/int64(timestampPrecision/time.Second)) % timestampSlots
+	age := (today - t + timestampSlots) % timestampSlots
+	if time.Duration(age)*timestampPrecision > s.MaxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+// isSRS returns the kind of an SRS local part, "SRS0" or "SRS1", and the
+// part following it without its separator.
+func isSRS(local string) (string, string, bool) {
+	if len(local) < 5 || !strings.ContainsRune("=+-", rune(local[4])) {
+		return "", "", false
+	}
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		return "SRS0", local[5:], true
+	case "SRS1":
+		return "SRS1", local[5:], true
+	}
+	return "", "", false
+}
+
+// Forward rewrites sender, an address of another domain, to an address of
+// Domain which Reverse turns back into sender.
+func (s *Scheme) Forward(now time.Time, sender string) (string, error) {
+	if len(s.Secrets) == 0 {
+		return "", errors.New("no SRS secret")
+	}
+	local, domain, ok := cutAddress(sender)
+	if !ok {
+		return "", fmt.Errorf("invalid sender %q", sender)
+	}
+	secret := s.Secrets[0]
+
+	switch kind, rest, _ := isSRS(local); kind {
+	case "SRS0":
+		// SRS0=rest@forwarder becomes SRS1=HHHH=forwarder==rest@Domain
+		hash := s.hash(secret, domain, "="+rest)
+		return fmt.Sprintf("SRS1=%s=%s==%s@%s", hash, domain, rest, s.Domain), nil
+	case "SRS1":
+		// keep the first forwarder, sign again for ourselves
+		parts := strings.SplitN(rest, "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			return "", ErrMalformed
+		}
+		host, srs0 := parts[1], parts[2]
+		hash := s.hash(secret, host, srs0)
+		return fmt.Sprintf("SRS1=%s=%s=%s@%s", hash, host, srs0, s.Domain), nil
+	}
+
+	ts := timestamp(now)
+	hash := s.hash(secret, ts, domain, local)
+	return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", hash, ts, domain, local, s.Domain), nil
+}
+
+// Reverse returns the address an SRS address of Domain was rewritten from.
+// An SRS1 address reverses to the SRS0 address of the first forwarder.
+func (s *Scheme) Reverse(now time.Time, address string) (string, error) {
+	local, domain, ok := cutAddress(address)
+	if !ok || !strings.EqualFold(domain, s.Domain) {
+		return "", ErrNotSRS
+	}
+	kind, rest, ok := isSRS(local)
+	if !ok {
+		return "", ErrNotSRS
+	}
+
+	if kind == "SRS1" {
+		parts := strings.SplitN(rest, "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			return "", ErrMalformed
+		}
+		hash, host, srs0 := parts[0], parts[1], parts[2]
+		if !s.verify(hash, host, srs0) {
+			return "", ErrInvalidHash
+		}
+		return fmt.Sprintf("SRS0%s@%s", srs0, host), nil
+	}
+
+	// the original local part may itself contain separators
+	parts := strings.SplitN(rest, "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", ErrMalformed
+	}
+	hash, ts, origDomain, origLocal := parts[0], parts[1], parts[2], parts[3]
+	if !s.verify(hash, ts, origDomain, origLocal) {
+		return "", ErrInvalidHash
+	}
+	if err := s.checkTimestamp(now, ts); err != nil {
+		return "", err
+	}
+	return origLocal + "@" + origDomain, nil
+}
+
+func cutAddress(address string) (string, string, bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
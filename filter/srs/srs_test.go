@@ -0,0 +1,175 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSRS0(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewScheme("forwarder.example", []byte("secret"))
+
+	for _, sender := range []string{"alice@example.com", "a=b+c@example.com", "Bob@Example.COM"} {
+		forwarded, err := s.Forward(now, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, domain, _ := strings.Cut(forwarded, "@")
+		if !strings.HasPrefix(local, "SRS0=") || domain != "forwarder.example" {
+			t.Errorf("Forward(%q) = %q, want an SRS0 address of forwarder.example", sender, forwarded)
+		}
+		reversed, err := s.Reverse(now.Add(24*time.Hour), forwarded)
+		if err != nil || reversed != sender {
+			t.Errorf("Reverse(%q) = %q, %v, want %q", forwarded, reversed, err, sender)
+		}
+		// addresses may be lowercased on the way back
+		reversed, err = s.Reverse(now, strings.ToLower(forwarded))
+		if err != nil || !strings.EqualFold(reversed, sender) {
+			t.Errorf("Reverse(%q) = %q, %v, want %q", strings.ToLower(forwarded), reversed, err, sender)
+		}
+	}
+}
+
+func TestSRS1(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := NewScheme("first.example", []byte("first secret"))
+	second := NewScheme("second.example", []byte("second secret"))
+	third := NewScheme("third.example", []byte("third secret"))
+
+	srs0, err := first.Forward(now, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := second.Forward(now, srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example==") || !strings.HasSuffix(srs1, "@second.example") {
+		t.Fatalf("Forward(%q) = %q, want an SRS1 address of second.example naming first.example", srs0, srs1)
+	}
+
+	// forwarded again, the first forwarder is kept
+	again, err := third.Forward(now, srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(again, "SRS1=") || !strings.Contains(again, "=first.example==") || !strings.HasSuffix(again, "@third.example") {
+		t.Fatalf("Forward(%q) = %q, want an SRS1 address of third.example naming first.example", srs1, again)
+	}
+
+	// each SRS1 address reverses to the SRS0 address of the first
+	// forwarder, which reverses to the sender
+	for _, test := range []struct {
+		scheme  *Scheme
+		address string
+	}{{second, srs1}, {third, again}} {
+		reversed, err := test.scheme.Reverse(now, test.address)
+		if err != nil || reversed != srs0 {
+			t.Errorf("Reverse(%q) = %q, %v, want %q", test.address, reversed, err, srs0)
+		}
+	}
+	reversed, err := first.Reverse(now, srs0)
+	if err != nil || reversed != "alice@example.com" {
+		t.Errorf("Reverse(%q) = %q, %v, want alice@example.com", srs0, reversed, err)
+	}
+}
+
+func TestReverseErrors(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewScheme("forwarder.example", []byte("secret"))
+	srs0, _ := s.Forward(now, "alice@example.com")
+	srs1, _ := s.Forward(now, "SRS0=HHHH=TT=example.com=alice@first.example")
+
+	tamper := func(address string, old string, new string) string {
+		return strings.Replace(address, old, new, 1)
+	}
+	tests := []struct {
+		name    string
+		address string
+		at      time.Time
+		want    error
+	}{
+		{"not srs", "alice@forwarder.example", now, ErrNotSRS},
+		{"other domain", tamper(srs0, "forwarder.example", "other.example"), now, ErrNotSRS},
+		{"srs0 hash mismatch", tamper(srs0, "alice", "mallory"), now, ErrInvalidHash},
+		{"srs0 forged hash", "SRS0=AAAA" + srs0[9:], now, ErrInvalidHash},
+		{"srs1 hash mismatch", tamper(srs1, "first.example", "evil.example"), now, ErrInvalidHash},
+		{"other secret", srs0, now, ErrInvalidHash},
+		{"malformed srs0", "SRS0=HHHH=TT@forwarder.example", now, ErrMalformed},
+		{"malformed srs1", "SRS1=HHHH=first.example@forwarder.example", now, ErrMalformed},
+		{"expired", srs0, now.Add(22 * 24 * time.Hour), ErrExpired},
+		{"within max age", srs0, now.Add(20 * 24 * time.Hour), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := s
+			if test.name == "other secret" {
+				scheme = NewScheme("forwarder.example", []byte("other"))
+			}
+			_, err := scheme.Reverse(test.at, test.address)
+			if !errors.Is(err, test.want) {
+				t.Errorf("Reverse(%q) = %v, want %v", test.address, err, test.want)
+			}
+		})
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := NewScheme("forwarder.example", []byte("old"))
+	forwarded, _ := old.Forward(now, "alice@example.com")
+
+	rotated := NewScheme("forwarder.example", []byte("new"), []byte("old"))
+	if reversed, err := rotated.Reverse(now, forwarded); err != nil || reversed != "alice@example.com" {
+		t.Errorf("Reverse with a rotated secret = %q, %v", reversed, err)
+	}
+	if _, err := NewScheme("forwarder.example").Forward(now, "alice@example.com"); err == nil {
+		t.Error("forwarded without a secret")
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	s := NewScheme("forwarder.example", []byte("secret"))
+	day := func(n int64) time.Time {
+		return time.Unix(n*24*3600+3600, 0)
+	}
+
+	tests := []struct {
+		name    string
+		signed  time.Time
+		checked time.Time
+		want    error
+	}{
+		{"same day", day(100), day(100), nil},
+		{"max age", day(100), day(121), nil},
+		{"past max age", day(100), day(122), ErrExpired},
+		// days count modulo 1024, ages across the wrap are still right
+		{"across the wrap", day(1020), day(1030), nil},
+		{"past max age across the wrap", day(1020), day(1050), ErrExpired},
+		// from the future, as with a skewed clock
+		{"future", day(101), day(100), ErrExpired},
+	}
+	for _, test := range tests {
+		ts := timestamp(test.signed)
+		if err := s.checkTimestamp(test.checked, ts); !errors.Is(err, test.want) {
+			t.Errorf("%s: checkTimestamp(%q) = %v, want %v", test.name, ts, err, test.want)
+		}
+	}
+
+	if ts := timestamp(day(0)); ts != "AA" {
+		t.Errorf("timestamp of day 0 = %q, want AA", ts)
+	}
+	if ts := timestamp(day(1023)); ts != "77" {
+		t.Errorf("timestamp of day 1023 = %q, want 77", ts)
+	}
+	if ts := timestamp(day(1024)); ts != "AA" {
+		t.Errorf("timestamp of day 1024 = %q, want AA", ts)
+	}
+	for _, ts := range []string{"A", "AAA", "A1"} {
+		if err := s.checkTimestamp(day(0), ts); !errors.Is(err, ErrMalformed) {
+			t.Errorf("checkTimestamp(%q) = %v, want %v", ts, err, ErrMalformed)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"sync"
+	"time"
+)
+
+var outputMtx sync.Mutex
+
+var tarpitted = make(map[Session]*time.Timer)
+var tarpitBudget = 1024
+var tarpittedMtx sync.Mutex
+
+// SetTarpitBudget sets the maximum number of sessions whose filter result
+// is delayed at once, 1024 by default. Delays beyond it are skipped so
+// that an attack cannot make the filter accumulate pending results.
+func SetTarpitBudget(budget int) {
+	tarpittedMtx.Lock()
+	defer tarpittedMtx.Unlock()
+	tarpitBudget = budget
+}
+
+// tarpit writes the result of a delayed response once its delay elapsed,
+// or right away when the budget is exhausted.
+func tarpit(sessionId Session, opaqueValue string, d delay) {
+	tarpittedMtx.Lock()
+	defer tarpittedMtx.Unlock()
+
+	if _, ok := tarpitted[sessionId]; ok || len(tarpitted) >= tarpitBudget {
+		writeResult(sessionId, opaqueValue, d.response)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d.duration, func() {
+		tarpittedMtx.Lock()
+		defer tarpittedMtx.Unlock()
+		if tarpitted[sessionId] != timer {
+			// cancelled by untarpit
+			return
+		}
+		delete(tarpitted, sessionId)
+		writeResult(sessionId, opaqueValue, d.response)
+	})
+	tarpitted[sessionId] = timer
+}
+
+// untarpit drops the pending result of a session that disconnected,
+// there is no one left to answer.
+func untarpit(sessionId Session) {
+	tarpittedMtx.Lock()
+	defer tarpittedMtx.Unlock()
+	if timer, ok := tarpitted[sessionId]; ok {
+		timer.Stop()
+		delete(tarpitted, sessionId)
+	}
+}
+
+// Tarpitted returns the number of sessions whose filter result is
+// currently delayed.
+func Tarpitted() int {
+	tarpittedMtx.Lock()
+	defer tarpittedMtx.Unlock()
+	return len(tarpitted)
+}
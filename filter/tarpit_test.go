@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureOutput returns the results written while f runs and during wait
+// afterwards, for the timers it started.
+func captureOutput(t *testing.T, wait time.Duration, f func()) []string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	time.Sleep(wait)
+	outputMtx.Lock()
+	os.Stdout = stdout
+	outputMtx.Unlock()
+	w.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestTarpit(t *testing.T) {
+	s := Session{"1"}
+	defer untarpit(s)
+
+	output := captureOutput(t, 100*time.Millisecond, func() {
+		tarpit(s, "a", delay{duration: 20 * time.Millisecond, response: Reject("550 go away")})
+		if Tarpitted() != 1 {
+			t.Errorf("%d sessions tarpitted, want 1", Tarpitted())
+		}
+	})
+	if want := []string{"filter-result|1|a|reject|550 go away"}; strings.Join(output, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output %q, want %q", output, want)
+	}
+	if Tarpitted() != 0 {
+		t.Errorf("%d sessions tarpitted after the delay, want 0", Tarpitted())
+	}
+}
+
+func TestTarpitBudget(t *testing.T) {
+	SetTarpitBudget(1)
+	defer SetTarpitBudget(1024)
+	first, second := Session{"1"}, Session{"2"}
+	defer untarpit(first)
+	defer untarpit(second)
+
+	output := captureOutput(t, 0, func() {
+		tarpit(first, "a", delay{duration: time.Hour, response: Reject("550 no")})
+		tarpit(second, "b", delay{duration: time.Hour, response: Junk()})
+	})
+	if want := []string{"filter-result|2|b|junk"}; strings.Join(output, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output %q, want %q", output, want)
+	}
+	if Tarpitted() != 1 {
+		t.Errorf("%d sessions tarpitted, want 1", Tarpitted())
+	}
+}
+
+func TestTarpitTwice(t *testing.T) {
+	s := Session{"1"}
+	defer untarpit(s)
+
+	output := captureOutput(t, 0, func() {
+		tarpit(s, "a", delay{duration: time.Hour, response: Proceed()})
+		tarpit(s, "b", delay{duration: time.Hour, response: Proceed()})
+	})
+	if want := []string{"filter-result|1|b|proceed"}; strings.Join(output, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output %q, want %q", output, want)
+	}
+	if Tarpitted() != 1 {
+		t.Errorf("%d sessions tarpitted, want 1", Tarpitted())
+	}
+}
+
+func TestUntarpit(t *testing.T) {
+	s := Session{"1"}
+
+	output := captureOutput(t, 50*time.Millisecond, func() {
+		tarpit(s, "a", delay{duration: 10 * time.Millisecond, response: Proceed()})
+		handleReport(time.Now(), "link-disconnect", &reporting{}, s, []string{})
+	})
+	if len(output) != 0 {
+		t.Errorf("output %q after disconnect, want none", output)
+	}
+	if Tarpitted() != 0 {
+		t.Errorf("%d sessions tarpitted after disconnect, want 0", Tarpitted())
+	}
+}
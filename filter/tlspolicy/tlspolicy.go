@@ -0,0 +1,286 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"github.com/poolpOrg/OpenSMTPD-framework/filter/message"
+)
+
+// State is the TLS state of a session as reported by link-tls.
+type State struct {
+	Version uint16
+	Cipher  string
+	Bits    int
+}
+
+var versions = map[string]uint16{
+	"SSLv3":   tls.VersionSSL30,
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.0": tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// ParseState parses the TLS string of link-tls, either as
+// "TLSv1.3:TLS_AES_256_GCM_SHA384:256" or as
+// "version=TLSv1.2, cipher=ECDHE-RSA-AES256-GCM-SHA384, bits=256".
+func ParseState(s string) (*State, error) {
+	var version, cipher, bits string
+	if strings.Contains(s, "=") {
+		for _, field := range strings.Split(s, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "version":
+				version = value
+			case "cipher":
+				cipher = value
+			case "bits":
+				bits = value
+			}
+		}
+	} else {
+		fields := strings.Split(s, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid TLS string %q", s)
+		}
+		version, cipher, bits = fields[0], fields[1], fields[2]
+	}
+
+	v, ok := versions[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", version)
+	}
+	b, err := strconv.Atoi(bits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cipher strength %q", bits)
+	}
+	return &State{Version: v, Cipher: cipher, Bits: b}, nil
+}
+
+// Listener is the policy of the sessions received on a listener.
+type Listener struct {
+	// RequireTLS refuses transactions on unencrypted sessions.
+	RequireTLS bool
+
+	// MinVersion is a crypto/tls version constant, MinBits a minimum
+	// cipher strength. Sessions negotiating less are disconnected.
+	MinVersion uint16
+	MinBits    int
+}
+
+type session struct {
+	src           net.IP
+	listener      *Listener
+	tls           *State
+	authenticated bool
+	sender        string
+}
+
+type Policy struct {
+	// AuthRequiresTLS rejects AUTH on unencrypted sessions.
+	AuthRequiresTLS bool
+
+	// AuthenticatedRequireTLS rejects transactions of authenticated users
+	// on unencrypted sessions.
+	AuthenticatedRequireTLS bool
+
+	// Listeners maps listener addresses, as "ip:port", ":port" or "ip",
+	// to their policy. The most specific match of the link-connect
+	// destination applies.
+	Listeners map[string]*Listener
+
+	// Domains lists the sender and recipient domains requiring TLS, a
+	// leading dot matches subdomains.
+	Domains []string
+
+	// Exempt lists networks the policy does not apply to, loopback
+	// addresses are always exempt.
+	Exempt []*net.IPNet
+
+	sessions    map[filter.Session]*session
+	sessionsMtx sync.Mutex
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		AuthRequiresTLS:         true,
+		AuthenticatedRequireTLS: true,
+		Listeners:               make(map[string]*Listener),
+		sessions:                make(map[filter.Session]*session),
+	}
+}
+
+func (p *Policy) Register(in *filter.SMTPIn) {
+	in.OnLinkConnect(p.linkConnectCb)
+	in.OnLinkTLS(p.linkTLSCb)
+	in.OnLinkAuth(p.linkAuthCb)
+	in.OnLinkDisconnect(p.linkDisconnectCb)
+	in.HeloRequest(p.heloCb)
+	in.EhloRequest(p.heloCb)
+	in.AuthRequest(p.authCb)
+	in.MailFromRequest(p.mailFromCb)
+	in.RcptToRequest(p.rcptToCb)
+}
+
+// TLS returns the TLS state of the session, nil if it is not encrypted.
+func (p *Policy) TLS(sessionId filter.Session) *State {
+	p.sessionsMtx.Lock()
+	defer p.sessionsMtx.Unlock()
+	if sess, ok := p.sessions[sessionId]; ok {
+		return sess.tls
+	}
+	return nil
+}
+
+// Listener returns the policy of the listener at addr, nil if none.
+func (p *Policy) Listener(addr net.Addr) *Listener {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, key := range []string{tcpAddr.String(), fmt.Sprintf(":%d", tcpAddr.Port), tcpAddr.IP.String()} {
+		if listener, ok := p.Listeners[key]; ok {
+			return listener
+		}
+	}
+	return nil
+}
+
+// RequiresTLS reports whether domain is one of Domains.
+func (p *Policy) RequiresTLS(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range p.Domains {
+		d = strings.ToLower(d)
+		if d == domain || strings.HasPrefix(d, ".") && strings.HasSuffix(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) exempt(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+	for _, network := range p.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) session(sessionId filter.Session) *session {
+	p.sessionsMtx.Lock()
+	defer p.sessionsMtx.Unlock()
+	sess, ok := p.sessions[sessionId]
+	if !ok {
+		sess = &session{}
+		p.sessions[sessionId] = sess
+	}
+	return sess
+}
+
+func (p *Policy) linkConnectCb(timestamp time.Time, sessionId filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
+	sess := p.session(sessionId)
+	if addr, ok := src.(*net.TCPAddr); ok {
+		sess.src = addr.IP
+	}
+	sess.listener = p.Listener(dest)
+}
+
+func (p *Policy) linkTLSCb(timestamp time.Time, sessionId filter.Session, tlsString string) {
+	state, err := ParseState(tlsString)
+	if err != nil {
+		// an unparsable state is still encrypted, with no known strength
+		state = &State{}
+	}
+	sess := p.session(sessionId)
+	p.sessionsMtx.Lock()
+	defer p.sessionsMtx.Unlock()
+	sess.tls = state
+}
+
+func (p *Policy) linkAuthCb(timestamp time.Time, sessionId filter.Session, result string, username string) {
+	p.session(sessionId).authenticated = result == "pass"
+}
+
+func (p *Policy) linkDisconnectCb(timestamp time.Time, sessionId filter.Session) {
+	p.sessionsMtx.Lock()
+	defer p.sessionsMtx.Unlock()
+	delete(p.sessions, sessionId)
+}
+
+// weak returns a disconnect response if the session negotiated less than
+// its listener requires.
+func (p *Policy) weak(sess *session) filter.Response {
+	if sess.listener == nil || sess.tls == nil || p.exempt(sess.src) {
+		return nil
+	}
+	if sess.listener.MinVersion != 0 && sess.tls.Version < sess.listener.MinVersion {
+		return filter.Disconnect(fmt.Sprintf("421 5.7.0 %s or later is required", tls.VersionName(sess.listener.MinVersion)))
+	}
+	if sess.listener.MinBits != 0 && sess.tls.Bits < sess.listener.MinBits {
+		return filter.Disconnect(fmt.Sprintf("421 5.7.0 A cipher of at least %d bits is required", sess.listener.MinBits))
+	}
+	return nil
+}
+
+func (p *Policy) heloCb(timestamp time.Time, sessionId filter.Session, helo string) filter.Response {
+	if res := p.weak(p.session(sessionId)); res != nil {
+		return res
+	}
+	return filter.Proceed()
+}
+
+func (p *Policy) authCb(timestamp time.Time, sessionId filter.Session, method string) filter.Response {
+	sess := p.session(sessionId)
+	if res := p.weak(sess); res != nil {
+		return res
+	}
+	if p.AuthRequiresTLS && sess.tls == nil && !p.exempt(sess.src) {
+		return filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism")
+	}
+	return filter.Proceed()
+}
+
+func (p *Policy) mailFromCb(timestamp time.Time, sessionId filter.Session, from string) filter.Response {
+	sess := p.session(sessionId)
+	sess.sender, _ = message.SplitParam(from)
+	if res := p.weak(sess); res != nil {
+		return res
+	}
+	if sess.tls != nil || p.exempt(sess.src) {
+		return filter.Proceed()
+	}
+	if sess.authenticated && p.AuthenticatedRequireTLS {
+		return filter.Reject("530 5.7.0 Authenticated users must issue a STARTTLS command first")
+	}
+	if sess.listener != nil && sess.listener.RequireTLS {
+		return filter.Reject("530 5.7.0 Must issue a STARTTLS command first")
+	}
+	return filter.Proceed()
+}
+
+func (p *Policy) rcptToCb(timestamp time.Time, sessionId filter.Session, to string) filter.Response {
+	sess := p.session(sessionId)
+	if sess.tls != nil || p.exempt(sess.src) {
+		return filter.Proceed()
+	}
+	if _, domain, ok := strings.Cut(sess.sender, "@"); ok && p.RequiresTLS(domain) {
+		return filter.Reject(fmt.Sprintf("530 5.7.0 Mail from %s requires TLS", domain))
+	}
+	recipient, _ := message.SplitParam(to)
+	if _, domain, ok := strings.Cut(recipient, "@"); ok && p.RequiresTLS(domain) {
+		return filter.Reject(fmt.Sprintf("530 5.7.0 Mail to %s requires TLS", domain))
+	}
+	return filter.Proceed()
+}
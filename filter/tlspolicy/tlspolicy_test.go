@@ -0,0 +1,176 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestParseState(t *testing.T) {
+	tests := []struct {
+		s    string
+		want *State
+	}{
+		{"TLSv1.3:TLS_AES_256_GCM_SHA384:256", &State{tls.VersionTLS13, "TLS_AES_256_GCM_SHA384", 256}},
+		{"version=TLSv1.2, cipher=ECDHE-RSA-AES256-GCM-SHA384, bits=256", &State{tls.VersionTLS12, "ECDHE-RSA-AES256-GCM-SHA384", 256}},
+		{"TLSv1:AES128-SHA:128", &State{tls.VersionTLS10, "AES128-SHA", 128}},
+		{"TLSv1.3:TLS_AES_256_GCM_SHA384", nil},
+		{"QUIC:TLS_AES_256_GCM_SHA384:256", nil},
+		{"TLSv1.3:TLS_AES_256_GCM_SHA384:strong", nil},
+	}
+	for _, test := range tests {
+		got, err := ParseState(test.s)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("ParseState(%q) = %+v, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || *got != *test.want {
+			t.Errorf("ParseState(%q) = %+v, %v, want %+v", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	p := NewPolicy()
+	ipPort := &Listener{}
+	port := &Listener{}
+	ip := &Listener{}
+	p.Listeners["192.0.2.1:25"] = ipPort
+	p.Listeners[":587"] = port
+	p.Listeners["192.0.2.1"] = ip
+
+	tests := []struct {
+		addr net.Addr
+		want *Listener
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, ipPort},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 587}, port},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 465}, ip},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 25}, nil},
+		{&net.UnixAddr{Name: "/var/run/smtpd.sock"}, nil},
+	}
+	for _, test := range tests {
+		if got := p.Listener(test.addr); got != test.want {
+			t.Errorf("Listener(%s) = %p, want %p", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestRequiresTLS(t *testing.T) {
+	p := NewPolicy()
+	p.Domains = []string{"bank.example", ".gov.example"}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"bank.example", true},
+		{"BANK.example.", true},
+		{"mail.bank.example", false},
+		{"tax.gov.example", true},
+		{"gov.example", false},
+		{"example.org", false},
+	}
+	for _, test := range tests {
+		if got := p.RequiresTLS(test.domain); got != test.want {
+			t.Errorf("RequiresTLS(%q) = %v, want %v", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	submission := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 587}
+	smtp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+
+	type want struct {
+		helo, auth, mail, rcpt filter.Response
+	}
+	proceed := filter.Proceed()
+	tests := []struct {
+		name string
+		src  string
+		dest net.Addr
+		tls  string
+		auth bool
+		from string
+		to   string
+		want want
+	}{
+		{"plain smtp", "198.51.100.1", smtp, "", false, "<a@example.com>", "<b@example.org>",
+			want{proceed, filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism"), proceed, proceed}},
+		{"plain submission", "198.51.100.1", submission, "", false, "<a@example.com>", "<b@example.org>",
+			want{proceed, filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism"), filter.Reject("530 5.7.0 Must issue a STARTTLS command first"), proceed}},
+		{"plain authenticated", "198.51.100.1", smtp, "", true, "<a@example.com>", "<b@example.org>",
+			want{proceed, filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism"), filter.Reject("530 5.7.0 Authenticated users must issue a STARTTLS command first"), proceed}},
+		{"encrypted submission", "198.51.100.1", submission, "TLSv1.3:TLS_AES_256_GCM_SHA384:256", true, "<a@example.com>", "<b@example.org>",
+			want{proceed, proceed, proceed, proceed}},
+		{"old version", "198.51.100.1", submission, "TLSv1.1:AES128-SHA:128", false, "<a@example.com>", "<b@example.org>",
+			want{filter.Disconnect("421 5.7.0 TLS 1.2 or later is required"), filter.Disconnect("421 5.7.0 TLS 1.2 or later is required"), filter.Disconnect("421 5.7.0 TLS 1.2 or later is required"), proceed}},
+		{"weak cipher", "198.51.100.1", submission, "TLSv1.2:DES-CBC3-SHA:112", false, "<a@example.com>", "<b@example.org>",
+			want{filter.Disconnect("421 5.7.0 A cipher of at least 128 bits is required"), filter.Disconnect("421 5.7.0 A cipher of at least 128 bits is required"), filter.Disconnect("421 5.7.0 A cipher of at least 128 bits is required"), proceed}},
+		{"sender domain", "198.51.100.1", smtp, "", false, "<a@bank.example>", "<b@example.org>",
+			want{proceed, filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism"), proceed, filter.Reject("530 5.7.0 Mail from bank.example requires TLS")}},
+		{"recipient domain", "198.51.100.1", smtp, "", false, "<a@example.com>", "<b@Bank.Example>",
+			want{proceed, filter.Reject("538 5.7.11 Encryption required for requested authentication mechanism"), proceed, filter.Reject("530 5.7.0 Mail to Bank.Example requires TLS")}},
+		{"encrypted recipient domain", "198.51.100.1", smtp, "TLSv1.2:ECDHE-RSA-AES256-GCM-SHA384:256", false, "<a@example.com>", "<b@bank.example>",
+			want{proceed, proceed, proceed, proceed}},
+		{"loopback", "127.0.0.1", submission, "", true, "<a@bank.example>", "<b@bank.example>",
+			want{proceed, proceed, proceed, proceed}},
+		{"exempt", "203.0.113.1", submission, "TLSv1:AES128-SHA:128", true, "<a@bank.example>", "<b@bank.example>",
+			want{proceed, proceed, proceed, proceed}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewPolicy()
+			p.Listeners[":587"] = &Listener{RequireTLS: true, MinVersion: tls.VersionTLS12, MinBits: 128}
+			p.Domains = []string{"bank.example"}
+			_, exempt, _ := net.ParseCIDR("203.0.113.0/24")
+			p.Exempt = []*net.IPNet{exempt}
+			s := filter.Session{}
+			defer p.linkDisconnectCb(start, s)
+
+			p.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP(test.src), Port: 4242}, test.dest)
+			if test.tls != "" {
+				p.linkTLSCb(start, s, test.tls)
+			}
+			if res := p.heloCb(start, s, "client.example.com"); res != test.want.helo {
+				t.Errorf("heloCb = %#v, want %#v", res, test.want.helo)
+			}
+			if res := p.authCb(start, s, "PLAIN"); res != test.want.auth {
+				t.Errorf("authCb = %#v, want %#v", res, test.want.auth)
+			}
+			if test.auth {
+				p.linkAuthCb(start, s, "pass", "alice")
+			}
+			if res := p.mailFromCb(start, s, test.from); res != test.want.mail {
+				t.Errorf("mailFromCb = %#v, want %#v", res, test.want.mail)
+			}
+			if res := p.rcptToCb(start, s, test.to); res != test.want.rcpt {
+				t.Errorf("rcptToCb = %#v, want %#v", res, test.want.rcpt)
+			}
+		})
+	}
+}
+
+func TestParameters(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	p := NewPolicy()
+	p.Domains = []string{"bank.example"}
+	s := filter.Session{}
+	p.linkConnectCb(start, s, "", "", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4242}, nil)
+
+	p.mailFromCb(start, s, "<a@bank.example> SIZE=1024 BODY=8BITMIME")
+	if res := p.rcptToCb(start, s, "<b@example.org> NOTIFY=NEVER"); res != filter.Reject("530 5.7.0 Mail from bank.example requires TLS") {
+		t.Errorf("rcptToCb = %#v, want the sender domain rejected", res)
+	}
+	p.mailFromCb(start, s, "<a@example.com> SIZE=1024")
+	if res := p.rcptToCb(start, s, "<b@bank.example> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b@bank.example"); res != filter.Reject("530 5.7.0 Mail to bank.example requires TLS") {
+		t.Errorf("rcptToCb = %#v, want the recipient domain rejected", res)
+	}
+}
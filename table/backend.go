@@ -0,0 +1,68 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNoHandler is returned by a backend asked for a service it does not
+// provide.
+var ErrNoHandler = errors.New("no handler registered")
+
+// Backend is the data logic of a table, independent of the table protocol
+// so that filters may call it directly and wrappers may decorate it.
+// Check and Lookup return false and "" for keys that do not exist, Fetch
+// returns "" when there is nothing to fetch.
+type Backend interface {
+	Check(ctx context.Context, service Service, table string, key string) (bool, error)
+	Lookup(ctx context.Context, service Service, table string, key string) (string, error)
+	Fetch(ctx context.Context, service Service, table string) (string, error)
+}
+
+type handlers struct{}
+
+// Handlers is the backend made of the callbacks registered with OnCheck,
+// OnLookup and OnFetch, for calling them in-process.
+var Handlers Backend = handlers{}
+
+func (handlers) Check(ctx context.Context, service Service, table string, key string) (bool, error) {
+	cb, ok := onCheckMap[service]
+	if !ok {
+		return false, ErrNoHandler
+	}
+	return cb(time.Now(), table, key)
+}
+
+func (handlers) Lookup(ctx context.Context, service Service, table string, key string) (string, error) {
+	cb, ok := onLookupMap[service]
+	if !ok {
+		return "", ErrNoHandler
+	}
+	return cb(time.Now(), table, key)
+}
+
+func (handlers) Fetch(ctx context.Context, service Service, table string) (string, error) {
+	cb, ok := onFetchMap[service]
+	if !ok {
+		return "", ErrNoHandler
+	}
+	return cb(time.Now(), table)
+}
+
+// Serve registers the check, lookup and fetch callbacks of services so
+// that Dispatch answers smtpd from backend. The backend must not be built
+// on Handlers for these services, they would call themselves.
+func Serve(backend Backend, services ...Service) {
+	for _, service := range services {
+		OnCheck(service, func(timestamp time.Time, table string, key string) (bool, error) {
+			return backend.Check(context.Background(), service, table, key)
+		})
+		OnLookup(service, func(timestamp time.Time, table string, key string) (string, error) {
+			return backend.Lookup(context.Background(), service, table, key)
+		})
+		OnFetch(service, func(timestamp time.Time, table string) (string, error) {
+			return backend.Fetch(context.Background(), service, table)
+		})
+	}
+}
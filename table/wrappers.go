@@ -0,0 +1,235 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	found   bool
+	value   string
+	expires time.Time
+}
+
+// Cache remembers the check and lookup results of a backend, fetches are
+// never cached and errors are not remembered.
+type Cache struct {
+	Backend Backend
+
+	// TTL and NegativeTTL are how long found and missing keys are
+	// remembered, MaxEntries bounds the cache size.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	entries map[string]cacheEntry
+	mtx     sync.Mutex
+}
+
+func NewCache(backend Backend, ttl time.Duration) *Cache {
+	return &Cache{
+		Backend:     backend,
+		TTL:         ttl,
+		NegativeTTL: ttl,
+		MaxEntries:  10000,
+		entries:     make(map[string]cacheEntry),
+	}
+}
+
+// Flush forgets every cached result, typically from the OnUpdate callback.
+func (c *Cache) Flush() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
+
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *Cache) put(key string, found bool, value string) {
+	ttl := c.TTL
+	if !found {
+		ttl = c.NegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.MaxEntries {
+			// still full of live entries, start over
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+	c.entries[key] = cacheEntry{found: found, value: value, expires: now.Add(ttl)}
+}
+
+func (c *Cache) Check(ctx context.Context, service Service, table string, key string) (bool, error) {
+	k := fmt.Sprintf("check|%s|%s|%s", service, table, key)
+	if e, ok := c.get(k); ok {
+		return e.found, nil
+	}
+	found, err := c.Backend.Check(ctx, service, table, key)
+	if err == nil {
+		c.put(k, found, "")
+	}
+	return found, err
+}
+
+func (c *Cache) Lookup(ctx context.Context, service Service, table string, key string) (string, error) {
+	k := fmt.Sprintf("lookup|%s|%s|%s", service, table, key)
+	if e, ok := c.get(k); ok {
+		return e.value, nil
+	}
+	value, err := c.Backend.Lookup(ctx, service, table, key)
+	if err == nil {
+		c.put(k, value != "", value)
+	}
+	return value, err
+}
+
+func (c *Cache) Fetch(ctx context.Context, service Service, table string) (string, error) {
+	return c.Backend.Fetch(ctx, service, table)
+}
+
+// Fallback asks its backends in order until one answers without error,
+// the error of the last one is returned if none does.
+type Fallback []Backend
+
+func (f Fallback) Check(ctx context.Context, service Service, table string, key string) (bool, error) {
+	err := ErrNoHandler
+	for _, backend := range f {
+		var found bool
+		if found, err = backend.Check(ctx, service, table, key); err == nil {
+			return found, nil
+		}
+	}
+	return false, err
+}
+
+func (f Fallback) Lookup(ctx context.Context, service Service, table string, key string) (string, error) {
+	err := ErrNoHandler
+	for _, backend := range f {
+		var value string
+		if value, err = backend.Lookup(ctx, service, table, key); err == nil {
+			return value, nil
+		}
+	}
+	return "", err
+}
+
+func (f Fallback) Fetch(ctx context.Context, service Service, table string) (string, error) {
+	err := ErrNoHandler
+	for _, backend := range f {
+		var value string
+		if value, err = backend.Fetch(ctx, service, table); err == nil {
+			return value, nil
+		}
+	}
+	return "", err
+}
+
+// Stat is the activity of a backend for one operation and service.
+type Stat struct {
+	Operation string
+	Service   Service
+	Calls     uint64
+	Found     uint64
+	Errors    uint64
+	Latency   time.Duration
+}
+
+type statKey struct {
+	operation string
+	service   Service
+}
+
+// Metrics counts the calls made to a backend, their outcome and latency.
+type Metrics struct {
+	Backend Backend
+
+	stats map[statKey]*Stat
+	mtx   sync.Mutex
+}
+
+func NewMetrics(backend Backend) *Metrics {
+	return &Metrics{
+		Backend: backend,
+		stats:   make(map[statKey]*Stat),
+	}
+}
+
+func (m *Metrics) record(operation string, service Service, start time.Time, found bool, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := statKey{operation, service}
+	stat, ok := m.stats[key]
+	if !ok {
+		stat = &Stat{Operation: operation, Service: service}
+		m.stats[key] = stat
+	}
+	stat.Calls++
+	stat.Latency += time.Since(start)
+	if err != nil && !errors.Is(err, ErrNoHandler) {
+		stat.Errors++
+	} else if found {
+		stat.Found++
+	}
+}
+
+// Stats returns the counters of each operation and service called so far.
+func (m *Metrics) Stats() []Stat {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make([]Stat, 0, len(m.stats))
+	for _, stat := range m.stats {
+		ret = append(ret, *stat)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Operation != ret[j].Operation {
+			return ret[i].Operation < ret[j].Operation
+		}
+		return ret[i].Service < ret[j].Service
+	})
+	return ret
+}
+
+func (m *Metrics) Check(ctx context.Context, service Service, table string, key string) (bool, error) {
+	start := time.Now()
+	found, err := m.Backend.Check(ctx, service, table, key)
+	m.record("check", service, start, found, err)
+	return found, err
+}
+
+func (m *Metrics) Lookup(ctx context.Context, service Service, table string, key string) (string, error) {
+	start := time.Now()
+	value, err := m.Backend.Lookup(ctx, service, table, key)
+	m.record("lookup", service, start, value != "", err)
+	return value, err
+}
+
+func (m *Metrics) Fetch(ctx context.Context, service Service, table string) (string, error) {
+	start := time.Now()
+	value, err := m.Backend.Fetch(ctx, service, table)
+	m.record("fetch", service, start, value != "", err)
+	return value, err
+}